@@ -0,0 +1,19 @@
+import { retrieveLaunchParams } from '@telegram-apps/sdk-react';
+import { host } from '@/host';
+
+// The bot checks the init data Telegram signed when it opened the Mini App.
+function apiFetch(path, options = {}) {
+  const { initDataRaw } = retrieveLaunchParams();
+
+  return fetch(host + path, {
+    ...options,
+    headers: {
+      ...options.headers,
+      "ngrok-skip-browser-warning": '1',
+      "Authorization": 'tma ' + initDataRaw,
+    },
+  });
+}
+
+
+export {apiFetch};
@@ -13,7 +13,7 @@ import { useThemeParams } from '@telegram-apps/sdk-react';
 import { createMuiTheme } from "../../functions/createMuiTheme";
 import { ThemeProvider } from '@mui/material';
 import { useState, useEffect } from "react";
-import {host} from '@/host';
+import { apiFetch } from '@/api';
  
 function ListInfo({ data }) {
   return (
@@ -98,7 +98,7 @@ export function CalendarPage() {
   const theme = createMuiTheme(tgTheme.getState());
 
   useEffect(() => {
-    fetch(host + "/get_transcriptions", { headers: { "ngrok-skip-browser-warning": '1' } })
+    apiFetch("/get_transcriptions")
       .then(response => {
         setError(undefined)
         if (response.ok && response.status == 200) {
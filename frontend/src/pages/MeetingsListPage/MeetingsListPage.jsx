@@ -2,7 +2,7 @@ import "./MeetingsListPage.css";
 import { List, Cell, Text, Spinner } from '@telegram-apps/telegram-ui';
 import { Link } from '@/components/Link/Link.jsx';
 import { useEffect, useState } from "react";
-import {host} from '@/host';
+import { apiFetch } from '@/api';
  
 export function MeetingsListPage() {
     const [error, setError] = useState(undefined)
@@ -10,7 +10,7 @@ export function MeetingsListPage() {
 
     
     useEffect(() => {
-         fetch(host + "/get_transcriptions", {headers: {"ngrok-skip-browser-warning": '1'}})
+         apiFetch("/get_transcriptions")
             .then(response => {
                 setError(undefined)
                 if (response.ok && response.status == 200) {
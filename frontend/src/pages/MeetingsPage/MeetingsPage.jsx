@@ -6,7 +6,7 @@ import WavesurferPlayer from '@wavesurfer/react'
 
 import './MeetingsPage.css';
 import { useParams } from 'react-router-dom';
-import { host } from '@/host';
+import { apiFetch } from '@/api';
 
 
 const formatTime = function (time) {
@@ -45,7 +45,7 @@ function Player({ src }) {
   const time_str = time ? `${formatTime(time)}/${formatTime(wavesurfer.getDuration())}` : ''
 
   useEffect(() => {
-    fetch(host + src, { headers: { "ngrok-skip-browser-warning": '1' } })
+    apiFetch(src)
       .then(d => d.blob())
       .then(data => {
         const newUrl = URL.createObjectURL(data)
@@ -104,15 +104,15 @@ export function MeetingsPage() {
 
 
   const download = (format, type) => {
-    const q = host + "/send_report/" + format + "/" + type + "/" + id
-    fetch(q, { headers: { "ngrok-skip-browser-warning": '1' } })
+    const q = "/send_report/" + format + "/" + type + "/" + id
+    apiFetch(q)
     setShowMessage(true)
   }
 
 
 
   useEffect(() => {
-    fetch(host + "/get_transcriptions", { headers: { "ngrok-skip-browser-warning": '1' } })
+    apiFetch("/get_transcriptions")
       .then(response => {
         setError(undefined)
         if (response.ok && response.status == 200) {
@@ -0,0 +1,356 @@
+package bot
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+	"github.com/gulldan/cp2024omsk-pmsk/bot/transcript"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+
+	postgres "github.com/gulldan/cp2024omsk-pmsk/bot/postgres/generated"
+)
+
+const (
+	RoleAdmin  = "admin"
+	RoleMember = "member"
+	RoleGuest  = "guest"
+
+	GRANT  = "/grant"
+	REVOKE = "/revoke"
+	USERS  = "/users"
+	INVITE = "/invite"
+	TOKEN  = "/token"
+
+	ACCESS_DENIED   = "Обработка записей доступна только участникам. Попросите администратора пригласить вас, ваш ID: %d."
+	ADMIN_ONLY      = "Команда доступна только администраторам."
+	GRANT_USAGE     = "Укажите ID пользователя и роль: /grant 123456789 member. Роли: admin, member, guest. В группе можно ответить командой на сообщение пользователя."
+	REVOKE_USAGE    = "Укажите ID пользователя: /revoke 123456789. В группе можно ответить командой на сообщение пользователя."
+	INVITE_USAGE    = "Укажите роль приглашения: /invite member. Роли: admin, member, guest."
+	INVITE_INVALID  = "Приглашение недействительно или уже использовано."
+	INVITE_ACCEPTED = "Приглашение принято, ваша роль: %s."
+	TOKEN_PRIVATE   = "Токен выдается только в личном чате с ботом."
+	TOKEN_ISSUED    = "Ваш токен для API, предыдущий больше не действует:\n%s\nПередавайте его в заголовке Authorization: Bearer <токен>."
+)
+
+var roleRanks = map[string]int{
+	RoleGuest:  0,
+	RoleMember: 1,
+	RoleAdmin:  2,
+}
+
+func validRole(role string) bool {
+	_, ok := roleRanks[role]
+
+	return ok
+}
+
+// userRole resolves the role of the user: the admins from the config, the role
+// stored for the user, or the default role for the users nobody has granted one.
+func (bw *BotWrapper) userRole(user postgres.User) string {
+	if slices.Contains(bw.cfg.Admins, user.TgUserID) {
+		return RoleAdmin
+	}
+
+	if user.Role.Valid && validRole(user.Role.String) {
+		return user.Role.String
+	}
+
+	return bw.cfg.DefaultRole
+}
+
+func (bw *BotWrapper) role(ctx context.Context, userID int64) string {
+	user, err := bw.psql.GetUser(ctx, userID)
+	if err != nil {
+		if !errors.Is(err, pgx.ErrNoRows) {
+			bw.log.Error().Err(err).Int64("chatID", userID).Msg("get user role failed")
+		}
+
+		user = postgres.User{TgUserID: userID}
+	}
+
+	return bw.userRole(user)
+}
+
+// hasRole reports whether the user has the role or a higher one.
+func (bw *BotWrapper) hasRole(ctx context.Context, userID int64, role string) bool {
+	return roleRanks[bw.role(ctx, userID)] >= roleRanks[role]
+}
+
+// requireMember checks that the sender may use the GPU, guests are told how to get access.
+func (bw *BotWrapper) requireMember(ctx context.Context, msg *models.Message) bool {
+	if bw.hasRole(ctx, senderID(msg), RoleMember) {
+		return true
+	}
+
+	if _, err := bw.b.SendMessage(ctx, &bot.SendMessageParams{
+		ChatID:          msg.Chat.ID,
+		MessageThreadID: threadID(msg),
+		Text:            fmt.Sprintf(ACCESS_DENIED, senderID(msg)),
+	}); err != nil {
+		bw.log.Error().Err(err).Msg("send access denied message failed")
+	}
+
+	return false
+}
+
+// randomToken returns n random bytes in hex.
+func randomToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("read random failed: %w", err)
+	}
+
+	return hex.EncodeToString(b), nil
+}
+
+// tokenHash is what is stored of an API token, a leaked database does not leak the tokens.
+func tokenHash(token string) pgtype.Text {
+	sum := sha256.Sum256([]byte(token))
+
+	return pgtype.Text{String: hex.EncodeToString(sum[:]), Valid: true}
+}
+
+// acceptInvite gives the user the role of the invite code from the /start link,
+// a role granted before is never lowered by an invite.
+func (bw *BotWrapper) acceptInvite(ctx context.Context, userID int64, code string) (string, error) {
+	role, err := bw.psql.UseInvite(ctx, postgres.UseInviteParams{
+		UsedBy: pgtype.Int8{Int64: userID, Valid: true},
+		Code:   code,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	if current := bw.role(ctx, userID); roleRanks[current] >= roleRanks[role] {
+		return current, nil
+	}
+
+	if err := bw.psql.SetUserRole(ctx, postgres.SetUserRoleParams{
+		TgUserID: userID,
+		Role:     pgtype.Text{String: role, Valid: true},
+	}); err != nil {
+		return "", fmt.Errorf("set user role failed: %w", err)
+	}
+
+	return role, nil
+}
+
+// adminCommand returns the handler of a command only admins may use.
+func (bw *BotWrapper) adminCommand(handler bot.HandlerFunc) bot.HandlerFunc {
+	return func(ctx context.Context, b *bot.Bot, update *models.Update) {
+		if !bw.hasRole(ctx, senderID(update.Message), RoleAdmin) {
+			bw.replyText(ctx, update.Message, ADMIN_ONLY)
+
+			return
+		}
+
+		handler(ctx, b, update)
+	}
+}
+
+func (bw *BotWrapper) replyText(ctx context.Context, msg *models.Message, text string) {
+	if _, err := bw.b.SendMessage(ctx, &bot.SendMessageParams{
+		ChatID:          msg.Chat.ID,
+		MessageThreadID: threadID(msg),
+		Text:            text,
+	}); err != nil {
+		bw.log.Error().Err(err).Int64("chatID", msg.Chat.ID).Msg("send message failed")
+	}
+}
+
+// commandTarget is the user the admin command is about: the user the command
+// replies to or the ID given as the first argument. The rest are the other arguments.
+func commandTarget(msg *models.Message, args []string) (int64, []string, bool) {
+	if r := msg.ReplyToMessage; r != nil && r.From != nil && !r.From.IsBot {
+		return r.From.ID, args, true
+	}
+
+	if len(args) == 0 {
+		return 0, nil, false
+	}
+
+	userID, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil {
+		return 0, nil, false
+	}
+
+	return userID, args[1:], true
+}
+
+func (bw *BotWrapper) commandArgs(text, command string) []string {
+	return strings.Fields(bw.stripMention(strings.TrimPrefix(text, command)))
+}
+
+func (bw *BotWrapper) grantHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
+	userID, args, ok := commandTarget(update.Message, bw.commandArgs(update.Message.Text, GRANT))
+	if !ok || len(args) > 1 {
+		bw.replyText(ctx, update.Message, GRANT_USAGE)
+
+		return
+	}
+
+	role := RoleMember
+	if len(args) == 1 {
+		role = strings.ToLower(args[0])
+	}
+
+	if !validRole(role) {
+		bw.replyText(ctx, update.Message, GRANT_USAGE)
+
+		return
+	}
+
+	bw.setRole(ctx, update.Message, userID, role)
+}
+
+// revokeHandler makes the user a guest, so an open bot does not let them back in.
+func (bw *BotWrapper) revokeHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
+	userID, args, ok := commandTarget(update.Message, bw.commandArgs(update.Message.Text, REVOKE))
+	if !ok || len(args) > 0 {
+		bw.replyText(ctx, update.Message, REVOKE_USAGE)
+
+		return
+	}
+
+	if slices.Contains(bw.cfg.Admins, userID) {
+		bw.replyText(ctx, update.Message, "Администраторов из конфигурации нельзя лишить доступа.")
+
+		return
+	}
+
+	bw.setRole(ctx, update.Message, userID, RoleGuest)
+}
+
+func (bw *BotWrapper) setRole(ctx context.Context, msg *models.Message, userID int64, role string) {
+	if err := bw.psql.SetUserRole(ctx, postgres.SetUserRoleParams{
+		TgUserID: userID,
+		Role:     pgtype.Text{String: role, Valid: true},
+	}); err != nil {
+		bw.log.Error().Err(err).Int64("chatID", userID).Msg("set user role failed")
+		bw.replyText(ctx, msg, "Не удалось сохранить роль.")
+
+		return
+	}
+
+	bw.log.Info().Int64("admin", senderID(msg)).Int64("chatID", userID).Str("role", role).Msg("role changed")
+	bw.replyText(ctx, msg, fmt.Sprintf("Пользователь %d теперь %s.", userID, role))
+}
+
+func (bw *BotWrapper) usersHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
+	users, err := bw.psql.GetUsersWithRoles(ctx)
+	if err != nil {
+		bw.log.Error().Err(err).Msg("get users failed")
+		bw.replyText(ctx, update.Message, "Не удалось получить список пользователей.")
+
+		return
+	}
+
+	lines := []string{fmt.Sprintf("Роль по умолчанию: %s.", bw.cfg.DefaultRole)}
+	for _, id := range bw.cfg.Admins {
+		lines = append(lines, fmt.Sprintf("%d · %s (из конфигурации)", id, RoleAdmin))
+	}
+
+	for _, u := range users {
+		if slices.Contains(bw.cfg.Admins, u.TgUserID) {
+			continue
+		}
+
+		line := fmt.Sprintf("%d · %s", u.TgUserID, bw.userRole(u))
+		if u.Username.Valid {
+			line += " · @" + u.Username.String
+		}
+
+		lines = append(lines, line)
+	}
+
+	for _, part := range transcript.Split(strings.Join(lines, "\n"), maxMessageLength) {
+		bw.replyText(ctx, update.Message, part)
+	}
+}
+
+// inviteHandler creates a one-time /start link giving the role.
+func (bw *BotWrapper) inviteHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
+	args := bw.commandArgs(update.Message.Text, INVITE)
+
+	role := RoleMember
+	if len(args) > 0 {
+		role = strings.ToLower(args[0])
+	}
+
+	if len(args) > 1 || !validRole(role) {
+		bw.replyText(ctx, update.Message, INVITE_USAGE)
+
+		return
+	}
+
+	code, err := randomToken(12)
+	if err != nil {
+		bw.log.Error().Err(err).Msg("generate invite failed")
+		bw.replyText(ctx, update.Message, "Не удалось создать приглашение.")
+
+		return
+	}
+
+	if err := bw.psql.CreateInvite(ctx, postgres.CreateInviteParams{
+		Code:      code,
+		Role:      role,
+		CreatedBy: senderID(update.Message),
+	}); err != nil {
+		bw.log.Error().Err(err).Msg("create invite failed")
+		bw.replyText(ctx, update.Message, "Не удалось создать приглашение.")
+
+		return
+	}
+
+	bw.replyText(ctx, update.Message, fmt.Sprintf("Одноразовое приглашение с ролью %s:\nhttps://t.me/%s?start=%s", role, bw.username, code))
+}
+
+// tokenHandler issues a new API token to the user, only its hash is stored.
+func (bw *BotWrapper) tokenHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
+	if update.Message.Chat.Type != "private" {
+		bw.replyText(ctx, update.Message, TOKEN_PRIVATE)
+
+		return
+	}
+
+	if !bw.requireMember(ctx, update.Message) {
+		return
+	}
+
+	token, err := randomToken(32)
+	if err != nil {
+		bw.log.Error().Err(err).Msg("generate token failed")
+		bw.replyText(ctx, update.Message, "Не удалось выпустить токен.")
+
+		return
+	}
+
+	userID := senderID(update.Message)
+	if err := bw.psql.CreateUser(ctx, userID); err != nil {
+		bw.log.Error().Err(err).Msg("CreateUser failed")
+
+		return
+	}
+
+	if err := bw.psql.SetAPIToken(ctx, postgres.SetAPITokenParams{
+		APITokenHash: tokenHash(token),
+		TgUserID:     userID,
+	}); err != nil {
+		bw.log.Error().Err(err).Int64("chatID", userID).Msg("set api token failed")
+		bw.replyText(ctx, update.Message, "Не удалось выпустить токен.")
+
+		return
+	}
+
+	bw.replyText(ctx, update.Message, fmt.Sprintf(TOKEN_ISSUED, token))
+}
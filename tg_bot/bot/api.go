@@ -2,6 +2,7 @@ package bot
 
 import (
 	"context"
+	"errors"
 	"io"
 	"net/http"
 	"strconv"
@@ -10,9 +11,13 @@ import (
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+
+	postgres "github.com/gulldan/cp2024omsk-pmsk/bot/postgres/generated"
 )
 
-func (bw *BotWrapper) serveApi(ctx context.Context) {
+// serveApi serves the API and, in webhook mode, the updates from Telegram.
+func (bw *BotWrapper) serveApi(ctx context.Context, webhook bool) {
 	router := gin.Default()
 	router.Use(cors.New(cors.Config{
 		AllowOriginFunc: func(origin string) bool {
@@ -26,176 +31,278 @@ func (bw *BotWrapper) serveApi(ctx context.Context) {
 	}))
 
 	router.MaxMultipartMemory = 32 << 20
-	router.GET("/get_transcriptions", bw.getTranscriptions)
-	router.GET("/audio/:id", bw.getMinioLink)
-	router.GET("/send_report/docx/unofficial/:id", bw.sendDocxUnofficialHandler)
-	router.GET("/send_report/docx/official/:id", bw.sendDocxOfficialHandler)
-	router.GET("/send_report/pdf/unofficial/:id", bw.sendPdfUnofficialHandler)
-	router.GET("/send_report/pdf/official/:id", bw.sendPdfOfficialHandler)
-
-	go router.Run("0.0.0.0:8888")
-}
 
-type getTranscriptionsResponse struct {
-	ID        int64     `json:"id"`
-	Status    int       `json:"status"`
-	Name      string    `json:"name"`
-	AudioLink string    `json:"audio_link"`
-	CreatedAt time.Time `json:"created_at"`
-}
+	api := router.Group("/", bw.apiAuth)
+	api.GET("/get_transcriptions", bw.getTranscriptions)
+	api.GET("/audio/:id", bw.getMinioLink)
+	api.GET("/send_report/docx/unofficial/:id", bw.sendDocxUnofficialHandler)
+	api.GET("/send_report/docx/official/:id", bw.sendDocxOfficialHandler)
+	api.GET("/send_report/pdf/unofficial/:id", bw.sendPdfUnofficialHandler)
+	api.GET("/send_report/pdf/official/:id", bw.sendPdfOfficialHandler)
 
-func (bw *BotWrapper) getTranscriptions(c *gin.Context) {
-	respPG, err := bw.psql.GetTranscribitions(c.Request.Context())
-	if err != nil {
-		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{
-			"message": "can't get GetTranscribitions: " + err.Error(),
-		})
-		return
+	if webhook {
+		// The webhook checks its own secret instead of the API tokens.
+		path, _ := bw.webhookPath()
+		router.POST(path, bw.webhookHandler(bw.b.WebhookHandler()))
 	}
 
-	resp := make([]getTranscriptionsResponse, len(respPG))
-	for i := range resp {
-		resp[i] = getTranscriptionsResponse{
-			ID:        respPG[i].ID,
-			Status:    int(respPG[i].Status.Int32),
-			Name:      "Совещание",
-			AudioLink: "/audio/" + strconv.Itoa(int(respPG[i].ID)),
-			CreatedAt: respPG[i].CreatedAt.Time,
+	go func() {
+		var err error
+		if bw.cfg.TLSCert != "" && bw.cfg.TLSKey != "" {
+			err = router.RunTLS(bw.cfg.APIAddr, bw.cfg.TLSCert, bw.cfg.TLSKey)
+		} else {
+			err = router.Run(bw.cfg.APIAddr)
 		}
-	}
 
-	c.JSON(http.StatusOK, resp)
+		bw.log.Error().Err(err).Str("addr", bw.cfg.APIAddr).Msg("api server stopped")
+	}()
 }
 
-func (bw *BotWrapper) getMinioLink(c *gin.Context) {
-	idStr := c.Param("id")
-	id, err := strconv.Atoi(idStr)
-	if err != nil {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
-			"message": "id is not number" + err.Error(),
+const apiUserKey = "user"
+
+// apiAuth lets in the members with an API token issued by /token. The token
+// comes in the Authorization header or, for audio players, in the token parameter.
+// The Mini App sends its init data signed by Telegram as "tma <init data>" instead.
+func (bw *BotWrapper) apiAuth(c *gin.Context) {
+	header := c.GetHeader("Authorization")
+	if initData, ok := strings.CutPrefix(header, "tma "); ok {
+		bw.initDataAuth(c, initData)
+
+		return
+	}
+
+	token := c.Query("token")
+	if header != "" {
+		token = strings.TrimPrefix(header, "Bearer ")
+	}
+
+	if token == "" {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
+			"message": "token required",
 		})
 		return
 	}
 
-	tr, err := bw.psql.GetTranscribition(c.Request.Context(), int64(id))
+	user, err := bw.psql.GetUserByAPIToken(c.Request.Context(), tokenHash(token))
+	if errors.Is(err, pgx.ErrNoRows) {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
+			"message": "invalid token",
+		})
+		return
+	}
 	if err != nil {
 		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{
-			"message": "get transcribition failed" + err.Error(),
+			"message": "get user failed: " + err.Error(),
 		})
 		return
 	}
 
-	f, err := bw.min.DownloadFile(c.Request.Context(), tr.AudioNameMinio.String, tr.AudioBucketMinio.String)
+	bw.apiLogin(c, user)
+}
+
+// initDataAuth lets in the member who opened the Mini App.
+func (bw *BotWrapper) initDataAuth(c *gin.Context, initData string) {
+	userID, err := validateInitData(initData, bw.cfg.Token, time.Now())
 	if err != nil {
-		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{
-			"message": "download file failed: " + err.Error(),
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
+			"message": err.Error(),
 		})
 		return
 	}
 
-	b, err := io.ReadAll(f)
-	if err != nil {
+	user, err := bw.psql.GetUser(c.Request.Context(), userID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		user = postgres.User{TgUserID: userID}
+	} else if err != nil {
 		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{
-			"message": "read body failed: " + err.Error(),
+			"message": "get user failed: " + err.Error(),
 		})
 		return
 	}
 
-	switch {
-	case strings.HasSuffix(tr.AudioNameMinio.String, ".mp3"):
-		c.Data(http.StatusOK, "audio/mpeg", b)
-	case strings.HasSuffix(tr.AudioNameMinio.String, ".ogg"):
-		c.Data(http.StatusOK, "audio/ogg", b)
-	case strings.HasSuffix(tr.AudioNameMinio.String, ".wav"):
-		c.Data(http.StatusOK, "audio/vnd.wav", b)
-	default:
-		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{
-			"message": "unknown type: " + tr.AudioNameMinio.String,
+	bw.apiLogin(c, user)
+}
+
+func (bw *BotWrapper) apiLogin(c *gin.Context, user postgres.User) {
+	if roleRanks[bw.userRole(user)] < roleRanks[RoleMember] {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+			"message": "access revoked",
 		})
 		return
 	}
+
+	c.Set(apiUserKey, user)
+	c.Next()
 }
 
-func (bw *BotWrapper) sendPdfUnofficialHandler(c *gin.Context) {
-	idStr := c.Param("id")
-	id, err := strconv.Atoi(idStr)
+func (bw *BotWrapper) apiAdmin(c *gin.Context) (postgres.User, bool) {
+	user := c.MustGet(apiUserKey).(postgres.User)
+
+	return user, bw.userRole(user) == RoleAdmin
+}
+
+// apiMeeting loads the meeting of the request, admins see every meeting and
+// members the ones they uploaded and the ones of their groups.
+func (bw *BotWrapper) apiMeeting(c *gin.Context) (postgres.Transcribition, bool) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
 	if err != nil {
 		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
 			"message": "id is not number" + err.Error(),
 		})
-		return
+		return postgres.Transcribition{}, false
 	}
 
-	ts, err := bw.psql.GetTranscribition(c.Request.Context(), int64(id))
+	tr, err := bw.psql.GetTranscribition(c.Request.Context(), id)
+	if errors.Is(err, pgx.ErrNoRows) {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{
+			"message": "meeting not found",
+		})
+		return postgres.Transcribition{}, false
+	}
 	if err != nil {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
-			"message": "" + err.Error(),
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{
+			"message": "get transcribition failed" + err.Error(),
 		})
-		return
+		return postgres.Transcribition{}, false
 	}
 
-	bw.sendPdfUnofficial(c.Request.Context(), ts.TgUserID)
-}
+	user, admin := bw.apiAdmin(c)
+	if admin || tr.TgUserID == user.TgUserID {
+		return tr, true
+	}
 
-func (bw *BotWrapper) sendPdfOfficialHandler(c *gin.Context) {
-	idStr := c.Param("id")
-	id, err := strconv.Atoi(idStr)
+	member, err := bw.psql.IsChatMember(c.Request.Context(), postgres.IsChatMemberParams{
+		ChatID:   tr.ChatID,
+		TgUserID: user.TgUserID,
+	})
 	if err != nil {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
-			"message": "id is not number" + err.Error(),
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{
+			"message": "check chat member failed" + err.Error(),
 		})
-		return
+		return postgres.Transcribition{}, false
 	}
 
-	ts, err := bw.psql.GetTranscribition(c.Request.Context(), int64(id))
+	if !member {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{
+			"message": "meeting not found",
+		})
+		return postgres.Transcribition{}, false
+	}
+
+	return tr, true
+}
+
+type getTranscriptionsResponse struct {
+	ID          int64      `json:"id"`
+	Status      int        `json:"status"`
+	Name        string     `json:"name"`
+	Description string     `json:"description,omitempty"`
+	Tags        []string   `json:"tags"`
+	AudioLink   string     `json:"audio_link"`
+	CreatedAt   time.Time  `json:"created_at"`
+	StartedAt   *time.Time `json:"started_at,omitempty"`
+}
+
+func (bw *BotWrapper) getTranscriptions(c *gin.Context) {
+	var (
+		respPG []postgres.Transcribition
+		err    error
+	)
+
+	if user, admin := bw.apiAdmin(c); admin {
+		respPG, err = bw.psql.GetTranscribitions(c.Request.Context())
+	} else {
+		respPG, err = bw.psql.GetUserTranscribitions(c.Request.Context(), user.TgUserID)
+	}
 	if err != nil {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
-			"message": "" + err.Error(),
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{
+			"message": "can't get GetTranscribitions: " + err.Error(),
 		})
 		return
 	}
 
-	bw.sendPdfOfficial(c.Request.Context(), ts.TgUserID)
+	resp := make([]getTranscriptionsResponse, len(respPG))
+	for i := range resp {
+		resp[i] = getTranscriptionsResponse{
+			ID:          respPG[i].ID,
+			Status:      int(respPG[i].Status.Int32),
+			Name:        meetingName(respPG[i]),
+			Description: respPG[i].Description.String,
+			Tags:        respPG[i].Tags,
+			AudioLink:   "/audio/" + strconv.Itoa(int(respPG[i].ID)),
+			CreatedAt:   respPG[i].CreatedAt.Time,
+		}
+
+		if respPG[i].StartedAt.Valid {
+			resp[i].StartedAt = &respPG[i].StartedAt.Time
+		}
+	}
+
+	c.JSON(http.StatusOK, resp)
 }
 
-func (bw *BotWrapper) sendDocxUnofficialHandler(c *gin.Context) {
-	idStr := c.Param("id")
-	id, err := strconv.Atoi(idStr)
+func (bw *BotWrapper) getMinioLink(c *gin.Context) {
+	tr, ok := bw.apiMeeting(c)
+	if !ok {
+		return
+	}
+
+	f, err := bw.min.DownloadFile(c.Request.Context(), tr.AudioNameMinio.String, tr.AudioBucketMinio.String)
 	if err != nil {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
-			"message": "id is not number" + err.Error(),
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{
+			"message": "download file failed: " + err.Error(),
 		})
 		return
 	}
+	defer f.Close()
 
-	ts, err := bw.psql.GetTranscribition(c.Request.Context(), int64(id))
+	b, err := io.ReadAll(f)
 	if err != nil {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
-			"message": "" + err.Error(),
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{
+			"message": "read body failed: " + err.Error(),
 		})
 		return
 	}
 
-	bw.sendDocxUnofficial(c.Request.Context(), ts.TgUserID)
+	format, ok := formatByExt(tr.AudioNameMinio.String)
+	if !ok {
+		c.Data(http.StatusOK, "application/octet-stream", b)
+		return
+	}
+
+	c.Data(http.StatusOK, format.Mime, b)
 }
 
-func (bw *BotWrapper) sendDocxOfficialHandler(c *gin.Context) {
-	idStr := c.Param("id")
-	id, err := strconv.Atoi(idStr)
-	if err != nil {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
-			"message": "id is not number" + err.Error(),
-		})
+// apiReport queues the report of the meeting within the report quota of the user.
+func (bw *BotWrapper) apiReport(c *gin.Context, official bool, format string) {
+	ts, ok := bw.apiMeeting(c)
+	if !ok {
 		return
 	}
 
-	ts, err := bw.psql.GetTranscribition(c.Request.Context(), int64(id))
-	if err != nil {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
-			"message": "" + err.Error(),
+	user, _ := bw.apiAdmin(c)
+	if !bw.takeReport(c.Request.Context(), user.TgUserID, ts.ID) {
+		c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{
+			"message": "report rate limit exceeded",
 		})
 		return
 	}
 
-	bw.sendDocxOfficial(c.Request.Context(), ts.TgUserID)
+	bw.submitReport(user.TgUserID, ts.ID, official, format)
+}
+
+func (bw *BotWrapper) sendPdfUnofficialHandler(c *gin.Context) {
+	bw.apiReport(c, false, "pdf")
+}
+
+func (bw *BotWrapper) sendPdfOfficialHandler(c *gin.Context) {
+	bw.apiReport(c, true, "pdf")
+}
+
+func (bw *BotWrapper) sendDocxUnofficialHandler(c *gin.Context) {
+	bw.apiReport(c, false, "docx")
+}
+
+func (bw *BotWrapper) sendDocxOfficialHandler(c *gin.Context) {
+	bw.apiReport(c, true, "docx")
 }
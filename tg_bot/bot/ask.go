@@ -0,0 +1,279 @@
+package bot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+	"github.com/gulldan/cp2024omsk-pmsk/bot/clients/llama"
+	"github.com/gulldan/cp2024omsk-pmsk/bot/clients/whisper"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+
+	postgres "github.com/gulldan/cp2024omsk-pmsk/bot/postgres/generated"
+)
+
+const (
+	ASK            = "/ask"
+	ASK_USAGE      = "Задайте вопрос о встрече: /ask что решили по бюджету? Чтобы спросить о конкретной встрече, ответьте на ее статусное сообщение."
+	ASK_NO_MEETING = "В этом чате пока нет расшифрованных встреч."
+	ASK_NOT_READY  = "Встреча еще не расшифрована, задайте вопрос позже."
+	ASK_THINKING   = "Ищу ответ в расшифровке…"
+	ASK_FAILED     = "Не удалось получить ответ, попробуйте позже."
+
+	// askContextLimit keeps the prompt within the context of the model.
+	askContextLimit = 12000
+	askAnswerTokens = 512
+	// maxMessageLength is the limit of a Telegram message.
+	maxMessageLength = 4096
+)
+
+// askPrompt takes the transcript fragments and the question.
+const askPrompt = `<|user|>
+Вы - ИИ секретарь. Ответьте на вопрос о рабочей встрече, используя только фрагменты расшифровки ниже.
+Каждый фрагмент начинается с времени и спикера. Подтверждайте ответ ссылками на фрагменты в формате [чч:мм:сс, спикер].
+Если во фрагментах нет ответа, так и скажите. Отвечайте кратко, на языке вопроса.
+
+Фрагменты расшифровки:
+%s
+Вопрос: %s<|end|>
+<|assistant|>`
+
+// askHandler answers the question about the meeting the command replies to or
+// the last transcribed meeting of the chat.
+func (bw *BotWrapper) askHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
+	reply := func(text string) {
+		if _, err := b.SendMessage(ctx, &bot.SendMessageParams{
+			ChatID:          update.Message.Chat.ID,
+			MessageThreadID: threadID(update.Message),
+			Text:            text,
+		}); err != nil {
+			bw.log.Error().Err(err).Msg("send ask message failed")
+		}
+	}
+
+	question := bw.stripMention(strings.TrimPrefix(update.Message.Text, ASK))
+	if question == "" {
+		reply(ASK_USAGE)
+
+		return
+	}
+
+	tr, err := bw.statusMessageMeeting(ctx, update.Message)
+	if errors.Is(err, pgx.ErrNoRows) {
+		tr, err = bw.psql.GetLastTranscribed(ctx, update.Message.Chat.ID)
+	}
+	if err != nil {
+		if !errors.Is(err, pgx.ErrNoRows) {
+			bw.log.Error().Err(err).Int64("chatID", update.Message.Chat.ID).Msg("get meeting failed")
+		}
+
+		reply(ASK_NO_MEETING)
+
+		return
+	}
+
+	bw.ask(ctx, update.Message, tr, question)
+}
+
+// questionReply answers a message replying to the status message of a meeting,
+// it reports whether the message was one.
+func (bw *BotWrapper) questionReply(ctx context.Context, msg *models.Message) bool {
+	if msg.Text == "" {
+		return false
+	}
+
+	tr, err := bw.statusMessageMeeting(ctx, msg)
+	if err != nil {
+		return false
+	}
+
+	bw.ask(ctx, msg, tr, bw.stripMention(msg.Text))
+
+	return true
+}
+
+// statusMessageMeeting finds the meeting whose status message the message replies to.
+func (bw *BotWrapper) statusMessageMeeting(ctx context.Context, msg *models.Message) (postgres.Transcribition, error) {
+	if msg.ReplyToMessage == nil {
+		return postgres.Transcribition{}, pgx.ErrNoRows
+	}
+
+	return bw.psql.GetTranscribitionByStatusMessage(ctx, postgres.GetTranscribitionByStatusMessageParams{
+		ChatID: msg.Chat.ID,
+		MessageToEdit: pgtype.Int8{
+			Int64: int64(msg.ReplyToMessage.ID),
+			Valid: true,
+		},
+	})
+}
+
+func (bw *BotWrapper) ask(ctx context.Context, msg *models.Message, tr postgres.Transcribition, question string) {
+	if !bw.requireMember(ctx, msg) {
+		return
+	}
+
+	params := &bot.SendMessageParams{
+		ChatID:          msg.Chat.ID,
+		MessageThreadID: threadID(msg),
+		Text:            ASK_THINKING,
+		ReplyParameters: &models.ReplyParameters{
+			MessageID:                msg.ID,
+			AllowSendingWithoutReply: true,
+		},
+	}
+
+	if !tr.Transcription.Valid {
+		params.Text = ASK_NOT_READY
+	}
+
+	m, err := bw.b.SendMessage(ctx, params)
+	if err != nil {
+		bw.log.Error().Err(err).Int64("id", tr.ID).Msg("send ask message failed")
+
+		return
+	}
+
+	if !tr.Transcription.Valid {
+		return
+	}
+
+	// The LLM takes a while, don't hold back other updates.
+	go func() {
+		text, err := bw.answerQuestion(ctx, tr, question)
+		if err != nil {
+			bw.log.Error().Err(err).Int64("id", tr.ID).Msg("answer question failed")
+			text = ASK_FAILED
+		}
+
+		if _, err := bw.b.EditMessageText(ctx, &bot.EditMessageTextParams{
+			ChatID:    m.Chat.ID,
+			MessageID: m.ID,
+			Text:      text,
+		}); err != nil {
+			bw.log.Error().Err(err).Int64("id", tr.ID).Msg("failed to edit message")
+		}
+	}()
+}
+
+// answerQuestion sends the question with the relevant part of the transcript to the LLM.
+func (bw *BotWrapper) answerQuestion(ctx context.Context, tr postgres.Transcribition, question string) (string, error) {
+	segments, err := bw.meetingSegments(ctx, tr)
+	if err != nil {
+		return "", err
+	}
+
+	var sb strings.Builder
+	for _, s := range relevantSegments(segments, question, askContextLimit) {
+		sb.WriteString(segmentLine(s) + "\n")
+	}
+
+	resp, err := bw.llama.Completion(ctx, llama.CompletionRequest{
+		Prompt:      fmt.Sprintf(askPrompt, sb.String(), question),
+		NPredict:    askAnswerTokens,
+		Temperature: 0.2,
+	})
+	if err != nil {
+		return "", fmt.Errorf("completion failed: %w", err)
+	}
+
+	answer := strings.TrimSpace(resp.Content)
+	if answer == "" {
+		return "", errors.New("empty answer")
+	}
+
+	if r := []rune(answer); len(r) > maxMessageLength {
+		answer = string(r[:maxMessageLength-1]) + "…"
+	}
+
+	return answer, nil
+}
+
+// questionStems are crude stems of the words, the first runes are enough to
+// match the inflected forms of Russian words.
+func questionStems(text string) map[string]bool {
+	const stemLength = 5
+
+	stems := make(map[string]bool)
+	for _, w := range strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) {
+		r := []rune(w)
+		if len(r) < 3 {
+			continue
+		}
+
+		if len(r) > stemLength {
+			r = r[:stemLength]
+		}
+
+		stems[string(r)] = true
+	}
+
+	return stems
+}
+
+// relevantSegments picks the segments sharing the most words with the question
+// together with their neighbours, the segments keep the order they were said in.
+// The whole transcript is used when it fits into the limit.
+func relevantSegments(segments []whisper.Segment, question string, limit int) []whisper.Segment {
+	total := 0
+	for _, s := range segments {
+		total += len(s.Text)
+	}
+
+	if total <= limit {
+		return segments
+	}
+
+	stems := questionStems(question)
+	scores := make([]int, len(segments))
+	for i, s := range segments {
+		for stem := range questionStems(s.Text) {
+			if stems[stem] {
+				scores[i]++
+			}
+		}
+	}
+
+	order := make([]int, len(segments))
+	for i := range order {
+		order[i] = i
+	}
+
+	sort.SliceStable(order, func(a, b int) bool {
+		return scores[order[a]] > scores[order[b]]
+	})
+
+	picked := make(map[int]bool)
+	size := 0
+
+	for _, i := range order {
+		for _, j := range []int{i - 1, i, i + 1} {
+			if j < 0 || j >= len(segments) || picked[j] || size+len(segments[j].Text) > limit {
+				continue
+			}
+
+			picked[j] = true
+			size += len(segments[j].Text)
+		}
+
+		if size >= limit {
+			break
+		}
+	}
+
+	result := make([]whisper.Segment, 0, len(picked))
+	for i, s := range segments {
+		if picked[i] {
+			result = append(result, s)
+		}
+	}
+
+	return result
+}
@@ -0,0 +1,357 @@
+package bot
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+	"github.com/gulldan/cp2024omsk-pmsk/bot/clients/whisper"
+	"github.com/jackc/pgx/v5/pgtype"
+
+	postgres "github.com/gulldan/cp2024omsk-pmsk/bot/postgres/generated"
+)
+
+const (
+	AsrModeFull   = "full"
+	AsrModeStages = "stages"
+
+	AsrStepTranscribe = "transcribe"
+	AsrStepAlign      = "align"
+	AsrStepDiarize    = "diarize"
+	AsrStepCombine    = "combine"
+
+	REDIARIZE     = "rediarize_"
+	REDIARIZE_ASK = "Сколько спикеров участвовало во встрече? Протокол с правками и утверждением останется как есть, транскрипт будет перестроен, а имена спикеров можно будет проверить заново."
+
+	minSpeakers = 2
+	maxSpeakers = 6
+)
+
+// asrSteps are the whisper steps of the staged transcription in the order they run.
+var asrSteps = []string{AsrStepTranscribe, AsrStepAlign, AsrStepDiarize, AsrStepCombine}
+
+var asrStepNames = map[string]string{
+	AsrStepTranscribe: "распознавание речи",
+	AsrStepAlign:      "выравнивание по времени",
+	AsrStepDiarize:    "разделение по спикерам",
+	AsrStepCombine:    "сопоставление реплик со спикерами",
+}
+
+// runStagedTranscription drives the whisper steps one by one and stores the result
+// of every step, so a restart or a re-run of diarization skips the finished steps.
+func (bw *BotWrapper) runStagedTranscription(ctx context.Context, tr postgres.Transcribition) (whisper.Result, error) {
+	rows, err := bw.psql.GetAsrSteps(ctx, tr.ID)
+	if err != nil {
+		return whisper.Result{}, stageError(StatusTranscription, ErrCodeStorage, fmt.Errorf("get asr steps failed: %w", err))
+	}
+
+	stored := make(map[string]postgres.AsrStep, len(rows))
+	for _, row := range rows {
+		stored[row.Step] = row
+	}
+
+	results := make(map[string]json.RawMessage, len(asrSteps))
+
+	for i, name := range asrSteps {
+		step, ok := stored[name]
+		if ok && step.Result.Valid {
+			results[name] = json.RawMessage(step.Result.String)
+
+			continue
+		}
+
+		bw.showAsrProgress(ctx, tr, i)
+
+		if !ok {
+			step = postgres.AsrStep{TranscribitionID: tr.ID, Step: name}
+
+			if err := bw.psql.CreateAsrStep(ctx, postgres.CreateAsrStepParams{
+				TranscribitionID: tr.ID,
+				Step:             name,
+			}); err != nil {
+				return whisper.Result{}, stageError(StatusTranscription, ErrCodeStorage, fmt.Errorf("create asr step failed: %w", err))
+			}
+		}
+
+		result, err := bw.runAsrStep(ctx, tr, step, results)
+		if err != nil {
+			return whisper.Result{}, fmt.Errorf("asr step %s failed: %w", name, err)
+		}
+
+		if err := bw.psql.UpdateAsrStepResult(ctx, postgres.UpdateAsrStepResultParams{
+			Result: pgtype.Text{
+				String: string(result),
+				Valid:  true,
+			},
+			TranscribitionID: tr.ID,
+			Step:             name,
+		}); err != nil {
+			return whisper.Result{}, stageError(StatusTranscription, ErrCodeStorage, fmt.Errorf("update asr step result failed: %w", err))
+		}
+
+		results[name] = result
+	}
+
+	return taskSegments(whisper.Task{Result: results[AsrStepCombine]}, nil)
+}
+
+// runAsrStep re-attaches to the whisper task of the step or submits a new one.
+func (bw *BotWrapper) runAsrStep(ctx context.Context, tr postgres.Transcribition, step postgres.AsrStep, results map[string]json.RawMessage) (json.RawMessage, error) {
+	if step.WhisperTaskID.Valid {
+		bw.log.Info().Int64("id", tr.ID).Str("step", step.Step).Str("task", step.WhisperTaskID.String).Msg("reattach to whisper task")
+
+		v, err := bw.waitTranscription(ctx, step.WhisperTaskID.String)
+		if !errors.Is(err, whisper.ErrTaskNotFound) {
+			return v.Result, whisperError(err)
+		}
+
+		bw.log.Warn().Int64("id", tr.ID).Str("step", step.Step).Msg("whisper task lost, resubmit")
+	}
+
+	created, err := bw.submitAsrStep(ctx, tr, step, results)
+	if err != nil {
+		return nil, stageError(StatusTranscription, ErrCodeWhisperUnavailable, fmt.Errorf("submit asr step failed: %w", err))
+	}
+
+	if err := bw.psql.UpdateAsrStepTask(ctx, postgres.UpdateAsrStepTaskParams{
+		WhisperTaskID: pgtype.Text{
+			String: created.ID,
+			Valid:  true,
+		},
+		TranscribitionID: tr.ID,
+		Step:             step.Step,
+	}); err != nil {
+		return nil, stageError(StatusTranscription, ErrCodeStorage, fmt.Errorf("update asr step task failed: %w", err))
+	}
+
+	v, err := bw.waitTranscription(ctx, created.ID)
+
+	return v.Result, whisperError(err)
+}
+
+func (bw *BotWrapper) submitAsrStep(ctx context.Context, tr postgres.Transcribition, step postgres.AsrStep, results map[string]json.RawMessage) (whisper.TaskCreated, error) {
+	if step.Step == AsrStepCombine {
+		return bw.whisper.Combine(ctx, results[AsrStepAlign], results[AsrStepDiarize])
+	}
+
+	file := tr.AudioNameMinio.String
+
+	audio, err := bw.min.DownloadFile(ctx, file, bw.min.GetAudioBucket())
+	if err != nil {
+		return whisper.TaskCreated{}, fmt.Errorf("download file failed: %w", err)
+	}
+	defer audio.Close()
+
+	params := bw.whisperParams(ctx, tr.TgUserID)
+
+	switch step.Step {
+	case AsrStepTranscribe:
+		return bw.whisper.Transcribe(ctx, filepath.Base(file), audio, whisper.Params{
+			Model:    params.Model,
+			Language: params.Language,
+		})
+	case AsrStepAlign:
+		return bw.whisper.Align(ctx, results[AsrStepTranscribe], filepath.Base(file), audio)
+	case AsrStepDiarize:
+		// The count chosen on re-diarization wins over the one from the settings.
+		if step.Speakers.Valid {
+			params.MinSpeakers, params.MaxSpeakers = int(step.Speakers.Int32), int(step.Speakers.Int32)
+		}
+
+		return bw.whisper.Diarize(ctx, filepath.Base(file), audio, whisper.Params{
+			MinSpeakers: params.MinSpeakers,
+			MaxSpeakers: params.MaxSpeakers,
+		})
+	default:
+		return whisper.TaskCreated{}, fmt.Errorf("unknown asr step %q", step.Step)
+	}
+}
+
+func (bw *BotWrapper) showAsrProgress(ctx context.Context, tr postgres.Transcribition, i int) {
+	text := fmt.Sprintf("транскрибация (шаг %d из %d: %s).", i+1, len(asrSteps), asrStepNames[asrSteps[i]])
+
+	if _, err := bw.b.EditMessageText(ctx, &bot.EditMessageTextParams{
+		ChatID:      tr.ChatID,
+		MessageID:   int(tr.MessageToEdit.Int64),
+		Text:        fmt.Sprintf(StatusMessageWait, text),
+		ReplyMarkup: bw.cancelMarkup(tr.ID),
+	}); err != nil {
+		bw.log.Error().Int64("id", tr.ID).Err(err).Msg("failed to edit message")
+	}
+}
+
+// deleteAsrTasks deletes the whisper tasks of the steps which are not finished yet.
+func (bw *BotWrapper) deleteAsrTasks(ctx context.Context, pgID int64) {
+	steps, err := bw.psql.GetAsrSteps(ctx, pgID)
+	if err != nil {
+		bw.log.Error().Err(err).Int64("id", pgID).Msg("get asr steps failed")
+
+		return
+	}
+
+	for _, step := range steps {
+		if !step.WhisperTaskID.Valid || step.Result.Valid {
+			continue
+		}
+
+		if err := bw.whisper.DeleteTask(ctx, step.WhisperTaskID.String); err != nil && !errors.Is(err, whisper.ErrTaskNotFound) {
+			bw.log.Error().Err(err).Int64("id", pgID).Str("task", step.WhisperTaskID.String).Msg("delete whisper task failed")
+		}
+	}
+}
+
+// resetWhisperTasks forgets the whisper tasks of the transcribition and of its
+// unfinished steps, so the next run submits new ones. The finished steps are kept.
+func (bw *BotWrapper) resetWhisperTasks(ctx context.Context, tr postgres.Transcribition) error {
+	if err := bw.psql.UpdateWhisperTaskID(ctx, postgres.UpdateWhisperTaskIDParams{ID: tr.ID}); err != nil {
+		return fmt.Errorf("update whisper task id failed: %w", err)
+	}
+
+	steps, err := bw.psql.GetAsrSteps(ctx, tr.ID)
+	if err != nil {
+		return fmt.Errorf("get asr steps failed: %w", err)
+	}
+
+	for _, step := range steps {
+		if step.Result.Valid {
+			continue
+		}
+
+		if err := bw.psql.CreateAsrStep(ctx, postgres.CreateAsrStepParams{
+			TranscribitionID: tr.ID,
+			Step:             step.Step,
+			Speakers:         step.Speakers,
+		}); err != nil {
+			return fmt.Errorf("create asr step failed: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// rediarizeMarkup asks for the number of speakers in the meeting, the action
+// is rediarize_<count>, 0 goes back.
+func (bw *BotWrapper) rediarizeMarkup(pgID int64) models.ReplyMarkup {
+	var row []models.InlineKeyboardButton
+	for n := minSpeakers; n <= maxSpeakers; n++ {
+		row = append(row, models.InlineKeyboardButton{Text: strconv.Itoa(n), CallbackData: bw.signedData(REDIARIZE+strconv.Itoa(n), pgID)})
+	}
+
+	return &models.InlineKeyboardMarkup{
+		InlineKeyboard: [][]models.InlineKeyboardButton{
+			row,
+			{
+				{Text: "Назад", CallbackData: bw.signedData(REDIARIZE+"0", pgID)},
+			},
+		},
+	}
+}
+
+// rediarizeCallbackQuery re-runs diarization with the number of speakers chosen by
+// the user, the transcript and the alignment are reused. Only the transcript is
+// rebuilt, the protocol versions are kept.
+func (bw *BotWrapper) rediarizeCallbackQuery(ctx context.Context, b *bot.Bot, update *models.Update) {
+	answer := func(text string) {
+		if _, err := b.AnswerCallbackQuery(ctx, &bot.AnswerCallbackQueryParams{
+			CallbackQueryID: update.CallbackQuery.ID,
+			Text:            text,
+		}); err != nil {
+			bw.log.Error().Err(err).Msg("answer callback query failed")
+		}
+	}
+
+	data, pgID, err := bw.parseSignedData(update.CallbackQuery.Data)
+	if err != nil {
+		answer(callbackError(err))
+
+		return
+	}
+
+	speakers := strings.TrimPrefix(data, REDIARIZE)
+
+	tr, err := bw.psql.GetTranscribition(ctx, pgID)
+	if err != nil || !canAccess(tr, update.CallbackQuery) {
+		answer("Встреча не найдена.")
+
+		return
+	}
+
+	if !bw.hasRole(ctx, update.CallbackQuery.From.ID, RoleMember) {
+		answer(fmt.Sprintf(ACCESS_DENIED, update.CallbackQuery.From.ID))
+
+		return
+	}
+
+	if tr.Status.Int32 != StatusDone {
+		answer("Встреча еще обрабатывается.")
+
+		return
+	}
+
+	if speakers == "" {
+		answer("")
+
+		if _, err := b.EditMessageText(ctx, &bot.EditMessageTextParams{
+			ChatID:      tr.ChatID,
+			MessageID:   int(tr.MessageToEdit.Int64),
+			Text:        REDIARIZE_ASK,
+			ReplyMarkup: bw.rediarizeMarkup(tr.ID),
+		}); err != nil {
+			bw.log.Error().Int64("id", tr.ID).Err(err).Msg("failed to edit message")
+		}
+
+		return
+	}
+
+	n, err := strconv.Atoi(speakers)
+	if err != nil || (n != 0 && (n < minSpeakers || n > maxSpeakers)) {
+		answer("Некорректный запрос.")
+
+		return
+	}
+
+	if n == 0 {
+		answer("")
+		bw.updateStatus(ctx, StatusDone, tr.ID, tr.ChatID, tr.MessageToEdit.Int64)
+
+		return
+	}
+
+	if err := bw.psql.CreateAsrStep(ctx, postgres.CreateAsrStepParams{
+		TranscribitionID: tr.ID,
+		Step:             AsrStepDiarize,
+		Speakers: pgtype.Int4{
+			Int32: int32(n),
+			Valid: true,
+		},
+	}); err != nil {
+		bw.log.Error().Err(err).Int64("id", tr.ID).Msg("create asr step failed")
+		answer("Не удалось перезапустить обработку.")
+
+		return
+	}
+
+	if err := bw.psql.DeleteAsrStep(ctx, postgres.DeleteAsrStepParams{
+		TranscribitionID: tr.ID,
+		Step:             AsrStepCombine,
+	}); err != nil {
+		bw.log.Error().Err(err).Int64("id", tr.ID).Msg("delete asr step failed")
+		answer("Не удалось перезапустить обработку.")
+
+		return
+	}
+
+	answer("Перераспределяем спикеров.")
+
+	bw.updateStatus(ctx, StatusTranscription, tr.ID, tr.ChatID, tr.MessageToEdit.Int64)
+
+	if err := bw.enqueueJob(ctx, tr.ID, StatusTranscription); err != nil {
+		bw.failTranscribition(ctx, tr, StatusTranscription, stageError(StatusTranscription, ErrCodeStorage, err))
+	}
+}
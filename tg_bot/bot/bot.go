@@ -4,16 +4,24 @@ import (
 	"bytes"
 	"context"
 	"embed"
+	"errors"
 	"fmt"
 	"net/url"
 	"os"
 	"os/signal"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/go-telegram/bot"
 	"github.com/go-telegram/bot/models"
+	"github.com/gulldan/cp2024omsk-pmsk/bot/clients/llama"
+	"github.com/gulldan/cp2024omsk-pmsk/bot/clients/reporter"
+	"github.com/gulldan/cp2024omsk-pmsk/bot/clients/whisper"
 	"github.com/gulldan/cp2024omsk-pmsk/bot/minio"
+	"github.com/gulldan/cp2024omsk-pmsk/bot/resilient"
 	"github.com/gulldan/cp2024omsk-pmsk/config"
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgtype"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/pressly/goose/v3"
@@ -28,9 +36,11 @@ const (
 	REPORT_PDF_OFF    = "report_pdf_off"
 	REPORT_DOCX_UNOFF = "report_docx_unoff"
 	REPORT_PDF_UNOFF  = "report_pdf_unoff"
+	REPORT_FAILED     = "Не удалось построить отчет: %s"
 
-	StatusMessageWait = "Пожалуйста, ожидайте.\nТекущий статус задачи: %s"
-	StatusMessageDone = "Задача выполнена."
+	StatusMessageWait  = "Пожалуйста, ожидайте.\nТекущий статус задачи: %s"
+	StatusMessageDone  = "Задача выполнена."
+	StatusMessageQueue = "Пожалуйста, ожидайте.\nТекущий статус задачи: ожидание этапа «%s».\nВы %d-й в очереди."
 )
 
 type BotWrapper struct {
@@ -39,6 +49,23 @@ type BotWrapper struct {
 	psql *postgres.Queries
 	cfg  *config.Config
 	b    *bot.Bot
+
+	whisper  WhisperClient
+	llama    LlamaClient
+	reporter ReporterClient
+
+	jobsNotify map[int]chan struct{}
+	runningMu  sync.Mutex
+	running    map[int64]context.CancelFunc
+	queueMu    sync.Mutex
+	// queuePositions keeps the last position shown to the user, so the status
+	// message is edited only when it changes.
+	queuePositions map[int64]int
+	reports        *fairPool
+	// callbackKey signs the meeting ids in callback data.
+	callbackKey []byte
+	// username of the bot, it is mentioned in groups and appended to commands there.
+	username string
 }
 
 //go:embed postgres/sql/migrations/*.sql
@@ -79,84 +106,211 @@ func New(cfg *config.Config) error {
 	bw.min = min
 	bw.psql = postgres.New(pg)
 	bw.cfg = cfg
+	bw.jobsNotify = map[int]chan struct{}{
+		StatusTranscription: make(chan struct{}, 1),
+		StatusNers:          make(chan struct{}, 1),
+	}
+	bw.queuePositions = make(map[int64]int)
+	bw.reports = newFairPool()
+	// The audio is streamed to whisper, only the wait for its answer is limited.
+	bw.whisper = whisper.New(cfg.WhisperAddr, resilient.New("whisper", resilient.Options{
+		ResponseHeaderTimeout: cfg.WhisperTimeout,
+		Retries:               cfg.HTTPRetries,
+		BreakerThreshold:      cfg.BreakerThreshold,
+		BreakerCooldown:       cfg.BreakerCooldown,
+	}))
+	bw.llama = llama.New(cfg.LlamaAddr, resilient.New("llama", resilient.Options{
+		Timeout:          cfg.LlamaTimeout,
+		Retries:          cfg.HTTPRetries,
+		RetryUnsafe:      true,
+		BreakerThreshold: cfg.BreakerThreshold,
+		BreakerCooldown:  cfg.BreakerCooldown,
+	}))
+	bw.reporter = reporter.New(cfg.ReporterAddr, resilient.New("reporter", resilient.Options{
+		Timeout:          cfg.ReporterTimeout,
+		Retries:          cfg.HTTPRetries,
+		RetryUnsafe:      true,
+		BreakerThreshold: cfg.BreakerThreshold,
+		BreakerCooldown:  cfg.BreakerCooldown,
+	}))
+	bw.reports.gate = bw.reporter.Available
+	bw.running = make(map[int64]context.CancelFunc)
+
+	// Buttons stay on old messages, so the key must survive restarts.
+	bw.callbackKey = []byte(cfg.CallbackSecret)
+	if cfg.CallbackSecret == "" {
+		bw.callbackKey = []byte(cfg.Token)
+	}
 
 	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
 	defer cancel()
 
+	commands := []struct {
+		command string
+		match   bot.MatchType
+		handler bot.HandlerFunc
+	}{
+		{START, bot.MatchTypePrefix, bw.startHandler},
+		{CANCEL, bot.MatchTypeExact, bw.cancelHandler},
+		{URL, bot.MatchTypePrefix, bw.urlHandler},
+		{HISTORY, bot.MatchTypeExact, bw.historyHandler},
+		{SETTINGS, bot.MatchTypeExact, bw.settingsHandler},
+		{AUTOPROCESS, bot.MatchTypeExact, bw.autoprocessHandler},
+		{ASK, bot.MatchTypePrefix, bw.askHandler},
+		{TRANSCRIPT, bot.MatchTypePrefix, bw.transcriptHandler},
+		{RENAME, bot.MatchTypePrefix, bw.meetingInfoHandler(RENAME, RENAME_USAGE, editTitle)},
+		{DESCRIBE, bot.MatchTypePrefix, bw.meetingInfoHandler(DESCRIBE, DESCRIBE_USAGE, editDescription)},
+		{TAGS, bot.MatchTypePrefix, bw.meetingInfoHandler(TAGS, TAGS_USAGE, editTags)},
+		{DATE, bot.MatchTypePrefix, bw.meetingInfoHandler(DATE, DATE_USAGE, editStartedAt)},
+		{GRANT, bot.MatchTypePrefix, bw.adminCommand(bw.grantHandler)},
+		{REVOKE, bot.MatchTypePrefix, bw.adminCommand(bw.revokeHandler)},
+		{USERS, bot.MatchTypeExact, bw.adminCommand(bw.usersHandler)},
+		{INVITE, bot.MatchTypePrefix, bw.adminCommand(bw.inviteHandler)},
+		{TOKEN, bot.MatchTypeExact, bw.tokenHandler},
+		{USAGE, bot.MatchTypeExact, bw.usageHandler},
+		{BEGIN, bot.MatchTypePrefix, bw.beginHandler},
+		{END, bot.MatchTypeExact, bw.endHandler},
+		{PROTOCOL, bot.MatchTypeExact, bw.protocolHandler},
+	}
+
 	opts := []bot.Option{
-		bot.WithDebug(),
 		bot.WithCheckInitTimeout(time.Minute),
-		bot.WithMessageTextHandler(START, bot.MatchTypeExact, bw.startHandler),
+		bot.WithMiddlewares(bw.trackMembers),
 		bot.WithDefaultHandler(bw.downloadHandler),
 		bot.WithCallbackQueryDataHandler("report", bot.MatchTypePrefix, bw.reportCallbackQuery),
+		bot.WithCallbackQueryDataHandler(RETRY, bot.MatchTypePrefix, bw.retryCallbackQuery),
+		bot.WithCallbackQueryDataHandler(CANCEL_CALLBACK, bot.MatchTypePrefix, bw.cancelCallbackQuery),
+		bot.WithCallbackQueryDataHandler(REDIARIZE, bot.MatchTypePrefix, bw.rediarizeCallbackQuery),
+		bot.WithCallbackQueryDataHandler(HISTORY_CALLBACK, bot.MatchTypePrefix, bw.historyCallbackQuery),
+		bot.WithCallbackQueryDataHandler(MEETING_CALLBACK, bot.MatchTypePrefix, bw.meetingCallbackQuery),
+		bot.WithCallbackQueryDataHandler(SETTINGS_CALLBACK, bot.MatchTypePrefix, bw.settingsCallbackQuery),
+		bot.WithCallbackQueryDataHandler(SPEAKER_CALLBACK, bot.MatchTypePrefix, bw.speakerCallbackQuery),
+		bot.WithCallbackQueryDataHandler(SPEAKERS_SKIP, bot.MatchTypePrefix, bw.skipSpeakersCallbackQuery),
+		bot.WithCallbackQueryDataHandler(TRANSCRIPT_CALLBACK, bot.MatchTypePrefix, bw.transcriptCallbackQuery),
+		bot.WithCallbackQueryDataHandler(ERRAND_CALLBACK, bot.MatchTypePrefix, bw.errandCallbackQuery),
+		bot.WithCallbackQueryDataHandler(PROTOCOL_CALLBACK, bot.MatchTypePrefix, bw.protocolCallbackQuery),
 	}
 
-	b, err := bot.New("6813542343:AAHfbZx-TjvJ3qf5B9L95X0kRkhO9emnWbU", opts...)
+	if cfg.Debug {
+		opts = append(opts, bot.WithDebug())
+	}
+
+	for _, c := range commands {
+		opts = append(opts, bot.WithMessageTextHandler(c.command, c.match, c.handler))
+	}
+
+	b, err := bot.New(cfg.Token, opts...)
 	if err != nil {
 		panic(err)
 	}
 	bw.b = b
 
-	bw.serveApi(ctx)
-	b.Start(ctx)
+	me, err := b.GetMe(ctx)
+	if err != nil {
+		return fmt.Errorf("get me failed: %w", err)
+	}
+	bw.username = me.Username
+
+	// Groups with several bots address commands as /command@bot.
+	for _, c := range commands {
+		b.RegisterHandler(bot.HandlerTypeMessageText, c.command+"@"+bw.username, c.match, c.handler)
+	}
+
+	if err := bw.resumeJobs(ctx); err != nil {
+		return fmt.Errorf("resume jobs failed: %w", err)
+	}
+
+	bw.runWorkers(ctx)
+	bw.receiveUpdates(ctx)
 
 	return nil
 }
 
+// startHandler greets the user, /start <code> comes from an invite link and
+// gives the user the role of the invite.
 func (bw *BotWrapper) startHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
-	_, err := b.SendMessage(ctx, &bot.SendMessageParams{
-		ChatID: update.Message.Chat.ID,
-		Text:   START_TEXT,
-	})
-	if err != nil {
-		bw.log.Error().Err(err).Msg("send start message failed")
+	userID := senderID(update.Message)
+
+	if from := update.Message.From; from != nil && from.Username != "" {
+		if err := bw.psql.SetUsername(ctx, postgres.SetUsernameParams{
+			TgUserID: userID,
+			Username: pgtype.Text{String: from.Username, Valid: true},
+		}); err != nil {
+			bw.log.Error().Err(err).Int64("chatID", userID).Msg("set username failed")
+		}
+	}
 
-		return
+	text := START_TEXT
+	if code := bw.stripMention(strings.TrimPrefix(update.Message.Text, START)); code != "" {
+		role, err := bw.acceptInvite(ctx, userID, code)
+		if err != nil {
+			if !errors.Is(err, pgx.ErrNoRows) {
+				bw.log.Error().Err(err).Int64("chatID", userID).Msg("accept invite failed")
+			}
+
+			bw.replyText(ctx, update.Message, INVITE_INVALID)
+
+			return
+		}
+
+		text = fmt.Sprintf(INVITE_ACCEPTED, role) + "\n" + START_TEXT
+	} else if !bw.hasRole(ctx, userID, RoleMember) {
+		text += "\n" + fmt.Sprintf(ACCESS_DENIED, userID)
 	}
+
+	bw.replyText(ctx, update.Message, text)
 }
 
+// downloadHandler starts processing of the recording from the message. In
+// groups the recording may come from the message the bot is mentioned in reply to,
+// the answers go to the chat and the topic of the message.
 func (bw *BotWrapper) downloadHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
-	mimeType := ""
-	fileID := ""
-
-	if update.Message.Audio != nil {
-		if update.Message.Audio.MimeType != "audio/mpeg" && update.Message.Audio.MimeType != "audio/ogg" && update.Message.Audio.MimeType != "audio/vnd.wav" {
-			_, err := b.SendMessage(ctx, &bot.SendMessageParams{
-				ChatID: update.Message.Chat.ID,
-				Text:   NOT_SUPPORTED_TYPE,
-			})
-			if err != nil {
-				bw.log.Error().Err(err).Msg("send start message failed")
-			}
+	if bw.speakerReply(ctx, update.Message) || bw.protocolReply(ctx, update.Message) || bw.questionReply(ctx, update.Message) {
+		return
+	}
 
+	recording := update.Message
+	if isGroup(update.Message.Chat) {
+		var ok bool
+		if recording, ok = bw.groupRecording(ctx, update.Message); !ok {
 			return
 		}
+	}
 
-		mimeType = update.Message.Audio.MimeType
-		fileID = update.Message.Audio.FileID
+	if !bw.requireMember(ctx, update.Message) {
+		return
 	}
 
-	if update.Message.Voice != nil {
-		if update.Message.Voice.MimeType != "audio/mpeg" && update.Message.Voice.MimeType != "audio/ogg" && update.Message.Voice.MimeType != "audio/vnd.wav" {
-			_, err := b.SendMessage(ctx, &bot.SendMessageParams{
-				ChatID: update.Message.Chat.ID,
-				Text:   NOT_SUPPORTED_TYPE,
-			})
-			if err != nil {
-				bw.log.Error().Err(err).Msg("send start message failed")
-			}
+	fileID, mimeType, size := attachment(recording)
+
+	if fileID == "" {
+		if link, ok := parseLink(bw.stripMention(recording.Text)); ok {
+			bw.ingestLink(ctx, b, update.Message, link)
 
 			return
 		}
 
-		mimeType = update.Message.Voice.MimeType
-		fileID = update.Message.Voice.FileID
+		_, err := b.SendMessage(ctx, &bot.SendMessageParams{
+			ChatID:          update.Message.Chat.ID,
+			MessageThreadID: threadID(update.Message),
+			Text:            NO_AUDIO_ATTACHED,
+		})
+		if err != nil {
+			bw.log.Error().Err(err).Msg("send start message failed")
+		}
+
+		return
 	}
 
-	if fileID == "" {
+	if !bw.checkUploadQuota(ctx, update.Message, 0) {
+		return
+	}
+
+	if size > telegramDownloadLimit {
 		_, err := b.SendMessage(ctx, &bot.SendMessageParams{
-			ChatID: update.Message.Chat.ID,
-			Text:   NO_AUDIO_ATTACHED,
+			ChatID:          update.Message.Chat.ID,
+			MessageThreadID: threadID(update.Message),
+			Text:            FILE_TOO_LARGE,
 		})
 		if err != nil {
 			bw.log.Error().Err(err).Msg("send start message failed")
@@ -170,8 +324,9 @@ func (bw *BotWrapper) downloadHandler(ctx context.Context, b *bot.Bot, update *m
 	})
 	if err != nil {
 		_, err := b.SendMessage(ctx, &bot.SendMessageParams{
-			ChatID: update.Message.Chat.ID,
-			Text:   FAILED_TO_DOWNLOAD_FILE,
+			ChatID:          update.Message.Chat.ID,
+			MessageThreadID: threadID(update.Message),
+			Text:            FAILED_TO_DOWNLOAD_FILE,
 		})
 		if err != nil {
 			bw.log.Error().Err(err).Msg("send start message failed")
@@ -180,17 +335,18 @@ func (bw *BotWrapper) downloadHandler(ctx context.Context, b *bot.Bot, update *m
 		return
 	}
 
-	err = bw.psql.CreateUser(ctx, update.Message.Chat.ID)
+	err = bw.psql.CreateUser(ctx, senderID(update.Message))
 	if err != nil {
 		bw.log.Error().Err(err).Msg("CreateUser failed")
 		return
 	}
 
-	file, err := downloadFileFromLink(ctx, b.FileDownloadLink(mf), mimeType)
+	file, err := downloadFileFromLink(ctx, b.FileDownloadLink(mf))
 	if err != nil {
 		_, err := b.SendMessage(ctx, &bot.SendMessageParams{
-			ChatID: update.Message.Chat.ID,
-			Text:   FAILED_TO_DOWNLOAD_FILE,
+			ChatID:          update.Message.Chat.ID,
+			MessageThreadID: threadID(update.Message),
+			Text:            FAILED_TO_DOWNLOAD_FILE,
 		})
 		if err != nil {
 			bw.log.Error().Err(err).Msg("send start message failed")
@@ -199,39 +355,91 @@ func (bw *BotWrapper) downloadHandler(ctx context.Context, b *bot.Bot, update *m
 		return
 	}
 
-	m, _ := bw.b.SendMessage(ctx, &bot.SendMessageParams{
-		Text:   fmt.Sprintf(StatusMessageWait, "загружено."),
-		ChatID: update.Message.Chat.ID,
-	})
+	named, format, err := sniffFile(file)
+	if err != nil {
+		bw.log.Warn().Err(err).Str("mime", mimeType).Msg("unsupported file")
+		os.Remove(file)
 
-	trID, err := bw.psql.CreateTranscribition(ctx, postgres.CreateTranscribitionParams{
-		TgUserID: update.Message.Chat.ID,
-		MessageToEdit: pgtype.Int8{
-			Int64: int64(m.ID),
-			Valid: true,
-		},
-	})
+		_, err := b.SendMessage(ctx, &bot.SendMessageParams{
+			ChatID:          update.Message.Chat.ID,
+			MessageThreadID: threadID(update.Message),
+			Text:            NOT_SUPPORTED_TYPE,
+		})
+		if err != nil {
+			bw.log.Error().Err(err).Msg("send start message failed")
+		}
+
+		return
+	}
+	file = named
+	defer os.Remove(file)
+
+	// Whisper gets the audio track in the canonical format, the original recording is kept next to it.
+	original := ""
+	if !format.Ready {
+		original = file
+
+		file, err = normalizeAudio(ctx, original)
+		if err != nil {
+			bw.log.Error().Err(err).Str("mime", format.Mime).Msg("normalize audio failed")
+
+			_, err := b.SendMessage(ctx, &bot.SendMessageParams{
+				ChatID:          update.Message.Chat.ID,
+				MessageThreadID: threadID(update.Message),
+				Text:            FAILED_TO_EXTRACT_AUDIO,
+			})
+			if err != nil {
+				bw.log.Error().Err(err).Msg("send start message failed")
+			}
+
+			return
+		}
+		defer os.Remove(file)
+	}
+
+	duration, err := audioDuration(ctx, file)
 	if err != nil {
-		bw.log.Error().Err(err).Msg("CreateTranscribition failed")
+		bw.log.Warn().Err(err).Msg("probe duration failed")
+	}
+
+	// The parts of a session count together, the merged recording is processed at /end.
+	if !bw.checkUploadQuota(ctx, update.Message, duration+bw.sessionDuration(ctx, update.Message)) {
 		return
 	}
 
-	bw.updateStatus(ctx, StatusUploaded, trID, update.Message.Chat.ID, int64(m.ID))
+	if session, ok := bw.openSession(ctx, update.Message); ok {
+		bw.addSessionPart(ctx, update.Message, recording, session, file, duration)
 
-	if err := bw.psql.UpdateCurrentBotID(ctx, postgres.UpdateCurrentBotIDParams{
-		CurrentBotID: pgtype.Int8{
-			Int64: trID,
-			Valid: true,
-		},
-		TgUserID: update.Message.Chat.ID,
-	}); err != nil {
-		bw.log.Error().Err(err).Msg("UpdateCurrentBotID failed")
 		return
 	}
 
-	fileName, bucket, err := bw.uploadFileToMinio(ctx, file)
+	tr, ok := bw.startTranscribition(ctx, update.Message, bw.stripMention(recording.Caption))
+	if !ok {
+		return
+	}
+
+	if original != "" {
+		originalName, _, err := bw.uploadFileToMinio(ctx, original, bw.min.GetOriginalBucket())
+		if err != nil {
+			bw.failTranscribition(ctx, tr, StatusUploaded, stageError(StatusUploaded, ErrCodeStorage, fmt.Errorf("UploadToMinio failed: %w", err)))
+			return
+		}
+
+		if err := bw.psql.UpdateOriginalName(ctx, postgres.UpdateOriginalNameParams{
+			OriginalNameMinio: pgtype.Text{
+				String: originalName,
+				Valid:  true,
+			},
+			ID: tr.ID,
+		}); err != nil {
+			bw.failTranscribition(ctx, tr, StatusUploaded, stageError(StatusUploaded, ErrCodeStorage, fmt.Errorf("UpdateOriginalName failed: %w", err)))
+			return
+		}
+	}
+
+	fileName, bucket, err := bw.uploadFileToMinio(ctx, file, bw.min.GetAudioBucket())
 	if err != nil {
-		bw.log.Error().Err(err).Msg("UploadToMinio failed")
+		bw.failTranscribition(ctx, tr, StatusUploaded, stageError(StatusUploaded, ErrCodeStorage, fmt.Errorf("UploadToMinio failed: %w", err)))
 		return
 	}
 
@@ -244,17 +452,72 @@ func (bw *BotWrapper) downloadHandler(ctx context.Context, b *bot.Bot, update *m
 			String: bucket,
 			Valid:  true,
 		},
-		ID: trID,
+		AudioSeconds: audioSeconds(duration),
+		ID:           tr.ID,
 	}); err != nil {
-		bw.log.Error().Err(err).Msg("UpdateCurrentBotID failed")
+		bw.failTranscribition(ctx, tr, StatusUploaded, stageError(StatusUploaded, ErrCodeStorage, fmt.Errorf("UpdateMinioLink failed: %w", err)))
 		return
 	}
 
-	bw.updateStatus(ctx, StatusTranscription, trID, update.Message.Chat.ID, int64(m.ID))
-	bw.startTranscription(ctx, trID, update.Message.Chat.ID, file, int64(m.ID))
+	if err := bw.enqueueJob(ctx, tr.ID, StatusTranscription); err != nil {
+		bw.failTranscribition(ctx, tr, StatusUploaded, stageError(StatusUploaded, ErrCodeStorage, err))
+		return
+	}
 }
 
-func (bw *BotWrapper) uploadFileToMinio(ctx context.Context, file string) (fileName, bucket string, err error) {
+// startTranscribition creates the transcribition with its status message and
+// makes it the current one of the user. The meeting belongs to the chat of the
+// message, the sender is kept as the uploader.
+func (bw *BotWrapper) startTranscribition(ctx context.Context, msg *models.Message, caption string) (postgres.Transcribition, bool) {
+	chatID, userID := msg.Chat.ID, senderID(msg)
+	thread := pgtype.Int8{Int64: int64(threadID(msg)), Valid: threadID(msg) != 0}
+
+	m, _ := bw.b.SendMessage(ctx, &bot.SendMessageParams{
+		Text:            fmt.Sprintf(StatusMessageWait, "загружено."),
+		ChatID:          chatID,
+		MessageThreadID: threadID(msg),
+	})
+
+	trID, err := bw.psql.CreateTranscribition(ctx, postgres.CreateTranscribitionParams{
+		TgUserID:        userID,
+		ChatID:          chatID,
+		MessageThreadID: thread,
+		MessageToEdit: pgtype.Int8{
+			Int64: int64(m.ID),
+			Valid: true,
+		},
+	})
+	if err != nil {
+		bw.log.Error().Err(err).Msg("CreateTranscribition failed")
+		return postgres.Transcribition{}, false
+	}
+
+	bw.saveCaptionInfo(ctx, trID, caption)
+	bw.updateStatus(ctx, StatusUploaded, trID, chatID, int64(m.ID))
+
+	tr := postgres.Transcribition{
+		ID:              trID,
+		TgUserID:        userID,
+		ChatID:          chatID,
+		MessageThreadID: thread,
+		MessageToEdit:   pgtype.Int8{Int64: int64(m.ID), Valid: true},
+	}
+
+	if err := bw.psql.UpdateCurrentBotID(ctx, postgres.UpdateCurrentBotIDParams{
+		CurrentBotID: pgtype.Int8{
+			Int64: trID,
+			Valid: true,
+		},
+		TgUserID: userID,
+	}); err != nil {
+		bw.failTranscribition(ctx, tr, StatusUploaded, stageError(StatusUploaded, ErrCodeStorage, fmt.Errorf("UpdateCurrentBotID failed: %w", err)))
+		return postgres.Transcribition{}, false
+	}
+
+	return tr, true
+}
+
+func (bw *BotWrapper) uploadFileToMinio(ctx context.Context, file, bucket string) (fileName, bucketName string, err error) {
 	f, err := os.Open(file)
 	if err != nil {
 		return "", "", fmt.Errorf("failed to open file: %w", err)
@@ -265,12 +528,12 @@ func (bw *BotWrapper) uploadFileToMinio(ctx context.Context, file string) (fileN
 		return "", "", fmt.Errorf("failed to get file stat: %w", err)
 	}
 
-	err = bw.min.UploadFile(ctx, f, fs.Size(), fs.Name(), bw.min.GetAudioBucket())
+	err = bw.min.UploadFile(ctx, f, fs.Size(), fs.Name(), bucket)
 	if err != nil {
 		return "", "", fmt.Errorf("failed to upload file: %w", err)
 	}
 
-	return fs.Name(), bw.min.GetAudioBucket(), nil
+	return fs.Name(), bucket, nil
 }
 
 func (bw *BotWrapper) updateStatus(ctx context.Context, status int, pgID, chatID, messageID int64) {
@@ -288,21 +551,24 @@ func (bw *BotWrapper) updateStatus(ctx context.Context, status int, pgID, chatID
 	switch status {
 	case StatusUploaded:
 		_, err = bw.b.EditMessageText(ctx, &bot.EditMessageTextParams{
-			ChatID:    chatID,
-			MessageID: int(messageID),
-			Text:      fmt.Sprintf(StatusMessageWait, "загружено."),
+			ChatID:      chatID,
+			MessageID:   int(messageID),
+			Text:        fmt.Sprintf(StatusMessageWait, "загружено."),
+			ReplyMarkup: bw.cancelMarkup(pgID),
 		})
 	case StatusTranscription:
 		_, err = bw.b.EditMessageText(ctx, &bot.EditMessageTextParams{
-			ChatID:    chatID,
-			MessageID: int(messageID),
-			Text:      fmt.Sprintf(StatusMessageWait, "транскрибация."),
+			ChatID:      chatID,
+			MessageID:   int(messageID),
+			Text:        fmt.Sprintf(StatusMessageWait, "транскрибация."),
+			ReplyMarkup: bw.cancelMarkup(pgID),
 		})
 	case StatusNers:
 		_, err = bw.b.EditMessageText(ctx, &bot.EditMessageTextParams{
-			ChatID:    chatID,
-			MessageID: int(messageID),
-			Text:      fmt.Sprintf(StatusMessageWait, "выделение информации для отчета."),
+			ChatID:      chatID,
+			MessageID:   int(messageID),
+			Text:        fmt.Sprintf(StatusMessageWait, "выделение информации для отчета."),
+			ReplyMarkup: bw.cancelMarkup(pgID),
 		})
 	case StatusReport:
 		_, err = bw.b.EditMessageText(ctx, &bot.EditMessageTextParams{
@@ -311,21 +577,37 @@ func (bw *BotWrapper) updateStatus(ctx context.Context, status int, pgID, chatID
 			Text:      fmt.Sprintf(StatusMessageWait, "генерация отчета."),
 		})
 	case StatusDone:
+		keyboard := append(bw.reportKeyboard(pgID), bw.transcriptKeyboard(pgID)...)
+		keyboard = append(keyboard, []models.InlineKeyboardButton{
+			{Text: "Проверить протокол", CallbackData: bw.signedData(protocolOpen, pgID)},
+		})
+
+		// Only the staged transcription keeps the alignment to re-run diarization on.
+		if bw.cfg.AsrMode == AsrModeStages {
+			keyboard = append(keyboard, []models.InlineKeyboardButton{
+				{Text: "Перераспределить спикеров", CallbackData: bw.signedData(REDIARIZE, pgID)},
+			})
+		}
+
+		_, err = bw.b.EditMessageText(ctx, &bot.EditMessageTextParams{
+			ChatID:      chatID,
+			MessageID:   int(messageID),
+			Text:        "Задача завершена",
+			ReplyMarkup: &models.InlineKeyboardMarkup{InlineKeyboard: keyboard},
+		})
+	case StatusCancelled:
 		_, err = bw.b.EditMessageText(ctx, &bot.EditMessageTextParams{
 			ChatID:    chatID,
 			MessageID: int(messageID),
-			Text:      "Задача завершена",
-			ReplyMarkup: &models.InlineKeyboardMarkup{
-				InlineKeyboard: [][]models.InlineKeyboardButton{
-					{
-						{Text: "Официальный DOCX", CallbackData: REPORT_DOCX_OFF},
-						{Text: "Официальный PDF", CallbackData: REPORT_PDF_OFF},
-					}, {
-						{Text: "Неофициальный DOCX", CallbackData: REPORT_DOCX_UNOFF},
-						{Text: "Неофициальный PDF", CallbackData: REPORT_PDF_UNOFF},
-					},
-				},
-			},
+			Text:      CANCELLED,
+		})
+	case StatusFailed:
+		text, markup := bw.failedStatusMessage(ctx, pgID)
+		_, err = bw.b.EditMessageText(ctx, &bot.EditMessageTextParams{
+			ChatID:      chatID,
+			MessageID:   int(messageID),
+			Text:        text,
+			ReplyMarkup: markup,
 		})
 	}
 
@@ -334,135 +616,149 @@ func (bw *BotWrapper) updateStatus(ctx context.Context, status int, pgID, chatID
 	}
 }
 
-func (bw *BotWrapper) sendPdfUnofficial(ctx context.Context, chatID int64) {
-	user, err := bw.psql.GetUser(ctx, chatID)
+// sendReport sends the report to the chat the meeting belongs to. The meeting
+// is processed already, so a failed report is only explained to the chat and
+// the status of the meeting stays as it is.
+func (bw *BotWrapper) sendReport(ctx context.Context, pgID int64, official bool, format string) {
+	tr, err := bw.psql.GetTranscribition(ctx, pgID)
 	if err != nil {
-		bw.log.Error().Int64("id", chatID).Err(err).Msg("failed to get user")
+		bw.log.Error().Int64("id", pgID).Err(err).Msg("failed to get transcibition")
 		return
 	}
 
-	tr, err := bw.psql.GetTranscribition(ctx, user.CurrentBotID.Int64)
-	if err != nil {
-		bw.log.Error().Int64("id", chatID).Err(err).Msg("failed to get transcibition")
-		return
+	name := "unofficial"
+	report := bw.unofficialReport
+	if official {
+		name = "official"
+		report = bw.officialReport
 	}
 
-	b, err := bw.unofficialReport(ctx, tr.ID, chatID, "pdf")
+	b, err := report(ctx, tr.ID, tr.ChatID, format)
 	if err != nil {
-		bw.log.Error().Int64("id", chatID).Err(err).Msg("failed to get report")
+		perr := asPipelineError(StatusReport, err)
+		bw.log.Error().Err(perr).Int64("id", tr.ID).Msg("report failed")
+
+		reason, ok := failureReasons[perr.Code]
+		if !ok {
+			reason = failureReasons[ErrCodeInternal]
+		}
+
+		if _, err := bw.b.SendMessage(ctx, &bot.SendMessageParams{
+			ChatID:          tr.ChatID,
+			MessageThreadID: int(tr.MessageThreadID.Int64),
+			Text:            fmt.Sprintf(REPORT_FAILED, reason),
+		}); err != nil {
+			bw.log.Error().Int64("id", tr.ID).Err(err).Msg("send report failed message failed")
+		}
+
 		return
 	}
 
 	if _, err := bw.b.SendDocument(ctx, &bot.SendDocumentParams{
-		ChatID:   chatID,
-		Document: &models.InputFileUpload{Filename: "unofficial.pdf", Data: bytes.NewReader(b)},
-		Caption:  "Document",
+		ChatID:          tr.ChatID,
+		MessageThreadID: int(tr.MessageThreadID.Int64),
+		Document:        &models.InputFileUpload{Filename: name + "." + format, Data: bytes.NewReader(b)},
+		Caption:         "Document",
 	}); err != nil {
-		bw.log.Error().Int64("id", chatID).Err(err).Msg("failed to send message")
+		bw.log.Error().Int64("id", tr.ChatID).Err(err).Msg("failed to send message")
 		return
 	}
 }
 
-func (bw *BotWrapper) sendPdfOfficial(ctx context.Context, chatID int64) {
-	user, err := bw.psql.GetUser(ctx, chatID)
-	if err != nil {
-		bw.log.Error().Int64("id", chatID).Err(err).Msg("failed to get user")
-		return
+// reportKeyboard offers the reports of the meeting.
+func (bw *BotWrapper) reportKeyboard(pgID int64) [][]models.InlineKeyboardButton {
+	return [][]models.InlineKeyboardButton{
+		{
+			{Text: "Официальный DOCX", CallbackData: bw.signedData(REPORT_DOCX_OFF, pgID)},
+			{Text: "Официальный PDF", CallbackData: bw.signedData(REPORT_PDF_OFF, pgID)},
+		}, {
+			{Text: "Неофициальный DOCX", CallbackData: bw.signedData(REPORT_DOCX_UNOFF, pgID)},
+			{Text: "Неофициальный PDF", CallbackData: bw.signedData(REPORT_PDF_UNOFF, pgID)},
+		},
 	}
+}
 
-	tr, err := bw.psql.GetTranscribition(ctx, user.CurrentBotID.Int64)
-	if err != nil {
-		bw.log.Error().Int64("id", chatID).Err(err).Msg("failed to get transcibition")
-		return
+func (bw *BotWrapper) reportCallbackQuery(ctx context.Context, b *bot.Bot, update *models.Update) {
+	chatID := update.CallbackQuery.From.ID
+
+	answer := func(text string) {
+		if _, err := b.AnswerCallbackQuery(ctx, &bot.AnswerCallbackQueryParams{
+			CallbackQueryID: update.CallbackQuery.ID,
+			Text:            text,
+			ShowAlert:       text != "",
+		}); err != nil {
+			bw.log.Error().Err(err).Msg("answer callback query failed")
+		}
 	}
 
-	b, err := bw.officialReport(ctx, tr.ID, chatID, "pdf")
-	if err != nil {
-		bw.log.Error().Int64("id", chatID).Err(err).Msg("failed to get report")
-		return
-	}
+	data, pgID, err := bw.parseSignedData(update.CallbackQuery.Data)
+	switch {
+	case errors.Is(err, errStaleCallback):
+		// Buttons sent before the meeting id was added to them.
+		answer(STALE_BUTTON)
 
-	if _, err := bw.b.SendDocument(ctx, &bot.SendDocumentParams{
-		ChatID:   chatID,
-		Document: &models.InputFileUpload{Filename: "official.pdf", Data: bytes.NewReader(b)},
-		Caption:  "Document",
-	}); err != nil {
-		bw.log.Error().Int64("id", chatID).Err(err).Msg("failed to send message")
 		return
-	}
-}
+	case err != nil:
+		bw.log.Warn().Err(err).Int64("chatID", chatID).Str("data", update.CallbackQuery.Data).Msg("invalid callback data")
+		answer(INVALID_BUTTON)
 
-func (bw *BotWrapper) sendDocxUnofficial(ctx context.Context, chatID int64) {
-	user, err := bw.psql.GetUser(ctx, chatID)
-	if err != nil {
-		bw.log.Error().Int64("id", chatID).Err(err).Msg("failed to get user")
 		return
 	}
 
-	tr, err := bw.psql.GetTranscribition(ctx, user.CurrentBotID.Int64)
-	if err != nil {
-		bw.log.Error().Int64("id", chatID).Err(err).Msg("failed to get transcibition")
+	var official bool
+	var format string
+	switch data {
+	case REPORT_DOCX_OFF:
+		official, format = true, "docx"
+	case REPORT_PDF_OFF:
+		official, format = true, "pdf"
+	case REPORT_DOCX_UNOFF:
+		official, format = false, "docx"
+	case REPORT_PDF_UNOFF:
+		official, format = false, "pdf"
+	default:
+		answer(INVALID_BUTTON)
+
 		return
 	}
 
-	b, err := bw.unofficialReport(ctx, tr.ID, chatID, "docx")
+	tr, err := bw.psql.GetTranscribition(ctx, pgID)
 	if err != nil {
-		bw.log.Error().Int64("id", chatID).Err(err).Msg("failed to get report")
-		return
-	}
+		answer("Встреча не найдена, возможно, она была удалена.")
 
-	if _, err := bw.b.SendDocument(ctx, &bot.SendDocumentParams{
-		ChatID:   chatID,
-		Document: &models.InputFileUpload{Filename: "unofficial.docx", Data: bytes.NewReader(b)},
-		Caption:  "Document",
-	}); err != nil {
-		bw.log.Error().Int64("id", chatID).Err(err).Msg("failed to send message")
 		return
 	}
-}
 
-func (bw *BotWrapper) sendDocxOfficial(ctx context.Context, chatID int64) {
-	user, err := bw.psql.GetUser(ctx, chatID)
-	if err != nil {
-		bw.log.Error().Int64("id", chatID).Err(err).Msg("failed to get user")
+	if !canAccess(tr, update.CallbackQuery) {
+		answer("Эта встреча принадлежит другому чату.")
+
 		return
 	}
 
-	tr, err := bw.psql.GetTranscribition(ctx, user.CurrentBotID.Int64)
-	if err != nil {
-		bw.log.Error().Int64("id", chatID).Err(err).Msg("failed to get transcibition")
+	if !tr.LlamaOutput.Valid {
+		answer("Встреча еще обрабатывается.")
+
 		return
 	}
 
-	b, err := bw.officialReport(ctx, tr.ID, chatID, "docx")
-	if err != nil {
-		bw.log.Error().Int64("id", chatID).Err(err).Msg("failed to get report")
+	if !bw.takeReport(ctx, chatID, tr.ID) {
+		answer(fmt.Sprintf(QUOTA_REPORTS, bw.cfg.QuotaReportsPerMinute))
+
 		return
 	}
 
-	if _, err := bw.b.SendDocument(ctx, &bot.SendDocumentParams{
-		ChatID:   chatID,
-		Document: &models.InputFileUpload{Filename: "official.docx", Data: bytes.NewReader(b)},
-		Caption:  "Document",
-	}); err != nil {
-		bw.log.Error().Int64("id", chatID).Err(err).Msg("failed to send message")
-		return
+	text := ""
+	if position := bw.submitReport(chatID, tr.ID, official, format); position > 0 {
+		text = fmt.Sprintf("Отчет в очереди, вы %d-й.", position)
 	}
+
+	answer(text)
 }
 
-func (bw *BotWrapper) reportCallbackQuery(ctx context.Context, b *bot.Bot, update *models.Update) {
-	b.AnswerCallbackQuery(ctx, &bot.AnswerCallbackQueryParams{
-		CallbackQueryID: update.CallbackQuery.ID,
-		ShowAlert:       false,
+// submitReport queues the report generation into the reporter pool, the pool
+// is shared fairly between the users requesting reports.
+func (bw *BotWrapper) submitReport(userID, pgID int64, official bool, format string) int {
+	return bw.reports.Submit(userID, func(ctx context.Context) {
+		bw.sendReport(ctx, pgID, official, format)
 	})
-	switch update.CallbackQuery.Data {
-	case REPORT_DOCX_OFF:
-		bw.sendDocxOfficial(ctx, update.CallbackQuery.From.ID)
-	case REPORT_PDF_OFF:
-		bw.sendPdfOfficial(ctx, update.CallbackQuery.From.ID)
-	case REPORT_DOCX_UNOFF:
-		bw.sendDocxUnofficial(ctx, update.CallbackQuery.From.ID)
-	case REPORT_PDF_UNOFF:
-		bw.sendPdfUnofficial(ctx, update.CallbackQuery.From.ID)
-	}
 }
@@ -0,0 +1,65 @@
+package bot
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+const (
+	STALE_BUTTON   = "Кнопка устарела. Откройте встречу через /history."
+	INVALID_BUTTON = "Кнопка недействительна."
+)
+
+var (
+	errStaleCallback   = errors.New("callback data has no meeting id")
+	errInvalidCallback = errors.New("callback data signature mismatch")
+)
+
+// signedData binds the button action to the meeting: <action>:<id>:<signature>.
+// The signature keeps a forged id out of the handlers, the ownership is still
+// checked since a signed button can be forwarded.
+func (bw *BotWrapper) signedData(action string, pgID int64) string {
+	data := action + ":" + strconv.FormatInt(pgID, 10)
+
+	return data + ":" + bw.sign(data)
+}
+
+// parseSignedData returns the action and the meeting id of signed callback data.
+func (bw *BotWrapper) parseSignedData(data string) (string, int64, error) {
+	parts := strings.Split(data, ":")
+	if len(parts) != 3 {
+		return parts[0], 0, errStaleCallback
+	}
+
+	if !hmac.Equal([]byte(bw.sign(parts[0]+":"+parts[1])), []byte(parts[2])) {
+		return parts[0], 0, errInvalidCallback
+	}
+
+	pgID, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return parts[0], 0, errInvalidCallback
+	}
+
+	return parts[0], pgID, nil
+}
+
+// callbackError is the answer to a button parseSignedData refused.
+func callbackError(err error) string {
+	if errors.Is(err, errStaleCallback) {
+		return STALE_BUTTON
+	}
+
+	return INVALID_BUTTON
+}
+
+// sign returns a truncated HMAC, callback data is limited to 64 bytes.
+func (bw *BotWrapper) sign(data string) string {
+	mac := hmac.New(sha256.New, bw.callbackKey)
+	mac.Write([]byte(data))
+
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:9])
+}
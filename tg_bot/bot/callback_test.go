@@ -0,0 +1,91 @@
+package bot
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestSignedData(t *testing.T) {
+	bw := &BotWrapper{callbackKey: []byte("secret")}
+	other := &BotWrapper{callbackKey: []byte("other")}
+
+	tests := []struct {
+		name       string
+		data       string
+		wantAction string
+		wantID     int64
+		wantErr    error
+	}{
+		{
+			name:       "signed",
+			data:       bw.signedData(meetingAudio, 42),
+			wantAction: meetingAudio,
+			wantID:     42,
+		},
+		{
+			name:       "action with payload",
+			data:       bw.signedData(MEETING_CALLBACK+"3_"+meetingDelete, 7),
+			wantAction: MEETING_CALLBACK + "3_" + meetingDelete,
+			wantID:     7,
+		},
+		{
+			name:       "unsigned button of an old message",
+			data:       RETRY + "42",
+			wantAction: RETRY + "42",
+			wantErr:    errStaleCallback,
+		},
+		{
+			name:       "signed with another key",
+			data:       other.signedData(meetingAudio, 42),
+			wantAction: meetingAudio,
+			wantErr:    errInvalidCallback,
+		},
+		{
+			name:       "forged id",
+			data:       meetingAudio + ":43:" + bw.sign(meetingAudio+":42"),
+			wantAction: meetingAudio,
+			wantErr:    errInvalidCallback,
+		},
+		{
+			name:       "id is not a number",
+			data:       meetingAudio + ":x:" + bw.sign(meetingAudio+":x"),
+			wantAction: meetingAudio,
+			wantErr:    errInvalidCallback,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if len(tt.data) > 64 {
+				t.Errorf("callback data %q is longer than 64 bytes", tt.data)
+			}
+
+			action, id, err := bw.parseSignedData(tt.data)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("parseSignedData() error = %v, want %v", err, tt.wantErr)
+			}
+
+			if action != tt.wantAction || id != tt.wantID {
+				t.Errorf("parseSignedData() = %q, %d, want %q, %d", action, id, tt.wantAction, tt.wantID)
+			}
+		})
+	}
+}
+
+func TestCallbackError(t *testing.T) {
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{err: errStaleCallback, want: STALE_BUTTON},
+		{err: errInvalidCallback, want: INVALID_BUTTON},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.err.Error(), func(t *testing.T) {
+			if got := callbackError(tt.err); got != tt.want {
+				t.Errorf("callbackError() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
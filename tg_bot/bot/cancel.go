@@ -0,0 +1,160 @@
+package bot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+	"github.com/gulldan/cp2024omsk-pmsk/bot/clients/whisper"
+
+	postgres "github.com/gulldan/cp2024omsk-pmsk/bot/postgres/generated"
+)
+
+const CANCEL_CALLBACK = "cancel_"
+
+// trackJob remembers how to abort the stage currently running for the transcribition.
+func (bw *BotWrapper) trackJob(pgID int64, cancel context.CancelFunc) {
+	bw.runningMu.Lock()
+	defer bw.runningMu.Unlock()
+
+	bw.running[pgID] = cancel
+}
+
+func (bw *BotWrapper) untrackJob(pgID int64) {
+	bw.runningMu.Lock()
+	defer bw.runningMu.Unlock()
+
+	delete(bw.running, pgID)
+}
+
+func (bw *BotWrapper) abortJob(pgID int64) {
+	bw.runningMu.Lock()
+	defer bw.runningMu.Unlock()
+
+	if cancel, ok := bw.running[pgID]; ok {
+		cancel()
+	}
+}
+
+func isFinished(status int32) bool {
+	return status == StatusDone || status == StatusFailed || status == StatusCancelled
+}
+
+func (bw *BotWrapper) cancelButton(pgID int64) models.InlineKeyboardButton {
+	return models.InlineKeyboardButton{Text: "Отменить", CallbackData: bw.signedData(CANCEL_CALLBACK, pgID)}
+}
+
+func (bw *BotWrapper) cancelMarkup(pgID int64) models.ReplyMarkup {
+	return &models.InlineKeyboardMarkup{
+		InlineKeyboard: [][]models.InlineKeyboardButton{
+			{bw.cancelButton(pgID)},
+		},
+	}
+}
+
+// cancelTranscribition stops all further processing of the transcribition.
+// Queued jobs are dropped, the running stage is aborted and the whisper task is
+// deleted, so neither the GPU nor the LLM spends time on it.
+func (bw *BotWrapper) cancelTranscribition(ctx context.Context, tr postgres.Transcribition) error {
+	if err := bw.psql.CancelJobs(ctx, tr.ID); err != nil {
+		return fmt.Errorf("failed to cancel jobs: %w", err)
+	}
+
+	bw.abortJob(tr.ID)
+	bw.clearQueuePosition(tr.ID)
+
+	if tr.WhisperTaskID.Valid && !tr.Transcription.Valid {
+		// The task may be already gone, there is nothing left to delete then.
+		if err := bw.whisper.DeleteTask(ctx, tr.WhisperTaskID.String); err != nil && !errors.Is(err, whisper.ErrTaskNotFound) {
+			bw.log.Error().Err(err).Int64("id", tr.ID).Str("task", tr.WhisperTaskID.String).Msg("delete whisper task failed")
+		}
+	}
+
+	bw.deleteAsrTasks(ctx, tr.ID)
+
+	bw.updateStatus(ctx, StatusCancelled, tr.ID, tr.ChatID, tr.MessageToEdit.Int64)
+
+	for stage := range bw.jobsNotify {
+		bw.refreshQueue(ctx, stage)
+	}
+
+	return nil
+}
+
+func (bw *BotWrapper) cancelHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
+	reply := func(text string) {
+		if _, err := b.SendMessage(ctx, &bot.SendMessageParams{
+			ChatID:          update.Message.Chat.ID,
+			MessageThreadID: threadID(update.Message),
+			Text:            text,
+		}); err != nil {
+			bw.log.Error().Err(err).Msg("send cancel message failed")
+		}
+	}
+
+	// The current meeting is the last one the sender uploaded, in any chat.
+	user, err := bw.psql.GetUser(ctx, senderID(update.Message))
+	if err != nil {
+		reply(NOTHING_TO_CANCEL)
+
+		return
+	}
+
+	tr, err := bw.psql.GetTranscribition(ctx, user.CurrentBotID.Int64)
+	if err != nil || isFinished(tr.Status.Int32) {
+		reply(NOTHING_TO_CANCEL)
+
+		return
+	}
+
+	if err := bw.cancelTranscribition(ctx, tr); err != nil {
+		bw.log.Error().Err(err).Int64("id", tr.ID).Msg("cancel failed")
+		reply("Не удалось отменить обработку. Повторите попытку.")
+
+		return
+	}
+
+	reply(CANCELLED)
+}
+
+func (bw *BotWrapper) cancelCallbackQuery(ctx context.Context, b *bot.Bot, update *models.Update) {
+	answer := func(text string) {
+		if _, err := b.AnswerCallbackQuery(ctx, &bot.AnswerCallbackQueryParams{
+			CallbackQueryID: update.CallbackQuery.ID,
+			Text:            text,
+		}); err != nil {
+			bw.log.Error().Err(err).Msg("answer callback query failed")
+		}
+	}
+
+	_, pgID, err := bw.parseSignedData(update.CallbackQuery.Data)
+	if err != nil {
+		answer(callbackError(err))
+
+		return
+	}
+
+	tr, err := bw.psql.GetTranscribition(ctx, pgID)
+	if err != nil || !canAccess(tr, update.CallbackQuery) {
+		answer("Встреча не найдена.")
+
+		return
+	}
+
+	if isFinished(tr.Status.Int32) {
+		answer(NOTHING_TO_CANCEL)
+
+		return
+	}
+
+	if err := bw.cancelTranscribition(ctx, tr); err != nil {
+		bw.log.Error().Err(err).Int64("id", tr.ID).Msg("cancel failed")
+		answer("Не удалось отменить обработку.")
+
+		return
+	}
+
+	answer(CANCELLED)
+}
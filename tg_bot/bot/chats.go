@@ -0,0 +1,218 @@
+package bot
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+	"github.com/jackc/pgx/v5"
+
+	postgres "github.com/gulldan/cp2024omsk-pmsk/bot/postgres/generated"
+)
+
+const (
+	AUTOPROCESS           = "/autoprocess"
+	AUTOPROCESS_ON        = "Теперь я обрабатываю все записи, отправленные в этот чат."
+	AUTOPROCESS_OFF       = "Теперь я обрабатываю только записи, в которых меня упомянули, или ответы на запись с упоминанием."
+	AUTOPROCESS_PRIVATE   = "Команда работает только в группах."
+	AUTOPROCESS_NOT_ADMIN = "Переключить режим могут только администраторы чата."
+)
+
+func isGroup(chat models.Chat) bool {
+	return chat.Type == "group" || chat.Type == "supergroup"
+}
+
+// threadID is the forum topic of the message, replies outside of topics go to the chat itself.
+func threadID(msg *models.Message) int {
+	if !msg.IsTopicMessage {
+		return 0
+	}
+
+	return msg.MessageThreadID
+}
+
+// senderID is the user who sent the message, messages sent on behalf of a
+// chat are attributed to the chat.
+func senderID(msg *models.Message) int64 {
+	if msg.SenderChat != nil {
+		return msg.SenderChat.ID
+	}
+
+	if msg.From == nil {
+		return msg.Chat.ID
+	}
+
+	return msg.From.ID
+}
+
+// callbackChatID is the chat the pressed button was shown in.
+func callbackChatID(q *models.CallbackQuery) int64 {
+	switch {
+	case q.Message.Message != nil:
+		return q.Message.Message.Chat.ID
+	case q.Message.InaccessibleMessage != nil:
+		return q.Message.InaccessibleMessage.Chat.ID
+	default:
+		return q.From.ID
+	}
+}
+
+// canAccess lets the uploader and, for a meeting of a group, every member of
+// the group use the buttons of the meeting.
+func canAccess(tr postgres.Transcribition, q *models.CallbackQuery) bool {
+	return tr.TgUserID == q.From.ID || callbackChatID(q) == tr.ChatID
+}
+
+// trackMembers remembers who writes or presses buttons in the groups and who
+// joins or leaves them, the API shows the members the meetings of their groups.
+func (bw *BotWrapper) trackMembers(next bot.HandlerFunc) bot.HandlerFunc {
+	return func(ctx context.Context, b *bot.Bot, update *models.Update) {
+		switch {
+		case update.Message != nil && isGroup(update.Message.Chat):
+			msg := update.Message
+			if msg.From != nil && msg.SenderChat == nil {
+				bw.addMember(ctx, msg.Chat.ID, *msg.From)
+			}
+			for _, user := range msg.NewChatMembers {
+				bw.addMember(ctx, msg.Chat.ID, user)
+			}
+			if user := msg.LeftChatMember; user != nil {
+				if err := bw.psql.DeleteChatMember(ctx, postgres.DeleteChatMemberParams{
+					ChatID:   msg.Chat.ID,
+					TgUserID: user.ID,
+				}); err != nil {
+					bw.log.Error().Err(err).Int64("chatID", msg.Chat.ID).Msg("delete chat member failed")
+				}
+			}
+		case update.CallbackQuery != nil && update.CallbackQuery.Message.Message != nil:
+			q := update.CallbackQuery
+			if isGroup(q.Message.Message.Chat) {
+				bw.addMember(ctx, q.Message.Message.Chat.ID, q.From)
+			}
+		}
+
+		next(ctx, b, update)
+	}
+}
+
+func (bw *BotWrapper) addMember(ctx context.Context, chatID int64, user models.User) {
+	if user.IsBot {
+		return
+	}
+
+	if err := bw.psql.CreateChatMember(ctx, postgres.CreateChatMemberParams{
+		ChatID:   chatID,
+		TgUserID: user.ID,
+	}); err != nil {
+		bw.log.Error().Err(err).Int64("chatID", chatID).Msg("create chat member failed")
+	}
+}
+
+func (bw *BotWrapper) mentioned(msg *models.Message) bool {
+	mention := "@" + strings.ToLower(bw.username)
+
+	return strings.Contains(strings.ToLower(msg.Text), mention) || strings.Contains(strings.ToLower(msg.Caption), mention)
+}
+
+// stripMention removes the mention of the bot, commands in groups come as /command@bot.
+func (bw *BotWrapper) stripMention(text string) string {
+	return strings.TrimSpace(strings.ReplaceAll(text, "@"+bw.username, ""))
+}
+
+func (bw *BotWrapper) autoProcess(ctx context.Context, chatID int64) bool {
+	chat, err := bw.psql.GetChat(ctx, chatID)
+	if err != nil {
+		if !errors.Is(err, pgx.ErrNoRows) {
+			bw.log.Error().Err(err).Int64("chatID", chatID).Msg("get chat failed")
+		}
+
+		return bw.cfg.GroupAutoProcess
+	}
+
+	return chat.AutoProcess
+}
+
+// groupRecording picks the message with the recording the bot is asked to
+// process in a group: a recording mentioning the bot, any recording when the
+// chat auto-processes them, or the recording a mention replies to.
+func (bw *BotWrapper) groupRecording(ctx context.Context, msg *models.Message) (*models.Message, bool) {
+	mentioned := bw.mentioned(msg)
+
+	if fileID, _, _ := attachment(msg); fileID != "" {
+		return msg, mentioned || bw.autoProcess(ctx, msg.Chat.ID)
+	}
+
+	if !mentioned {
+		return nil, false
+	}
+
+	if r := msg.ReplyToMessage; r != nil {
+		if fileID, _, _ := attachment(r); fileID != "" {
+			return r, true
+		}
+	}
+
+	return msg, true
+}
+
+// autoprocessHandler switches the group between processing every recording
+// and only the ones the bot is mentioned with.
+func (bw *BotWrapper) autoprocessHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
+	reply := func(text string) {
+		if _, err := b.SendMessage(ctx, &bot.SendMessageParams{
+			ChatID:          update.Message.Chat.ID,
+			MessageThreadID: threadID(update.Message),
+			Text:            text,
+		}); err != nil {
+			bw.log.Error().Err(err).Msg("send autoprocess message failed")
+		}
+	}
+
+	chatID := update.Message.Chat.ID
+
+	if !isGroup(update.Message.Chat) {
+		reply(AUTOPROCESS_PRIVATE)
+
+		return
+	}
+
+	// Anonymous admins write on behalf of the chat.
+	admin := update.Message.SenderChat != nil && update.Message.SenderChat.ID == chatID
+	if !admin {
+		member, err := b.GetChatMember(ctx, &bot.GetChatMemberParams{
+			ChatID: chatID,
+			UserID: senderID(update.Message),
+		})
+		if err != nil {
+			bw.log.Error().Err(err).Int64("chatID", chatID).Msg("get chat member failed")
+		}
+
+		admin = member != nil && (member.Type == models.ChatMemberTypeOwner || member.Type == models.ChatMemberTypeAdministrator)
+	}
+
+	if !admin {
+		reply(AUTOPROCESS_NOT_ADMIN)
+
+		return
+	}
+
+	enabled := !bw.autoProcess(ctx, chatID)
+
+	if err := bw.psql.SetChatAutoProcess(ctx, postgres.SetChatAutoProcessParams{
+		ChatID:      chatID,
+		AutoProcess: enabled,
+	}); err != nil {
+		bw.log.Error().Err(err).Int64("chatID", chatID).Msg("set chat auto process failed")
+		reply("Не удалось сохранить настройку.")
+
+		return
+	}
+
+	if enabled {
+		reply(AUTOPROCESS_ON)
+	} else {
+		reply(AUTOPROCESS_OFF)
+	}
+}
@@ -0,0 +1,36 @@
+package bot
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+
+	"github.com/gulldan/cp2024omsk-pmsk/bot/clients/llama"
+	"github.com/gulldan/cp2024omsk-pmsk/bot/clients/reporter"
+	"github.com/gulldan/cp2024omsk-pmsk/bot/clients/whisper"
+)
+
+// WhisperClient is the speech recognition backend.
+type WhisperClient interface {
+	Available() bool
+	SpeechToText(ctx context.Context, name string, audio io.Reader, params whisper.Params) (whisper.TaskCreated, error)
+	Transcribe(ctx context.Context, name string, audio io.Reader, params whisper.Params) (whisper.TaskCreated, error)
+	Align(ctx context.Context, transcript json.RawMessage, name string, audio io.Reader) (whisper.TaskCreated, error)
+	Diarize(ctx context.Context, name string, audio io.Reader, params whisper.Params) (whisper.TaskCreated, error)
+	Combine(ctx context.Context, aligned, diarization json.RawMessage) (whisper.TaskCreated, error)
+	Task(ctx context.Context, id string) (whisper.Task, error)
+	DeleteTask(ctx context.Context, id string) error
+}
+
+// LlamaClient is the LLM backend which extracts the protocol from the transcript.
+type LlamaClient interface {
+	Available() bool
+	Completion(ctx context.Context, req llama.CompletionRequest) (llama.CompletionResponse, error)
+}
+
+// ReporterClient renders protocols into documents.
+type ReporterClient interface {
+	Available() bool
+	Official(ctx context.Context, req reporter.OfficialRequest) ([]byte, error)
+	Unofficial(ctx context.Context, req reporter.UnofficialRequest) ([]byte, error)
+}
@@ -0,0 +1,54 @@
+package llama
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/gulldan/cp2024omsk-pmsk/bot/resilient"
+)
+
+// Client talks to the llama.cpp server.
+type Client struct {
+	addr string
+	http *resilient.Client
+}
+
+func New(addr string, http *resilient.Client) *Client {
+	return &Client{
+		addr: addr,
+		http: http,
+	}
+}
+
+func (c *Client) Available() bool {
+	return c.http.Available()
+}
+
+func (c *Client) Completion(ctx context.Context, req CompletionRequest) (CompletionResponse, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return CompletionResponse{}, fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, c.addr+"/completion", bytes.NewReader(body))
+	if err != nil {
+		return CompletionResponse{}, fmt.Errorf("failed to create request: %w", err)
+	}
+	r.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.http.Do(r)
+	if err != nil {
+		return CompletionResponse{}, err
+	}
+	defer resp.Body.Close()
+
+	var out CompletionResponse
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return CompletionResponse{}, fmt.Errorf("failed to decode response: %w", err)
+	}
+
+	return out, nil
+}
@@ -0,0 +1,73 @@
+package llama
+
+type CompletionResponse struct {
+	Content            string `json:"content"`
+	GenerationSettings struct {
+		FrequencyPenalty float64       `json:"frequency_penalty"`
+		IgnoreEos        bool          `json:"ignore_eos"`
+		LogitBias        []interface{} `json:"logit_bias"`
+		Mirostat         int           `json:"mirostat"`
+		MirostatEta      float64       `json:"mirostat_eta"`
+		MirostatTau      float64       `json:"mirostat_tau"`
+		Model            string        `json:"model"`
+		NCtx             int           `json:"n_ctx"`
+		NKeep            int           `json:"n_keep"`
+		NPredict         int           `json:"n_predict"`
+		NProbs           int           `json:"n_probs"`
+		PenalizeNl       bool          `json:"penalize_nl"`
+		PresencePenalty  float64       `json:"presence_penalty"`
+		RepeatLastN      int           `json:"repeat_last_n"`
+		RepeatPenalty    float64       `json:"repeat_penalty"`
+		Seed             int64         `json:"seed"`
+		Stop             []interface{} `json:"stop"`
+		Stream           bool          `json:"stream"`
+		Temp             float64       `json:"temp"`
+		TfsZ             float64       `json:"tfs_z"`
+		TopK             int           `json:"top_k"`
+		TopP             float64       `json:"top_p"`
+		TypicalP         float64       `json:"typical_p"`
+	} `json:"generation_settings"`
+	Model        string `json:"model"`
+	Prompt       string `json:"prompt"`
+	Stop         bool   `json:"stop"`
+	StoppedEos   bool   `json:"stopped_eos"`
+	StoppedLimit bool   `json:"stopped_limit"`
+	StoppedWord  bool   `json:"stopped_word"`
+	StoppingWord string `json:"stopping_word"`
+	Timings      struct {
+		PredictedMs         float64     `json:"predicted_ms"`
+		PredictedN          int         `json:"predicted_n"`
+		PredictedPerSecond  float64     `json:"predicted_per_second"`
+		PredictedPerTokenMs float64     `json:"predicted_per_token_ms"`
+		PromptMs            float64     `json:"prompt_ms"`
+		PromptN             int         `json:"prompt_n"`
+		PromptPerSecond     interface{} `json:"prompt_per_second"`
+		PromptPerTokenMs    float64     `json:"prompt_per_token_ms"`
+	} `json:"timings"`
+	TokensCached    int  `json:"tokens_cached"`
+	TokensEvaluated int  `json:"tokens_evaluated"`
+	TokensPredicted int  `json:"tokens_predicted"`
+	Truncated       bool `json:"truncated"`
+}
+type CompletionRequest struct {
+	Temperature      float64  `json:"temperature,omitempty"`
+	TopK             int      `json:"top_k,omitempty"`
+	TopP             float64  `json:"top_p,omitempty"`
+	NPredict         int      `json:"n_predict,omitempty"`
+	NKeep            int      `json:"n_keep,omitempty"`
+	Stream           bool     `json:"stream,omitempty"`
+	Prompt           string   `json:"prompt,omitempty"`
+	Stop             []string `json:"stop,omitempty"`
+	TfsZ             float64  `json:"tfs_z,omitempty"`
+	TypicalP         float64  `json:"typical_p,omitempty"`
+	RepeatPenalty    float64  `json:"repeat_penalty,omitempty"`
+	RepeatLastN      int      `json:"repeat_last_n,omitempty"`
+	PenalizeNl       bool     `json:"penalize_nl,omitempty"`
+	PrecensePenalty  float64  `json:"precence_penalty,omitempty"`
+	FrequencyPenalty float64  `json:"frequency_penalty,omitempty"`
+	Mirostat         int      `json:"mirostat,omitempty"`
+	MirostatTAU      float64  `json:"mirostat_tau,omitempty"`
+	MirostatETA      float64  `json:"mirostat_eta,omitempty"`
+	Seed             int      `json:"seed,omitempty"`
+	IgnoreEOS        bool     `json:"ignore_eos,omitempty"`
+}
@@ -0,0 +1,65 @@
+package reporter
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/gulldan/cp2024omsk-pmsk/bot/resilient"
+)
+
+// Client talks to the report rendering service.
+type Client struct {
+	addr string
+	http *resilient.Client
+}
+
+func New(addr string, http *resilient.Client) *Client {
+	return &Client{
+		addr: addr,
+		http: http,
+	}
+}
+
+func (c *Client) Available() bool {
+	return c.http.Available()
+}
+
+// Official renders the official protocol and returns the document.
+func (c *Client) Official(ctx context.Context, req OfficialRequest) ([]byte, error) {
+	return c.render(ctx, "/reports/official", req)
+}
+
+// Unofficial renders the unofficial protocol and returns the document.
+func (c *Client) Unofficial(ctx context.Context, req UnofficialRequest) ([]byte, error) {
+	return c.render(ctx, "/reports/unofficial", req)
+}
+
+func (c *Client) render(ctx context.Context, path string, req any) ([]byte, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, c.addr+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	r.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.http.Do(r)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read body: %w", err)
+	}
+
+	return b, nil
+}
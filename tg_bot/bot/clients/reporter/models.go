@@ -0,0 +1,68 @@
+package reporter
+
+import "time"
+
+type DocumentType string
+
+const (
+	DocumentDocx DocumentType = "docx"
+	DocumentPdf  DocumentType = "pdf"
+)
+
+type TimeInAudio struct {
+	Start string `json:"start"`
+	End   string `json:"end"`
+}
+
+type Proposal struct {
+	Text      string      `json:"text"`
+	Context   string      `json:"context"`
+	AudioTime TimeInAudio `json:"audio_time"`
+}
+
+type Block struct {
+	NameBlock string     `json:"name_block"`
+	Proposals []Proposal `json:"proposals"`
+}
+
+type Errand struct {
+	Assignee *string    `json:"assignee"`
+	Context  *string    `json:"context"`
+	Deadline *time.Time `json:"deadline"`
+}
+
+type ErrandProtocol struct {
+	ListErrands []Errand `json:"list_errands"`
+}
+
+type OfficialProtocol struct {
+	Date           *time.Time      `json:"date"`
+	Time           *string         `json:"time"`
+	Attendees      []string        `json:"attendees"`
+	Blocks         []Block         `json:"blocks"`
+	ErrandProtocol *ErrandProtocol `json:"errand_protocol"`
+}
+
+type UnofficialProtocol struct {
+	Date         *time.Time    `json:"date"`
+	Time         *string       `json:"time"`
+	Duration     *string       `json:"duration"`
+	Participants []string      `json:"participants"`
+	Agenda       []string      `json:"agenda"`
+	Blocks       []Block       `json:"blocks"`
+	AudioTimes   []TimeInAudio `json:"audio_times"`
+}
+
+type OfficialRequest struct {
+	NameReport   string           `json:"name_report"`
+	DocumentType DocumentType     `json:"document_type"`
+	Password     *string          `json:"password"`
+	Data         OfficialProtocol `json:"data"`
+}
+
+type UnofficialRequest struct {
+	NameReport   string             `json:"name_report"`
+	DocumentType DocumentType       `json:"document_type"`
+	Password     *string            `json:"password"`
+	Data         UnofficialProtocol `json:"data"`
+}
@@ -0,0 +1,202 @@
+package whisper
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/gulldan/cp2024omsk-pmsk/bot/resilient"
+)
+
+var ErrTaskNotFound = errors.New("whisper task not found")
+
+// Client talks to the whisperx service.
+type Client struct {
+	addr string
+	http *resilient.Client
+}
+
+func New(addr string, http *resilient.Client) *Client {
+	return &Client{
+		addr: addr,
+		http: http,
+	}
+}
+
+func (c *Client) Available() bool {
+	return c.http.Available()
+}
+
+// SpeechToText queues the full transcription, alignment and diarization of the audio.
+func (c *Client) SpeechToText(ctx context.Context, name string, audio io.Reader, params Params) (TaskCreated, error) {
+	return c.queueFiles(ctx, "/speech-to-text", params.values(), formFile{"file", name, audio})
+}
+
+// Transcribe queues only the transcription of the audio, the result has no
+// word timings and speakers.
+func (c *Client) Transcribe(ctx context.Context, name string, audio io.Reader, params Params) (TaskCreated, error) {
+	return c.queueFiles(ctx, "/service/transcribe", params.values(), formFile{"file", name, audio})
+}
+
+// Align queues the alignment of the transcript produced by Transcribe.
+func (c *Client) Align(ctx context.Context, transcript json.RawMessage, name string, audio io.Reader) (TaskCreated, error) {
+	return c.queueFiles(ctx, "/service/align", nil,
+		formFile{"transcript", "transcript.json", bytes.NewReader(transcript)},
+		formFile{"file", name, audio},
+	)
+}
+
+// Diarize queues the split of the audio into speaker turns.
+func (c *Client) Diarize(ctx context.Context, name string, audio io.Reader, params Params) (TaskCreated, error) {
+	return c.queueFiles(ctx, "/service/diarize", params.values(), formFile{"file", name, audio})
+}
+
+// Combine queues the assignment of speakers from the diarization to the aligned transcript.
+func (c *Client) Combine(ctx context.Context, aligned, diarization json.RawMessage) (TaskCreated, error) {
+	return c.queueFiles(ctx, "/service/combine", nil,
+		formFile{"aligned_transcript", "aligned_transcript.json", bytes.NewReader(aligned)},
+		formFile{"diarization_result", "diarization_result.json", bytes.NewReader(diarization)},
+	)
+}
+
+type formFile struct {
+	field string
+	name  string
+	data  io.Reader
+}
+
+// queueFiles streams the multipart body to whisper while it is written, an hour
+// long recording is never held in memory.
+func (c *Client) queueFiles(ctx context.Context, path string, query url.Values, files ...formFile) (TaskCreated, error) {
+	pr, pw := io.Pipe()
+	defer pr.Close()
+
+	w := multipart.NewWriter(pw)
+
+	go func() {
+		pw.CloseWithError(writeFiles(w, files))
+	}()
+
+	return c.queue(ctx, path, query, pr, w.FormDataContentType())
+}
+
+func writeFiles(w *multipart.Writer, files []formFile) error {
+	for _, f := range files {
+		fw, err := w.CreateFormFile(f.field, f.name)
+		if err != nil {
+			return fmt.Errorf("failed to create form file: %w", err)
+		}
+
+		if _, err := io.Copy(fw, f.data); err != nil {
+			return fmt.Errorf("failed to copy %s: %w", f.field, err)
+		}
+	}
+
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("failed to close multipart writer: %w", err)
+	}
+
+	return nil
+}
+
+func (c *Client) queue(ctx context.Context, path string, query url.Values, body io.Reader, contentType string) (TaskCreated, error) {
+	var created TaskCreated
+	if err := c.do(ctx, http.MethodPost, path, query, body, contentType, &created); err != nil {
+		return TaskCreated{}, err
+	}
+
+	if created.ID == "" {
+		return TaskCreated{}, fmt.Errorf("whisper returned no task identifier: %s", created.Message)
+	}
+
+	return created, nil
+}
+
+// Task returns the status and, once completed, the result of the task.
+func (c *Client) Task(ctx context.Context, id string) (Task, error) {
+	var task Task
+	if err := c.do(ctx, http.MethodGet, "/task/"+url.PathEscape(id), nil, nil, "", &task); err != nil {
+		if resilient.IsStatus(err, http.StatusNotFound) {
+			return Task{}, ErrTaskNotFound
+		}
+
+		return Task{}, err
+	}
+
+	return task, nil
+}
+
+func (c *Client) DeleteTask(ctx context.Context, id string) error {
+	err := c.do(ctx, http.MethodDelete, "/task/"+url.PathEscape(id)+"/delete", nil, nil, "", nil)
+	if resilient.IsStatus(err, http.StatusNotFound) {
+		return ErrTaskNotFound
+	}
+
+	return err
+}
+
+func (c *Client) do(ctx context.Context, method, path string, query url.Values, body io.Reader, contentType string, out any) error {
+	u, err := url.Parse(c.addr + path)
+	if err != nil {
+		return fmt.Errorf("url parser failed: %w", err)
+	}
+	u.RawQuery = query.Encode()
+
+	if body == nil {
+		body = http.NoBody
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if out == nil {
+		return nil
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("failed to decode response: %w", err)
+	}
+
+	return nil
+}
+
+func (p Params) values() url.Values {
+	values := url.Values{}
+
+	if p.Model != "" {
+		values.Set("model", p.Model)
+	}
+
+	if p.Language != "" {
+		values.Set("language", p.Language)
+	}
+
+	if p.MinSpeakers > 0 {
+		values.Set("min_speakers", strconv.Itoa(p.MinSpeakers))
+	}
+
+	if p.MaxSpeakers > 0 {
+		values.Set("max_speakers", strconv.Itoa(p.MaxSpeakers))
+	}
+
+	return values
+}
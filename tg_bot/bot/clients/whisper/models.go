@@ -0,0 +1,94 @@
+package whisper
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+const (
+	TaskStatusProcessing = "processing"
+	TaskStatusCompleted  = "completed"
+	TaskStatusFailed     = "failed"
+)
+
+// Params are the query parameters of the speech-to-text endpoints.
+type Params struct {
+	Model       string
+	Language    string
+	MinSpeakers int
+	MaxSpeakers int
+}
+
+// TaskCreated is the response of the endpoints which queue a task.
+type TaskCreated struct {
+	ID      string `json:"identifier"`
+	Message string `json:"message"`
+}
+
+type Segment struct {
+	Start   float64 `json:"start"`
+	End     float64 `json:"end"`
+	Text    string  `json:"text"`
+	Speaker string  `json:"speaker"`
+}
+
+type Result struct {
+	Segments []Segment `json:"segments"`
+}
+
+type Task struct {
+	Status string `json:"status"`
+	// Result depends on the task type, e.g. diarization returns a list of
+	// speaker turns, use Transcript for the tasks producing segments.
+	Result   json.RawMessage `json:"result"`
+	Metadata struct {
+		TaskType   string `json:"task_type"`
+		TaskParams struct {
+			Language             string `json:"language"`
+			Task                 string `json:"task"`
+			Model                string `json:"model"`
+			Device               string `json:"device"`
+			DeviceIndex          int    `json:"device_index"`
+			Threads              int    `json:"threads"`
+			BatchSize            int    `json:"batch_size"`
+			ComputeType          string `json:"compute_type"`
+			AlignModel           any    `json:"align_model"`
+			InterpolateMethod    string `json:"interpolate_method"`
+			ReturnCharAlignments bool   `json:"return_char_alignments"`
+			AsrOptions           struct {
+				BeamSize                  int     `json:"beam_size"`
+				Patience                  float64 `json:"patience"`
+				LengthPenalty             float64 `json:"length_penalty"`
+				Temperatures              float64 `json:"temperatures"`
+				CompressionRatioThreshold float64 `json:"compression_ratio_threshold"`
+				LogProbThreshold          float64 `json:"log_prob_threshold"`
+				NoSpeechThreshold         float64 `json:"no_speech_threshold"`
+				InitialPrompt             any     `json:"initial_prompt"`
+				SuppressTokens            []int   `json:"suppress_tokens"`
+				SuppressNumerals          bool    `json:"suppress_numerals"`
+			} `json:"asr_options"`
+			VadOptions struct {
+				VadOnset  float64 `json:"vad_onset"`
+				VadOffset float64 `json:"vad_offset"`
+			} `json:"vad_options"`
+			MinSpeakers any `json:"min_speakers"`
+			MaxSpeakers any `json:"max_speakers"`
+		} `json:"task_params"`
+		Language      string  `json:"language"`
+		FileName      string  `json:"file_name"`
+		URL           any     `json:"url"`
+		Duration      float64 `json:"duration"`
+		AudioDuration any     `json:"audio_duration"`
+	} `json:"metadata"`
+	Error any `json:"error"`
+}
+
+// Transcript decodes the result of a task which produces segments.
+func (t Task) Transcript() (Result, error) {
+	var r Result
+	if err := json.Unmarshal(t.Result, &r); err != nil {
+		return Result{}, fmt.Errorf("failed to decode transcript: %w", err)
+	}
+
+	return r, nil
+}
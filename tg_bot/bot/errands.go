@@ -0,0 +1,288 @@
+package bot
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+	"github.com/jackc/pgx/v5/pgtype"
+
+	postgres "github.com/gulldan/cp2024omsk-pmsk/bot/postgres/generated"
+)
+
+const (
+	ERRAND_CALLBACK = "errand_"
+	ERRAND_REMINDER = "Напоминание о поручении со встречи «%s»:\n%s"
+	ERRAND_DONE     = "Поручение выполнено."
+
+	errandDone       = ERRAND_CALLBACK + "done"
+	errandSnoozeHour = ERRAND_CALLBACK + "hour"
+	errandSnoozeDay  = ERRAND_CALLBACK + "day"
+
+	// reminderBatch limits the reminders sent at once.
+	reminderBatch = 50
+	// remindHour is the hour the reminders are sent at for deadlines given without time.
+	remindHour = 9
+)
+
+// parseDeadline reads the deadline of an errand, dates without a zone are in
+// the local time of the bot. The errands keep their time in UTC.
+func parseDeadline(s string) (time.Time, bool) {
+	s = strings.TrimSpace(s)
+
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t.UTC(), true
+	}
+
+	for _, layout := range []string{"2006-01-02T15:04:05", "2006-01-02 15:04", "2006-01-02", "02.01.2006"} {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t.UTC(), true
+		}
+	}
+
+	return time.Time{}, false
+}
+
+// dateOnly reports whether the deadline was given as a date.
+func dateOnly(t time.Time) bool {
+	t = t.Local()
+
+	return t.Hour() == 0 && t.Minute() == 0 && t.Second() == 0
+}
+
+// nextReminder is the first reminder after now: a day before the deadline and
+// on the deadline itself. None is left once the deadline has passed.
+func nextReminder(deadline pgtype.Timestamp, now time.Time) pgtype.Timestamp {
+	if !deadline.Valid {
+		return pgtype.Timestamp{}
+	}
+
+	due := deadline.Time
+	if dateOnly(due) {
+		due = due.Add(remindHour * time.Hour)
+	}
+
+	for _, t := range []time.Time{due.AddDate(0, 0, -1), due} {
+		if t.After(now) {
+			return pgtype.Timestamp{Time: t, Valid: true}
+		}
+	}
+
+	return pgtype.Timestamp{}
+}
+
+func formatDeadline(t time.Time) string {
+	if dateOnly(t) {
+		return t.Local().Format("02.01.2006")
+	}
+
+	return t.Local().Format(meetingTimeLayout)
+}
+
+// saveErrands stores the errands of the protocol and schedules their reminders
+// to the owner of the meeting. The errands of a previous protocol version are
+// replaced, except the ones already done.
+func (bw *BotWrapper) saveErrands(ctx context.Context, tr postgres.Transcribition) {
+	p, err := bw.protocol(ctx, tr.ID)
+	if err != nil {
+		bw.log.Warn().Err(err).Int64("id", tr.ID).Msg("read protocol errands failed")
+
+		return
+	}
+
+	done, err := bw.psql.GetDoneErrands(ctx, tr.ID)
+	if err != nil {
+		bw.log.Error().Err(err).Int64("id", tr.ID).Msg("get done errands failed")
+
+		return
+	}
+
+	if err := bw.psql.DeleteErrands(ctx, tr.ID); err != nil {
+		bw.log.Error().Err(err).Int64("id", tr.ID).Msg("delete errands failed")
+
+		return
+	}
+
+	doneContexts := make(map[string]bool, len(done))
+	for _, e := range done {
+		doneContexts[e.Context] = true
+	}
+
+	now := time.Now().UTC()
+
+	for _, e := range p.Data.Errands {
+		if strings.TrimSpace(e.Context) == "" || doneContexts[strings.TrimSpace(e.Context)] {
+			continue
+		}
+
+		var deadline pgtype.Timestamp
+		if t, ok := parseDeadline(e.Deadline); ok {
+			deadline = pgtype.Timestamp{Time: t, Valid: true}
+		}
+
+		if err := bw.psql.CreateErrand(ctx, postgres.CreateErrandParams{
+			TranscribitionID: tr.ID,
+			TgUserID:         tr.TgUserID,
+			Assignee:         optionalText(strings.TrimSpace(e.Assignee)),
+			Context:          strings.TrimSpace(e.Context),
+			Deadline:         deadline,
+			RemindAt:         nextReminder(deadline, now),
+		}); err != nil {
+			bw.log.Error().Err(err).Int64("id", tr.ID).Msg("create errand failed")
+		}
+	}
+}
+
+// runReminders sends the due reminders, the schedule is kept in the database
+// so the reminders survive restarts.
+func (bw *BotWrapper) runReminders(ctx context.Context) {
+	ticker := time.NewTicker(bw.cfg.ReminderPollInterval)
+	defer ticker.Stop()
+
+	for {
+		bw.sendReminders(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (bw *BotWrapper) sendReminders(ctx context.Context) {
+	now := time.Now().UTC()
+
+	errands, err := bw.psql.GetDueErrands(ctx, postgres.GetDueErrandsParams{
+		RemindAt: pgtype.Timestamp{Time: now, Valid: true},
+		Limit:    reminderBatch,
+	})
+	if err != nil {
+		bw.log.Error().Err(err).Msg("get due errands failed")
+
+		return
+	}
+
+	for _, e := range errands {
+		if _, err := bw.b.SendMessage(ctx, &bot.SendMessageParams{
+			ChatID:      e.TgUserID,
+			Text:        bw.errandText(ctx, e),
+			ReplyMarkup: bw.errandMarkup(e.ID),
+		}); err != nil {
+			// The owner may have never started the bot in private, the reminder is not retried.
+			bw.log.Error().Err(err).Int64("errand", e.ID).Int64("chatID", e.TgUserID).Msg("send reminder failed")
+		}
+
+		if err := bw.psql.SetErrandReminder(ctx, postgres.SetErrandReminderParams{
+			RemindAt: nextReminder(e.Deadline, now),
+			ID:       e.ID,
+		}); err != nil {
+			bw.log.Error().Err(err).Int64("errand", e.ID).Msg("set errand reminder failed")
+		}
+	}
+}
+
+// errandText describes the errand, speakers named after the protocol was made are shown by their names.
+func (bw *BotWrapper) errandText(ctx context.Context, e postgres.Errand) string {
+	name := "встреча"
+	if tr, err := bw.psql.GetTranscribition(ctx, e.TranscribitionID); err == nil {
+		name = meetingName(tr)
+	}
+
+	lines := []string{e.Context}
+
+	if e.Assignee.Valid {
+		assignee := e.Assignee.String
+		if speaker, ok := bw.speakerNames(ctx, e.TranscribitionID)[assignee]; ok {
+			assignee = speaker
+		}
+
+		lines = append(lines, "Ответственный: "+assignee)
+	}
+
+	if e.Deadline.Valid {
+		lines = append(lines, "Срок: "+formatDeadline(e.Deadline.Time))
+	}
+
+	return fmt.Sprintf(ERRAND_REMINDER, name, strings.Join(lines, "\n"))
+}
+
+func (bw *BotWrapper) errandMarkup(errandID int64) *models.InlineKeyboardMarkup {
+	return &models.InlineKeyboardMarkup{
+		InlineKeyboard: [][]models.InlineKeyboardButton{
+			{
+				{Text: "Через час", CallbackData: bw.signedData(errandSnoozeHour, errandID)},
+				{Text: "Завтра", CallbackData: bw.signedData(errandSnoozeDay, errandID)},
+			}, {
+				{Text: "Выполнено", CallbackData: bw.signedData(errandDone, errandID)},
+			},
+		},
+	}
+}
+
+// errandCallbackQuery snoozes the reminder or marks the errand done.
+func (bw *BotWrapper) errandCallbackQuery(ctx context.Context, b *bot.Bot, update *models.Update) {
+	answer := func(text string) {
+		if _, err := b.AnswerCallbackQuery(ctx, &bot.AnswerCallbackQueryParams{
+			CallbackQueryID: update.CallbackQuery.ID,
+			Text:            text,
+		}); err != nil {
+			bw.log.Error().Err(err).Msg("answer callback query failed")
+		}
+	}
+
+	action, errandID, err := bw.parseSignedData(update.CallbackQuery.Data)
+	if err != nil {
+		answer(INVALID_BUTTON)
+
+		return
+	}
+
+	e, err := bw.psql.GetErrand(ctx, errandID)
+	if err != nil || e.TgUserID != update.CallbackQuery.From.ID {
+		answer("Поручение не найдено.")
+
+		return
+	}
+
+	text := ""
+	if msg := update.CallbackQuery.Message.Message; msg != nil {
+		text = msg.Text
+	}
+
+	switch action {
+	case errandDone:
+		if err := bw.psql.CompleteErrand(ctx, e.ID); err != nil {
+			bw.log.Error().Err(err).Int64("errand", e.ID).Msg("complete errand failed")
+			answer("Не удалось сохранить.")
+
+			return
+		}
+
+		answer(ERRAND_DONE)
+		bw.editCallbackMessage(ctx, update, text+"\n\n"+ERRAND_DONE, nil)
+	case errandSnoozeHour, errandSnoozeDay:
+		snooze, reply := time.Hour, "Напомню через час."
+		if action == errandSnoozeDay {
+			snooze, reply = 24*time.Hour, "Напомню завтра."
+		}
+
+		if err := bw.psql.SetErrandReminder(ctx, postgres.SetErrandReminderParams{
+			RemindAt: pgtype.Timestamp{Time: time.Now().UTC().Add(snooze), Valid: true},
+			ID:       e.ID,
+		}); err != nil {
+			bw.log.Error().Err(err).Int64("errand", e.ID).Msg("snooze errand failed")
+			answer("Не удалось сохранить.")
+
+			return
+		}
+
+		answer(reply)
+		bw.editCallbackMessage(ctx, update, text, nil)
+	default:
+		answer(INVALID_BUTTON)
+	}
+}
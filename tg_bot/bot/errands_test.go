@@ -0,0 +1,110 @@
+package bot
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+func TestParseDeadline(t *testing.T) {
+	tests := []struct {
+		input  string
+		want   time.Time
+		wantOk bool
+	}{
+		{
+			input:  "2024-10-05T12:00:00+03:00",
+			want:   time.Date(2024, 10, 5, 9, 0, 0, 0, time.UTC),
+			wantOk: true,
+		},
+		{
+			input:  "2024-10-05T12:00:00",
+			want:   time.Date(2024, 10, 5, 12, 0, 0, 0, time.Local),
+			wantOk: true,
+		},
+		{
+			input:  "2024-10-05 14:30",
+			want:   time.Date(2024, 10, 5, 14, 30, 0, 0, time.Local),
+			wantOk: true,
+		},
+		{
+			input:  " 2024-10-05 ",
+			want:   time.Date(2024, 10, 5, 0, 0, 0, 0, time.Local),
+			wantOk: true,
+		},
+		{
+			input:  "05.10.2024",
+			want:   time.Date(2024, 10, 5, 0, 0, 0, 0, time.Local),
+			wantOk: true,
+		},
+		{input: "завтра"},
+		{input: "31.02.2024"},
+		{input: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			got, ok := parseDeadline(tt.input)
+			if ok != tt.wantOk {
+				t.Fatalf("parseDeadline() ok = %v, want %v", ok, tt.wantOk)
+			}
+
+			if !got.Equal(tt.want) {
+				t.Errorf("parseDeadline() = %v, want %v", got, tt.want)
+			}
+
+			if ok && got.Location() != time.UTC {
+				t.Errorf("parseDeadline() location = %v, want UTC", got.Location())
+			}
+		})
+	}
+}
+
+func TestNextReminder(t *testing.T) {
+	deadline := time.Date(2024, 10, 5, 14, 30, 0, 0, time.Local).UTC()
+	date := time.Date(2024, 10, 5, 0, 0, 0, 0, time.Local).UTC()
+
+	tests := []struct {
+		name     string
+		deadline pgtype.Timestamp
+		now      time.Time
+		want     pgtype.Timestamp
+	}{
+		{
+			name: "no deadline",
+			now:  deadline,
+		},
+		{
+			name:     "a day before",
+			deadline: pgtype.Timestamp{Time: deadline, Valid: true},
+			now:      deadline.AddDate(0, 0, -3),
+			want:     pgtype.Timestamp{Time: deadline.AddDate(0, 0, -1), Valid: true},
+		},
+		{
+			name:     "on the deadline",
+			deadline: pgtype.Timestamp{Time: deadline, Valid: true},
+			now:      deadline.Add(-time.Hour),
+			want:     pgtype.Timestamp{Time: deadline, Valid: true},
+		},
+		{
+			name:     "passed",
+			deadline: pgtype.Timestamp{Time: deadline, Valid: true},
+			now:      deadline,
+		},
+		{
+			name:     "date without time",
+			deadline: pgtype.Timestamp{Time: date, Valid: true},
+			now:      date.AddDate(0, 0, -1).Add(remindHour * time.Hour),
+			want:     pgtype.Timestamp{Time: date.Add(remindHour * time.Hour), Valid: true},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := nextReminder(tt.deadline, tt.now); got != tt.want {
+				t.Errorf("nextReminder() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
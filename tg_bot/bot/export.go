@@ -0,0 +1,224 @@
+package bot
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+	"github.com/gulldan/cp2024omsk-pmsk/bot/clients/whisper"
+	"github.com/gulldan/cp2024omsk-pmsk/bot/transcript"
+	"github.com/jackc/pgx/v5"
+
+	postgres "github.com/gulldan/cp2024omsk-pmsk/bot/postgres/generated"
+)
+
+const (
+	TRANSCRIPT          = "/transcript"
+	TRANSCRIPT_CALLBACK = "transcript_"
+	TRANSCRIPT_USAGE    = "Форматы расшифровки: text, txt, srt, vtt, json. Например: /transcript srt"
+	TRANSCRIPT_EMPTY    = "Расшифровка пуста."
+
+	transcriptText = "text"
+	transcriptTXT  = "txt"
+	transcriptSRT  = "srt"
+	transcriptVTT  = "vtt"
+	transcriptJSON = "json"
+
+	// transcriptMaxMessages limits the text sent as messages, longer transcripts come as a file.
+	transcriptMaxMessages = 10
+)
+
+var transcriptFormats = []string{transcriptText, transcriptTXT, transcriptSRT, transcriptVTT, transcriptJSON}
+
+// transcriptKeyboard offers the transcript of the meeting in every format.
+func (bw *BotWrapper) transcriptKeyboard(pgID int64) [][]models.InlineKeyboardButton {
+	return [][]models.InlineKeyboardButton{
+		{
+			{Text: "Текст", CallbackData: bw.signedData(TRANSCRIPT_CALLBACK+transcriptText, pgID)},
+			{Text: "TXT", CallbackData: bw.signedData(TRANSCRIPT_CALLBACK+transcriptTXT, pgID)},
+			{Text: "SRT", CallbackData: bw.signedData(TRANSCRIPT_CALLBACK+transcriptSRT, pgID)},
+			{Text: "VTT", CallbackData: bw.signedData(TRANSCRIPT_CALLBACK+transcriptVTT, pgID)},
+			{Text: "JSON", CallbackData: bw.signedData(TRANSCRIPT_CALLBACK+transcriptJSON, pgID)},
+		},
+	}
+}
+
+// meetingSegments decodes the stored transcription, the speakers named by the
+// user are replaced by their names.
+func (bw *BotWrapper) meetingSegments(ctx context.Context, tr postgres.Transcribition) ([]whisper.Segment, error) {
+	var v TaskResponseMarshal
+	if err := json.Unmarshal([]byte(tr.Transcription.String), &v); err != nil {
+		return nil, fmt.Errorf("json unmarshal failed: %w", err)
+	}
+
+	names := bw.speakerNames(ctx, tr.ID)
+	for i, s := range v.Result.Segments {
+		if name, ok := names[s.Speaker]; ok {
+			v.Result.Segments[i].Speaker = name
+		}
+	}
+
+	return v.Result.Segments, nil
+}
+
+// sendTranscript sends the transcript of the meeting to its chat, the text
+// format is sent as messages and the others as files.
+func (bw *BotWrapper) sendTranscript(ctx context.Context, tr postgres.Transcribition, format string) error {
+	segments, err := bw.meetingSegments(ctx, tr)
+	if err != nil {
+		return err
+	}
+
+	var data []byte
+	switch format {
+	case transcriptText, transcriptTXT:
+		text := transcript.Text(segments)
+		if text == "" {
+			return bw.sendTranscriptMessage(ctx, tr, TRANSCRIPT_EMPTY)
+		}
+
+		if parts := transcript.Split(text, maxMessageLength); format == transcriptText && len(parts) <= transcriptMaxMessages {
+			for _, part := range parts {
+				if err := bw.sendTranscriptMessage(ctx, tr, part); err != nil {
+					return err
+				}
+			}
+
+			return nil
+		}
+
+		data, format = []byte(text), transcriptTXT
+	case transcriptSRT:
+		data = []byte(transcript.SRT(segments))
+	case transcriptVTT:
+		data = []byte(transcript.VTT(segments))
+	case transcriptJSON:
+		if data, err = transcript.JSON(segments); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown transcript format %q", format)
+	}
+
+	if _, err := bw.b.SendDocument(ctx, &bot.SendDocumentParams{
+		ChatID:          tr.ChatID,
+		MessageThreadID: int(tr.MessageThreadID.Int64),
+		Document:        &models.InputFileUpload{Filename: "transcript." + format, Data: bytes.NewReader(data)},
+		Caption:         meetingName(tr),
+	}); err != nil {
+		return fmt.Errorf("send document failed: %w", err)
+	}
+
+	return nil
+}
+
+func (bw *BotWrapper) sendTranscriptMessage(ctx context.Context, tr postgres.Transcribition, text string) error {
+	if _, err := bw.b.SendMessage(ctx, &bot.SendMessageParams{
+		ChatID:          tr.ChatID,
+		MessageThreadID: int(tr.MessageThreadID.Int64),
+		Text:            text,
+	}); err != nil {
+		return fmt.Errorf("send message failed: %w", err)
+	}
+
+	return nil
+}
+
+// transcriptHandler sends the transcript of the meeting the command replies to
+// or of the last transcribed meeting of the chat: /transcript [format].
+func (bw *BotWrapper) transcriptHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
+	reply := func(text string) {
+		if _, err := b.SendMessage(ctx, &bot.SendMessageParams{
+			ChatID:          update.Message.Chat.ID,
+			MessageThreadID: threadID(update.Message),
+			Text:            text,
+		}); err != nil {
+			bw.log.Error().Err(err).Msg("send transcript message failed")
+		}
+	}
+
+	format := strings.ToLower(bw.stripMention(strings.TrimPrefix(update.Message.Text, TRANSCRIPT)))
+	if format == "" {
+		format = transcriptText
+	}
+
+	known := false
+	for _, f := range transcriptFormats {
+		known = known || f == format
+	}
+
+	if !known {
+		reply(TRANSCRIPT_USAGE)
+
+		return
+	}
+
+	tr, err := bw.statusMessageMeeting(ctx, update.Message)
+	if errors.Is(err, pgx.ErrNoRows) {
+		tr, err = bw.psql.GetLastTranscribed(ctx, update.Message.Chat.ID)
+	}
+	if err != nil {
+		if !errors.Is(err, pgx.ErrNoRows) {
+			bw.log.Error().Err(err).Int64("chatID", update.Message.Chat.ID).Msg("get meeting failed")
+		}
+
+		reply(ASK_NO_MEETING)
+
+		return
+	}
+
+	if !tr.Transcription.Valid {
+		reply("Встреча еще не расшифрована.")
+
+		return
+	}
+
+	if err := bw.sendTranscript(ctx, tr, format); err != nil {
+		bw.log.Error().Err(err).Int64("id", tr.ID).Msg("send transcript failed")
+		reply("Не удалось отправить расшифровку.")
+	}
+}
+
+func (bw *BotWrapper) transcriptCallbackQuery(ctx context.Context, b *bot.Bot, update *models.Update) {
+	answer := func(text string) {
+		if _, err := b.AnswerCallbackQuery(ctx, &bot.AnswerCallbackQueryParams{
+			CallbackQueryID: update.CallbackQuery.ID,
+			Text:            text,
+			ShowAlert:       text != "",
+		}); err != nil {
+			bw.log.Error().Err(err).Msg("answer callback query failed")
+		}
+	}
+
+	data, pgID, err := bw.parseSignedData(update.CallbackQuery.Data)
+	if err != nil {
+		bw.log.Warn().Err(err).Int64("chatID", update.CallbackQuery.From.ID).Str("data", update.CallbackQuery.Data).Msg("invalid callback data")
+		answer(INVALID_BUTTON)
+
+		return
+	}
+
+	tr, err := bw.psql.GetTranscribition(ctx, pgID)
+	if err != nil || !canAccess(tr, update.CallbackQuery) {
+		answer("Встреча не найдена.")
+
+		return
+	}
+
+	if !tr.Transcription.Valid {
+		answer("Встреча еще не расшифрована.")
+
+		return
+	}
+
+	answer("")
+
+	if err := bw.sendTranscript(ctx, tr, strings.TrimPrefix(data, TRANSCRIPT_CALLBACK)); err != nil {
+		bw.log.Error().Err(err).Int64("id", tr.ID).Msg("send transcript failed")
+	}
+}
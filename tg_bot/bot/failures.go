@@ -0,0 +1,227 @@
+package bot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+
+	postgres "github.com/gulldan/cp2024omsk-pmsk/bot/postgres/generated"
+)
+
+const (
+	ErrCodeStorage            = "storage"
+	ErrCodeWhisperUnavailable = "whisper_unavailable"
+	ErrCodeWhisperTaskFailed  = "whisper_task_failed"
+	ErrCodeLlamaUnavailable   = "llama_unavailable"
+	ErrCodeReportUnavailable  = "report_unavailable"
+	ErrCodeReportBadInput     = "report_bad_input"
+	ErrCodeInternal           = "internal"
+	ErrCodeLinkUnavailable    = "link_unavailable"
+	ErrCodeLinkNotAllowed     = "link_not_allowed"
+	ErrCodeLinkTooLarge       = "link_too_large"
+	ErrCodeAudioQuota         = "audio_quota"
+
+	RETRY = "retry_"
+
+	StatusMessageFailed = "Не удалось обработать встречу.\nЭтап: %s\nПричина: %s"
+	UPLOAD_AGAIN        = "Загрузите аудиофайл или отправьте ссылку повторно."
+)
+
+var stageNames = map[int]string{
+	StatusUploaded:      "загрузка",
+	StatusTranscription: "транскрибация",
+	StatusNers:          "выделение информации для отчета",
+	StatusReport:        "генерация отчета",
+}
+
+var failureReasons = map[string]string{
+	ErrCodeStorage:            "не удалось сохранить данные, попробуйте позже.",
+	ErrCodeWhisperUnavailable: "сервис распознавания речи недоступен.",
+	ErrCodeWhisperTaskFailed:  "не удалось распознать речь в аудиофайле.",
+	ErrCodeLlamaUnavailable:   "сервис составления протокола недоступен.",
+	ErrCodeReportUnavailable:  "сервис генерации отчетов недоступен.",
+	ErrCodeReportBadInput:     "не удалось разобрать протокол встречи.",
+	ErrCodeInternal:           "внутренняя ошибка.",
+	ErrCodeLinkUnavailable:    "не удалось скачать запись по ссылке.",
+	ErrCodeLinkNotAllowed:     "ссылка ведет на неподдерживаемый адрес или формат файла.",
+	ErrCodeLinkTooLarge:       "запись по ссылке слишком большая.",
+	ErrCodeAudioQuota:         "запись длиннее, чем осталось от лимита аудио, см. /usage.",
+}
+
+// PipelineError describes the failure of a single processing stage.
+type PipelineError struct {
+	Stage int
+	Code  string
+	Err   error
+}
+
+func (e *PipelineError) Error() string {
+	return fmt.Sprintf("stage %d failed with %s: %v", e.Stage, e.Code, e.Err)
+}
+
+func (e *PipelineError) Unwrap() error {
+	return e.Err
+}
+
+func stageError(stage int, code string, err error) error {
+	return &PipelineError{Stage: stage, Code: code, Err: err}
+}
+
+// asPipelineError attributes errors without a known cause to the given stage.
+func asPipelineError(stage int, err error) *PipelineError {
+	var perr *PipelineError
+	if errors.As(err, &perr) {
+		return perr
+	}
+
+	return &PipelineError{Stage: stage, Code: ErrCodeInternal, Err: err}
+}
+
+// failTranscribition records the error, moves the transcribition to StatusFailed
+// and explains the failure in the status message.
+func (bw *BotWrapper) failTranscribition(ctx context.Context, tr postgres.Transcribition, stage int, err error) {
+	perr := asPipelineError(stage, err)
+
+	bw.log.Error().Err(perr).Int64("id", tr.ID).Int64("chatID", tr.ChatID).Msg("stage failed")
+
+	if err := bw.psql.CreateStageError(ctx, postgres.CreateStageErrorParams{
+		TranscribitionID: tr.ID,
+		Stage:            int32(perr.Stage),
+		Code:             perr.Code,
+		Message:          perr.Err.Error(),
+	}); err != nil {
+		bw.log.Error().Err(err).Int64("id", tr.ID).Msg("failed to create stage error")
+	}
+
+	bw.updateStatus(ctx, StatusFailed, tr.ID, tr.ChatID, tr.MessageToEdit.Int64)
+}
+
+func (bw *BotWrapper) failedStatusMessage(ctx context.Context, pgID int64) (string, models.ReplyMarkup) {
+	stageErr, err := bw.psql.GetLastStageError(ctx, pgID)
+	if err != nil {
+		bw.log.Error().Err(err).Int64("id", pgID).Msg("failed to get stage error")
+
+		return fmt.Sprintf(StatusMessageFailed, "неизвестно", failureReasons[ErrCodeInternal]), nil
+	}
+
+	reason, ok := failureReasons[stageErr.Code]
+	if !ok {
+		reason = failureReasons[ErrCodeInternal]
+	}
+
+	text := fmt.Sprintf(StatusMessageFailed, stageNames[int(stageErr.Stage)], reason)
+
+	tr, err := bw.psql.GetTranscribition(ctx, pgID)
+	if err != nil {
+		bw.log.Error().Err(err).Int64("id", pgID).Msg("failed to get transcibition")
+
+		return text, nil
+	}
+
+	if _, ok := retryStage(tr, int(stageErr.Stage)); !ok {
+		return text + "\n" + UPLOAD_AGAIN, nil
+	}
+
+	return text, &models.InlineKeyboardMarkup{
+		InlineKeyboard: [][]models.InlineKeyboardButton{
+			{
+				{Text: "Повторить", CallbackData: bw.signedData(RETRY, pgID)},
+			},
+		},
+	}
+}
+
+func (bw *BotWrapper) retryCallbackQuery(ctx context.Context, b *bot.Bot, update *models.Update) {
+	answer := func(text string) {
+		if _, err := b.AnswerCallbackQuery(ctx, &bot.AnswerCallbackQueryParams{
+			CallbackQueryID: update.CallbackQuery.ID,
+			Text:            text,
+		}); err != nil {
+			bw.log.Error().Err(err).Msg("answer callback query failed")
+		}
+	}
+
+	_, pgID, err := bw.parseSignedData(update.CallbackQuery.Data)
+	if err != nil {
+		answer(callbackError(err))
+
+		return
+	}
+
+	tr, err := bw.psql.GetTranscribition(ctx, pgID)
+	if err != nil || !canAccess(tr, update.CallbackQuery) {
+		answer("Встреча не найдена.")
+
+		return
+	}
+
+	if !bw.hasRole(ctx, update.CallbackQuery.From.ID, RoleMember) {
+		answer(fmt.Sprintf(ACCESS_DENIED, update.CallbackQuery.From.ID))
+
+		return
+	}
+
+	if tr.Status.Int32 != StatusFailed {
+		answer("Встреча уже обрабатывается.")
+
+		return
+	}
+
+	stageErr, err := bw.psql.GetLastStageError(ctx, tr.ID)
+	if err != nil {
+		bw.log.Error().Err(err).Int64("id", tr.ID).Msg("failed to get stage error")
+		answer("Не удалось перезапустить обработку.")
+
+		return
+	}
+
+	stage, ok := retryStage(tr, int(stageErr.Stage))
+	if !ok {
+		answer(UPLOAD_AGAIN)
+
+		return
+	}
+
+	// The failed whisper task would be re-attached to and fail again.
+	if stage == StatusTranscription {
+		if err := bw.resetWhisperTasks(ctx, tr); err != nil {
+			bw.log.Error().Err(err).Int64("id", tr.ID).Msg("reset whisper tasks failed")
+			answer("Не удалось перезапустить обработку.")
+
+			return
+		}
+	}
+
+	answer("Перезапускаем обработку.")
+
+	// Report generation is started by the report buttons, so bring them back.
+	if stage == StatusReport {
+		bw.updateStatus(ctx, StatusDone, tr.ID, tr.ChatID, tr.MessageToEdit.Int64)
+
+		return
+	}
+
+	bw.updateStatus(ctx, stage, tr.ID, tr.ChatID, tr.MessageToEdit.Int64)
+
+	if err := bw.enqueueJob(ctx, tr.ID, stage); err != nil {
+		bw.failTranscribition(ctx, tr, stage, stageError(stage, ErrCodeStorage, err))
+	}
+}
+
+// retryStage is the stage a failed transcribition is started over from. There is
+// no worker for the upload, it is retried by transcribing the stored audio, and
+// without the audio the user has to upload the recording again.
+func retryStage(tr postgres.Transcribition, stage int) (int, bool) {
+	if stage != StatusUploaded {
+		return stage, true
+	}
+
+	if !tr.AudioNameMinio.Valid {
+		return 0, false
+	}
+
+	return StatusTranscription, true
+}
@@ -0,0 +1,184 @@
+package bot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gabriel-vasile/mimetype"
+	"github.com/rs/xid"
+)
+
+// mediaFormat is a container the bot accepts recordings in.
+type mediaFormat struct {
+	// Mime is the content type the format is detected as and served with.
+	Mime string
+	Ext  string
+	// Ready formats are decoded by whisper as they are, the others are
+	// normalized to canonicalFormat before transcription.
+	Ready bool
+}
+
+// canonicalFormat is what normalizeAudio produces: mono 16 kHz opus, the
+// sample rate whisper works at, in an ogg container.
+var canonicalFormat = mediaFormat{Mime: "audio/ogg", Ext: ".ogg", Ready: true}
+
+// mediaFormats is the registry of supported formats, the files are told apart
+// by their content, so mislabelled uploads are accepted too.
+var mediaFormats = []mediaFormat{
+	{Mime: "audio/mpeg", Ext: ".mp3", Ready: true},
+	{Mime: "audio/wav", Ext: ".wav", Ready: true},
+	canonicalFormat,
+	{Mime: "audio/x-m4a", Ext: ".m4a"},
+	{Mime: "audio/mp4", Ext: ".m4a"},
+	{Mime: "audio/aac", Ext: ".aac"},
+	{Mime: "audio/flac", Ext: ".flac"},
+	{Mime: "audio/amr", Ext: ".amr"},
+	{Mime: "audio/aiff", Ext: ".aiff"},
+	{Mime: "video/mp4", Ext: ".mp4"},
+	{Mime: "video/quicktime", Ext: ".mov"},
+	{Mime: "video/x-matroska", Ext: ".mkv"},
+	{Mime: "video/webm", Ext: ".webm"},
+	{Mime: "video/x-msvideo", Ext: ".avi"},
+	{Mime: "video/x-ms-asf", Ext: ".wmv"},
+	{Mime: "video/3gpp", Ext: ".3gp"},
+	{Mime: "video/mpeg", Ext: ".mpeg"},
+}
+
+var errUnsupportedFormat = errors.New("unsupported format")
+
+// detectFormat sniffs the magic bytes of the file. A format which is not
+// registered itself is matched by its parent, e.g. a specific mp4 brand.
+func detectFormat(file string) (mediaFormat, error) {
+	mtype, err := mimetype.DetectFile(file)
+	if err != nil {
+		return mediaFormat{}, fmt.Errorf("detect mime type failed: %w", err)
+	}
+
+	return matchFormat(mtype)
+}
+
+// detectReaderFormat sniffs the head of a file which is not on disk, e.g. a stored link.
+func detectReaderFormat(r io.Reader) (mediaFormat, error) {
+	mtype, err := mimetype.DetectReader(r)
+	if err != nil {
+		return mediaFormat{}, fmt.Errorf("detect mime type failed: %w", err)
+	}
+
+	return matchFormat(mtype)
+}
+
+func matchFormat(mtype *mimetype.MIME) (mediaFormat, error) {
+	for m := mtype; m != nil; m = m.Parent() {
+		for _, f := range mediaFormats {
+			if m.Is(f.Mime) {
+				return f, nil
+			}
+		}
+	}
+
+	return mediaFormat{}, fmt.Errorf("%w: %s", errUnsupportedFormat, mtype.String())
+}
+
+// formatByExt finds the format of a stored file by its extension.
+func formatByExt(name string) (mediaFormat, bool) {
+	ext := strings.ToLower(filepath.Ext(name))
+
+	for _, f := range mediaFormats {
+		if f.Ext == ext {
+			return f, true
+		}
+	}
+
+	return mediaFormat{}, false
+}
+
+// sniffFile detects the format of the downloaded file and gives it the matching extension.
+func sniffFile(file string) (string, mediaFormat, error) {
+	format, err := detectFormat(file)
+	if err != nil {
+		return "", mediaFormat{}, err
+	}
+
+	named := strings.TrimSuffix(file, filepath.Ext(file)) + format.Ext
+	if err := os.Rename(file, named); err != nil {
+		return "", mediaFormat{}, fmt.Errorf("failed to rename file: %w", err)
+	}
+
+	return named, format, nil
+}
+
+// audioDuration probes the length of the recording.
+func audioDuration(ctx context.Context, file string) (time.Duration, error) {
+	output, err := exec.CommandContext(ctx, "ffprobe",
+		"-v", "error",
+		"-show_entries", "format=duration",
+		"-of", "default=noprint_wrappers=1:nokey=1",
+		file,
+	).Output()
+	if err != nil {
+		return 0, fmt.Errorf("ffprobe failed: %w", err)
+	}
+
+	seconds, err := strconv.ParseFloat(strings.TrimSpace(string(output)), 64)
+	if err != nil {
+		return 0, fmt.Errorf("parse duration failed: %w", err)
+	}
+
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
+// normalizeAudio converts the audio track of the file, or of the URL ffmpeg can
+// read, into canonicalFormat in the working directory.
+func normalizeAudio(ctx context.Context, file string) (string, error) {
+	out := xid.New().String() + canonicalFormat.Ext
+
+	cmd := exec.CommandContext(ctx, "ffmpeg",
+		"-nostdin", "-hide_banner", "-loglevel", "error",
+		"-i", file,
+		"-vn", "-ac", "1", "-ar", "16000",
+		"-c:a", "libopus", "-b:a", "32k",
+		out,
+	)
+
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return "", fmt.Errorf("ffmpeg failed: %w: %s", err, strings.TrimSpace(string(output)))
+	}
+
+	return out, nil
+}
+
+// mergeAudio joins the recordings one after another into canonicalFormat, the
+// parts may come in different formats and sample rates.
+func mergeAudio(ctx context.Context, files []string) (string, error) {
+	out := xid.New().String() + canonicalFormat.Ext
+
+	args := []string{"-nostdin", "-hide_banner", "-loglevel", "error"}
+	var filter, inputs strings.Builder
+	for i, f := range files {
+		args = append(args, "-i", f)
+		fmt.Fprintf(&filter, "[%d:a:0]aresample=16000,aformat=channel_layouts=mono[a%d];", i, i)
+		fmt.Fprintf(&inputs, "[a%d]", i)
+	}
+	fmt.Fprintf(&filter, "%sconcat=n=%d:v=0:a=1[out]", inputs.String(), len(files))
+
+	args = append(args,
+		"-filter_complex", filter.String(),
+		"-map", "[out]",
+		"-c:a", "libopus", "-b:a", "32k",
+		out,
+	)
+
+	if output, err := exec.CommandContext(ctx, "ffmpeg", args...).CombinedOutput(); err != nil {
+		return "", fmt.Errorf("ffmpeg failed: %w: %s", err, strings.TrimSpace(string(output)))
+	}
+
+	return out, nil
+}
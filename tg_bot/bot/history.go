@@ -0,0 +1,335 @@
+package bot
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+
+	postgres "github.com/gulldan/cp2024omsk-pmsk/bot/postgres/generated"
+)
+
+const (
+	HISTORY          = "/history"
+	HISTORY_CALLBACK = "history_"
+	MEETING_CALLBACK = "meeting_"
+	HISTORY_EMPTY    = "У вас пока нет встреч. Загрузите аудио- или видеозапись встречи."
+	AUDIO_TOO_LARGE  = "Запись «%s» больше 50 МБ, Telegram не позволяет боту ее отправить. Прослушать ее можно в мини-приложении бота."
+
+	historyPageSize = 5
+
+	meetingTranscript    = "transcript"
+	meetingAudio         = "audio"
+	meetingDelete        = "delete"
+	meetingDeleteConfirm = "deleteok"
+)
+
+var statusNames = map[int32]string{
+	StatusUploaded:      "загружено",
+	StatusTranscription: "транскрибация",
+	StatusNers:          "выделение информации",
+	StatusReport:        "генерация отчета",
+	StatusDone:          "готово",
+	StatusFailed:        "ошибка",
+	StatusCancelled:     "отменено",
+}
+
+// meetingData signs the button of the meeting, the action is meeting_<page>[_<action>].
+func (bw *BotWrapper) meetingData(pgID int64, page int, action string) string {
+	data := MEETING_CALLBACK + strconv.Itoa(page)
+	if action != "" {
+		data += "_" + action
+	}
+
+	return bw.signedData(data, pgID)
+}
+
+func (bw *BotWrapper) historyHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
+	text, markup := bw.historyPage(ctx, update.Message.Chat.ID, 0)
+
+	if _, err := b.SendMessage(ctx, &bot.SendMessageParams{
+		ChatID:          update.Message.Chat.ID,
+		MessageThreadID: threadID(update.Message),
+		Text:            text,
+		ReplyMarkup:     markup,
+	}); err != nil {
+		bw.log.Error().Err(err).Msg("send history message failed")
+	}
+}
+
+// historyPage lists the meetings of the chat from the newest one, a group shares
+// its meetings between the members.
+func (bw *BotWrapper) historyPage(ctx context.Context, chatID int64, page int) (string, models.ReplyMarkup) {
+	total, err := bw.psql.CountChatTranscribitions(ctx, chatID)
+	if err != nil {
+		bw.log.Error().Err(err).Int64("chatID", chatID).Msg("count transcribitions failed")
+
+		return "Не удалось получить список встреч.", nil
+	}
+
+	if total == 0 {
+		return HISTORY_EMPTY, nil
+	}
+
+	pages := int((total + historyPageSize - 1) / historyPageSize)
+	page = max(0, min(page, pages-1))
+
+	trs, err := bw.psql.GetChatTranscribitions(ctx, postgres.GetChatTranscribitionsParams{
+		ChatID: chatID,
+		Limit:  historyPageSize,
+		Offset: int32(page * historyPageSize),
+	})
+	if err != nil {
+		bw.log.Error().Err(err).Int64("chatID", chatID).Msg("get transcribitions failed")
+
+		return "Не удалось получить список встреч.", nil
+	}
+
+	keyboard := make([][]models.InlineKeyboardButton, 0, len(trs)+1)
+	for _, tr := range trs {
+		keyboard = append(keyboard, []models.InlineKeyboardButton{{
+			Text:         fmt.Sprintf("%s · %s", meetingName(tr), statusNames[tr.Status.Int32]),
+			CallbackData: bw.meetingData(tr.ID, page, ""),
+		}})
+	}
+
+	var nav []models.InlineKeyboardButton
+	if page > 0 {
+		nav = append(nav, models.InlineKeyboardButton{Text: "« Назад", CallbackData: HISTORY_CALLBACK + strconv.Itoa(page-1)})
+	}
+	if page < pages-1 {
+		nav = append(nav, models.InlineKeyboardButton{Text: "Вперед »", CallbackData: HISTORY_CALLBACK + strconv.Itoa(page+1)})
+	}
+	if len(nav) > 0 {
+		keyboard = append(keyboard, nav)
+	}
+
+	text := fmt.Sprintf("Ваши встречи, страница %d из %d:", page+1, pages)
+
+	return text, &models.InlineKeyboardMarkup{InlineKeyboard: keyboard}
+}
+
+func (bw *BotWrapper) historyCallbackQuery(ctx context.Context, b *bot.Bot, update *models.Update) {
+	if _, err := b.AnswerCallbackQuery(ctx, &bot.AnswerCallbackQueryParams{
+		CallbackQueryID: update.CallbackQuery.ID,
+	}); err != nil {
+		bw.log.Error().Err(err).Msg("answer callback query failed")
+	}
+
+	page, err := strconv.Atoi(strings.TrimPrefix(update.CallbackQuery.Data, HISTORY_CALLBACK))
+	if err != nil {
+		return
+	}
+
+	text, markup := bw.historyPage(ctx, callbackChatID(update.CallbackQuery), page)
+	bw.editCallbackMessage(ctx, update, text, markup)
+}
+
+// editCallbackMessage replaces the message the pressed button belongs to.
+func (bw *BotWrapper) editCallbackMessage(ctx context.Context, update *models.Update, text string, markup models.ReplyMarkup) {
+	msg := update.CallbackQuery.Message.Message
+	if msg == nil {
+		return
+	}
+
+	if _, err := bw.b.EditMessageText(ctx, &bot.EditMessageTextParams{
+		ChatID:      msg.Chat.ID,
+		MessageID:   msg.ID,
+		Text:        text,
+		ReplyMarkup: markup,
+	}); err != nil {
+		bw.log.Error().Err(err).Int64("chatID", msg.Chat.ID).Msg("failed to edit message")
+	}
+}
+
+func (bw *BotWrapper) meetingDetails(ctx context.Context, tr postgres.Transcribition, page int) (string, models.ReplyMarkup) {
+	text := fmt.Sprintf("%s\nСтатус: %s", meetingInfo(tr), statusNames[tr.Status.Int32])
+
+	if tr.Status.Int32 == StatusFailed {
+		if stageErr, err := bw.psql.GetLastStageError(ctx, tr.ID); err == nil {
+			text += fmt.Sprintf("\nЭтап: %s", stageNames[int(stageErr.Stage)])
+		}
+	}
+
+	var keyboard [][]models.InlineKeyboardButton
+	if tr.LlamaOutput.Valid {
+		keyboard = append(keyboard, bw.reportKeyboard(tr.ID)...)
+		keyboard = append(keyboard, []models.InlineKeyboardButton{
+			{Text: "Протокол", CallbackData: bw.signedData(protocolOpen, tr.ID)},
+		})
+	}
+
+	var files []models.InlineKeyboardButton
+	if tr.Transcription.Valid {
+		files = append(files, models.InlineKeyboardButton{Text: "Транскрипт", CallbackData: bw.meetingData(tr.ID, page, meetingTranscript)})
+	}
+	if tr.AudioNameMinio.Valid {
+		files = append(files, models.InlineKeyboardButton{Text: "Аудио", CallbackData: bw.meetingData(tr.ID, page, meetingAudio)})
+	}
+	if len(files) > 0 {
+		keyboard = append(keyboard, files)
+	}
+
+	keyboard = append(keyboard, []models.InlineKeyboardButton{
+		{Text: "Удалить", CallbackData: bw.meetingData(tr.ID, page, meetingDelete)},
+	}, []models.InlineKeyboardButton{
+		{Text: "« К списку", CallbackData: HISTORY_CALLBACK + strconv.Itoa(page)},
+	})
+
+	return text, &models.InlineKeyboardMarkup{InlineKeyboard: keyboard}
+}
+
+// meetingCallbackQuery handles the detail view of a meeting and its buttons.
+func (bw *BotWrapper) meetingCallbackQuery(ctx context.Context, b *bot.Bot, update *models.Update) {
+	answer := func(text string) {
+		if _, err := b.AnswerCallbackQuery(ctx, &bot.AnswerCallbackQueryParams{
+			CallbackQueryID: update.CallbackQuery.ID,
+			Text:            text,
+		}); err != nil {
+			bw.log.Error().Err(err).Msg("answer callback query failed")
+		}
+	}
+
+	data, pgID, err := bw.parseSignedData(update.CallbackQuery.Data)
+	if err != nil {
+		answer(callbackError(err))
+
+		return
+	}
+
+	pageData, action, _ := strings.Cut(strings.TrimPrefix(data, MEETING_CALLBACK), "_")
+
+	page, err := strconv.Atoi(pageData)
+	if err != nil {
+		answer("Некорректный запрос.")
+
+		return
+	}
+
+	tr, err := bw.psql.GetTranscribition(ctx, pgID)
+	if err != nil || !canAccess(tr, update.CallbackQuery) {
+		answer("Встреча не найдена.")
+
+		return
+	}
+
+	if (action == meetingDelete || action == meetingDeleteConfirm) && tr.TgUserID != update.CallbackQuery.From.ID {
+		answer("Удалить встречу может только тот, кто ее загрузил.")
+
+		return
+	}
+
+	switch action {
+	case "":
+		answer("")
+
+		text, markup := bw.meetingDetails(ctx, tr, page)
+		bw.editCallbackMessage(ctx, update, text, markup)
+	case meetingTranscript:
+		answer("")
+
+		if err := bw.sendTranscript(ctx, tr, transcriptTXT); err != nil {
+			bw.log.Error().Err(err).Int64("id", tr.ID).Msg("send transcript failed")
+		}
+	case meetingAudio:
+		answer("")
+		bw.sendAudio(ctx, tr)
+	case meetingDelete:
+		answer("")
+
+		bw.editCallbackMessage(ctx, update, fmt.Sprintf("Удалить «%s» вместе с записью и отчетами?", meetingName(tr)), &models.InlineKeyboardMarkup{
+			InlineKeyboard: [][]models.InlineKeyboardButton{
+				{
+					{Text: "Да, удалить", CallbackData: bw.meetingData(tr.ID, page, meetingDeleteConfirm)},
+					{Text: "Отмена", CallbackData: bw.meetingData(tr.ID, page, "")},
+				},
+			},
+		})
+	case meetingDeleteConfirm:
+		if err := bw.deleteTranscribition(ctx, tr); err != nil {
+			bw.log.Error().Err(err).Int64("id", tr.ID).Msg("delete transcribition failed")
+			answer("Не удалось удалить встречу.")
+
+			return
+		}
+
+		answer("Встреча удалена.")
+
+		text, markup := bw.historyPage(ctx, tr.ChatID, page)
+		bw.editCallbackMessage(ctx, update, text, markup)
+	default:
+		answer("Некорректный запрос.")
+	}
+}
+
+// sendAudio sends the stored recording to the meeting chat. Recordings the Bot
+// API can't send are left to the mini app, which streams them from the API.
+func (bw *BotWrapper) sendAudio(ctx context.Context, tr postgres.Transcribition) {
+	size, err := bw.min.FileSize(ctx, tr.AudioNameMinio.String, tr.AudioBucketMinio.String)
+	if err != nil {
+		bw.log.Error().Err(err).Int64("id", tr.ID).Msg("get file size failed")
+
+		return
+	}
+
+	if size > telegramUploadLimit {
+		if _, err := bw.b.SendMessage(ctx, &bot.SendMessageParams{
+			ChatID:          tr.ChatID,
+			MessageThreadID: int(tr.MessageThreadID.Int64),
+			Text:            fmt.Sprintf(AUDIO_TOO_LARGE, meetingName(tr)),
+		}); err != nil {
+			bw.log.Error().Err(err).Int64("id", tr.ID).Msg("send message failed")
+		}
+
+		return
+	}
+
+	f, err := bw.min.DownloadFile(ctx, tr.AudioNameMinio.String, tr.AudioBucketMinio.String)
+	if err != nil {
+		bw.log.Error().Err(err).Int64("id", tr.ID).Msg("download file failed")
+
+		return
+	}
+	defer f.Close()
+
+	if _, err := bw.b.SendDocument(ctx, &bot.SendDocumentParams{
+		ChatID:          tr.ChatID,
+		MessageThreadID: int(tr.MessageThreadID.Int64),
+		Document:        &models.InputFileUpload{Filename: "meeting" + filepath.Ext(tr.AudioNameMinio.String), Data: f},
+		Caption:         meetingName(tr),
+	}); err != nil {
+		bw.log.Error().Err(err).Int64("id", tr.ID).Msg("failed to send audio")
+	}
+}
+
+// deleteTranscribition stops the processing of the meeting and removes it with its files.
+func (bw *BotWrapper) deleteTranscribition(ctx context.Context, tr postgres.Transcribition) error {
+	if !isFinished(tr.Status.Int32) {
+		if err := bw.cancelTranscribition(ctx, tr); err != nil {
+			return err
+		}
+	}
+
+	if err := bw.psql.DeleteTranscribition(ctx, tr.ID); err != nil {
+		return fmt.Errorf("failed to delete transcribition: %w", err)
+	}
+
+	// The row is gone already, leftover files only take space.
+	if tr.AudioNameMinio.Valid {
+		if err := bw.min.RemoveFile(ctx, tr.AudioNameMinio.String, tr.AudioBucketMinio.String); err != nil {
+			bw.log.Error().Err(err).Int64("id", tr.ID).Msg("remove audio failed")
+		}
+	}
+
+	if tr.OriginalNameMinio.Valid {
+		if err := bw.min.RemoveFile(ctx, tr.OriginalNameMinio.String, bw.min.GetOriginalBucket()); err != nil {
+			bw.log.Error().Err(err).Int64("id", tr.ID).Msg("remove original failed")
+		}
+	}
+
+	return nil
+}
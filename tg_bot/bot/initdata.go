@@ -0,0 +1,73 @@
+package bot
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// initDataMaxAge limits how long the Mini App may use the init data it was opened with.
+const initDataMaxAge = 24 * time.Hour
+
+var (
+	errInitDataInvalid = errors.New("init data is invalid")
+	errInitDataExpired = errors.New("init data is expired")
+)
+
+// validateInitData checks the signature Telegram put on the init data of the
+// Mini App with the bot token and returns the id of the user who opened it.
+func validateInitData(raw, token string, now time.Time) (int64, error) {
+	values, err := url.ParseQuery(raw)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %v", errInitDataInvalid, err)
+	}
+
+	hash := values.Get("hash")
+	if hash == "" {
+		return 0, fmt.Errorf("%w: no hash", errInitDataInvalid)
+	}
+
+	pairs := make([]string, 0, len(values))
+	for key := range values {
+		if key != "hash" {
+			pairs = append(pairs, key+"="+values.Get(key))
+		}
+	}
+	sort.Strings(pairs)
+
+	secret := hmac.New(sha256.New, []byte("WebAppData"))
+	secret.Write([]byte(token))
+
+	mac := hmac.New(sha256.New, secret.Sum(nil))
+	mac.Write([]byte(strings.Join(pairs, "\n")))
+
+	if !hmac.Equal([]byte(hex.EncodeToString(mac.Sum(nil))), []byte(hash)) {
+		return 0, fmt.Errorf("%w: hash mismatch", errInitDataInvalid)
+	}
+
+	authDate, err := strconv.ParseInt(values.Get("auth_date"), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%w: auth_date", errInitDataInvalid)
+	}
+
+	if now.Sub(time.Unix(authDate, 0)) > initDataMaxAge {
+		return 0, errInitDataExpired
+	}
+
+	var user struct {
+		ID int64 `json:"id"`
+	}
+	if err := json.Unmarshal([]byte(values.Get("user")), &user); err != nil || user.ID == 0 {
+		return 0, fmt.Errorf("%w: user", errInitDataInvalid)
+	}
+
+	return user.ID, nil
+}
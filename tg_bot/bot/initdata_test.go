@@ -0,0 +1,105 @@
+package bot
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/url"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testBotToken = "123456:test-token"
+
+func signInitData(values url.Values, token string) string {
+	pairs := make([]string, 0, len(values))
+	for key := range values {
+		pairs = append(pairs, key+"="+values.Get(key))
+	}
+	sort.Strings(pairs)
+
+	secret := hmac.New(sha256.New, []byte("WebAppData"))
+	secret.Write([]byte(token))
+
+	mac := hmac.New(sha256.New, secret.Sum(nil))
+	mac.Write([]byte(strings.Join(pairs, "\n")))
+
+	signed := url.Values{}
+	for key := range values {
+		signed.Set(key, values.Get(key))
+	}
+	signed.Set("hash", hex.EncodeToString(mac.Sum(nil)))
+
+	return signed.Encode()
+}
+
+func TestValidateInitData(t *testing.T) {
+	now := time.Unix(1716922846, 0)
+	values := url.Values{
+		"user":          {`{"id":99281932,"first_name":"Andrew"}`},
+		"auth_date":     {"1716922846"},
+		"chat_instance": {"8428209589180549439"},
+	}
+
+	tests := []struct {
+		name    string
+		raw     string
+		now     time.Time
+		want    int64
+		wantErr error
+	}{
+		{
+			name: "valid",
+			raw:  signInitData(values, testBotToken),
+			now:  now,
+			want: 99281932,
+		},
+		{
+			name:    "other bot",
+			raw:     signInitData(values, "654321:other-token"),
+			now:     now,
+			wantErr: errInitDataInvalid,
+		},
+		{
+			name:    "tampered user",
+			raw:     strings.Replace(signInitData(values, testBotToken), "99281932", "1", 1),
+			now:     now,
+			wantErr: errInitDataInvalid,
+		},
+		{
+			name:    "no hash",
+			raw:     values.Encode(),
+			now:     now,
+			wantErr: errInitDataInvalid,
+		},
+		{
+			name:    "expired",
+			raw:     signInitData(values, testBotToken),
+			now:     now.Add(initDataMaxAge + time.Second),
+			wantErr: errInitDataExpired,
+		},
+		{
+			name: "no user",
+			raw: signInitData(url.Values{
+				"auth_date": {"1716922846"},
+			}, testBotToken),
+			now:     now,
+			wantErr: errInitDataInvalid,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := validateInitData(tt.raw, testBotToken, tt.now)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("validateInitData() error = %v, want %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("validateInitData() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,438 @@
+package bot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/go-telegram/bot"
+	"github.com/gulldan/cp2024omsk-pmsk/bot/resilient"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+
+	postgres "github.com/gulldan/cp2024omsk-pmsk/bot/postgres/generated"
+)
+
+const (
+	JobStatePending   = "pending"
+	JobStateRunning   = "running"
+	JobStateDone      = "done"
+	JobStateFailed    = "failed"
+	JobStateCancelled = "cancelled"
+	JobStateWaiting   = "waiting"
+
+	heldJobsPollInterval = 30 * time.Second
+)
+
+// enqueueJob persists a job for the transcribition and wakes up an idle worker.
+// A transcribition cancelled in the meantime is left as it is.
+func (bw *BotWrapper) enqueueJob(ctx context.Context, pgID int64, stage int) error {
+	if _, err := bw.psql.CreateJob(ctx, postgres.CreateJobParams{
+		TranscribitionID: pgID,
+		Stage:            int32(stage),
+		Status:           StatusDone,
+	}); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			bw.log.Info().Int64("id", pgID).Int("stage", stage).Msg("transcribition is finished, job not created")
+
+			return nil
+		}
+
+		return fmt.Errorf("failed to create job: %w", err)
+	}
+
+	bw.wakeWorkers(stage)
+	bw.refreshQueue(ctx, stage)
+
+	return nil
+}
+
+func (bw *BotWrapper) wakeWorkers(stage int) {
+	select {
+	case bw.jobsNotify[stage] <- struct{}{}:
+	default:
+	}
+}
+
+// refreshQueue shows every user waiting for the stage their place in the queue.
+func (bw *BotWrapper) refreshQueue(ctx context.Context, stage int) {
+	queue, err := bw.psql.GetJobQueue(ctx, int32(stage))
+	if err != nil {
+		bw.log.Error().Err(err).Int("stage", stage).Msg("get job queue failed")
+
+		return
+	}
+
+	for _, q := range queue {
+		if !bw.setQueuePosition(q.TranscribitionID, int(q.Position)) {
+			continue
+		}
+
+		if _, err := bw.b.EditMessageText(ctx, &bot.EditMessageTextParams{
+			ChatID:      q.ChatID,
+			MessageID:   int(q.MessageToEdit.Int64),
+			Text:        fmt.Sprintf(StatusMessageQueue, stageNames[stage], q.Position),
+			ReplyMarkup: bw.cancelMarkup(q.TranscribitionID),
+		}); err != nil {
+			bw.log.Error().Err(err).Int64("id", q.TranscribitionID).Msg("failed to edit queue position")
+		}
+	}
+}
+
+// setQueuePosition reports whether the position differs from the one shown before.
+func (bw *BotWrapper) setQueuePosition(pgID int64, position int) bool {
+	bw.queueMu.Lock()
+	defer bw.queueMu.Unlock()
+
+	if bw.queuePositions[pgID] == position {
+		return false
+	}
+
+	bw.queuePositions[pgID] = position
+
+	return true
+}
+
+func (bw *BotWrapper) clearQueuePosition(pgID int64) {
+	bw.queueMu.Lock()
+	defer bw.queueMu.Unlock()
+
+	delete(bw.queuePositions, pgID)
+}
+
+// resumeJobs returns jobs interrupted by a restart to the queue and creates jobs
+// for unfinished transcribitions which were uploaded before the queue existed.
+func (bw *BotWrapper) resumeJobs(ctx context.Context) error {
+	if err := bw.psql.RequeueRunningJobs(ctx); err != nil {
+		return fmt.Errorf("failed to requeue running jobs: %w", err)
+	}
+
+	trs, err := bw.psql.GetUnqueuedTranscribitions(ctx, pgtype.Int4{
+		Int32: StatusDone,
+		Valid: true,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to get unqueued transcribitions: %w", err)
+	}
+
+	for _, tr := range trs {
+		stage := resumeStage(tr)
+		bw.log.Info().Int64("id", tr.ID).Int("stage", stage).Msg("resume transcribition")
+
+		// Everything is stored, the bot stopped before the meeting was
+		// completed. No worker takes jobs of the final stage.
+		if stage == StatusDone {
+			bw.completeMeeting(ctx, tr)
+
+			continue
+		}
+
+		if err := bw.enqueueJob(ctx, tr.ID, stage); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// resumeStage picks the first stage whose result is not stored yet.
+func resumeStage(tr postgres.Transcribition) int {
+	switch {
+	case !tr.Transcription.Valid:
+		return StatusTranscription
+	case !tr.LlamaOutput.Valid:
+		return StatusNers
+	default:
+		return StatusDone
+	}
+}
+
+// runWorkers starts a separate pool per downstream service, so a slow
+// transcription does not hold back the LLM and vice versa.
+func (bw *BotWrapper) runWorkers(ctx context.Context) {
+	for stage, workers := range map[int]int{
+		StatusTranscription: bw.cfg.AsrWorkers,
+		StatusNers:          bw.cfg.LlmWorkers,
+	} {
+		for i := 0; i < workers; i++ {
+			go bw.worker(ctx, stage)
+		}
+	}
+
+	bw.reports.Run(ctx, bw.cfg.ReportWorkers)
+	go bw.runReminders(ctx)
+	go bw.runHeldJobs(ctx)
+}
+
+func (bw *BotWrapper) worker(ctx context.Context, stage int) {
+	ticker := time.NewTicker(bw.cfg.JobPollInterval)
+	defer ticker.Stop()
+
+	for {
+		// Leave the jobs in the queue while the backend of the stage is down,
+		// they are picked up again once the circuit breaker lets calls through.
+		if !bw.stageAvailable(stage) {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			continue
+		}
+
+		job, err := bw.psql.ClaimJob(ctx, postgres.ClaimJobParams{
+			Stage:  int32(stage),
+			Status: StatusDone,
+		})
+		switch {
+		case err == nil:
+			bw.clearQueuePosition(job.TranscribitionID)
+			bw.refreshQueue(ctx, stage)
+			bw.processJob(ctx, job)
+
+			continue
+		case errors.Is(err, pgx.ErrNoRows):
+		default:
+			bw.log.Error().Err(err).Msg("claim job failed")
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-bw.jobsNotify[stage]:
+		case <-ticker.C:
+		}
+	}
+}
+
+func (bw *BotWrapper) stageAvailable(stage int) bool {
+	if stage == StatusNers {
+		return bw.llama.Available()
+	}
+
+	return bw.whisper.Available()
+}
+
+// backendDown reports whether the stage failed because its backend is unavailable,
+// such a job is put back to the queue instead of failing until it runs out of attempts.
+func (bw *BotWrapper) backendDown(job postgres.Job, err error) bool {
+	if errors.Is(err, resilient.ErrCircuitOpen) {
+		return true
+	}
+
+	if int(job.Attempts) >= bw.cfg.JobMaxAttempts {
+		return false
+	}
+
+	perr := asPipelineError(int(job.Stage), err)
+
+	return perr.Code == ErrCodeWhisperUnavailable || perr.Code == ErrCodeLlamaUnavailable
+}
+
+func (bw *BotWrapper) requeueJob(ctx context.Context, job postgres.Job) {
+	bw.log.Warn().Int64("job", job.ID).Int32("stage", job.Stage).Msg("backend is down, requeue job")
+
+	if err := bw.psql.AdvanceJob(ctx, postgres.AdvanceJobParams{
+		Stage: job.Stage,
+		ID:    job.ID,
+	}); err != nil {
+		bw.log.Error().Err(err).Int64("job", job.ID).Msg("requeue job failed")
+	}
+
+	bw.refreshQueue(ctx, int(job.Stage))
+}
+
+func (bw *BotWrapper) processJob(ctx context.Context, job postgres.Job) {
+	tr, err := bw.psql.GetTranscribition(ctx, job.TranscribitionID)
+	if err != nil {
+		bw.log.Error().Err(err).Int64("job", job.ID).Msg("get transcribition failed")
+		bw.finishJob(ctx, job.ID, JobStateFailed)
+
+		return
+	}
+
+	chatID, messageID := tr.ChatID, tr.MessageToEdit.Int64
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	bw.trackJob(tr.ID, cancel)
+	defer bw.untrackJob(tr.ID)
+
+	// Cancelled between the claim and now, the status must not be overwritten.
+	if isFinished(tr.Status.Int32) {
+		bw.finishJob(ctx, job.ID, JobStateCancelled)
+
+		return
+	}
+
+	switch job.Stage {
+	case StatusTranscription:
+		bw.updateStatus(ctx, StatusTranscription, tr.ID, chatID, messageID)
+
+		if err := bw.transcribe(ctx, tr); err != nil {
+			// The job was cancelled or the bot is shutting down: leave the job
+			// as it is, a cancelled job is already marked, a running one is requeued.
+			if ctx.Err() != nil {
+				return
+			}
+
+			if bw.backendDown(job, err) {
+				bw.requeueJob(ctx, job)
+
+				return
+			}
+
+			bw.finishJob(ctx, job.ID, JobStateFailed)
+			bw.failTranscribition(ctx, tr, StatusTranscription, err)
+
+			return
+		}
+
+		// A re-diarized meeting keeps its protocol with the edits and the
+		// confirmation, only the speakers are asked again.
+		if tr.LlamaOutput.Valid {
+			bw.updateStatus(ctx, StatusDone, tr.ID, chatID, messageID)
+			bw.finishJob(ctx, job.ID, JobStateDone)
+			bw.askSpeakerNames(ctx, tr.ID)
+
+			return
+		}
+
+		bw.holdForSpeakers(ctx, job, tr)
+	case StatusNers:
+		text := renameSpeakers(tr.Transcription.String, bw.speakerNames(ctx, tr.ID))
+
+		if err := bw.llamaComplete(ctx, text, tr.ID, chatID, messageID); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+
+			if bw.backendDown(job, err) {
+				bw.requeueJob(ctx, job)
+
+				return
+			}
+
+			bw.finishJob(ctx, job.ID, JobStateFailed)
+			bw.failTranscribition(ctx, tr, StatusNers, err)
+
+			return
+		}
+
+		bw.finishJob(ctx, job.ID, JobStateDone)
+		bw.completeMeeting(ctx, tr)
+	default:
+		bw.updateStatus(ctx, StatusDone, tr.ID, chatID, messageID)
+		bw.finishJob(ctx, job.ID, JobStateDone)
+	}
+}
+
+// completeMeeting marks the processed meeting done and notifies about it. The
+// protocol is shown for review, the reminders and the default report wait
+// until it is confirmed.
+func (bw *BotWrapper) completeMeeting(ctx context.Context, tr postgres.Transcribition) {
+	bw.updateStatus(ctx, StatusDone, tr.ID, tr.ChatID, tr.MessageToEdit.Int64)
+	bw.meetingDone(ctx, tr)
+
+	if err := bw.sendProtocol(ctx, tr.ID); err != nil {
+		bw.log.Warn().Err(err).Int64("id", tr.ID).Msg("send protocol failed")
+	}
+}
+
+// holdForSpeakers moves the job to the protocol stage and keeps it there until
+// the speakers are named, so the names get into the protocol. The job is held
+// before the prompts are sent, an answer must not come before it.
+func (bw *BotWrapper) holdForSpeakers(ctx context.Context, job postgres.Job, tr postgres.Transcribition) {
+	if bw.cfg.SpeakerNamesTimeout <= 0 {
+		if err := bw.psql.AdvanceJob(ctx, postgres.AdvanceJobParams{
+			Stage: StatusNers,
+			ID:    job.ID,
+		}); err != nil {
+			bw.log.Error().Err(err).Int64("job", job.ID).Msg("advance job failed")
+		}
+
+		bw.wakeWorkers(StatusNers)
+		bw.refreshQueue(ctx, StatusNers)
+		bw.askSpeakerNames(ctx, tr.ID)
+
+		return
+	}
+
+	if err := bw.psql.HoldJob(ctx, postgres.HoldJobParams{
+		Stage: StatusNers,
+		ID:    job.ID,
+	}); err != nil {
+		bw.log.Error().Err(err).Int64("job", job.ID).Msg("hold job failed")
+	}
+
+	if bw.askSpeakerNames(ctx, tr.ID) == 0 {
+		bw.releaseJob(ctx, tr.ID)
+
+		return
+	}
+
+	if _, err := bw.b.EditMessageText(ctx, &bot.EditMessageTextParams{
+		ChatID:      tr.ChatID,
+		MessageID:   int(tr.MessageToEdit.Int64),
+		Text:        fmt.Sprintf(StatusMessageWait, fmt.Sprintf(SPEAKERS_WAIT, int(bw.cfg.SpeakerNamesTimeout.Minutes()))),
+		ReplyMarkup: bw.speakersWaitMarkup(tr.ID),
+	}); err != nil {
+		bw.log.Error().Int64("id", tr.ID).Err(err).Msg("failed to edit message")
+	}
+}
+
+// releaseJob queues the held job of the transcribition, if there is one.
+func (bw *BotWrapper) releaseJob(ctx context.Context, pgID int64) bool {
+	n, err := bw.psql.ReleaseJob(ctx, pgID)
+	if err != nil {
+		bw.log.Error().Err(err).Int64("id", pgID).Msg("release job failed")
+
+		return false
+	}
+
+	if n == 0 {
+		return false
+	}
+
+	bw.wakeWorkers(StatusNers)
+	bw.refreshQueue(ctx, StatusNers)
+
+	return true
+}
+
+// runHeldJobs releases the jobs nobody has named the speakers for in time.
+func (bw *BotWrapper) runHeldJobs(ctx context.Context) {
+	ticker := time.NewTicker(heldJobsPollInterval)
+	defer ticker.Stop()
+
+	for {
+		ids, err := bw.psql.ReleaseExpiredJobs(ctx, bw.cfg.SpeakerNamesTimeout.Seconds())
+		if err != nil {
+			bw.log.Error().Err(err).Msg("release expired jobs failed")
+		}
+
+		if len(ids) > 0 {
+			bw.log.Info().Ints64("ids", ids).Msg("speakers not named in time, release jobs")
+			bw.wakeWorkers(StatusNers)
+			bw.refreshQueue(ctx, StatusNers)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (bw *BotWrapper) finishJob(ctx context.Context, jobID int64, state string) {
+	if err := bw.psql.UpdateJobState(ctx, postgres.UpdateJobStateParams{
+		State: state,
+		ID:    jobID,
+	}); err != nil {
+		bw.log.Error().Err(err).Int64("job", jobID).Msg("update job state failed")
+	}
+}
@@ -1,15 +1,17 @@
 package bot
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
 	"net/http"
-	"net/url"
 	"time"
 
+	"github.com/gulldan/cp2024omsk-pmsk/bot/clients/llama"
+	"github.com/gulldan/cp2024omsk-pmsk/bot/clients/reporter"
+	"github.com/gulldan/cp2024omsk-pmsk/bot/resilient"
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgtype"
 
 	postgres "github.com/gulldan/cp2024omsk-pmsk/bot/postgres/generated"
@@ -23,6 +25,7 @@ const llamaSystemPrompt = `<|user|>
 Инструкции:
 1. Создание точных транскрипций, без добавления лишней информации, с указанием только ключевых тем обсуждений и задач.
 2. Распределение задач с указанием только ответственных лиц и сроков выполнения.
+   Поручения с названным сроком перечислите в errands, срок укажите в формате ГГГГ-ММ-ДД.
 3. Формирование структурированных и кратких протоколов, включающих:
    - Список участников и их роли (только тех, кто активно принимал участие).
    - Повестку дня с кратким описанием обсуждаемых вопросов.
@@ -82,6 +85,13 @@ const llamaSystemPrompt = `<|user|>
           ]
         }
       ],
+      "errands": [
+        {
+          "assignee": "SPEAKER_01",
+          "context": "Подготовить предложения по защите экономики",
+          "deadline": "2024-09-14"
+        }
+      ],
       "audio_times": [
         {
           "start": 0,
@@ -222,77 +232,38 @@ type ReportedRequest struct {
 	DocumentType string `json:"document_type"`
 	Password     string `json:"password"`
 	Data         struct {
-		Date         time.Time `json:"date"`
-		Time         string    `json:"time"`
-		Duration     string    `json:"duration"`
-		Participants []string  `json:"participants"`
-		Agenda       []string  `json:"agenda"`
-		Blocks       []struct {
-			NameBlock string `json:"name_block"`
-			Proposals []struct {
-				Text      string `json:"text"`
-				Context   string `json:"context"`
-				AudioTime struct {
-					Start string `json:"start"`
-					End   string `json:"end"`
-				} `json:"audio_time"`
-			} `json:"proposals"`
-		} `json:"blocks"`
-		AudioTimes []struct {
-			Start string `json:"start"`
-			End   string `json:"end"`
-		} `json:"audio_times"`
+		Date         time.Time       `json:"date"`
+		Time         string          `json:"time"`
+		Duration     string          `json:"duration"`
+		Participants []string        `json:"participants"`
+		Agenda       []string        `json:"agenda"`
+		Blocks       []ReportedBlock `json:"blocks"`
+		// Errands keep the deadline as a string, a date the LLM got wrong must not break the protocol.
+		Errands    []ReportedErrand `json:"errands"`
+		AudioTimes []ReportedTime   `json:"audio_times"`
 	} `json:"data"`
 }
 
-type CompletionResp struct {
-	Content            string `json:"content"`
-	GenerationSettings struct {
-		FrequencyPenalty float64       `json:"frequency_penalty"`
-		IgnoreEos        bool          `json:"ignore_eos"`
-		LogitBias        []interface{} `json:"logit_bias"`
-		Mirostat         int           `json:"mirostat"`
-		MirostatEta      float64       `json:"mirostat_eta"`
-		MirostatTau      float64       `json:"mirostat_tau"`
-		Model            string        `json:"model"`
-		NCtx             int           `json:"n_ctx"`
-		NKeep            int           `json:"n_keep"`
-		NPredict         int           `json:"n_predict"`
-		NProbs           int           `json:"n_probs"`
-		PenalizeNl       bool          `json:"penalize_nl"`
-		PresencePenalty  float64       `json:"presence_penalty"`
-		RepeatLastN      int           `json:"repeat_last_n"`
-		RepeatPenalty    float64       `json:"repeat_penalty"`
-		Seed             int64         `json:"seed"`
-		Stop             []interface{} `json:"stop"`
-		Stream           bool          `json:"stream"`
-		Temp             float64       `json:"temp"`
-		TfsZ             float64       `json:"tfs_z"`
-		TopK             int           `json:"top_k"`
-		TopP             float64       `json:"top_p"`
-		TypicalP         float64       `json:"typical_p"`
-	} `json:"generation_settings"`
-	Model        string `json:"model"`
-	Prompt       string `json:"prompt"`
-	Stop         bool   `json:"stop"`
-	StoppedEos   bool   `json:"stopped_eos"`
-	StoppedLimit bool   `json:"stopped_limit"`
-	StoppedWord  bool   `json:"stopped_word"`
-	StoppingWord string `json:"stopping_word"`
-	Timings      struct {
-		PredictedMs         float64     `json:"predicted_ms"`
-		PredictedN          int         `json:"predicted_n"`
-		PredictedPerSecond  float64     `json:"predicted_per_second"`
-		PredictedPerTokenMs float64     `json:"predicted_per_token_ms"`
-		PromptMs            float64     `json:"prompt_ms"`
-		PromptN             int         `json:"prompt_n"`
-		PromptPerSecond     interface{} `json:"prompt_per_second"`
-		PromptPerTokenMs    float64     `json:"prompt_per_token_ms"`
-	} `json:"timings"`
-	TokensCached    int  `json:"tokens_cached"`
-	TokensEvaluated int  `json:"tokens_evaluated"`
-	TokensPredicted int  `json:"tokens_predicted"`
-	Truncated       bool `json:"truncated"`
+type ReportedBlock struct {
+	NameBlock string             `json:"name_block"`
+	Proposals []ReportedProposal `json:"proposals"`
+}
+
+type ReportedProposal struct {
+	Text      string       `json:"text"`
+	Context   string       `json:"context"`
+	AudioTime ReportedTime `json:"audio_time"`
+}
+
+type ReportedErrand struct {
+	Assignee string `json:"assignee"`
+	Context  string `json:"context"`
+	Deadline string `json:"deadline"`
+}
+
+type ReportedTime struct {
+	Start string `json:"start"`
+	End   string `json:"end"`
 }
 
 const TestResponse = `{
@@ -402,42 +373,20 @@ const TestResponse = `{
     }
   }`
 
-type CompletionReq struct {
-	Temperature      float64  `json:"temperature,omitempty"`
-	TopK             int      `json:"top_k,omitempty"`
-	TopP             float64  `json:"top_p,omitempty"`
-	NPredict         int      `json:"n_predict,omitempty"`
-	NKeep            int      `json:"n_keep,omitempty"`
-	Stream           bool     `json:"stream,omitempty"`
-	Prompt           string   `json:"prompt,omitempty"`
-	Stop             []string `json:"stop,omitempty"`
-	TfsZ             float64  `json:"tfs_z,omitempty"`
-	TypicalP         float64  `json:"typical_p,omitempty"`
-	RepeatPenalty    float64  `json:"repeat_penalty,omitempty"`
-	RepeatLastN      int      `json:"repeat_last_n,omitempty"`
-	PenalizeNl       bool     `json:"penalize_nl,omitempty"`
-	PrecensePenalty  float64  `json:"precence_penalty,omitempty"`
-	FrequencyPenalty float64  `json:"frequency_penalty,omitempty"`
-	Mirostat         int      `json:"mirostat,omitempty"`
-	MirostatTAU      float64  `json:"mirostat_tau,omitempty"`
-	MirostatETA      float64  `json:"mirostat_eta,omitempty"`
-	Seed             int      `json:"seed,omitempty"`
-	IgnoreEOS        bool     `json:"ignore_eos,omitempty"`
-}
-
-func (bw *BotWrapper) llamaComplete(ctx context.Context, text string, pgID, chatID, messageID int64) {
+func (bw *BotWrapper) llamaComplete(ctx context.Context, text string, pgID, chatID, messageID int64) error {
 	bw.updateStatus(ctx, StatusNers, pgID, chatID, messageID)
 
-	body, err := bw.llamaRequest(context.Background(), CompletionReq{
+	resp, err := bw.llama.Completion(ctx, llama.CompletionRequest{
 		Prompt: llamaSystemPrompt + " - " + text,
-	}, "/completion")
+	})
 	if err != nil {
-		bw.log.Error().Err(err).Msg("failed to make completeion req")
-
-		return
+		return stageError(StatusNers, ErrCodeLlamaUnavailable, fmt.Errorf("failed to make completion req: %w", err))
 	}
 
-	fmt.Println(string(body))
+	body, err := json.Marshal(resp)
+	if err != nil {
+		return stageError(StatusNers, ErrCodeInternal, fmt.Errorf("failed to marshal completion: %w", err))
+	}
 
 	if err := bw.psql.UpdateLlamaOutput(ctx, postgres.UpdateLlamaOutputParams{
 		LlamaOutput: pgtype.Text{
@@ -446,145 +395,206 @@ func (bw *BotWrapper) llamaComplete(ctx context.Context, text string, pgID, chat
 		},
 		ID: pgID,
 	}); err != nil {
-		bw.log.Error().Err(err).Msg("failed to update llama output")
+		return stageError(StatusNers, ErrCodeStorage, fmt.Errorf("failed to update llama output: %w", err))
+	}
 
-		return
+	// The generated protocol is the first version, the edits of the users follow it.
+	if _, err := bw.psql.CreateProtocolVersion(ctx, postgres.CreateProtocolVersionParams{
+		TranscribitionID: pgID,
+		Content:          resp.Content,
+	}); err != nil {
+		return stageError(StatusNers, ErrCodeStorage, fmt.Errorf("failed to create protocol version: %w", err))
 	}
-}
 
-func (bw *BotWrapper) llamaRequest(ctx context.Context, req interface{}, handler string) ([]byte, error) {
-	bt, err := json.Marshal(req)
-	if err != nil {
-		return nil, err
+	// The protocol is validated when the report is made, a broken one just leaves the meeting unnamed.
+	var p ReportedRequest
+	if err := json.Unmarshal([]byte(resp.Content), &p); err == nil {
+		bw.saveGeneratedTitle(ctx, pgID, p.NameReport)
 	}
 
-	b := bytes.NewBuffer(bt)
+	return nil
+}
 
-	r, err := http.NewRequestWithContext(ctx, "POST", bw.cfg.LlamaAddr+handler, b)
+// protocol extracts the latest protocol of the transcribition for the reports.
+// Speakers named after the LLM has run are renamed in the protocol as well.
+func (bw *BotWrapper) protocol(ctx context.Context, pgID int64) (ReportedRequest, error) {
+	tr, err := bw.psql.GetTranscribition(ctx, pgID)
 	if err != nil {
-		return nil, err
+		return ReportedRequest{}, stageError(StatusReport, ErrCodeStorage, fmt.Errorf("failed to get transcribition: %w", err))
 	}
 
-	resp, err := http.DefaultClient.Do(r)
+	reportedReq, _, err := bw.protocolVersion(ctx, tr, bw.speakerNames(ctx, pgID))
 	if err != nil {
-		return nil, err
+		return ReportedRequest{}, err
 	}
 
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
+	// The title and the start given by the user are more reliable than the guesses of the LLM.
+	if tr.Title.Valid {
+		reportedReq.NameReport = tr.Title.String
+	}
+	if tr.StartedAt.Valid {
+		reportedReq.Data.Date = tr.StartedAt.Time
+		reportedReq.Data.Time = tr.StartedAt.Time.Format("15:04")
 	}
 
-	resp.Body.Close()
-
-	return body, nil
+	return reportedReq, nil
 }
 
-func (bw *BotWrapper) officialReport(ctx context.Context, pgID, chatID int64, reportType string) ([]byte, error) {
-	tr, err := bw.psql.GetTranscribition(ctx, pgID)
-	if err != nil {
-		bw.log.Error().Err(err).Int64("chatID", chatID).Msg("failed to get transcribition")
-
-		return nil, err
+// protocolVersion decodes the latest version of the protocol with the speakers
+// renamed. The meetings processed before the versions were kept have only the
+// output of the LLM, it is version 0.
+func (bw *BotWrapper) protocolVersion(ctx context.Context, tr postgres.Transcribition, names map[string]string) (ReportedRequest, int32, error) {
+	var content string
+	var version int32
+
+	v, err := bw.psql.GetLatestProtocolVersion(ctx, tr.ID)
+	switch {
+	case err == nil:
+		content, version = v.Content, v.Version
+	case errors.Is(err, pgx.ErrNoRows):
+		var compResp llama.CompletionResponse
+		if err := json.Unmarshal([]byte(tr.LlamaOutput.String), &compResp); err != nil {
+			return ReportedRequest{}, 0, stageError(StatusReport, ErrCodeReportBadInput, fmt.Errorf("unmarshal llama output failed: %w", err))
+		}
+
+		content = compResp.Content
+	default:
+		return ReportedRequest{}, 0, stageError(StatusReport, ErrCodeStorage, fmt.Errorf("failed to get protocol version: %w", err))
 	}
 
-	var compResp CompletionResp
+	var reportedReq ReportedRequest
+	if err := json.Unmarshal([]byte(renameSpeakers(content, names)), &reportedReq); err != nil {
+		return ReportedRequest{}, 0, stageError(StatusReport, ErrCodeReportBadInput, fmt.Errorf("unmarshal protocol failed: %w", err))
+	}
 
-	if err := json.Unmarshal([]byte(tr.LlamaOutput.String), &compResp); err != nil {
-		bw.log.Error().Err(err).Int64("chatID", chatID).Msg("unmarshal json response failed")
+	return reportedReq, version, nil
+}
 
-		return nil, err
+// reportError tells a protocol the reporter refused to render from a reporter
+// which is down, the first can't be fixed by asking again.
+func reportError(err error) error {
+	var serr *resilient.StatusError
+	if errors.As(err, &serr) && serr.Code >= http.StatusBadRequest && serr.Code < http.StatusInternalServerError &&
+		serr.Code != http.StatusTooManyRequests {
+		return stageError(StatusReport, ErrCodeReportBadInput, err)
 	}
 
-	var reportedReq ReportedRequest
-	if err := json.Unmarshal([]byte(compResp.Content), &reportedReq); err != nil {
-		bw.log.Error().Err(err).Int64("chatID", chatID).Msg("unmarshal json response failed")
+	return stageError(StatusReport, ErrCodeReportUnavailable, err)
+}
 
+func (bw *BotWrapper) officialReport(ctx context.Context, pgID, chatID int64, reportType string) ([]byte, error) {
+	p, err := bw.protocol(ctx, pgID)
+	if err != nil {
 		return nil, err
 	}
 
-	bytesResp, err := json.Marshal(reportedReq)
+	b, err := bw.reporter.Official(ctx, p.official(reporter.DocumentType(reportType)))
 	if err != nil {
-		bw.log.Error().Err(err).Int64("chatID", chatID).Msg("unmarshal json marshal failed")
-
-		return nil, err
+		return nil, reportError(fmt.Errorf("official report failed: %w", err))
 	}
 
-	buf := bytes.NewBuffer(bytesResp)
+	return b, nil
+}
 
-	llama, _ := url.Parse(bw.cfg.ReporterAddr + "/reports/official")
-	newReq, err := http.NewRequest(http.MethodPost, llama.String(), buf)
+func (bw *BotWrapper) unofficialReport(ctx context.Context, pgID, chatID int64, reportType string) ([]byte, error) {
+	p, err := bw.protocol(ctx, pgID)
 	if err != nil {
-		bw.log.Error().Err(err).Int64("chatID", chatID).Msg("get report failed")
-
 		return nil, err
 	}
 
-	resp, err := http.DefaultClient.Do(newReq)
+	b, err := bw.reporter.Unofficial(ctx, p.unofficial(reporter.DocumentType(reportType)))
 	if err != nil {
-		bw.log.Error().Err(err).Int64("chatID", chatID).Msg("request failed")
-
-		return nil, err
+		return nil, reportError(fmt.Errorf("unofficial report failed: %w", err))
 	}
 
-	b, err := io.ReadAll(resp.Body)
-	if err != nil {
-		bw.log.Error().Err(err).Int64("chatID", chatID).Msg("read body failed")
+	return b, nil
+}
 
-		return nil, err
+func (r ReportedRequest) blocks() []reporter.Block {
+	blocks := make([]reporter.Block, 0, len(r.Data.Blocks))
+	for _, b := range r.Data.Blocks {
+		block := reporter.Block{NameBlock: b.NameBlock}
+		for _, p := range b.Proposals {
+			block.Proposals = append(block.Proposals, reporter.Proposal{
+				Text:    p.Text,
+				Context: p.Context,
+				AudioTime: reporter.TimeInAudio{
+					Start: p.AudioTime.Start,
+					End:   p.AudioTime.End,
+				},
+			})
+		}
+		blocks = append(blocks, block)
 	}
-	resp.Body.Close()
 
-	return b, nil
+	return blocks
 }
 
-func (bw *BotWrapper) unofficialReport(ctx context.Context, pgID, chatID int64, reportType string) ([]byte, error) {
-	tr, err := bw.psql.GetTranscribition(ctx, pgID)
-	if err != nil {
-		bw.log.Error().Err(err).Int64("chatID", chatID).Msg("failed to get transcribition")
-
-		return nil, err
+func (r ReportedRequest) errands() *reporter.ErrandProtocol {
+	if len(r.Data.Errands) == 0 {
+		return nil
 	}
 
-	var llamaResp CompletionResp
+	errands := make([]reporter.Errand, 0, len(r.Data.Errands))
+	for _, e := range r.Data.Errands {
+		errand := reporter.Errand{
+			Assignee: optional(e.Assignee),
+			Context:  optional(e.Context),
+		}
 
-	if err := json.Unmarshal([]byte(tr.LlamaOutput.String), &llamaResp); err != nil {
-		bw.log.Error().Err(err).Int64("chatID", chatID).Msg("unmarshal json response failed")
+		if deadline, ok := parseDeadline(e.Deadline); ok {
+			errand.Deadline = &deadline
+		}
 
-		return nil, err
+		errands = append(errands, errand)
 	}
 
-	bytesResp, err := json.Marshal(llamaResp)
-	if err != nil {
-		bw.log.Error().Err(err).Int64("chatID", chatID).Msg("unmarshal json marshal failed")
+	return &reporter.ErrandProtocol{ListErrands: errands}
+}
 
-		return nil, err
+func (r ReportedRequest) official(format reporter.DocumentType) reporter.OfficialRequest {
+	date := r.Data.Date
+
+	return reporter.OfficialRequest{
+		NameReport:   r.NameReport,
+		DocumentType: format,
+		Data: reporter.OfficialProtocol{
+			Date:           &date,
+			Time:           optional(r.Data.Time),
+			Attendees:      r.Data.Participants,
+			Blocks:         r.blocks(),
+			ErrandProtocol: r.errands(),
+		},
 	}
+}
 
-	buf := bytes.NewBuffer(bytesResp)
+func (r ReportedRequest) unofficial(format reporter.DocumentType) reporter.UnofficialRequest {
+	date := r.Data.Date
 
-	llama, _ := url.Parse(bw.cfg.ReporterAddr + "/reports/unofficial")
-	newReq, err := http.NewRequest(http.MethodPost, llama.String(), buf)
-	if err != nil {
-		bw.log.Error().Err(err).Int64("chatID", chatID).Msg("get report failed")
-
-		return nil, err
+	audioTimes := make([]reporter.TimeInAudio, 0, len(r.Data.AudioTimes))
+	for _, t := range r.Data.AudioTimes {
+		audioTimes = append(audioTimes, reporter.TimeInAudio{Start: t.Start, End: t.End})
 	}
 
-	resp, err := http.DefaultClient.Do(newReq)
-	if err != nil {
-		bw.log.Error().Err(err).Int64("chatID", chatID).Msg("request failed")
-
-		return nil, err
+	return reporter.UnofficialRequest{
+		NameReport:   r.NameReport,
+		DocumentType: format,
+		Data: reporter.UnofficialProtocol{
+			Date:         &date,
+			Time:         optional(r.Data.Time),
+			Duration:     optional(r.Data.Duration),
+			Participants: r.Data.Participants,
+			Agenda:       r.Data.Agenda,
+			Blocks:       r.blocks(),
+			AudioTimes:   audioTimes,
+		},
 	}
+}
 
-	b, err := io.ReadAll(resp.Body)
-	if err != nil {
-		bw.log.Error().Err(err).Int64("chatID", chatID).Msg("read body failed")
-
-		return nil, err
+func optional(s string) *string {
+	if s == "" {
+		return nil
 	}
-	resp.Body.Close()
 
-	return b, nil
+	return &s
 }
@@ -0,0 +1,32 @@
+package bot
+
+import (
+	"github.com/go-telegram/bot/models"
+)
+
+// telegramDownloadLimit is the largest file the Bot API lets bots download.
+const telegramDownloadLimit = 20 << 20
+
+// telegramUploadLimit is the largest file the Bot API lets bots send.
+const telegramUploadLimit = 50 << 20
+
+// attachment picks the recording from the message: audio, voice, video,
+// round video note or a file sent as a document.
+// The declared mime type is only a hint, the format is detected from the content.
+func attachment(msg *models.Message) (fileID, mimeType string, size int64) {
+	switch {
+	case msg.Audio != nil:
+		return msg.Audio.FileID, msg.Audio.MimeType, msg.Audio.FileSize
+	case msg.Voice != nil:
+		return msg.Voice.FileID, msg.Voice.MimeType, msg.Voice.FileSize
+	case msg.Video != nil:
+		return msg.Video.FileID, msg.Video.MimeType, msg.Video.FileSize
+	case msg.VideoNote != nil:
+		// Video notes are always mp4 and come without a mime type.
+		return msg.VideoNote.FileID, "video/mp4", int64(msg.VideoNote.FileSize)
+	case msg.Document != nil:
+		return msg.Document.FileID, msg.Document.MimeType, msg.Document.FileSize
+	default:
+		return "", "", 0
+	}
+}
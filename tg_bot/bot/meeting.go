@@ -0,0 +1,301 @@
+package bot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+
+	postgres "github.com/gulldan/cp2024omsk-pmsk/bot/postgres/generated"
+)
+
+const (
+	RENAME   = "/rename"
+	DESCRIBE = "/describe"
+	TAGS     = "/tags"
+	DATE     = "/date"
+
+	RENAME_USAGE   = "Укажите название встречи: /rename Планерка отдела продаж. Чтобы переименовать конкретную встречу, ответьте на ее статусное сообщение."
+	DESCRIBE_USAGE = "Укажите описание встречи: /describe Обсуждение бюджета на квартал."
+	TAGS_USAGE     = "Укажите теги через пробел или запятую: /tags бюджет продажи. Пустая команда удаляет теги."
+	DATE_USAGE     = "Укажите время начала встречи: /date 02.01.2006 15:04"
+	MEETING_SAVED  = "Сохранено: %s"
+	NO_MEETING     = "В этом чате пока нет встреч."
+
+	meetingTimeLayout = "02.01.2006 15:04"
+	// maxTitleLength keeps the title readable on the buttons of /history.
+	maxTitleLength = 100
+)
+
+var meetingDatePattern = regexp.MustCompile(`\b(\d{2}\.\d{2}\.\d{4})(?:\s+(\d{1,2}:\d{2}))?`)
+
+// meetingName is the title of the meeting or the time it started when it has none.
+func meetingName(tr postgres.Transcribition) string {
+	if tr.Title.Valid {
+		return tr.Title.String
+	}
+
+	return "Совещание от " + meetingTime(tr).Format(meetingTimeLayout)
+}
+
+// meetingTime is the start of the meeting given by the user, otherwise the upload time.
+func meetingTime(tr postgres.Transcribition) time.Time {
+	if tr.StartedAt.Valid {
+		return tr.StartedAt.Time
+	}
+
+	return tr.CreatedAt.Time
+}
+
+// meetingInfo describes the meeting for its detail view.
+func meetingInfo(tr postgres.Transcribition) string {
+	lines := []string{meetingName(tr)}
+
+	if tr.StartedAt.Valid {
+		lines = append(lines, "Начало: "+tr.StartedAt.Time.Format(meetingTimeLayout))
+	}
+	if tr.Description.Valid {
+		lines = append(lines, tr.Description.String)
+	}
+	if len(tr.Tags) > 0 {
+		lines = append(lines, hashtags(tr.Tags))
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+func hashtags(tags []string) string {
+	out := make([]string, len(tags))
+	for i, t := range tags {
+		out[i] = "#" + t
+	}
+
+	return strings.Join(out, " ")
+}
+
+func optionalText(s string) pgtype.Text {
+	return pgtype.Text{String: s, Valid: s != ""}
+}
+
+// shortTitle cuts the title to maxTitleLength runes.
+func shortTitle(s string) string {
+	s = strings.TrimSpace(s)
+	if r := []rune(s); len(r) > maxTitleLength {
+		return strings.TrimSpace(string(r[:maxTitleLength-1])) + "…"
+	}
+
+	return s
+}
+
+// parseTags splits the tags by spaces and commas, the # sign is optional.
+func parseTags(text string) []string {
+	tags := []string{}
+	seen := make(map[string]bool)
+
+	for _, f := range strings.FieldsFunc(text, func(r rune) bool { return r == ',' || r == ' ' || r == '\n' }) {
+		tag := strings.ToLower(strings.TrimLeft(f, "#"))
+		if tag == "" || seen[tag] {
+			continue
+		}
+
+		seen[tag] = true
+		tags = append(tags, tag)
+	}
+
+	return tags
+}
+
+// parseMeetingTime reads dd.mm.yyyy [hh:mm] in the local time of the bot.
+func parseMeetingTime(text string) (time.Time, bool) {
+	m := meetingDatePattern.FindStringSubmatch(text)
+	if m == nil {
+		return time.Time{}, false
+	}
+
+	value, layout := m[1], "02.01.2006"
+	if m[2] != "" {
+		value, layout = m[1]+" "+m[2], "02.01.2006 15:04"
+	}
+
+	t, err := time.ParseInLocation(layout, value, time.Local)
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	return t, true
+}
+
+// captionInfo reads the meeting info from the caption of the recording: the
+// first line is the title, the rest is the description, #hashtags are tags and
+// a dd.mm.yyyy hh:mm date is the start of the meeting.
+func captionInfo(caption string) (postgres.UpdateMeetingInfoParams, bool) {
+	var params postgres.UpdateMeetingInfoParams
+
+	var words []string
+	var tags []string
+	for _, line := range strings.Split(caption, "\n") {
+		var kept []string
+		for _, w := range strings.Fields(line) {
+			if strings.HasPrefix(w, "#") && len(w) > 1 {
+				tags = append(tags, w)
+			} else {
+				kept = append(kept, w)
+			}
+		}
+
+		words = append(words, strings.Join(kept, " "))
+	}
+
+	params.Tags = parseTags(strings.Join(tags, " "))
+
+	lines := strings.Split(strings.TrimSpace(strings.Join(words, "\n")), "\n")
+	params.Title = optionalText(shortTitle(lines[0]))
+	params.Description = optionalText(strings.TrimSpace(strings.Join(lines[1:], "\n")))
+
+	if t, ok := parseMeetingTime(caption); ok {
+		params.StartedAt = pgtype.Timestamp{Time: t, Valid: true}
+	}
+
+	return params, params.Title.Valid || params.Description.Valid || len(params.Tags) > 0 || params.StartedAt.Valid
+}
+
+// saveCaptionInfo stores the meeting info given in the caption of the recording.
+func (bw *BotWrapper) saveCaptionInfo(ctx context.Context, pgID int64, caption string) {
+	params, ok := captionInfo(caption)
+	if !ok {
+		return
+	}
+
+	params.ID = pgID
+	if err := bw.psql.UpdateMeetingInfo(ctx, params); err != nil {
+		bw.log.Error().Err(err).Int64("id", pgID).Msg("update meeting info failed")
+	}
+}
+
+// saveGeneratedTitle names the meeting after the report generated by the LLM,
+// unless it was already named.
+func (bw *BotWrapper) saveGeneratedTitle(ctx context.Context, pgID int64, name string) {
+	if name = shortTitle(name); name == "" {
+		return
+	}
+
+	if err := bw.psql.SetGeneratedTitle(ctx, postgres.SetGeneratedTitleParams{
+		Title: optionalText(name),
+		ID:    pgID,
+	}); err != nil {
+		bw.log.Error().Err(err).Int64("id", pgID).Msg("set generated title failed")
+	}
+}
+
+// chatMeeting finds the meeting whose status message the message replies to,
+// otherwise the last meeting of the chat.
+func (bw *BotWrapper) chatMeeting(ctx context.Context, msg *models.Message) (postgres.Transcribition, error) {
+	tr, err := bw.statusMessageMeeting(ctx, msg)
+	if !errors.Is(err, pgx.ErrNoRows) {
+		return tr, err
+	}
+
+	trs, err := bw.psql.GetChatTranscribitions(ctx, postgres.GetChatTranscribitionsParams{
+		ChatID: msg.Chat.ID,
+		Limit:  1,
+	})
+	if err != nil {
+		return postgres.Transcribition{}, err
+	}
+
+	if len(trs) == 0 {
+		return postgres.Transcribition{}, pgx.ErrNoRows
+	}
+
+	return trs[0], nil
+}
+
+// meetingInfoEditor changes a field of the meeting info from the command argument.
+type meetingInfoEditor func(params *postgres.UpdateMeetingInfoParams, arg string) bool
+
+func editTitle(params *postgres.UpdateMeetingInfoParams, arg string) bool {
+	params.Title = optionalText(shortTitle(arg))
+
+	return params.Title.Valid
+}
+
+func editDescription(params *postgres.UpdateMeetingInfoParams, arg string) bool {
+	params.Description = optionalText(arg)
+
+	return params.Description.Valid
+}
+
+func editTags(params *postgres.UpdateMeetingInfoParams, arg string) bool {
+	params.Tags = parseTags(arg)
+
+	return true
+}
+
+func editStartedAt(params *postgres.UpdateMeetingInfoParams, arg string) bool {
+	t, ok := parseMeetingTime(arg)
+	params.StartedAt = pgtype.Timestamp{Time: t, Valid: ok}
+
+	return ok
+}
+
+// meetingInfoHandler returns the handler of a command editing the meeting the
+// command replies to or the last meeting of the chat.
+func (bw *BotWrapper) meetingInfoHandler(command, usage string, edit meetingInfoEditor) bot.HandlerFunc {
+	return func(ctx context.Context, b *bot.Bot, update *models.Update) {
+		reply := func(text string) {
+			if _, err := b.SendMessage(ctx, &bot.SendMessageParams{
+				ChatID:          update.Message.Chat.ID,
+				MessageThreadID: threadID(update.Message),
+				Text:            text,
+			}); err != nil {
+				bw.log.Error().Err(err).Msg("send meeting info message failed")
+			}
+		}
+
+		tr, err := bw.chatMeeting(ctx, update.Message)
+		if err != nil {
+			if !errors.Is(err, pgx.ErrNoRows) {
+				bw.log.Error().Err(err).Int64("chatID", update.Message.Chat.ID).Msg("get meeting failed")
+			}
+
+			reply(NO_MEETING)
+
+			return
+		}
+
+		params := postgres.UpdateMeetingInfoParams{
+			Title:       tr.Title,
+			Description: tr.Description,
+			Tags:        tr.Tags,
+			StartedAt:   tr.StartedAt,
+			ID:          tr.ID,
+		}
+
+		if !edit(&params, bw.stripMention(strings.TrimPrefix(update.Message.Text, command))) {
+			reply(usage)
+
+			return
+		}
+
+		if params.Tags == nil {
+			params.Tags = []string{}
+		}
+
+		if err := bw.psql.UpdateMeetingInfo(ctx, params); err != nil {
+			bw.log.Error().Err(err).Int64("id", tr.ID).Msg("update meeting info failed")
+			reply("Не удалось сохранить изменения.")
+
+			return
+		}
+
+		tr.Title, tr.Description, tr.Tags, tr.StartedAt = params.Title, params.Description, params.Tags, params.StartedAt
+		reply(fmt.Sprintf(MEETING_SAVED, meetingInfo(tr)))
+	}
+}
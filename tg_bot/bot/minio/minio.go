@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"time"
 
 	"github.com/gulldan/cp2024omsk-pmsk/config"
 	"github.com/minio/minio-go/v7/pkg/credentials"
@@ -67,7 +68,13 @@ func (s *MinioClient) GetAudioBucket() string {
 	return "audio"
 }
 
-func (s *MinioClient) DownloadFile(ctx context.Context, objectName, bucketName string) (io.Reader, error) {
+// GetOriginalBucket holds the recordings as they were sent, e.g. videos the audio was extracted from.
+func (s *MinioClient) GetOriginalBucket() string {
+	return "original"
+}
+
+// DownloadFile opens the object for reading, the caller closes it.
+func (s *MinioClient) DownloadFile(ctx context.Context, objectName, bucketName string) (io.ReadCloser, error) {
 	reader, err := s.client.GetObject(ctx, bucketName, objectName, minio.GetObjectOptions{})
 	if err != nil {
 		return nil, fmt.Errorf("failed to get object from s3: %w", err)
@@ -75,3 +82,31 @@ func (s *MinioClient) DownloadFile(ctx context.Context, objectName, bucketName s
 
 	return reader, nil
 }
+
+// FileSize returns the size of the object in bytes.
+func (s *MinioClient) FileSize(ctx context.Context, objectName, bucketName string) (int64, error) {
+	info, err := s.client.StatObject(ctx, bucketName, objectName, minio.StatObjectOptions{})
+	if err != nil {
+		return 0, fmt.Errorf("failed to stat object in s3: %w", err)
+	}
+
+	return info.Size, nil
+}
+
+// PresignedURL lets tools which can't use the client, e.g. ffmpeg, read the object.
+func (s *MinioClient) PresignedURL(ctx context.Context, objectName, bucketName string, expires time.Duration) (string, error) {
+	u, err := s.client.PresignedGetObject(ctx, bucketName, objectName, expires, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to presign object in s3: %w", err)
+	}
+
+	return u.String(), nil
+}
+
+func (s *MinioClient) RemoveFile(ctx context.Context, objectName, bucketName string) error {
+	if err := s.client.RemoveObject(ctx, bucketName, objectName, minio.RemoveObjectOptions{}); err != nil {
+		return fmt.Errorf("failed to remove object from s3: %w", err)
+	}
+
+	return nil
+}
@@ -7,12 +7,18 @@ const (
 	StatusReport
 	StatusDone
 	StatusFailed
+	StatusCancelled
 )
 
 const (
 	START                   = "/start"
-	START_TEXT              = "Здравствуйте. Для начала работы загрузите аудиофайл."
-	NO_AUDIO_ATTACHED       = "Ошибка. Загрузите аудиофайл."
-	NOT_SUPPORTED_TYPE      = "Ошибка. Загрузите аудиофайл формата: mp3, ogg или wav."
+	START_TEXT              = "Здравствуйте. Для начала работы загрузите аудио- или видеозапись встречи."
+	NO_AUDIO_ATTACHED       = "Ошибка. Загрузите аудио- или видеофайл."
+	NOT_SUPPORTED_TYPE      = "Ошибка. Формат файла не поддерживается. Загрузите аудиозапись (mp3, wav, ogg, opus, m4a, aac, flac, amr) или видео (mp4, mov, mkv, webm, avi)."
 	FAILED_TO_DOWNLOAD_FILE = "Ошибка. Не получилось загрузить файл. Повторите попытку."
+	FAILED_TO_EXTRACT_AUDIO = "Ошибка. Не получилось извлечь звук из файла."
+	FILE_TOO_LARGE          = "Ошибка. Telegram позволяет ботам скачивать файлы размером до 20 МБ. Отправьте ссылку на запись командой /url."
+	CANCEL                  = "/cancel"
+	NOTHING_TO_CANCEL       = "Нет встречи в обработке."
+	CANCELLED               = "Обработка отменена."
 )
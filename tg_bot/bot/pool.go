@@ -0,0 +1,128 @@
+package bot
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+type poolTask func(ctx context.Context)
+
+// fairPool runs tasks with bounded concurrency. Tasks are taken round-robin
+// between users, so one user submitting many tasks does not starve the others.
+type fairPool struct {
+	mu     sync.Mutex
+	idle   int
+	order  []int64
+	queues map[int64][]poolTask
+	notify chan struct{}
+	// gate pauses the workers while it returns false, e.g. while the backend is down.
+	gate func() bool
+}
+
+func newFairPool() *fairPool {
+	return &fairPool{
+		queues: make(map[int64][]poolTask),
+		notify: make(chan struct{}, 1),
+	}
+}
+
+// Submit queues the task and returns its position among waiting tasks,
+// zero means that an idle worker picks it up right away.
+func (p *fairPool) Submit(user int64, task poolTask) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.queues[user]) == 0 {
+		p.order = append(p.order, user)
+	}
+	p.queues[user] = append(p.queues[user], task)
+
+	// Every other user gets at most as many turns before this task as this
+	// user has tasks queued.
+	rank := len(p.queues[user])
+	position := rank
+	for u, q := range p.queues {
+		if u != user {
+			position += min(len(q), rank)
+		}
+	}
+
+	select {
+	case p.notify <- struct{}{}:
+	default:
+	}
+
+	if position <= p.idle {
+		return 0
+	}
+
+	return position - p.idle
+}
+
+func (p *fairPool) next() (poolTask, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.order) == 0 {
+		return nil, false
+	}
+
+	user := p.order[0]
+	p.order = p.order[1:]
+
+	task := p.queues[user][0]
+	p.queues[user] = p.queues[user][1:]
+
+	if len(p.queues[user]) == 0 {
+		delete(p.queues, user)
+	} else {
+		p.order = append(p.order, user)
+	}
+
+	p.idle--
+
+	// Wake up another worker while there is work left.
+	if len(p.order) > 0 {
+		select {
+		case p.notify <- struct{}{}:
+		default:
+		}
+	}
+
+	return task, true
+}
+
+func (p *fairPool) Run(ctx context.Context, workers int) {
+	p.mu.Lock()
+	p.idle += workers
+	p.mu.Unlock()
+
+	for i := 0; i < workers; i++ {
+		go p.worker(ctx)
+	}
+}
+
+func (p *fairPool) worker(ctx context.Context) {
+	for {
+		for p.gate == nil || p.gate() {
+			task, ok := p.next()
+			if !ok {
+				break
+			}
+
+			task(ctx)
+
+			p.mu.Lock()
+			p.idle++
+			p.mu.Unlock()
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-p.notify:
+		case <-time.After(time.Second):
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package bot
+
+import (
+	"context"
+	"slices"
+	"testing"
+)
+
+func TestFairPoolSubmit(t *testing.T) {
+	tests := []struct {
+		name  string
+		idle  int
+		users []int64
+		want  []int
+	}{
+		{
+			name:  "idle workers take the tasks right away",
+			idle:  2,
+			users: []int64{1, 2, 1},
+			want:  []int{0, 0, 1},
+		},
+		{
+			name:  "one user queues behind itself",
+			users: []int64{1, 1, 1},
+			want:  []int{1, 2, 3},
+		},
+		{
+			name:  "another user overtakes the long queue",
+			users: []int64{1, 1, 1, 2},
+			want:  []int{1, 2, 3, 2},
+		},
+		{
+			name:  "every user gets a turn",
+			users: []int64{1, 2, 3, 1},
+			want:  []int{1, 2, 3, 4},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newFairPool()
+			p.idle = tt.idle
+
+			var got []int
+			for _, user := range tt.users {
+				got = append(got, p.Submit(user, func(context.Context) {}))
+			}
+
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("Submit() positions = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFairPoolNext(t *testing.T) {
+	p := newFairPool()
+
+	var ran []int64
+	for _, user := range []int64{1, 1, 1, 2, 3, 3} {
+		p.Submit(user, func(context.Context) { ran = append(ran, user) })
+	}
+
+	for {
+		task, ok := p.next()
+		if !ok {
+			break
+		}
+
+		task(context.Background())
+	}
+
+	if want := []int64{1, 2, 3, 1, 3, 1}; !slices.Equal(ran, want) {
+		t.Errorf("tasks ran for users %v, want %v", ran, want)
+	}
+}
@@ -8,6 +8,136 @@ import (
 	"github.com/jackc/pgx/v5/pgtype"
 )
 
+type AsrStep struct {
+	TranscribitionID int64
+	Step             string
+	Speakers         pgtype.Int4
+	WhisperTaskID    pgtype.Text
+	Result           pgtype.Text
+	CreatedAt        pgtype.Timestamp
+	UpdatedAt        pgtype.Timestamp
+}
+
+type Chat struct {
+	ChatID      int64
+	AutoProcess bool
+}
+
+type ChatMember struct {
+	ChatID    int64
+	TgUserID  int64
+	CreatedAt pgtype.Timestamp
+}
+
+type Errand struct {
+	ID               int64
+	TranscribitionID int64
+	TgUserID         int64
+	Assignee         pgtype.Text
+	Context          string
+	Deadline         pgtype.Timestamp
+	RemindAt         pgtype.Timestamp
+	Done             bool
+	CreatedAt        pgtype.Timestamp
+}
+
+type Invite struct {
+	Code      string
+	Role      string
+	CreatedBy int64
+	UsedBy    pgtype.Int8
+	CreatedAt pgtype.Timestamp
+	UsedAt    pgtype.Timestamp
+}
+
+type Job struct {
+	ID               int64
+	TranscribitionID int64
+	Stage            int32
+	State            string
+	Attempts         int32
+	LockedAt         pgtype.Timestamp
+	CreatedAt        pgtype.Timestamp
+	UpdatedAt        pgtype.Timestamp
+}
+
+type KnownSpeaker struct {
+	ID       int64
+	TgUserID int64
+	Name     string
+	Role     pgtype.Text
+	UsedAt   pgtype.Timestamp
+}
+
+type ProtocolEdit struct {
+	ChatID           int64
+	PromptMessageID  int64
+	TranscribitionID int64
+	TgUserID         int64
+	Action           string
+	Target           string
+	Version          int32
+	CreatedAt        pgtype.Timestamp
+}
+
+type ProtocolVersion struct {
+	TranscribitionID int64
+	Version          int32
+	Content          string
+	TgUserID         pgtype.Int8
+	CreatedAt        pgtype.Timestamp
+	ConfirmedBy      pgtype.Int8
+	ConfirmedAt      pgtype.Timestamp
+}
+
+type QuotaUsage struct {
+	ID               int64
+	TgUserID         int64
+	Kind             string
+	Amount           int64
+	TranscribitionID pgtype.Int8
+	CreatedAt        pgtype.Timestamp
+}
+
+type Session struct {
+	ID               int64
+	TgUserID         int64
+	ChatID           int64
+	MessageThreadID  pgtype.Int8
+	Caption          pgtype.Text
+	TranscribitionID pgtype.Int8
+	CreatedAt        pgtype.Timestamp
+	EndedAt          pgtype.Timestamp
+}
+
+type SessionPart struct {
+	ID               int64
+	SessionID        int64
+	MessageID        int64
+	AudioNameMinio   string
+	AudioBucketMinio string
+	Duration         float64
+	CreatedAt        pgtype.Timestamp
+}
+
+type Speaker struct {
+	TranscribitionID int64
+	Label            string
+	Name             pgtype.Text
+	Role             pgtype.Text
+	Quote            pgtype.Text
+	PromptMessageID  pgtype.Int8
+}
+
+type StageError struct {
+	ID               int64
+	TranscribitionID int64
+	Stage            int32
+	Code             string
+	Message          string
+	CreatedAt        pgtype.Timestamp
+}
+
 type Transcribition struct {
 	ID                  int64
 	TgUserID            int64
@@ -20,10 +150,29 @@ type Transcribition struct {
 	CreatedAt           pgtype.Timestamp
 	LlamaOutput         pgtype.Text
 	MessageToEdit       pgtype.Int8
+	WhisperTaskID       pgtype.Text
+	SourceUrl           pgtype.Text
+	OriginalNameMinio   pgtype.Text
+	ChatID              int64
+	MessageThreadID     pgtype.Int8
+	Title               pgtype.Text
+	Description         pgtype.Text
+	Tags                []string
+	StartedAt           pgtype.Timestamp
+	AudioSeconds        pgtype.Int4
 }
 
 type User struct {
 	TgUserID         int64
 	CurrentBotStatus pgtype.Text
 	CurrentBotID     pgtype.Int8
+	AsrLanguage      string
+	AsrModel         string
+	Speakers         pgtype.Int4
+	ReportType       pgtype.Text
+	ReportFormat     pgtype.Text
+	NotifyDone       bool
+	Role             pgtype.Text
+	Username         pgtype.Text
+	APITokenHash     pgtype.Text
 }
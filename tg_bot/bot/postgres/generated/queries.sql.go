@@ -11,23 +11,553 @@ import (
 	"github.com/jackc/pgx/v5/pgtype"
 )
 
+const addSessionPart = `-- name: AddSessionPart :exec
+INSERT INTO session_parts (
+  session_id,
+  message_id,
+  audio_name_minio,
+  audio_bucket_minio,
+  duration
+) VALUES (
+  $1, $2, $3, $4, $5
+)
+`
+
+type AddSessionPartParams struct {
+	SessionID        int64
+	MessageID        int64
+	AudioNameMinio   string
+	AudioBucketMinio string
+	Duration         float64
+}
+
+func (q *Queries) AddSessionPart(ctx context.Context, arg AddSessionPartParams) error {
+	_, err := q.db.Exec(ctx, addSessionPart,
+		arg.SessionID,
+		arg.MessageID,
+		arg.AudioNameMinio,
+		arg.AudioBucketMinio,
+		arg.Duration,
+	)
+	return err
+}
+
+const advanceJob = `-- name: AdvanceJob :exec
+UPDATE jobs
+SET stage = $1,
+    state = 'pending',
+    locked_at = NULL,
+    updated_at = current_timestamp
+WHERE id = $2 AND state = 'running'
+`
+
+type AdvanceJobParams struct {
+	Stage int32
+	ID    int64
+}
+
+func (q *Queries) AdvanceJob(ctx context.Context, arg AdvanceJobParams) error {
+	_, err := q.db.Exec(ctx, advanceJob, arg.Stage, arg.ID)
+	return err
+}
+
+const cancelJobs = `-- name: CancelJobs :exec
+UPDATE jobs
+SET state = 'cancelled',
+    locked_at = NULL,
+    updated_at = current_timestamp
+WHERE transcribition_id = $1
+  AND state IN ('pending', 'running', 'waiting')
+`
+
+func (q *Queries) CancelJobs(ctx context.Context, transcribitionID int64) error {
+	_, err := q.db.Exec(ctx, cancelJobs, transcribitionID)
+	return err
+}
+
+const claimJob = `-- name: ClaimJob :one
+UPDATE jobs
+SET state = 'running',
+    attempts = attempts + 1,
+    locked_at = current_timestamp,
+    updated_at = current_timestamp
+WHERE id = (
+  SELECT j.id FROM jobs j
+  JOIN transcribitions t ON t.id = j.transcribition_id
+  WHERE j.state = 'pending' AND j.stage = $1
+    AND COALESCE(t.status, 0) < $2
+  ORDER BY (
+    SELECT count(*) FROM jobs p
+    JOIN transcribitions pt ON pt.id = p.transcribition_id
+    WHERE p.state = 'pending'
+      AND p.stage = j.stage
+      AND pt.tg_user_id = t.tg_user_id
+      AND p.id < j.id
+  ), j.id
+  FOR UPDATE OF j SKIP LOCKED
+  LIMIT 1
+)
+RETURNING id, transcribition_id, stage, state, attempts, locked_at, created_at, updated_at
+`
+
+type ClaimJobParams struct {
+	Stage  int32
+	Status int32
+}
+
+// Jobs of a stage are taken round-robin between users: the first pending job of
+// every user goes before the second one of anybody, and so on. The jobs of
+// finished transcribitions are skipped.
+func (q *Queries) ClaimJob(ctx context.Context, arg ClaimJobParams) (Job, error) {
+	row := q.db.QueryRow(ctx, claimJob, arg.Stage, arg.Status)
+	var i Job
+	err := row.Scan(
+		&i.ID,
+		&i.TranscribitionID,
+		&i.Stage,
+		&i.State,
+		&i.Attempts,
+		&i.LockedAt,
+		&i.CreatedAt,
+		&i.UpdatedAt,
+	)
+	return i, err
+}
+
+const completeErrand = `-- name: CompleteErrand :exec
+UPDATE errands
+SET done = true,
+    remind_at = NULL
+WHERE id = $1
+`
+
+func (q *Queries) CompleteErrand(ctx context.Context, id int64) error {
+	_, err := q.db.Exec(ctx, completeErrand, id)
+	return err
+}
+
+const confirmProtocolVersion = `-- name: ConfirmProtocolVersion :execrows
+UPDATE protocol_versions
+SET confirmed_by = $1,
+    confirmed_at = $2
+WHERE transcribition_id = $3 AND version = $4 AND confirmed_at IS NULL
+`
+
+type ConfirmProtocolVersionParams struct {
+	ConfirmedBy      pgtype.Int8
+	ConfirmedAt      pgtype.Timestamp
+	TranscribitionID int64
+	Version          int32
+}
+
+func (q *Queries) ConfirmProtocolVersion(ctx context.Context, arg ConfirmProtocolVersionParams) (int64, error) {
+	result, err := q.db.Exec(ctx, confirmProtocolVersion,
+		arg.ConfirmedBy,
+		arg.ConfirmedAt,
+		arg.TranscribitionID,
+		arg.Version,
+	)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
+}
+
+const countActiveTranscribitions = `-- name: CountActiveTranscribitions :one
+SELECT count(DISTINCT t.id) FROM transcribitions t
+JOIN jobs j ON j.transcribition_id = t.id
+WHERE t.tg_user_id = $1 AND j.state IN ('pending', 'running', 'waiting')
+`
+
+// Meetings with a job queued, running or waiting for the speakers are still being processed.
+func (q *Queries) CountActiveTranscribitions(ctx context.Context, tgUserID int64) (int64, error) {
+	row := q.db.QueryRow(ctx, countActiveTranscribitions, tgUserID)
+	var count int64
+	err := row.Scan(&count)
+	return count, err
+}
+
+const countChatTranscribitions = `-- name: CountChatTranscribitions :one
+SELECT count(*) FROM transcribitions
+WHERE chat_id = $1
+`
+
+func (q *Queries) CountChatTranscribitions(ctx context.Context, chatID int64) (int64, error) {
+	row := q.db.QueryRow(ctx, countChatTranscribitions, chatID)
+	var count int64
+	err := row.Scan(&count)
+	return count, err
+}
+
+const createAsrStep = `-- name: CreateAsrStep :exec
+INSERT INTO asr_steps (
+  transcribition_id,
+  step,
+  speakers
+) VALUES (
+  $1, $2, $3
+)
+ON CONFLICT (transcribition_id, step) DO UPDATE
+SET speakers = excluded.speakers,
+    whisper_task_id = NULL,
+    result = NULL,
+    updated_at = current_timestamp
+`
+
+type CreateAsrStepParams struct {
+	TranscribitionID int64
+	Step             string
+	Speakers         pgtype.Int4
+}
+
+// Starting a step over drops its task and result.
+func (q *Queries) CreateAsrStep(ctx context.Context, arg CreateAsrStepParams) error {
+	_, err := q.db.Exec(ctx, createAsrStep, arg.TranscribitionID, arg.Step, arg.Speakers)
+	return err
+}
+
+const createChatMember = `-- name: CreateChatMember :exec
+INSERT INTO chat_members (
+  chat_id,
+  tg_user_id
+) VALUES (
+  $1, $2
+)
+ON CONFLICT DO NOTHING
+`
+
+type CreateChatMemberParams struct {
+	ChatID   int64
+	TgUserID int64
+}
+
+func (q *Queries) CreateChatMember(ctx context.Context, arg CreateChatMemberParams) error {
+	_, err := q.db.Exec(ctx, createChatMember, arg.ChatID, arg.TgUserID)
+	return err
+}
+
+const createErrand = `-- name: CreateErrand :exec
+INSERT INTO errands (
+  transcribition_id,
+  tg_user_id,
+  assignee,
+  context,
+  deadline,
+  remind_at
+) VALUES (
+  $1, $2, $3, $4, $5, $6
+)
+`
+
+type CreateErrandParams struct {
+	TranscribitionID int64
+	TgUserID         int64
+	Assignee         pgtype.Text
+	Context          string
+	Deadline         pgtype.Timestamp
+	RemindAt         pgtype.Timestamp
+}
+
+func (q *Queries) CreateErrand(ctx context.Context, arg CreateErrandParams) error {
+	_, err := q.db.Exec(ctx, createErrand,
+		arg.TranscribitionID,
+		arg.TgUserID,
+		arg.Assignee,
+		arg.Context,
+		arg.Deadline,
+		arg.RemindAt,
+	)
+	return err
+}
+
+const createInvite = `-- name: CreateInvite :exec
+INSERT INTO invites (
+  code,
+  role,
+  created_by
+) VALUES (
+  $1, $2, $3
+)
+`
+
+type CreateInviteParams struct {
+	Code      string
+	Role      string
+	CreatedBy int64
+}
+
+func (q *Queries) CreateInvite(ctx context.Context, arg CreateInviteParams) error {
+	_, err := q.db.Exec(ctx, createInvite, arg.Code, arg.Role, arg.CreatedBy)
+	return err
+}
+
+const createJob = `-- name: CreateJob :one
+INSERT INTO jobs (
+  transcribition_id,
+  stage
+)
+SELECT id, $2 FROM transcribitions
+WHERE id = $1 AND COALESCE(status, 0) < $3
+RETURNING id
+`
+
+type CreateJobParams struct {
+	TranscribitionID int64
+	Stage            int32
+	Status           int32
+}
+
+// No job is created for a finished transcribition, e.g. cancelled during the upload.
+func (q *Queries) CreateJob(ctx context.Context, arg CreateJobParams) (int64, error) {
+	row := q.db.QueryRow(ctx, createJob, arg.TranscribitionID, arg.Stage, arg.Status)
+	var id int64
+	err := row.Scan(&id)
+	return id, err
+}
+
+const createProtocolEdit = `-- name: CreateProtocolEdit :exec
+INSERT INTO protocol_edits (
+  chat_id,
+  prompt_message_id,
+  transcribition_id,
+  tg_user_id,
+  action,
+  target,
+  version
+) VALUES (
+  $1, $2, $3, $4, $5, $6, $7
+)
+`
+
+type CreateProtocolEditParams struct {
+	ChatID           int64
+	PromptMessageID  int64
+	TranscribitionID int64
+	TgUserID         int64
+	Action           string
+	Target           string
+	Version          int32
+}
+
+func (q *Queries) CreateProtocolEdit(ctx context.Context, arg CreateProtocolEditParams) error {
+	_, err := q.db.Exec(ctx, createProtocolEdit,
+		arg.ChatID,
+		arg.PromptMessageID,
+		arg.TranscribitionID,
+		arg.TgUserID,
+		arg.Action,
+		arg.Target,
+		arg.Version,
+	)
+	return err
+}
+
+const createProtocolVersion = `-- name: CreateProtocolVersion :one
+INSERT INTO protocol_versions (
+  transcribition_id,
+  version,
+  content,
+  tg_user_id
+)
+SELECT $1, COALESCE(MAX(version), 0) + 1, $2, $3
+FROM protocol_versions
+WHERE transcribition_id = $1
+RETURNING version
+`
+
+type CreateProtocolVersionParams struct {
+	TranscribitionID int64
+	Content          string
+	TgUserID         pgtype.Int8
+}
+
+func (q *Queries) CreateProtocolVersion(ctx context.Context, arg CreateProtocolVersionParams) (int32, error) {
+	row := q.db.QueryRow(ctx, createProtocolVersion, arg.TranscribitionID, arg.Content, arg.TgUserID)
+	var version int32
+	err := row.Scan(&version)
+	return version, err
+}
+
+const createQuotaUsage = `-- name: CreateQuotaUsage :exec
+INSERT INTO quota_usage (
+  tg_user_id,
+  kind,
+  amount,
+  transcribition_id,
+  created_at
+) VALUES (
+  $1, $2, $3, $4, $5
+)
+`
+
+type CreateQuotaUsageParams struct {
+	TgUserID         int64
+	Kind             string
+	Amount           int64
+	TranscribitionID pgtype.Int8
+	CreatedAt        pgtype.Timestamp
+}
+
+func (q *Queries) CreateQuotaUsage(ctx context.Context, arg CreateQuotaUsageParams) error {
+	_, err := q.db.Exec(ctx, createQuotaUsage,
+		arg.TgUserID,
+		arg.Kind,
+		arg.Amount,
+		arg.TranscribitionID,
+		arg.CreatedAt,
+	)
+	return err
+}
+
+const createQuotaUsageOnce = `-- name: CreateQuotaUsageOnce :exec
+INSERT INTO quota_usage (
+  tg_user_id,
+  kind,
+  amount,
+  transcribition_id,
+  created_at
+)
+SELECT $1, $2, $3, $4, $5
+WHERE NOT EXISTS (
+  SELECT 1 FROM quota_usage
+  WHERE transcribition_id = $4 AND kind = $2
+)
+`
+
+type CreateQuotaUsageOnceParams struct {
+	TgUserID         int64
+	Kind             string
+	Amount           int64
+	TranscribitionID pgtype.Int8
+	CreatedAt        pgtype.Timestamp
+}
+
+// The usage of a kind is charged once per transcribition, re-runs of its stages are free.
+func (q *Queries) CreateQuotaUsageOnce(ctx context.Context, arg CreateQuotaUsageOnceParams) error {
+	_, err := q.db.Exec(ctx, createQuotaUsageOnce,
+		arg.TgUserID,
+		arg.Kind,
+		arg.Amount,
+		arg.TranscribitionID,
+		arg.CreatedAt,
+	)
+	return err
+}
+
+const createSession = `-- name: CreateSession :exec
+INSERT INTO sessions (
+  tg_user_id,
+  chat_id,
+  message_thread_id,
+  caption
+) VALUES (
+  $1, $2, $3, $4
+)
+`
+
+type CreateSessionParams struct {
+	TgUserID        int64
+	ChatID          int64
+	MessageThreadID pgtype.Int8
+	Caption         pgtype.Text
+}
+
+func (q *Queries) CreateSession(ctx context.Context, arg CreateSessionParams) error {
+	_, err := q.db.Exec(ctx, createSession,
+		arg.TgUserID,
+		arg.ChatID,
+		arg.MessageThreadID,
+		arg.Caption,
+	)
+	return err
+}
+
+const createSpeaker = `-- name: CreateSpeaker :exec
+INSERT INTO speakers (
+  transcribition_id,
+  label,
+  quote,
+  prompt_message_id
+) VALUES (
+  $1, $2, $3, $4
+)
+ON CONFLICT (transcribition_id, label) DO UPDATE
+SET quote = excluded.quote,
+    prompt_message_id = excluded.prompt_message_id
+`
+
+type CreateSpeakerParams struct {
+	TranscribitionID int64
+	Label            string
+	Quote            pgtype.Text
+	PromptMessageID  pgtype.Int8
+}
+
+// A label asked again after re-diarization keeps its name, the new prompt shows it for correction.
+func (q *Queries) CreateSpeaker(ctx context.Context, arg CreateSpeakerParams) error {
+	_, err := q.db.Exec(ctx, createSpeaker,
+		arg.TranscribitionID,
+		arg.Label,
+		arg.Quote,
+		arg.PromptMessageID,
+	)
+	return err
+}
+
+const createStageError = `-- name: CreateStageError :exec
+INSERT INTO stage_errors (
+  transcribition_id,
+  stage,
+  code,
+  message
+) VALUES (
+  $1, $2, $3, $4
+)
+`
+
+type CreateStageErrorParams struct {
+	TranscribitionID int64
+	Stage            int32
+	Code             string
+	Message          string
+}
+
+func (q *Queries) CreateStageError(ctx context.Context, arg CreateStageErrorParams) error {
+	_, err := q.db.Exec(ctx, createStageError,
+		arg.TranscribitionID,
+		arg.Stage,
+		arg.Code,
+		arg.Message,
+	)
+	return err
+}
+
 const createTranscribition = `-- name: CreateTranscribition :one
 INSERT INTO transcribitions (
   tg_user_id,
+  chat_id,
+  message_thread_id,
   message_to_edit
 ) VALUES (
-  $1, $2
+  $1, $2, $3, $4
 )
 RETURNING id
 `
 
 type CreateTranscribitionParams struct {
-	TgUserID      int64
-	MessageToEdit pgtype.Int8
+	TgUserID        int64
+	ChatID          int64
+	MessageThreadID pgtype.Int8
+	MessageToEdit   pgtype.Int8
 }
 
 func (q *Queries) CreateTranscribition(ctx context.Context, arg CreateTranscribitionParams) (int64, error) {
-	row := q.db.QueryRow(ctx, createTranscribition, arg.TgUserID, arg.MessageToEdit)
+	row := q.db.QueryRow(ctx, createTranscribition,
+		arg.TgUserID,
+		arg.ChatID,
+		arg.MessageThreadID,
+		arg.MessageToEdit,
+	)
 	var id int64
 	err := row.Scan(&id)
 	return id, err
@@ -48,36 +578,921 @@ func (q *Queries) CreateUser(ctx context.Context, tgUserID int64) error {
 	return err
 }
 
-const getTranscribition = `-- name: GetTranscribition :one
-SELECT id, tg_user_id, audio_name_minio, audio_bucket_minio, formal_report_minio, informal_report_minio, transcription, status, created_at, llama_output, message_to_edit FROM transcribitions
-WHERE id = $1 LIMIT 1
+const deleteAsrStep = `-- name: DeleteAsrStep :exec
+DELETE FROM asr_steps
+WHERE transcribition_id = $1 AND step = $2
+`
+
+type DeleteAsrStepParams struct {
+	TranscribitionID int64
+	Step             string
+}
+
+func (q *Queries) DeleteAsrStep(ctx context.Context, arg DeleteAsrStepParams) error {
+	_, err := q.db.Exec(ctx, deleteAsrStep, arg.TranscribitionID, arg.Step)
+	return err
+}
+
+const deleteChatMember = `-- name: DeleteChatMember :exec
+DELETE FROM chat_members
+WHERE chat_id = $1 AND tg_user_id = $2
+`
+
+type DeleteChatMemberParams struct {
+	ChatID   int64
+	TgUserID int64
+}
+
+func (q *Queries) DeleteChatMember(ctx context.Context, arg DeleteChatMemberParams) error {
+	_, err := q.db.Exec(ctx, deleteChatMember, arg.ChatID, arg.TgUserID)
+	return err
+}
+
+const deleteErrands = `-- name: DeleteErrands :exec
+DELETE FROM errands
+WHERE transcribition_id = $1 AND NOT done
+`
+
+// The errands marked done are kept, so they are not reminded of again.
+func (q *Queries) DeleteErrands(ctx context.Context, transcribitionID int64) error {
+	_, err := q.db.Exec(ctx, deleteErrands, transcribitionID)
+	return err
+}
+
+const deleteProtocolEdit = `-- name: DeleteProtocolEdit :exec
+DELETE FROM protocol_edits
+WHERE chat_id = $1 AND prompt_message_id = $2
+`
+
+type DeleteProtocolEditParams struct {
+	ChatID          int64
+	PromptMessageID int64
+}
+
+func (q *Queries) DeleteProtocolEdit(ctx context.Context, arg DeleteProtocolEditParams) error {
+	_, err := q.db.Exec(ctx, deleteProtocolEdit, arg.ChatID, arg.PromptMessageID)
+	return err
+}
+
+const deleteSession = `-- name: DeleteSession :exec
+DELETE FROM sessions
+WHERE id = $1
+`
+
+func (q *Queries) DeleteSession(ctx context.Context, id int64) error {
+	_, err := q.db.Exec(ctx, deleteSession, id)
+	return err
+}
+
+const deleteStaleSpeakers = `-- name: DeleteStaleSpeakers :exec
+DELETE FROM speakers
+WHERE transcribition_id = $1 AND NOT (label = ANY($2::text[]))
+`
+
+type DeleteStaleSpeakersParams struct {
+	TranscribitionID int64
+	Labels           []string
+}
+
+// The labels the new diarization has no more.
+func (q *Queries) DeleteStaleSpeakers(ctx context.Context, arg DeleteStaleSpeakersParams) error {
+	_, err := q.db.Exec(ctx, deleteStaleSpeakers, arg.TranscribitionID, arg.Labels)
+	return err
+}
+
+const deleteTranscribition = `-- name: DeleteTranscribition :exec
+DELETE FROM transcribitions
+WHERE id = $1
+`
+
+func (q *Queries) DeleteTranscribition(ctx context.Context, id int64) error {
+	_, err := q.db.Exec(ctx, deleteTranscribition, id)
+	return err
+}
+
+const endSession = `-- name: EndSession :execrows
+UPDATE sessions
+SET ended_at = $1
+WHERE id = $2 AND ended_at IS NULL
+`
+
+type EndSessionParams struct {
+	EndedAt pgtype.Timestamp
+	ID      int64
+}
+
+// Only one /end closes the session, the others find it closed.
+func (q *Queries) EndSession(ctx context.Context, arg EndSessionParams) (int64, error) {
+	result, err := q.db.Exec(ctx, endSession, arg.EndedAt, arg.ID)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
+}
+
+const getAsrSteps = `-- name: GetAsrSteps :many
+SELECT transcribition_id, step, speakers, whisper_task_id, result, created_at, updated_at FROM asr_steps
+WHERE transcribition_id = $1
+`
+
+func (q *Queries) GetAsrSteps(ctx context.Context, transcribitionID int64) ([]AsrStep, error) {
+	rows, err := q.db.Query(ctx, getAsrSteps, transcribitionID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []AsrStep
+	for rows.Next() {
+		var i AsrStep
+		if err := rows.Scan(
+			&i.TranscribitionID,
+			&i.Step,
+			&i.Speakers,
+			&i.WhisperTaskID,
+			&i.Result,
+			&i.CreatedAt,
+			&i.UpdatedAt,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getChat = `-- name: GetChat :one
+SELECT chat_id, auto_process FROM chats
+WHERE chat_id = $1 LIMIT 1
+`
+
+func (q *Queries) GetChat(ctx context.Context, chatID int64) (Chat, error) {
+	row := q.db.QueryRow(ctx, getChat, chatID)
+	var i Chat
+	err := row.Scan(&i.ChatID, &i.AutoProcess)
+	return i, err
+}
+
+const getChatTranscribitions = `-- name: GetChatTranscribitions :many
+SELECT id, tg_user_id, audio_name_minio, audio_bucket_minio, formal_report_minio, informal_report_minio, transcription, status, created_at, llama_output, message_to_edit, whisper_task_id, source_url, original_name_minio, chat_id, message_thread_id, title, description, tags, started_at, audio_seconds FROM transcribitions
+WHERE chat_id = $1
+ORDER BY id DESC
+LIMIT $2 OFFSET $3
+`
+
+type GetChatTranscribitionsParams struct {
+	ChatID int64
+	Limit  int32
+	Offset int32
+}
+
+func (q *Queries) GetChatTranscribitions(ctx context.Context, arg GetChatTranscribitionsParams) ([]Transcribition, error) {
+	rows, err := q.db.Query(ctx, getChatTranscribitions, arg.ChatID, arg.Limit, arg.Offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []Transcribition
+	for rows.Next() {
+		var i Transcribition
+		if err := rows.Scan(
+			&i.ID,
+			&i.TgUserID,
+			&i.AudioNameMinio,
+			&i.AudioBucketMinio,
+			&i.FormalReportMinio,
+			&i.InformalReportMinio,
+			&i.Transcription,
+			&i.Status,
+			&i.CreatedAt,
+			&i.LlamaOutput,
+			&i.MessageToEdit,
+			&i.WhisperTaskID,
+			&i.SourceUrl,
+			&i.OriginalNameMinio,
+			&i.ChatID,
+			&i.MessageThreadID,
+			&i.Title,
+			&i.Description,
+			&i.Tags,
+			&i.StartedAt,
+			&i.AudioSeconds,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getDoneErrands = `-- name: GetDoneErrands :many
+SELECT id, transcribition_id, tg_user_id, assignee, context, deadline, remind_at, done, created_at FROM errands
+WHERE transcribition_id = $1 AND done
+`
+
+func (q *Queries) GetDoneErrands(ctx context.Context, transcribitionID int64) ([]Errand, error) {
+	rows, err := q.db.Query(ctx, getDoneErrands, transcribitionID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []Errand
+	for rows.Next() {
+		var i Errand
+		if err := rows.Scan(
+			&i.ID,
+			&i.TranscribitionID,
+			&i.TgUserID,
+			&i.Assignee,
+			&i.Context,
+			&i.Deadline,
+			&i.RemindAt,
+			&i.Done,
+			&i.CreatedAt,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getDueErrands = `-- name: GetDueErrands :many
+SELECT id, transcribition_id, tg_user_id, assignee, context, deadline, remind_at, done, created_at FROM errands
+WHERE NOT done AND remind_at <= $1
+ORDER BY remind_at
+LIMIT $2
+`
+
+type GetDueErrandsParams struct {
+	RemindAt pgtype.Timestamp
+	Limit    int32
+}
+
+func (q *Queries) GetDueErrands(ctx context.Context, arg GetDueErrandsParams) ([]Errand, error) {
+	rows, err := q.db.Query(ctx, getDueErrands, arg.RemindAt, arg.Limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []Errand
+	for rows.Next() {
+		var i Errand
+		if err := rows.Scan(
+			&i.ID,
+			&i.TranscribitionID,
+			&i.TgUserID,
+			&i.Assignee,
+			&i.Context,
+			&i.Deadline,
+			&i.RemindAt,
+			&i.Done,
+			&i.CreatedAt,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getErrand = `-- name: GetErrand :one
+SELECT id, transcribition_id, tg_user_id, assignee, context, deadline, remind_at, done, created_at FROM errands
+WHERE id = $1 LIMIT 1
+`
+
+func (q *Queries) GetErrand(ctx context.Context, id int64) (Errand, error) {
+	row := q.db.QueryRow(ctx, getErrand, id)
+	var i Errand
+	err := row.Scan(
+		&i.ID,
+		&i.TranscribitionID,
+		&i.TgUserID,
+		&i.Assignee,
+		&i.Context,
+		&i.Deadline,
+		&i.RemindAt,
+		&i.Done,
+		&i.CreatedAt,
+	)
+	return i, err
+}
+
+const getJobQueue = `-- name: GetJobQueue :many
+WITH pending AS (
+  SELECT j.id,
+         j.transcribition_id,
+         t.chat_id,
+         t.message_to_edit,
+         row_number() OVER (PARTITION BY t.tg_user_id ORDER BY j.id) AS user_rank
+  FROM jobs j
+  JOIN transcribitions t ON t.id = j.transcribition_id
+  WHERE j.state = 'pending' AND j.stage = $1
+)
+SELECT transcribition_id,
+       chat_id,
+       message_to_edit,
+       row_number() OVER (ORDER BY user_rank, id) AS position
+FROM pending
+ORDER BY position
+`
+
+type GetJobQueueRow struct {
+	TranscribitionID int64
+	ChatID           int64
+	MessageToEdit    pgtype.Int8
+	Position         int64
+}
+
+func (q *Queries) GetJobQueue(ctx context.Context, stage int32) ([]GetJobQueueRow, error) {
+	rows, err := q.db.Query(ctx, getJobQueue, stage)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []GetJobQueueRow
+	for rows.Next() {
+		var i GetJobQueueRow
+		if err := rows.Scan(
+			&i.TranscribitionID,
+			&i.ChatID,
+			&i.MessageToEdit,
+			&i.Position,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getKnownSpeaker = `-- name: GetKnownSpeaker :one
+SELECT id, tg_user_id, name, role, used_at FROM known_speakers
+WHERE id = $1 LIMIT 1
+`
+
+func (q *Queries) GetKnownSpeaker(ctx context.Context, id int64) (KnownSpeaker, error) {
+	row := q.db.QueryRow(ctx, getKnownSpeaker, id)
+	var i KnownSpeaker
+	err := row.Scan(
+		&i.ID,
+		&i.TgUserID,
+		&i.Name,
+		&i.Role,
+		&i.UsedAt,
+	)
+	return i, err
+}
+
+const getKnownSpeakers = `-- name: GetKnownSpeakers :many
+SELECT id, tg_user_id, name, role, used_at FROM known_speakers
+WHERE tg_user_id = $1
+ORDER BY used_at DESC
+LIMIT $2
+`
+
+type GetKnownSpeakersParams struct {
+	TgUserID int64
+	Limit    int32
+}
+
+func (q *Queries) GetKnownSpeakers(ctx context.Context, arg GetKnownSpeakersParams) ([]KnownSpeaker, error) {
+	rows, err := q.db.Query(ctx, getKnownSpeakers, arg.TgUserID, arg.Limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []KnownSpeaker
+	for rows.Next() {
+		var i KnownSpeaker
+		if err := rows.Scan(
+			&i.ID,
+			&i.TgUserID,
+			&i.Name,
+			&i.Role,
+			&i.UsedAt,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getLastStageError = `-- name: GetLastStageError :one
+SELECT id, transcribition_id, stage, code, message, created_at FROM stage_errors
+WHERE transcribition_id = $1
+ORDER BY id DESC
+LIMIT 1
+`
+
+func (q *Queries) GetLastStageError(ctx context.Context, transcribitionID int64) (StageError, error) {
+	row := q.db.QueryRow(ctx, getLastStageError, transcribitionID)
+	var i StageError
+	err := row.Scan(
+		&i.ID,
+		&i.TranscribitionID,
+		&i.Stage,
+		&i.Code,
+		&i.Message,
+		&i.CreatedAt,
+	)
+	return i, err
+}
+
+const getLastTranscribed = `-- name: GetLastTranscribed :one
+SELECT id, tg_user_id, audio_name_minio, audio_bucket_minio, formal_report_minio, informal_report_minio, transcription, status, created_at, llama_output, message_to_edit, whisper_task_id, source_url, original_name_minio, chat_id, message_thread_id, title, description, tags, started_at, audio_seconds FROM transcribitions
+WHERE chat_id = $1 AND transcription IS NOT NULL
+ORDER BY id DESC
+LIMIT 1
+`
+
+func (q *Queries) GetLastTranscribed(ctx context.Context, chatID int64) (Transcribition, error) {
+	row := q.db.QueryRow(ctx, getLastTranscribed, chatID)
+	var i Transcribition
+	err := row.Scan(
+		&i.ID,
+		&i.TgUserID,
+		&i.AudioNameMinio,
+		&i.AudioBucketMinio,
+		&i.FormalReportMinio,
+		&i.InformalReportMinio,
+		&i.Transcription,
+		&i.Status,
+		&i.CreatedAt,
+		&i.LlamaOutput,
+		&i.MessageToEdit,
+		&i.WhisperTaskID,
+		&i.SourceUrl,
+		&i.OriginalNameMinio,
+		&i.ChatID,
+		&i.MessageThreadID,
+		&i.Title,
+		&i.Description,
+		&i.Tags,
+		&i.StartedAt,
+		&i.AudioSeconds,
+	)
+	return i, err
+}
+
+const getLatestProtocolVersion = `-- name: GetLatestProtocolVersion :one
+SELECT transcribition_id, version, content, tg_user_id, created_at, confirmed_by, confirmed_at FROM protocol_versions
+WHERE transcribition_id = $1
+ORDER BY version DESC
+LIMIT 1
+`
+
+func (q *Queries) GetLatestProtocolVersion(ctx context.Context, transcribitionID int64) (ProtocolVersion, error) {
+	row := q.db.QueryRow(ctx, getLatestProtocolVersion, transcribitionID)
+	var i ProtocolVersion
+	err := row.Scan(
+		&i.TranscribitionID,
+		&i.Version,
+		&i.Content,
+		&i.TgUserID,
+		&i.CreatedAt,
+		&i.ConfirmedBy,
+		&i.ConfirmedAt,
+	)
+	return i, err
+}
+
+const getOpenSession = `-- name: GetOpenSession :one
+SELECT id, tg_user_id, chat_id, message_thread_id, caption, transcribition_id, created_at, ended_at FROM sessions
+WHERE chat_id = $1 AND tg_user_id = $2 AND ended_at IS NULL
+LIMIT 1
+`
+
+type GetOpenSessionParams struct {
+	ChatID   int64
+	TgUserID int64
+}
+
+func (q *Queries) GetOpenSession(ctx context.Context, arg GetOpenSessionParams) (Session, error) {
+	row := q.db.QueryRow(ctx, getOpenSession, arg.ChatID, arg.TgUserID)
+	var i Session
+	err := row.Scan(
+		&i.ID,
+		&i.TgUserID,
+		&i.ChatID,
+		&i.MessageThreadID,
+		&i.Caption,
+		&i.TranscribitionID,
+		&i.CreatedAt,
+		&i.EndedAt,
+	)
+	return i, err
+}
+
+const getProtocolEdit = `-- name: GetProtocolEdit :one
+SELECT chat_id, prompt_message_id, transcribition_id, tg_user_id, action, target, version, created_at FROM protocol_edits
+WHERE chat_id = $1 AND prompt_message_id = $2
+LIMIT 1
+`
+
+type GetProtocolEditParams struct {
+	ChatID          int64
+	PromptMessageID int64
+}
+
+func (q *Queries) GetProtocolEdit(ctx context.Context, arg GetProtocolEditParams) (ProtocolEdit, error) {
+	row := q.db.QueryRow(ctx, getProtocolEdit, arg.ChatID, arg.PromptMessageID)
+	var i ProtocolEdit
+	err := row.Scan(
+		&i.ChatID,
+		&i.PromptMessageID,
+		&i.TranscribitionID,
+		&i.TgUserID,
+		&i.Action,
+		&i.Target,
+		&i.Version,
+		&i.CreatedAt,
+	)
+	return i, err
+}
+
+const getSessionParts = `-- name: GetSessionParts :many
+SELECT id, session_id, message_id, audio_name_minio, audio_bucket_minio, duration, created_at FROM session_parts
+WHERE session_id = $1
+ORDER BY message_id, id
+`
+
+func (q *Queries) GetSessionParts(ctx context.Context, sessionID int64) ([]SessionPart, error) {
+	rows, err := q.db.Query(ctx, getSessionParts, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []SessionPart
+	for rows.Next() {
+		var i SessionPart
+		if err := rows.Scan(
+			&i.ID,
+			&i.SessionID,
+			&i.MessageID,
+			&i.AudioNameMinio,
+			&i.AudioBucketMinio,
+			&i.Duration,
+			&i.CreatedAt,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getSpeakerByPrompt = `-- name: GetSpeakerByPrompt :one
+SELECT s.transcribition_id, s.label, s.name, s.role, s.quote, s.prompt_message_id FROM speakers s
+JOIN transcribitions t ON t.id = s.transcribition_id
+WHERE t.chat_id = $1 AND s.prompt_message_id = $2
+LIMIT 1
+`
+
+type GetSpeakerByPromptParams struct {
+	ChatID          int64
+	PromptMessageID pgtype.Int8
+}
+
+func (q *Queries) GetSpeakerByPrompt(ctx context.Context, arg GetSpeakerByPromptParams) (Speaker, error) {
+	row := q.db.QueryRow(ctx, getSpeakerByPrompt, arg.ChatID, arg.PromptMessageID)
+	var i Speaker
+	err := row.Scan(
+		&i.TranscribitionID,
+		&i.Label,
+		&i.Name,
+		&i.Role,
+		&i.Quote,
+		&i.PromptMessageID,
+	)
+	return i, err
+}
+
+const getSpeakers = `-- name: GetSpeakers :many
+SELECT transcribition_id, label, name, role, quote, prompt_message_id FROM speakers
+WHERE transcribition_id = $1
+ORDER BY label
+`
+
+func (q *Queries) GetSpeakers(ctx context.Context, transcribitionID int64) ([]Speaker, error) {
+	rows, err := q.db.Query(ctx, getSpeakers, transcribitionID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []Speaker
+	for rows.Next() {
+		var i Speaker
+		if err := rows.Scan(
+			&i.TranscribitionID,
+			&i.Label,
+			&i.Name,
+			&i.Role,
+			&i.Quote,
+			&i.PromptMessageID,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getTranscribition = `-- name: GetTranscribition :one
+SELECT id, tg_user_id, audio_name_minio, audio_bucket_minio, formal_report_minio, informal_report_minio, transcription, status, created_at, llama_output, message_to_edit, whisper_task_id, source_url, original_name_minio, chat_id, message_thread_id, title, description, tags, started_at, audio_seconds FROM transcribitions
+WHERE id = $1 LIMIT 1
+`
+
+func (q *Queries) GetTranscribition(ctx context.Context, id int64) (Transcribition, error) {
+	row := q.db.QueryRow(ctx, getTranscribition, id)
+	var i Transcribition
+	err := row.Scan(
+		&i.ID,
+		&i.TgUserID,
+		&i.AudioNameMinio,
+		&i.AudioBucketMinio,
+		&i.FormalReportMinio,
+		&i.InformalReportMinio,
+		&i.Transcription,
+		&i.Status,
+		&i.CreatedAt,
+		&i.LlamaOutput,
+		&i.MessageToEdit,
+		&i.WhisperTaskID,
+		&i.SourceUrl,
+		&i.OriginalNameMinio,
+		&i.ChatID,
+		&i.MessageThreadID,
+		&i.Title,
+		&i.Description,
+		&i.Tags,
+		&i.StartedAt,
+		&i.AudioSeconds,
+	)
+	return i, err
+}
+
+const getTranscribitionByStatusMessage = `-- name: GetTranscribitionByStatusMessage :one
+SELECT id, tg_user_id, audio_name_minio, audio_bucket_minio, formal_report_minio, informal_report_minio, transcription, status, created_at, llama_output, message_to_edit, whisper_task_id, source_url, original_name_minio, chat_id, message_thread_id, title, description, tags, started_at, audio_seconds FROM transcribitions
+WHERE chat_id = $1 AND message_to_edit = $2
+LIMIT 1
+`
+
+type GetTranscribitionByStatusMessageParams struct {
+	ChatID        int64
+	MessageToEdit pgtype.Int8
+}
+
+func (q *Queries) GetTranscribitionByStatusMessage(ctx context.Context, arg GetTranscribitionByStatusMessageParams) (Transcribition, error) {
+	row := q.db.QueryRow(ctx, getTranscribitionByStatusMessage, arg.ChatID, arg.MessageToEdit)
+	var i Transcribition
+	err := row.Scan(
+		&i.ID,
+		&i.TgUserID,
+		&i.AudioNameMinio,
+		&i.AudioBucketMinio,
+		&i.FormalReportMinio,
+		&i.InformalReportMinio,
+		&i.Transcription,
+		&i.Status,
+		&i.CreatedAt,
+		&i.LlamaOutput,
+		&i.MessageToEdit,
+		&i.WhisperTaskID,
+		&i.SourceUrl,
+		&i.OriginalNameMinio,
+		&i.ChatID,
+		&i.MessageThreadID,
+		&i.Title,
+		&i.Description,
+		&i.Tags,
+		&i.StartedAt,
+		&i.AudioSeconds,
+	)
+	return i, err
+}
+
+const getTranscribitions = `-- name: GetTranscribitions :many
+SELECT id, tg_user_id, audio_name_minio, audio_bucket_minio, formal_report_minio, informal_report_minio, transcription, status, created_at, llama_output, message_to_edit, whisper_task_id, source_url, original_name_minio, chat_id, message_thread_id, title, description, tags, started_at, audio_seconds FROM transcribitions
+`
+
+func (q *Queries) GetTranscribitions(ctx context.Context) ([]Transcribition, error) {
+	rows, err := q.db.Query(ctx, getTranscribitions)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []Transcribition
+	for rows.Next() {
+		var i Transcribition
+		if err := rows.Scan(
+			&i.ID,
+			&i.TgUserID,
+			&i.AudioNameMinio,
+			&i.AudioBucketMinio,
+			&i.FormalReportMinio,
+			&i.InformalReportMinio,
+			&i.Transcription,
+			&i.Status,
+			&i.CreatedAt,
+			&i.LlamaOutput,
+			&i.MessageToEdit,
+			&i.WhisperTaskID,
+			&i.SourceUrl,
+			&i.OriginalNameMinio,
+			&i.ChatID,
+			&i.MessageThreadID,
+			&i.Title,
+			&i.Description,
+			&i.Tags,
+			&i.StartedAt,
+			&i.AudioSeconds,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getUnqueuedTranscribitions = `-- name: GetUnqueuedTranscribitions :many
+SELECT t.id, t.tg_user_id, t.audio_name_minio, t.audio_bucket_minio, t.formal_report_minio, t.informal_report_minio, t.transcription, t.status, t.created_at, t.llama_output, t.message_to_edit, t.whisper_task_id, t.source_url, t.original_name_minio, t.chat_id, t.message_thread_id, t.title, t.description, t.tags, t.started_at, t.audio_seconds FROM transcribitions t
+WHERE t.status < $1
+  AND t.audio_name_minio IS NOT NULL
+  AND NOT EXISTS (
+    SELECT 1 FROM jobs j
+    WHERE j.transcribition_id = t.id
+  )
+`
+
+func (q *Queries) GetUnqueuedTranscribitions(ctx context.Context, status pgtype.Int4) ([]Transcribition, error) {
+	rows, err := q.db.Query(ctx, getUnqueuedTranscribitions, status)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []Transcribition
+	for rows.Next() {
+		var i Transcribition
+		if err := rows.Scan(
+			&i.ID,
+			&i.TgUserID,
+			&i.AudioNameMinio,
+			&i.AudioBucketMinio,
+			&i.FormalReportMinio,
+			&i.InformalReportMinio,
+			&i.Transcription,
+			&i.Status,
+			&i.CreatedAt,
+			&i.LlamaOutput,
+			&i.MessageToEdit,
+			&i.WhisperTaskID,
+			&i.SourceUrl,
+			&i.OriginalNameMinio,
+			&i.ChatID,
+			&i.MessageThreadID,
+			&i.Title,
+			&i.Description,
+			&i.Tags,
+			&i.StartedAt,
+			&i.AudioSeconds,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getUser = `-- name: GetUser :one
+SELECT tg_user_id, current_bot_status, current_bot_id, asr_language, asr_model, speakers, report_type, report_format, notify_done, role, username, api_token_hash FROM users
+WHERE tg_user_id = $1 LIMIT 1
+`
+
+func (q *Queries) GetUser(ctx context.Context, tgUserID int64) (User, error) {
+	row := q.db.QueryRow(ctx, getUser, tgUserID)
+	var i User
+	err := row.Scan(
+		&i.TgUserID,
+		&i.CurrentBotStatus,
+		&i.CurrentBotID,
+		&i.AsrLanguage,
+		&i.AsrModel,
+		&i.Speakers,
+		&i.ReportType,
+		&i.ReportFormat,
+		&i.NotifyDone,
+		&i.Role,
+		&i.Username,
+		&i.APITokenHash,
+	)
+	return i, err
+}
+
+const getUserByAPIToken = `-- name: GetUserByAPIToken :one
+SELECT tg_user_id, current_bot_status, current_bot_id, asr_language, asr_model, speakers, report_type, report_format, notify_done, role, username, api_token_hash FROM users
+WHERE api_token_hash = $1 LIMIT 1
 `
 
-func (q *Queries) GetTranscribition(ctx context.Context, id int64) (Transcribition, error) {
-	row := q.db.QueryRow(ctx, getTranscribition, id)
-	var i Transcribition
+func (q *Queries) GetUserByAPIToken(ctx context.Context, apiTokenHash pgtype.Text) (User, error) {
+	row := q.db.QueryRow(ctx, getUserByAPIToken, apiTokenHash)
+	var i User
 	err := row.Scan(
-		&i.ID,
 		&i.TgUserID,
-		&i.AudioNameMinio,
-		&i.AudioBucketMinio,
-		&i.FormalReportMinio,
-		&i.InformalReportMinio,
-		&i.Transcription,
-		&i.Status,
-		&i.CreatedAt,
-		&i.LlamaOutput,
-		&i.MessageToEdit,
+		&i.CurrentBotStatus,
+		&i.CurrentBotID,
+		&i.AsrLanguage,
+		&i.AsrModel,
+		&i.Speakers,
+		&i.ReportType,
+		&i.ReportFormat,
+		&i.NotifyDone,
+		&i.Role,
+		&i.Username,
+		&i.APITokenHash,
 	)
 	return i, err
 }
 
-const getTranscribitions = `-- name: GetTranscribitions :many
-SELECT id, tg_user_id, audio_name_minio, audio_bucket_minio, formal_report_minio, informal_report_minio, transcription, status, created_at, llama_output, message_to_edit FROM transcribitions
+const getUsersWithRoles = `-- name: GetUsersWithRoles :many
+SELECT tg_user_id, current_bot_status, current_bot_id, asr_language, asr_model, speakers, report_type, report_format, notify_done, role, username, api_token_hash FROM users
+WHERE role IS NOT NULL
+ORDER BY role, tg_user_id
 `
 
-func (q *Queries) GetTranscribitions(ctx context.Context) ([]Transcribition, error) {
-	rows, err := q.db.Query(ctx, getTranscribitions)
+func (q *Queries) GetUsersWithRoles(ctx context.Context) ([]User, error) {
+	rows, err := q.db.Query(ctx, getUsersWithRoles)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []User
+	for rows.Next() {
+		var i User
+		if err := rows.Scan(
+			&i.TgUserID,
+			&i.CurrentBotStatus,
+			&i.CurrentBotID,
+			&i.AsrLanguage,
+			&i.AsrModel,
+			&i.Speakers,
+			&i.ReportType,
+			&i.ReportFormat,
+			&i.NotifyDone,
+			&i.Role,
+			&i.Username,
+			&i.APITokenHash,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getUserTranscribitions = `-- name: GetUserTranscribitions :many
+SELECT id, tg_user_id, audio_name_minio, audio_bucket_minio, formal_report_minio, informal_report_minio, transcription, status, created_at, llama_output, message_to_edit, whisper_task_id, source_url, original_name_minio, chat_id, message_thread_id, title, description, tags, started_at, audio_seconds FROM transcribitions
+WHERE tg_user_id = $1
+   OR chat_id IN (SELECT chat_id FROM chat_members WHERE tg_user_id = $1)
+ORDER BY id DESC
+`
+
+// The meetings the user uploaded and the meetings of the groups the user is a member of.
+func (q *Queries) GetUserTranscribitions(ctx context.Context, tgUserID int64) ([]Transcribition, error) {
+	rows, err := q.db.Query(ctx, getUserTranscribitions, tgUserID)
 	if err != nil {
 		return nil, err
 	}
@@ -97,6 +1512,16 @@ func (q *Queries) GetTranscribitions(ctx context.Context) ([]Transcribition, err
 			&i.CreatedAt,
 			&i.LlamaOutput,
 			&i.MessageToEdit,
+			&i.WhisperTaskID,
+			&i.SourceUrl,
+			&i.OriginalNameMinio,
+			&i.ChatID,
+			&i.MessageThreadID,
+			&i.Title,
+			&i.Description,
+			&i.Tags,
+			&i.StartedAt,
+			&i.AudioSeconds,
 		); err != nil {
 			return nil, err
 		}
@@ -108,16 +1533,307 @@ func (q *Queries) GetTranscribitions(ctx context.Context) ([]Transcribition, err
 	return items, nil
 }
 
-const getUser = `-- name: GetUser :one
-SELECT tg_user_id, current_bot_status, current_bot_id FROM users
-WHERE tg_user_id = $1 LIMIT 1
+const holdJob = `-- name: HoldJob :exec
+UPDATE jobs
+SET stage = $1,
+    state = 'waiting',
+    locked_at = NULL,
+    updated_at = current_timestamp
+WHERE id = $2 AND state = 'running'
 `
 
-func (q *Queries) GetUser(ctx context.Context, tgUserID int64) (User, error) {
-	row := q.db.QueryRow(ctx, getUser, tgUserID)
-	var i User
-	err := row.Scan(&i.TgUserID, &i.CurrentBotStatus, &i.CurrentBotID)
-	return i, err
+type HoldJobParams struct {
+	Stage int32
+	ID    int64
+}
+
+// A held job is not claimed until it is released, e.g. while the speakers are named.
+func (q *Queries) HoldJob(ctx context.Context, arg HoldJobParams) error {
+	_, err := q.db.Exec(ctx, holdJob, arg.Stage, arg.ID)
+	return err
+}
+
+const isChatMember = `-- name: IsChatMember :one
+SELECT EXISTS (
+  SELECT 1 FROM chat_members
+  WHERE chat_id = $1 AND tg_user_id = $2
+)
+`
+
+type IsChatMemberParams struct {
+	ChatID   int64
+	TgUserID int64
+}
+
+func (q *Queries) IsChatMember(ctx context.Context, arg IsChatMemberParams) (bool, error) {
+	row := q.db.QueryRow(ctx, isChatMember, arg.ChatID, arg.TgUserID)
+	var exists bool
+	err := row.Scan(&exists)
+	return exists, err
+}
+
+const releaseExpiredJobs = `-- name: ReleaseExpiredJobs :many
+UPDATE jobs
+SET state = 'pending',
+    updated_at = current_timestamp
+WHERE state = 'waiting'
+  AND updated_at < current_timestamp - make_interval(secs => $1)
+RETURNING transcribition_id
+`
+
+func (q *Queries) ReleaseExpiredJobs(ctx context.Context, secs float64) ([]int64, error) {
+	rows, err := q.db.Query(ctx, releaseExpiredJobs, secs)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []int64
+	for rows.Next() {
+		var transcribition_id int64
+		if err := rows.Scan(&transcribition_id); err != nil {
+			return nil, err
+		}
+		items = append(items, transcribition_id)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const releaseJob = `-- name: ReleaseJob :execrows
+UPDATE jobs
+SET state = 'pending',
+    updated_at = current_timestamp
+WHERE transcribition_id = $1 AND state = 'waiting'
+`
+
+func (q *Queries) ReleaseJob(ctx context.Context, transcribitionID int64) (int64, error) {
+	result, err := q.db.Exec(ctx, releaseJob, transcribitionID)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
+}
+
+const requeueRunningJobs = `-- name: RequeueRunningJobs :exec
+UPDATE jobs
+SET state = 'pending',
+    locked_at = NULL,
+    updated_at = current_timestamp
+WHERE state = 'running'
+`
+
+func (q *Queries) RequeueRunningJobs(ctx context.Context) error {
+	_, err := q.db.Exec(ctx, requeueRunningJobs)
+	return err
+}
+
+const saveKnownSpeaker = `-- name: SaveKnownSpeaker :exec
+INSERT INTO known_speakers (
+  tg_user_id,
+  name,
+  role
+) VALUES (
+  $1, $2, $3
+)
+ON CONFLICT (tg_user_id, name) DO UPDATE
+SET role = excluded.role,
+    used_at = current_timestamp
+`
+
+type SaveKnownSpeakerParams struct {
+	TgUserID int64
+	Name     string
+	Role     pgtype.Text
+}
+
+// Names used last are suggested first.
+func (q *Queries) SaveKnownSpeaker(ctx context.Context, arg SaveKnownSpeakerParams) error {
+	_, err := q.db.Exec(ctx, saveKnownSpeaker, arg.TgUserID, arg.Name, arg.Role)
+	return err
+}
+
+const setAPIToken = `-- name: SetAPIToken :exec
+UPDATE users
+SET api_token_hash = $1
+WHERE tg_user_id = $2
+`
+
+type SetAPITokenParams struct {
+	APITokenHash pgtype.Text
+	TgUserID     int64
+}
+
+func (q *Queries) SetAPIToken(ctx context.Context, arg SetAPITokenParams) error {
+	_, err := q.db.Exec(ctx, setAPIToken, arg.APITokenHash, arg.TgUserID)
+	return err
+}
+
+const setChatAutoProcess = `-- name: SetChatAutoProcess :exec
+INSERT INTO chats (
+  chat_id,
+  auto_process
+) VALUES (
+  $1, $2
+)
+ON CONFLICT (chat_id) DO UPDATE
+SET auto_process = excluded.auto_process
+`
+
+type SetChatAutoProcessParams struct {
+	ChatID      int64
+	AutoProcess bool
+}
+
+func (q *Queries) SetChatAutoProcess(ctx context.Context, arg SetChatAutoProcessParams) error {
+	_, err := q.db.Exec(ctx, setChatAutoProcess, arg.ChatID, arg.AutoProcess)
+	return err
+}
+
+const setErrandReminder = `-- name: SetErrandReminder :exec
+UPDATE errands
+SET remind_at = $1
+WHERE id = $2
+`
+
+type SetErrandReminderParams struct {
+	RemindAt pgtype.Timestamp
+	ID       int64
+}
+
+func (q *Queries) SetErrandReminder(ctx context.Context, arg SetErrandReminderParams) error {
+	_, err := q.db.Exec(ctx, setErrandReminder, arg.RemindAt, arg.ID)
+	return err
+}
+
+const setGeneratedTitle = `-- name: SetGeneratedTitle :exec
+UPDATE transcribitions
+SET title = COALESCE(title, $1)
+WHERE id = $2
+`
+
+type SetGeneratedTitleParams struct {
+	Title pgtype.Text
+	ID    int64
+}
+
+// The title given by the user is kept.
+func (q *Queries) SetGeneratedTitle(ctx context.Context, arg SetGeneratedTitleParams) error {
+	_, err := q.db.Exec(ctx, setGeneratedTitle, arg.Title, arg.ID)
+	return err
+}
+
+const setSessionTranscribition = `-- name: SetSessionTranscribition :exec
+UPDATE sessions
+SET transcribition_id = $1
+WHERE id = $2
+`
+
+type SetSessionTranscribitionParams struct {
+	TranscribitionID pgtype.Int8
+	ID               int64
+}
+
+func (q *Queries) SetSessionTranscribition(ctx context.Context, arg SetSessionTranscribitionParams) error {
+	_, err := q.db.Exec(ctx, setSessionTranscribition, arg.TranscribitionID, arg.ID)
+	return err
+}
+
+const setUsername = `-- name: SetUsername :exec
+INSERT INTO users (
+  tg_user_id,
+  username
+) VALUES (
+  $1, $2
+)
+ON CONFLICT(tg_user_id)
+DO UPDATE SET username = excluded.username
+`
+
+type SetUsernameParams struct {
+	TgUserID int64
+	Username pgtype.Text
+}
+
+func (q *Queries) SetUsername(ctx context.Context, arg SetUsernameParams) error {
+	_, err := q.db.Exec(ctx, setUsername, arg.TgUserID, arg.Username)
+	return err
+}
+
+const setUserRole = `-- name: SetUserRole :exec
+INSERT INTO users (
+  tg_user_id,
+  role
+) VALUES (
+  $1, $2
+)
+ON CONFLICT(tg_user_id)
+DO UPDATE SET role = excluded.role
+`
+
+type SetUserRoleParams struct {
+	TgUserID int64
+	Role     pgtype.Text
+}
+
+func (q *Queries) SetUserRole(ctx context.Context, arg SetUserRoleParams) error {
+	_, err := q.db.Exec(ctx, setUserRole, arg.TgUserID, arg.Role)
+	return err
+}
+
+const sumQuotaUsage = `-- name: SumQuotaUsage :one
+SELECT COALESCE(SUM(amount), 0)::bigint FROM quota_usage
+WHERE tg_user_id = $1 AND kind = $2 AND created_at >= $3
+`
+
+type SumQuotaUsageParams struct {
+	TgUserID  int64
+	Kind      string
+	CreatedAt pgtype.Timestamp
+}
+
+func (q *Queries) SumQuotaUsage(ctx context.Context, arg SumQuotaUsageParams) (int64, error) {
+	row := q.db.QueryRow(ctx, sumQuotaUsage, arg.TgUserID, arg.Kind, arg.CreatedAt)
+	var column_1 int64
+	err := row.Scan(&column_1)
+	return column_1, err
+}
+
+const updateAsrStepResult = `-- name: UpdateAsrStepResult :exec
+UPDATE asr_steps
+SET result = $1,
+    updated_at = current_timestamp
+WHERE transcribition_id = $2 AND step = $3
+`
+
+type UpdateAsrStepResultParams struct {
+	Result           pgtype.Text
+	TranscribitionID int64
+	Step             string
+}
+
+func (q *Queries) UpdateAsrStepResult(ctx context.Context, arg UpdateAsrStepResultParams) error {
+	_, err := q.db.Exec(ctx, updateAsrStepResult, arg.Result, arg.TranscribitionID, arg.Step)
+	return err
+}
+
+const updateAsrStepTask = `-- name: UpdateAsrStepTask :exec
+UPDATE asr_steps
+SET whisper_task_id = $1,
+    updated_at = current_timestamp
+WHERE transcribition_id = $2 AND step = $3
+`
+
+type UpdateAsrStepTaskParams struct {
+	WhisperTaskID    pgtype.Text
+	TranscribitionID int64
+	Step             string
+}
+
+func (q *Queries) UpdateAsrStepTask(ctx context.Context, arg UpdateAsrStepTaskParams) error {
+	_, err := q.db.Exec(ctx, updateAsrStepTask, arg.WhisperTaskID, arg.TranscribitionID, arg.Step)
+	return err
 }
 
 const updateCurrentBotID = `-- name: UpdateCurrentBotID :exec
@@ -152,6 +1868,24 @@ func (q *Queries) UpdateCurrentBotStatus(ctx context.Context, arg UpdateCurrentB
 	return err
 }
 
+const updateJobState = `-- name: UpdateJobState :exec
+UPDATE jobs
+SET state = $1,
+    locked_at = NULL,
+    updated_at = current_timestamp
+WHERE id = $2 AND state = 'running'
+`
+
+type UpdateJobStateParams struct {
+	State string
+	ID    int64
+}
+
+func (q *Queries) UpdateJobState(ctx context.Context, arg UpdateJobStateParams) error {
+	_, err := q.db.Exec(ctx, updateJobState, arg.State, arg.ID)
+	return err
+}
+
 const updateLlamaOutput = `-- name: UpdateLlamaOutput :exec
 UPDATE transcribitions
 SET llama_output = $1
@@ -168,21 +1902,112 @@ func (q *Queries) UpdateLlamaOutput(ctx context.Context, arg UpdateLlamaOutputPa
 	return err
 }
 
+const updateMeetingInfo = `-- name: UpdateMeetingInfo :exec
+UPDATE transcribitions
+SET title = $1,
+    description = $2,
+    tags = $3,
+    started_at = $4
+WHERE id = $5
+`
+
+type UpdateMeetingInfoParams struct {
+	Title       pgtype.Text
+	Description pgtype.Text
+	Tags        []string
+	StartedAt   pgtype.Timestamp
+	ID          int64
+}
+
+func (q *Queries) UpdateMeetingInfo(ctx context.Context, arg UpdateMeetingInfoParams) error {
+	_, err := q.db.Exec(ctx, updateMeetingInfo,
+		arg.Title,
+		arg.Description,
+		arg.Tags,
+		arg.StartedAt,
+		arg.ID,
+	)
+	return err
+}
+
 const updateMinioLink = `-- name: UpdateMinioLink :exec
 UPDATE transcribitions
 SET audio_name_minio = $1,
-    audio_bucket_minio = $2
-WHERE id = $3
+    audio_bucket_minio = $2,
+    audio_seconds = $3
+WHERE id = $4
 `
 
 type UpdateMinioLinkParams struct {
 	AudioNameMinio   pgtype.Text
 	AudioBucketMinio pgtype.Text
+	AudioSeconds     pgtype.Int4
 	ID               int64
 }
 
 func (q *Queries) UpdateMinioLink(ctx context.Context, arg UpdateMinioLinkParams) error {
-	_, err := q.db.Exec(ctx, updateMinioLink, arg.AudioNameMinio, arg.AudioBucketMinio, arg.ID)
+	_, err := q.db.Exec(ctx, updateMinioLink,
+		arg.AudioNameMinio,
+		arg.AudioBucketMinio,
+		arg.AudioSeconds,
+		arg.ID,
+	)
+	return err
+}
+
+const updateOriginalName = `-- name: UpdateOriginalName :exec
+UPDATE transcribitions
+SET original_name_minio = $1
+WHERE id = $2
+`
+
+type UpdateOriginalNameParams struct {
+	OriginalNameMinio pgtype.Text
+	ID                int64
+}
+
+func (q *Queries) UpdateOriginalName(ctx context.Context, arg UpdateOriginalNameParams) error {
+	_, err := q.db.Exec(ctx, updateOriginalName, arg.OriginalNameMinio, arg.ID)
+	return err
+}
+
+const updateSourceURL = `-- name: UpdateSourceURL :exec
+UPDATE transcribitions
+SET source_url = $1
+WHERE id = $2
+`
+
+type UpdateSourceURLParams struct {
+	SourceUrl pgtype.Text
+	ID        int64
+}
+
+func (q *Queries) UpdateSourceURL(ctx context.Context, arg UpdateSourceURLParams) error {
+	_, err := q.db.Exec(ctx, updateSourceURL, arg.SourceUrl, arg.ID)
+	return err
+}
+
+const updateSpeakerName = `-- name: UpdateSpeakerName :exec
+UPDATE speakers
+SET name = $1,
+    role = $2
+WHERE transcribition_id = $3 AND label = $4
+`
+
+type UpdateSpeakerNameParams struct {
+	Name             pgtype.Text
+	Role             pgtype.Text
+	TranscribitionID int64
+	Label            string
+}
+
+func (q *Queries) UpdateSpeakerName(ctx context.Context, arg UpdateSpeakerNameParams) error {
+	_, err := q.db.Exec(ctx, updateSpeakerName,
+		arg.Name,
+		arg.Role,
+		arg.TranscribitionID,
+		arg.Label,
+	)
 	return err
 }
 
@@ -217,3 +2042,74 @@ func (q *Queries) UpdateTranscription(ctx context.Context, arg UpdateTranscripti
 	_, err := q.db.Exec(ctx, updateTranscription, arg.Transcription, arg.ID)
 	return err
 }
+
+const updateUserSettings = `-- name: UpdateUserSettings :exec
+UPDATE users
+SET asr_language = $1,
+    asr_model = $2,
+    speakers = $3,
+    report_type = $4,
+    report_format = $5,
+    notify_done = $6
+WHERE tg_user_id = $7
+`
+
+type UpdateUserSettingsParams struct {
+	AsrLanguage  string
+	AsrModel     string
+	Speakers     pgtype.Int4
+	ReportType   pgtype.Text
+	ReportFormat pgtype.Text
+	NotifyDone   bool
+	TgUserID     int64
+}
+
+func (q *Queries) UpdateUserSettings(ctx context.Context, arg UpdateUserSettingsParams) error {
+	_, err := q.db.Exec(ctx, updateUserSettings,
+		arg.AsrLanguage,
+		arg.AsrModel,
+		arg.Speakers,
+		arg.ReportType,
+		arg.ReportFormat,
+		arg.NotifyDone,
+		arg.TgUserID,
+	)
+	return err
+}
+
+const updateWhisperTaskID = `-- name: UpdateWhisperTaskID :exec
+UPDATE transcribitions
+SET whisper_task_id = $1
+WHERE id = $2
+`
+
+type UpdateWhisperTaskIDParams struct {
+	WhisperTaskID pgtype.Text
+	ID            int64
+}
+
+func (q *Queries) UpdateWhisperTaskID(ctx context.Context, arg UpdateWhisperTaskIDParams) error {
+	_, err := q.db.Exec(ctx, updateWhisperTaskID, arg.WhisperTaskID, arg.ID)
+	return err
+}
+
+const useInvite = `-- name: UseInvite :one
+UPDATE invites
+SET used_by = $1,
+    used_at = current_timestamp
+WHERE code = $2 AND used_by IS NULL
+RETURNING role
+`
+
+type UseInviteParams struct {
+	UsedBy pgtype.Int8
+	Code   string
+}
+
+// An invite is used once.
+func (q *Queries) UseInvite(ctx context.Context, arg UseInviteParams) (string, error) {
+	row := q.db.QueryRow(ctx, useInvite, arg.UsedBy, arg.Code)
+	var role string
+	err := row.Scan(&role)
+	return role, err
+}
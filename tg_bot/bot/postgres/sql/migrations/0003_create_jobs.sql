@@ -0,0 +1,16 @@
+-- +goose Up
+CREATE TABLE jobs (
+  id                BIGSERIAL PRIMARY KEY,
+  transcribition_id BIGINT NOT NULL REFERENCES transcribitions(id) ON DELETE CASCADE,
+  stage             INT NOT NULL,
+  state             TEXT NOT NULL DEFAULT 'pending',
+  attempts          INT NOT NULL DEFAULT 0,
+  locked_at         timestamp,
+  created_at        timestamp default current_timestamp,
+  updated_at        timestamp default current_timestamp
+);
+
+CREATE INDEX jobs_state_idx ON jobs (state, id);
+
+-- +goose Down
+DROP TABLE jobs;
@@ -0,0 +1,5 @@
+-- +goose Up
+ALTER TABLE transcribitions ADD COLUMN whisper_task_id TEXT;
+
+-- +goose Down
+ALTER TABLE transcribitions DROP COLUMN whisper_task_id;
@@ -0,0 +1,14 @@
+-- +goose Up
+CREATE TABLE stage_errors (
+  id                BIGSERIAL PRIMARY KEY,
+  transcribition_id BIGINT NOT NULL REFERENCES transcribitions(id) ON DELETE CASCADE,
+  stage             INT NOT NULL,
+  code              TEXT NOT NULL,
+  message           TEXT NOT NULL,
+  created_at        timestamp default current_timestamp
+);
+
+CREATE INDEX stage_errors_transcribition_idx ON stage_errors (transcribition_id, id);
+
+-- +goose Down
+DROP TABLE stage_errors;
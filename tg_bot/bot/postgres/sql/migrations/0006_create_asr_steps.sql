@@ -0,0 +1,14 @@
+-- +goose Up
+CREATE TABLE asr_steps (
+  transcribition_id BIGINT NOT NULL REFERENCES transcribitions(id) ON DELETE CASCADE,
+  step              TEXT NOT NULL,
+  speakers          INT,
+  whisper_task_id   TEXT,
+  result            TEXT,
+  created_at        timestamp default current_timestamp,
+  updated_at        timestamp default current_timestamp,
+  PRIMARY KEY (transcribition_id, step)
+);
+
+-- +goose Down
+DROP TABLE asr_steps;
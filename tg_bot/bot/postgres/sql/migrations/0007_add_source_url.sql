@@ -0,0 +1,5 @@
+-- +goose Up
+ALTER TABLE transcribitions ADD COLUMN source_url TEXT;
+
+-- +goose Down
+ALTER TABLE transcribitions DROP COLUMN source_url;
@@ -0,0 +1,5 @@
+-- +goose Up
+ALTER TABLE transcribitions ADD COLUMN original_name_minio TEXT;
+
+-- +goose Down
+ALTER TABLE transcribitions DROP COLUMN original_name_minio;
@@ -0,0 +1,17 @@
+-- +goose Up
+ALTER TABLE users
+  ADD COLUMN asr_language  TEXT NOT NULL DEFAULT 'ru',
+  ADD COLUMN asr_model     TEXT NOT NULL DEFAULT 'large-v3',
+  ADD COLUMN speakers      INT,
+  ADD COLUMN report_type   TEXT,
+  ADD COLUMN report_format TEXT,
+  ADD COLUMN notify_done   BOOLEAN NOT NULL DEFAULT TRUE;
+
+-- +goose Down
+ALTER TABLE users
+  DROP COLUMN asr_language,
+  DROP COLUMN asr_model,
+  DROP COLUMN speakers,
+  DROP COLUMN report_type,
+  DROP COLUMN report_format,
+  DROP COLUMN notify_done;
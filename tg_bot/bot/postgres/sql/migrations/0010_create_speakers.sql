@@ -0,0 +1,23 @@
+-- +goose Up
+CREATE TABLE speakers (
+  transcribition_id BIGINT NOT NULL REFERENCES transcribitions(id) ON DELETE CASCADE,
+  label             TEXT NOT NULL,
+  name              TEXT,
+  role              TEXT,
+  quote             TEXT,
+  prompt_message_id BIGINT,
+  PRIMARY KEY (transcribition_id, label)
+);
+
+CREATE TABLE known_speakers (
+  id         BIGSERIAL PRIMARY KEY,
+  tg_user_id BIGINT NOT NULL,
+  name       TEXT NOT NULL,
+  role       TEXT,
+  used_at    timestamp default current_timestamp,
+  UNIQUE (tg_user_id, name)
+);
+
+-- +goose Down
+DROP TABLE known_speakers;
+DROP TABLE speakers;
@@ -0,0 +1,21 @@
+-- +goose Up
+-- tg_user_id keeps the uploader, chat_id is the chat the meeting belongs to.
+ALTER TABLE transcribitions
+  ADD COLUMN chat_id           BIGINT,
+  ADD COLUMN message_thread_id BIGINT;
+
+UPDATE transcribitions SET chat_id = tg_user_id;
+
+ALTER TABLE transcribitions ALTER COLUMN chat_id SET NOT NULL;
+
+CREATE TABLE chats (
+  chat_id      BIGINT PRIMARY KEY,
+  auto_process BOOLEAN NOT NULL
+);
+
+-- +goose Down
+DROP TABLE chats;
+
+ALTER TABLE transcribitions
+  DROP COLUMN chat_id,
+  DROP COLUMN message_thread_id;
@@ -0,0 +1,14 @@
+-- +goose Up
+-- title comes from the caption, /rename or the name of the report generated by the LLM.
+ALTER TABLE transcribitions
+  ADD COLUMN title       TEXT,
+  ADD COLUMN description TEXT,
+  ADD COLUMN tags        TEXT[] NOT NULL DEFAULT '{}',
+  ADD COLUMN started_at  TIMESTAMP;
+
+-- +goose Down
+ALTER TABLE transcribitions
+  DROP COLUMN title,
+  DROP COLUMN description,
+  DROP COLUMN tags,
+  DROP COLUMN started_at;
@@ -0,0 +1,18 @@
+-- +goose Up
+-- remind_at is the next reminder sent to tg_user_id, the owner of the meeting.
+CREATE TABLE errands (
+  id                BIGSERIAL PRIMARY KEY,
+  transcribition_id BIGINT NOT NULL REFERENCES transcribitions(id) ON DELETE CASCADE,
+  tg_user_id        BIGINT NOT NULL,
+  assignee          TEXT,
+  context           TEXT NOT NULL,
+  deadline          TIMESTAMP,
+  remind_at         TIMESTAMP,
+  done              BOOLEAN NOT NULL DEFAULT false,
+  created_at        timestamp default current_timestamp
+);
+
+CREATE INDEX errands_remind_at_idx ON errands (remind_at) WHERE NOT done;
+
+-- +goose Down
+DROP TABLE errands;
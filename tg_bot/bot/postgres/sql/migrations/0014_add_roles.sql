@@ -0,0 +1,26 @@
+-- +goose Up
+-- A user without a role gets the default role from the config, the users who
+-- already uploaded meetings keep their access.
+ALTER TABLE users
+  ADD COLUMN role           TEXT,
+  ADD COLUMN username       TEXT,
+  ADD COLUMN api_token_hash TEXT UNIQUE;
+
+UPDATE users SET role = 'member';
+
+CREATE TABLE invites (
+  code       TEXT PRIMARY KEY,
+  role       TEXT NOT NULL,
+  created_by BIGINT NOT NULL,
+  used_by    BIGINT,
+  created_at timestamp default current_timestamp,
+  used_at    timestamp
+);
+
+-- +goose Down
+DROP TABLE invites;
+
+ALTER TABLE users
+  DROP COLUMN role,
+  DROP COLUMN username,
+  DROP COLUMN api_token_hash;
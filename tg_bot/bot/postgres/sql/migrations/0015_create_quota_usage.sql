@@ -0,0 +1,16 @@
+-- +goose Up
+-- kind is "audio" with the amount in seconds or "report" with one per request.
+-- Deleting a meeting does not give the quota back.
+CREATE TABLE quota_usage (
+  id                BIGSERIAL PRIMARY KEY,
+  tg_user_id        BIGINT NOT NULL,
+  kind              TEXT NOT NULL,
+  amount            BIGINT NOT NULL,
+  transcribition_id BIGINT REFERENCES transcribitions(id) ON DELETE SET NULL,
+  created_at        TIMESTAMP NOT NULL
+);
+
+CREATE INDEX quota_usage_user_idx ON quota_usage (tg_user_id, kind, created_at);
+
+-- +goose Down
+DROP TABLE quota_usage;
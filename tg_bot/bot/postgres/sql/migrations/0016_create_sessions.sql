@@ -0,0 +1,30 @@
+-- +goose Up
+-- A session collects the parts of one meeting uploaded between /begin and /end,
+-- a user has at most one open session per chat.
+CREATE TABLE sessions (
+  id                BIGSERIAL PRIMARY KEY,
+  tg_user_id        BIGINT NOT NULL,
+  chat_id           BIGINT NOT NULL,
+  message_thread_id BIGINT,
+  caption           TEXT,
+  transcribition_id BIGINT REFERENCES transcribitions(id) ON DELETE SET NULL,
+  created_at        timestamp default current_timestamp,
+  ended_at          TIMESTAMP
+);
+
+CREATE UNIQUE INDEX sessions_open_idx ON sessions (chat_id, tg_user_id) WHERE ended_at IS NULL;
+
+-- The parts are ordered by the messages they were sent in, duration is in seconds.
+CREATE TABLE session_parts (
+  id                 BIGSERIAL PRIMARY KEY,
+  session_id         BIGINT NOT NULL REFERENCES sessions(id) ON DELETE CASCADE,
+  message_id         BIGINT NOT NULL,
+  audio_name_minio   TEXT NOT NULL,
+  audio_bucket_minio TEXT NOT NULL,
+  duration           DOUBLE PRECISION NOT NULL,
+  created_at         timestamp default current_timestamp
+);
+
+-- +goose Down
+DROP TABLE session_parts;
+DROP TABLE sessions;
@@ -0,0 +1,30 @@
+-- +goose Up
+-- Every protocol of the meeting is kept: the one generated by the LLM and the
+-- ones edited by the users, tg_user_id is NULL for the LLM. The reports use the
+-- latest version, the meetings from before it fall back to llama_output.
+CREATE TABLE protocol_versions (
+  transcribition_id BIGINT NOT NULL REFERENCES transcribitions(id) ON DELETE CASCADE,
+  version           INT NOT NULL,
+  content           TEXT NOT NULL,
+  tg_user_id        BIGINT,
+  created_at        timestamp default current_timestamp,
+  PRIMARY KEY (transcribition_id, version)
+);
+
+-- An edit waits for the reply to its prompt message, version is the protocol
+-- the item was picked in, so a reply to an outdated prompt is refused.
+CREATE TABLE protocol_edits (
+  chat_id           BIGINT NOT NULL,
+  prompt_message_id BIGINT NOT NULL,
+  transcribition_id BIGINT NOT NULL REFERENCES transcribitions(id) ON DELETE CASCADE,
+  tg_user_id        BIGINT NOT NULL,
+  action            TEXT NOT NULL,
+  target            TEXT NOT NULL,
+  version           INT NOT NULL,
+  created_at        timestamp default current_timestamp,
+  PRIMARY KEY (chat_id, prompt_message_id)
+);
+
+-- +goose Down
+DROP TABLE protocol_edits;
+DROP TABLE protocol_versions;
@@ -0,0 +1,9 @@
+-- +goose Up
+-- A version is confirmed by the user who reviewed it, the reminders of its
+-- errands and the default report wait for the confirmation.
+ALTER TABLE protocol_versions ADD COLUMN confirmed_by BIGINT;
+ALTER TABLE protocol_versions ADD COLUMN confirmed_at timestamp;
+
+-- +goose Down
+ALTER TABLE protocol_versions DROP COLUMN confirmed_at;
+ALTER TABLE protocol_versions DROP COLUMN confirmed_by;
@@ -0,0 +1,12 @@
+-- +goose Up
+-- The members of the groups the bot has seen, the API shows them the meetings
+-- of their groups.
+CREATE TABLE chat_members (
+  chat_id    BIGINT NOT NULL,
+  tg_user_id BIGINT NOT NULL,
+  created_at timestamp default current_timestamp,
+  PRIMARY KEY (chat_id, tg_user_id)
+);
+
+-- +goose Down
+DROP TABLE chat_members;
@@ -0,0 +1,7 @@
+-- +goose Up
+-- The length of the stored audio probed at upload, the audio quota is charged
+-- by it. It is NULL for the meetings from before it.
+ALTER TABLE transcribitions ADD COLUMN audio_seconds INT;
+
+-- +goose Down
+ALTER TABLE transcribitions DROP COLUMN audio_seconds;
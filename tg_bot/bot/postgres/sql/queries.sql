@@ -1,9 +1,11 @@
 -- name: CreateTranscribition :one
 INSERT INTO transcribitions (
   tg_user_id,
+  chat_id,
+  message_thread_id,
   message_to_edit
 ) VALUES (
-  $1, $2
+  $1, $2, $3, $4
 )
 RETURNING id;
 
@@ -18,11 +20,36 @@ WHERE id = $1 LIMIT 1;
 -- name: GetTranscribitions :many
 SELECT * FROM transcribitions;
 
+-- name: GetChatTranscribitions :many
+SELECT * FROM transcribitions
+WHERE chat_id = $1
+ORDER BY id DESC
+LIMIT $2 OFFSET $3;
+
+-- name: CountChatTranscribitions :one
+SELECT count(*) FROM transcribitions
+WHERE chat_id = $1;
+
+-- name: DeleteTranscribition :exec
+DELETE FROM transcribitions
+WHERE id = $1;
+
 -- name: UpdateMinioLink :exec
 UPDATE transcribitions
 SET audio_name_minio = $1,
-    audio_bucket_minio = $2
-WHERE id = $3;
+    audio_bucket_minio = $2,
+    audio_seconds = $3
+WHERE id = $4;
+
+-- name: UpdateOriginalName :exec
+UPDATE transcribitions
+SET original_name_minio = $1
+WHERE id = $2;
+
+-- name: UpdateSourceURL :exec
+UPDATE transcribitions
+SET source_url = $1
+WHERE id = $2;
 
 -- name: UpdateTranscription :exec
 UPDATE transcribitions
@@ -39,6 +66,20 @@ UPDATE transcribitions
 SET llama_output = $1
 WHERE id = $2;
 
+-- name: GetChat :one
+SELECT * FROM chats
+WHERE chat_id = $1 LIMIT 1;
+
+-- name: SetChatAutoProcess :exec
+INSERT INTO chats (
+  chat_id,
+  auto_process
+) VALUES (
+  $1, $2
+)
+ON CONFLICT (chat_id) DO UPDATE
+SET auto_process = excluded.auto_process;
+
 -- name: CreateUser :exec
 INSERT INTO users (
   tg_user_id 
@@ -53,7 +94,521 @@ UPDATE users
 SET current_bot_id = $1
 WHERE tg_user_id = $2;
 
+-- name: UpdateUserSettings :exec
+UPDATE users
+SET asr_language = $1,
+    asr_model = $2,
+    speakers = $3,
+    report_type = $4,
+    report_format = $5,
+    notify_done = $6
+WHERE tg_user_id = $7;
+
 -- name: UpdateCurrentBotStatus :exec
 UPDATE users
 SET current_bot_status = $1
 WHERE tg_user_id = $2;
+
+-- name: CreateJob :one
+-- No job is created for a finished transcribition, e.g. cancelled during the upload.
+INSERT INTO jobs (
+  transcribition_id,
+  stage
+)
+SELECT id, $2 FROM transcribitions
+WHERE id = $1 AND COALESCE(status, 0) < $3
+RETURNING id;
+
+-- name: ClaimJob :one
+-- Jobs of a stage are taken round-robin between users: the first pending job of
+-- every user goes before the second one of anybody, and so on. The jobs of
+-- finished transcribitions are skipped.
+UPDATE jobs
+SET state = 'running',
+    attempts = attempts + 1,
+    locked_at = current_timestamp,
+    updated_at = current_timestamp
+WHERE id = (
+  SELECT j.id FROM jobs j
+  JOIN transcribitions t ON t.id = j.transcribition_id
+  WHERE j.state = 'pending' AND j.stage = $1
+    AND COALESCE(t.status, 0) < $2
+  ORDER BY (
+    SELECT count(*) FROM jobs p
+    JOIN transcribitions pt ON pt.id = p.transcribition_id
+    WHERE p.state = 'pending'
+      AND p.stage = j.stage
+      AND pt.tg_user_id = t.tg_user_id
+      AND p.id < j.id
+  ), j.id
+  FOR UPDATE OF j SKIP LOCKED
+  LIMIT 1
+)
+RETURNING *;
+
+-- name: AdvanceJob :exec
+UPDATE jobs
+SET stage = $1,
+    state = 'pending',
+    locked_at = NULL,
+    updated_at = current_timestamp
+WHERE id = $2 AND state = 'running';
+
+-- name: HoldJob :exec
+-- A held job is not claimed until it is released, e.g. while the speakers are named.
+UPDATE jobs
+SET stage = $1,
+    state = 'waiting',
+    locked_at = NULL,
+    updated_at = current_timestamp
+WHERE id = $2 AND state = 'running';
+
+-- name: ReleaseJob :execrows
+UPDATE jobs
+SET state = 'pending',
+    updated_at = current_timestamp
+WHERE transcribition_id = $1 AND state = 'waiting';
+
+-- name: ReleaseExpiredJobs :many
+UPDATE jobs
+SET state = 'pending',
+    updated_at = current_timestamp
+WHERE state = 'waiting'
+  AND updated_at < current_timestamp - make_interval(secs => $1)
+RETURNING transcribition_id;
+
+-- name: UpdateJobState :exec
+UPDATE jobs
+SET state = $1,
+    locked_at = NULL,
+    updated_at = current_timestamp
+WHERE id = $2 AND state = 'running';
+
+-- name: RequeueRunningJobs :exec
+UPDATE jobs
+SET state = 'pending',
+    locked_at = NULL,
+    updated_at = current_timestamp
+WHERE state = 'running';
+
+-- name: GetUnqueuedTranscribitions :many
+SELECT * FROM transcribitions t
+WHERE t.status < $1
+  AND t.audio_name_minio IS NOT NULL
+  AND NOT EXISTS (
+    SELECT 1 FROM jobs j
+    WHERE j.transcribition_id = t.id
+  );
+
+-- name: UpdateWhisperTaskID :exec
+UPDATE transcribitions
+SET whisper_task_id = $1
+WHERE id = $2;
+
+-- name: CreateStageError :exec
+INSERT INTO stage_errors (
+  transcribition_id,
+  stage,
+  code,
+  message
+) VALUES (
+  $1, $2, $3, $4
+);
+
+-- name: GetLastStageError :one
+SELECT * FROM stage_errors
+WHERE transcribition_id = $1
+ORDER BY id DESC
+LIMIT 1;
+
+-- name: CancelJobs :exec
+UPDATE jobs
+SET state = 'cancelled',
+    locked_at = NULL,
+    updated_at = current_timestamp
+WHERE transcribition_id = $1
+  AND state IN ('pending', 'running', 'waiting');
+
+-- name: GetJobQueue :many
+WITH pending AS (
+  SELECT j.id,
+         j.transcribition_id,
+         t.chat_id,
+         t.message_to_edit,
+         row_number() OVER (PARTITION BY t.tg_user_id ORDER BY j.id) AS user_rank
+  FROM jobs j
+  JOIN transcribitions t ON t.id = j.transcribition_id
+  WHERE j.state = 'pending' AND j.stage = $1
+)
+SELECT transcribition_id,
+       chat_id,
+       message_to_edit,
+       row_number() OVER (ORDER BY user_rank, id) AS position
+FROM pending
+ORDER BY position;
+
+-- name: GetAsrSteps :many
+SELECT * FROM asr_steps
+WHERE transcribition_id = $1;
+
+-- name: CreateAsrStep :exec
+-- Starting a step over drops its task and result.
+INSERT INTO asr_steps (
+  transcribition_id,
+  step,
+  speakers
+) VALUES (
+  $1, $2, $3
+)
+ON CONFLICT (transcribition_id, step) DO UPDATE
+SET speakers = excluded.speakers,
+    whisper_task_id = NULL,
+    result = NULL,
+    updated_at = current_timestamp;
+
+-- name: UpdateAsrStepTask :exec
+UPDATE asr_steps
+SET whisper_task_id = $1,
+    updated_at = current_timestamp
+WHERE transcribition_id = $2 AND step = $3;
+
+-- name: UpdateAsrStepResult :exec
+UPDATE asr_steps
+SET result = $1,
+    updated_at = current_timestamp
+WHERE transcribition_id = $2 AND step = $3;
+
+-- name: DeleteAsrStep :exec
+DELETE FROM asr_steps
+WHERE transcribition_id = $1 AND step = $2;
+
+-- name: CreateSpeaker :exec
+-- A label asked again after re-diarization keeps its name, the new prompt shows it for correction.
+INSERT INTO speakers (
+  transcribition_id,
+  label,
+  quote,
+  prompt_message_id
+) VALUES (
+  $1, $2, $3, $4
+)
+ON CONFLICT (transcribition_id, label) DO UPDATE
+SET quote = excluded.quote,
+    prompt_message_id = excluded.prompt_message_id;
+
+-- name: DeleteStaleSpeakers :exec
+-- The labels the new diarization has no more.
+DELETE FROM speakers
+WHERE transcribition_id = $1 AND NOT (label = ANY(sqlc.arg(labels)::text[]));
+
+-- name: GetSpeakers :many
+SELECT * FROM speakers
+WHERE transcribition_id = $1
+ORDER BY label;
+
+-- name: GetSpeakerByPrompt :one
+SELECT s.* FROM speakers s
+JOIN transcribitions t ON t.id = s.transcribition_id
+WHERE t.chat_id = $1 AND s.prompt_message_id = $2
+LIMIT 1;
+
+-- name: UpdateSpeakerName :exec
+UPDATE speakers
+SET name = $1,
+    role = $2
+WHERE transcribition_id = $3 AND label = $4;
+
+-- name: SaveKnownSpeaker :exec
+-- Names used last are suggested first.
+INSERT INTO known_speakers (
+  tg_user_id,
+  name,
+  role
+) VALUES (
+  $1, $2, $3
+)
+ON CONFLICT (tg_user_id, name) DO UPDATE
+SET role = excluded.role,
+    used_at = current_timestamp;
+
+-- name: GetKnownSpeakers :many
+SELECT * FROM known_speakers
+WHERE tg_user_id = $1
+ORDER BY used_at DESC
+LIMIT $2;
+
+-- name: GetKnownSpeaker :one
+SELECT * FROM known_speakers
+WHERE id = $1 LIMIT 1;
+
+-- name: GetTranscribitionByStatusMessage :one
+SELECT * FROM transcribitions
+WHERE chat_id = $1 AND message_to_edit = $2
+LIMIT 1;
+
+-- name: GetLastTranscribed :one
+SELECT * FROM transcribitions
+WHERE chat_id = $1 AND transcription IS NOT NULL
+ORDER BY id DESC
+LIMIT 1;
+
+-- name: UpdateMeetingInfo :exec
+UPDATE transcribitions
+SET title = $1,
+    description = $2,
+    tags = $3,
+    started_at = $4
+WHERE id = $5;
+
+-- name: SetGeneratedTitle :exec
+-- The title given by the user is kept.
+UPDATE transcribitions
+SET title = COALESCE(title, $1)
+WHERE id = $2;
+
+-- name: CreateErrand :exec
+INSERT INTO errands (
+  transcribition_id,
+  tg_user_id,
+  assignee,
+  context,
+  deadline,
+  remind_at
+) VALUES (
+  $1, $2, $3, $4, $5, $6
+);
+
+-- name: DeleteErrands :exec
+-- The errands marked done are kept, so they are not reminded of again.
+DELETE FROM errands
+WHERE transcribition_id = $1 AND NOT done;
+
+-- name: GetDoneErrands :many
+SELECT * FROM errands
+WHERE transcribition_id = $1 AND done;
+
+-- name: GetErrand :one
+SELECT * FROM errands
+WHERE id = $1 LIMIT 1;
+
+-- name: GetDueErrands :many
+SELECT * FROM errands
+WHERE NOT done AND remind_at <= $1
+ORDER BY remind_at
+LIMIT $2;
+
+-- name: SetErrandReminder :exec
+UPDATE errands
+SET remind_at = $1
+WHERE id = $2;
+
+-- name: CompleteErrand :exec
+UPDATE errands
+SET done = true,
+    remind_at = NULL
+WHERE id = $1;
+
+-- name: SetUserRole :exec
+INSERT INTO users (
+  tg_user_id,
+  role
+) VALUES (
+  $1, $2
+)
+ON CONFLICT(tg_user_id)
+DO UPDATE SET role = excluded.role;
+
+-- name: SetUsername :exec
+INSERT INTO users (
+  tg_user_id,
+  username
+) VALUES (
+  $1, $2
+)
+ON CONFLICT(tg_user_id)
+DO UPDATE SET username = excluded.username;
+
+-- name: GetUsersWithRoles :many
+SELECT * FROM users
+WHERE role IS NOT NULL
+ORDER BY role, tg_user_id;
+
+-- name: SetAPIToken :exec
+UPDATE users
+SET api_token_hash = $1
+WHERE tg_user_id = $2;
+
+-- name: GetUserByAPIToken :one
+SELECT * FROM users
+WHERE api_token_hash = $1 LIMIT 1;
+
+-- name: GetUserTranscribitions :many
+-- The meetings the user uploaded and the meetings of the groups the user is a member of.
+SELECT * FROM transcribitions
+WHERE tg_user_id = $1
+   OR chat_id IN (SELECT chat_id FROM chat_members WHERE tg_user_id = $1)
+ORDER BY id DESC;
+
+-- name: CreateInvite :exec
+INSERT INTO invites (
+  code,
+  role,
+  created_by
+) VALUES (
+  $1, $2, $3
+);
+
+-- name: UseInvite :one
+-- An invite is used once.
+UPDATE invites
+SET used_by = $1,
+    used_at = current_timestamp
+WHERE code = $2 AND used_by IS NULL
+RETURNING role;
+
+-- name: CreateQuotaUsage :exec
+INSERT INTO quota_usage (
+  tg_user_id,
+  kind,
+  amount,
+  transcribition_id,
+  created_at
+) VALUES (
+  $1, $2, $3, $4, $5
+);
+
+-- name: CreateQuotaUsageOnce :exec
+-- The usage of a kind is charged once per transcribition, re-runs of its stages are free.
+INSERT INTO quota_usage (
+  tg_user_id,
+  kind,
+  amount,
+  transcribition_id,
+  created_at
+)
+SELECT $1, $2, $3, $4, $5
+WHERE NOT EXISTS (
+  SELECT 1 FROM quota_usage
+  WHERE transcribition_id = $4 AND kind = $2
+);
+
+-- name: SumQuotaUsage :one
+SELECT COALESCE(SUM(amount), 0)::bigint FROM quota_usage
+WHERE tg_user_id = $1 AND kind = $2 AND created_at >= $3;
+
+-- name: CountActiveTranscribitions :one
+-- Meetings with a job queued, running or waiting for the speakers are still being processed.
+SELECT count(DISTINCT t.id) FROM transcribitions t
+JOIN jobs j ON j.transcribition_id = t.id
+WHERE t.tg_user_id = $1 AND j.state IN ('pending', 'running', 'waiting');
+
+-- name: CreateSession :exec
+INSERT INTO sessions (
+  tg_user_id,
+  chat_id,
+  message_thread_id,
+  caption
+) VALUES (
+  $1, $2, $3, $4
+);
+
+-- name: GetOpenSession :one
+SELECT * FROM sessions
+WHERE chat_id = $1 AND tg_user_id = $2 AND ended_at IS NULL
+LIMIT 1;
+
+-- name: AddSessionPart :exec
+INSERT INTO session_parts (
+  session_id,
+  message_id,
+  audio_name_minio,
+  audio_bucket_minio,
+  duration
+) VALUES (
+  $1, $2, $3, $4, $5
+);
+
+-- name: GetSessionParts :many
+SELECT * FROM session_parts
+WHERE session_id = $1
+ORDER BY message_id, id;
+
+-- name: EndSession :execrows
+-- Only one /end closes the session, the others find it closed.
+UPDATE sessions
+SET ended_at = $1
+WHERE id = $2 AND ended_at IS NULL;
+
+-- name: SetSessionTranscribition :exec
+UPDATE sessions
+SET transcribition_id = $1
+WHERE id = $2;
+
+-- name: DeleteSession :exec
+DELETE FROM sessions
+WHERE id = $1;
+
+-- name: CreateProtocolVersion :one
+INSERT INTO protocol_versions (
+  transcribition_id,
+  version,
+  content,
+  tg_user_id
+)
+SELECT $1, COALESCE(MAX(version), 0) + 1, $2, $3
+FROM protocol_versions
+WHERE transcribition_id = $1
+RETURNING version;
+
+-- name: GetLatestProtocolVersion :one
+SELECT * FROM protocol_versions
+WHERE transcribition_id = $1
+ORDER BY version DESC
+LIMIT 1;
+
+-- name: ConfirmProtocolVersion :execrows
+UPDATE protocol_versions
+SET confirmed_by = $1,
+    confirmed_at = $2
+WHERE transcribition_id = $3 AND version = $4 AND confirmed_at IS NULL;
+
+-- name: CreateProtocolEdit :exec
+INSERT INTO protocol_edits (
+  chat_id,
+  prompt_message_id,
+  transcribition_id,
+  tg_user_id,
+  action,
+  target,
+  version
+) VALUES (
+  $1, $2, $3, $4, $5, $6, $7
+);
+
+-- name: GetProtocolEdit :one
+SELECT * FROM protocol_edits
+WHERE chat_id = $1 AND prompt_message_id = $2
+LIMIT 1;
+
+-- name: DeleteProtocolEdit :exec
+DELETE FROM protocol_edits
+WHERE chat_id = $1 AND prompt_message_id = $2;
+
+-- name: CreateChatMember :exec
+INSERT INTO chat_members (
+  chat_id,
+  tg_user_id
+) VALUES (
+  $1, $2
+)
+ON CONFLICT DO NOTHING;
+
+-- name: DeleteChatMember :exec
+DELETE FROM chat_members
+WHERE chat_id = $1 AND tg_user_id = $2;
+
+-- name: IsChatMember :one
+SELECT EXISTS (
+  SELECT 1 FROM chat_members
+  WHERE chat_id = $1 AND tg_user_id = $2
+);
@@ -0,0 +1,992 @@
+package bot
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+	"github.com/gulldan/cp2024omsk-pmsk/bot/transcript"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+
+	postgres "github.com/gulldan/cp2024omsk-pmsk/bot/postgres/generated"
+)
+
+const (
+	PROTOCOL          = "/protocol"
+	PROTOCOL_CALLBACK = "protocol_"
+
+	PROTOCOL_HINT      = "Проверьте протокол: выберите раздел, чтобы исправить, удалить или добавить пункты. Отчеты строятся по последней версии. Напоминания о поручениях и отчет по умолчанию будут созданы, когда протокол утвердят."
+	PROTOCOL_NOT_READY = "Протокол еще не готов."
+	PROTOCOL_OUTDATED  = "Протокол уже изменился, откройте его заново: /protocol."
+	PROTOCOL_SAVED     = "Сохранено, версия %d. Отчеты будут построены по ней, напоминания о поручениях обновятся, когда ее утвердят."
+	PROTOCOL_ERRAND    = "Ответьте на это сообщение поручением: в первой строке что сделать, во второй ответственный, в третьей срок в формате ДД.ММ.ГГГГ. Ответственного и срок можно пропустить или указать «-»."
+	PROTOCOL_BAD_DATE  = "Не удалось разобрать срок, укажите его в формате ДД.ММ.ГГГГ и ответьте на сообщение с вопросом еще раз."
+	PROTOCOL_EMPTY     = "Текст пункта пуст, ответьте на сообщение с вопросом еще раз."
+	PROTOCOL_CONFIRMED = "Протокол утвержден, версия %d."
+
+	protocolOpen    = PROTOCOL_CALLBACK + "open"
+	protocolView    = PROTOCOL_CALLBACK + "view"
+	protocolSection = PROTOCOL_CALLBACK + "s_"
+	protocolEdit    = PROTOCOL_CALLBACK + "e_"
+	protocolAdd     = PROTOCOL_CALLBACK + "n_"
+	protocolDelete  = PROTOCOL_CALLBACK + "d_"
+	protocolConfirm = PROTOCOL_CALLBACK + "ok_"
+
+	protocolActionEdit = "edit"
+	protocolActionAdd  = "add"
+
+	sectionAgenda = 'a'
+	sectionBlock  = 'b'
+	sectionErrand = 'e'
+
+	// maxItemPreview keeps the sections short enough for one message.
+	maxItemPreview = 300
+)
+
+var (
+	errProtocolItem  = errors.New("protocol item not found")
+	errBadDeadline   = errors.New("bad deadline")
+	errEmptyItem     = errors.New("empty protocol item")
+	itemNumberPrefix = regexp.MustCompile(`^(\d+[.)]\s*|[-•]\s*)`)
+)
+
+// protocolTarget addresses a section or an item of the protocol in callback
+// data and pending edits: "a" is the agenda, "a2" its third item, "e" and "e2"
+// the errands, "b" the blocks, "b1" the second block and "b1-2" its third proposal.
+type protocolTarget struct {
+	section byte
+	block   int
+	item    int
+}
+
+func (t protocolTarget) String() string {
+	s := string(t.section)
+	if t.section == sectionBlock && t.block >= 0 {
+		s += strconv.Itoa(t.block)
+		if t.item >= 0 {
+			s += "-" + strconv.Itoa(t.item)
+		}
+
+		return s
+	}
+
+	if t.item >= 0 {
+		s += strconv.Itoa(t.item)
+	}
+
+	return s
+}
+
+// parent is the section the target is shown in, a deleted block returns to the overview.
+func (t protocolTarget) parent() protocolTarget {
+	if t.section == sectionBlock && t.item < 0 {
+		return protocolTarget{section: sectionBlock, block: -1, item: -1}
+	}
+
+	return protocolTarget{section: t.section, block: t.block, item: -1}
+}
+
+func parseProtocolTarget(s string) (protocolTarget, error) {
+	t := protocolTarget{block: -1, item: -1}
+	if s == "" {
+		return t, errProtocolItem
+	}
+
+	t.section = s[0]
+	rest := s[1:]
+
+	switch t.section {
+	case sectionAgenda, sectionErrand:
+	case sectionBlock:
+		block, item, hasItem := strings.Cut(rest, "-")
+		if block == "" {
+			return t, nil
+		}
+
+		n, err := strconv.Atoi(block)
+		if err != nil {
+			return t, errProtocolItem
+		}
+		t.block = n
+
+		if !hasItem {
+			return t, nil
+		}
+		rest = item
+	default:
+		return t, errProtocolItem
+	}
+
+	if rest == "" {
+		return t, nil
+	}
+
+	n, err := strconv.Atoi(rest)
+	if err != nil {
+		return t, errProtocolItem
+	}
+	t.item = n
+
+	return t, nil
+}
+
+// protocolAction is <action><target>_<version>, the version keeps a button
+// pressed on an outdated view from changing another item.
+func protocolAction(action string, t protocolTarget, version int32) string {
+	return action + t.String() + "_" + strconv.FormatInt(int64(version), 10)
+}
+
+func parseProtocolAction(data, action string) (protocolTarget, int32, error) {
+	target, version, ok := strings.Cut(strings.TrimPrefix(data, action), "_")
+	if !ok {
+		return protocolTarget{}, 0, errProtocolItem
+	}
+
+	v, err := strconv.ParseInt(version, 10, 32)
+	if err != nil {
+		return protocolTarget{}, 0, errProtocolItem
+	}
+
+	t, err := parseProtocolTarget(target)
+
+	return t, int32(v), err
+}
+
+// parseProposal reads the proposal from the first line, the others are its context.
+func parseProposal(text string) ReportedProposal {
+	title, context, _ := strings.Cut(strings.TrimSpace(text), "\n")
+
+	return ReportedProposal{Text: strings.TrimSpace(title), Context: strings.TrimSpace(context)}
+}
+
+// parseErrand reads the errand from the lines: what to do, the assignee and
+// the deadline, the last two may be skipped or given as "-".
+func parseErrand(text string) (ReportedErrand, error) {
+	lines := strings.Split(strings.TrimSpace(text), "\n")
+	for len(lines) < 3 {
+		lines = append(lines, "")
+	}
+
+	field := func(s string) string {
+		if s = strings.TrimSpace(s); s == "-" {
+			return ""
+		}
+
+		return s
+	}
+
+	e := ReportedErrand{Context: field(lines[0]), Assignee: field(lines[1])}
+
+	if deadline := field(strings.Join(lines[2:], " ")); deadline != "" {
+		t, ok := parseDeadline(deadline)
+		if !ok {
+			return ReportedErrand{}, errBadDeadline
+		}
+
+		e.Deadline = t.Local().Format(time.RFC3339)
+		if dateOnly(t) {
+			e.Deadline = t.Local().Format("2006-01-02")
+		}
+	}
+
+	return e, nil
+}
+
+// removeItem deletes the item or the whole block of the protocol.
+func (p *ReportedRequest) removeItem(t protocolTarget) error {
+	switch {
+	case t.section == sectionAgenda && t.item >= 0 && t.item < len(p.Data.Agenda):
+		p.Data.Agenda = append(p.Data.Agenda[:t.item], p.Data.Agenda[t.item+1:]...)
+	case t.section == sectionErrand && t.item >= 0 && t.item < len(p.Data.Errands):
+		p.Data.Errands = append(p.Data.Errands[:t.item], p.Data.Errands[t.item+1:]...)
+	case t.section == sectionBlock && t.block >= 0 && t.block < len(p.Data.Blocks):
+		if t.item < 0 {
+			p.Data.Blocks = append(p.Data.Blocks[:t.block], p.Data.Blocks[t.block+1:]...)
+
+			return nil
+		}
+
+		b := &p.Data.Blocks[t.block]
+		if t.item >= len(b.Proposals) {
+			return errProtocolItem
+		}
+
+		b.Proposals = append(b.Proposals[:t.item], b.Proposals[t.item+1:]...)
+	default:
+		return errProtocolItem
+	}
+
+	return nil
+}
+
+// applyText replaces the item with the text or adds it to the section.
+func (p *ReportedRequest) applyText(action string, t protocolTarget, text string) error {
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return errEmptyItem
+	}
+
+	add := action == protocolActionAdd
+
+	switch t.section {
+	case sectionAgenda:
+		if add {
+			p.Data.Agenda = append(p.Data.Agenda, text)
+		} else if t.item >= 0 && t.item < len(p.Data.Agenda) {
+			p.Data.Agenda[t.item] = text
+		} else {
+			return errProtocolItem
+		}
+	case sectionErrand:
+		e, err := parseErrand(text)
+		if err != nil {
+			return err
+		}
+
+		if e.Context == "" {
+			return errEmptyItem
+		}
+
+		if add {
+			p.Data.Errands = append(p.Data.Errands, e)
+		} else if t.item >= 0 && t.item < len(p.Data.Errands) {
+			p.Data.Errands[t.item] = e
+		} else {
+			return errProtocolItem
+		}
+	case sectionBlock:
+		if t.block < 0 {
+			if !add {
+				return errProtocolItem
+			}
+
+			p.Data.Blocks = append(p.Data.Blocks, ReportedBlock{NameBlock: text, Proposals: []ReportedProposal{}})
+
+			return nil
+		}
+
+		if t.block >= len(p.Data.Blocks) {
+			return errProtocolItem
+		}
+
+		b := &p.Data.Blocks[t.block]
+		switch {
+		case add:
+			b.Proposals = append(b.Proposals, parseProposal(text))
+		case t.item < 0:
+			b.NameBlock = text
+		case t.item < len(b.Proposals):
+			// The proposal keeps its place in the recording.
+			proposal := parseProposal(text)
+			proposal.AudioTime = b.Proposals[t.item].AudioTime
+			b.Proposals[t.item] = proposal
+		default:
+			return errProtocolItem
+		}
+	default:
+		return errProtocolItem
+	}
+
+	return nil
+}
+
+// itemText is the text of the item as the user gave it, to be copied when editing.
+func (p ReportedRequest) itemText(t protocolTarget) string {
+	switch {
+	case t.section == sectionAgenda && t.item >= 0 && t.item < len(p.Data.Agenda):
+		return p.Data.Agenda[t.item]
+	case t.section == sectionErrand && t.item >= 0 && t.item < len(p.Data.Errands):
+		e := p.Data.Errands[t.item]
+		lines := []string{e.Context, e.Assignee, e.Deadline}
+		for i, l := range lines {
+			if l == "" {
+				lines[i] = "-"
+			}
+		}
+
+		return strings.Join(lines, "\n")
+	case t.section == sectionBlock && t.block >= 0 && t.block < len(p.Data.Blocks):
+		b := p.Data.Blocks[t.block]
+		if t.item < 0 {
+			return b.NameBlock
+		}
+
+		if t.item < len(b.Proposals) {
+			return strings.TrimSpace(b.Proposals[t.item].Text + "\n" + b.Proposals[t.item].Context)
+		}
+	}
+
+	return ""
+}
+
+// previewItem drops the numbering the LLM puts into the items, the preview numbers them itself.
+func previewItem(s string) string {
+	s = itemNumberPrefix.ReplaceAllString(strings.TrimSpace(s), "")
+	if r := []rune(s); len(r) > maxItemPreview {
+		return string(r[:maxItemPreview-1]) + "…"
+	}
+
+	return s
+}
+
+// errandLine describes the errand and warns about the deadlines the LLM may
+// have made up: the ones it wrote as no date and the ones before the meeting.
+func errandLine(e ReportedErrand, meeting time.Time) string {
+	line := previewItem(e.Context)
+	if e.Assignee != "" {
+		line += "\n   Ответственный: " + e.Assignee
+	}
+
+	if e.Deadline == "" {
+		return line
+	}
+
+	t, ok := parseDeadline(e.Deadline)
+	switch {
+	case !ok:
+		line += "\n   Срок: " + e.Deadline + " ⚠ срок не распознан"
+	case t.Local().Before(dayStart(meeting)):
+		line += "\n   Срок: " + formatDeadline(t) + " ⚠ срок раньше встречи"
+	default:
+		line += "\n   Срок: " + formatDeadline(t)
+	}
+
+	return line
+}
+
+func numbered(items []string) []string {
+	if len(items) == 0 {
+		return []string{"—"}
+	}
+
+	lines := make([]string, len(items))
+	for i, item := range items {
+		lines[i] = fmt.Sprintf("%d. %s", i+1, item)
+	}
+
+	return lines
+}
+
+func (p ReportedRequest) agendaLines() []string {
+	items := make([]string, len(p.Data.Agenda))
+	for i, a := range p.Data.Agenda {
+		items[i] = previewItem(a)
+	}
+
+	return numbered(items)
+}
+
+func (p ReportedRequest) blockLines(block int) []string {
+	b := p.Data.Blocks[block]
+
+	items := make([]string, len(b.Proposals))
+	for i, proposal := range b.Proposals {
+		items[i] = previewItem(proposal.Text)
+		if proposal.Context != "" {
+			items[i] += "\n   " + previewItem(proposal.Context)
+		}
+	}
+
+	return numbered(items)
+}
+
+func (p ReportedRequest) errandLines(meeting time.Time) []string {
+	items := make([]string, len(p.Data.Errands))
+	for i, e := range p.Data.Errands {
+		items[i] = errandLine(e, meeting)
+	}
+
+	return numbered(items)
+}
+
+func blockTitle(block int, b ReportedBlock) string {
+	return fmt.Sprintf("Блок %d. %s", block+1, previewItem(b.NameBlock))
+}
+
+// protocolPreview shows the whole protocol for review.
+func protocolPreview(tr postgres.Transcribition, p ReportedRequest, version int32, confirmed bool) string {
+	title := fmt.Sprintf("Протокол «%s», версия %d", meetingName(tr), version)
+	if confirmed {
+		title += " (утвержден)"
+	}
+
+	lines := []string{title, "", "Повестка:"}
+	lines = append(lines, p.agendaLines()...)
+
+	for i, b := range p.Data.Blocks {
+		lines = append(lines, "", blockTitle(i, b)+":")
+		lines = append(lines, p.blockLines(i)...)
+	}
+
+	lines = append(lines, "", "Поручения:")
+	lines = append(lines, p.errandLines(meetingTime(tr))...)
+	lines = append(lines, "", PROTOCOL_HINT)
+
+	return strings.Join(lines, "\n")
+}
+
+func (bw *BotWrapper) protocolKeyboard(pgID int64, p ReportedRequest, version int32, confirmed bool) *models.InlineKeyboardMarkup {
+	section := func(t protocolTarget) string {
+		return bw.signedData(protocolSection+t.String(), pgID)
+	}
+
+	keyboard := [][]models.InlineKeyboardButton{{
+		{Text: "Повестка", CallbackData: section(protocolTarget{section: sectionAgenda, block: -1, item: -1})},
+		{Text: "Поручения", CallbackData: section(protocolTarget{section: sectionErrand, block: -1, item: -1})},
+	}}
+
+	for i, b := range p.Data.Blocks {
+		keyboard = append(keyboard, []models.InlineKeyboardButton{
+			{Text: shortButton(blockTitle(i, b)), CallbackData: section(protocolTarget{section: sectionBlock, block: i, item: -1})},
+		})
+	}
+
+	keyboard = append(keyboard, []models.InlineKeyboardButton{
+		{Text: "➕ Новый блок", CallbackData: section(protocolTarget{section: sectionBlock, block: -1, item: -1})},
+	})
+
+	if !confirmed {
+		keyboard = append(keyboard, []models.InlineKeyboardButton{
+			{Text: "✅ Утвердить", CallbackData: bw.signedData(protocolConfirm+strconv.FormatInt(int64(version), 10), pgID)},
+		})
+	}
+
+	return &models.InlineKeyboardMarkup{InlineKeyboard: keyboard}
+}
+
+// protocolConfirmed reports whether the version is the latest one and confirmed.
+func (bw *BotWrapper) protocolConfirmed(ctx context.Context, pgID int64, version int32) bool {
+	latest, err := bw.psql.GetLatestProtocolVersion(ctx, pgID)
+	if err != nil {
+		if !errors.Is(err, pgx.ErrNoRows) {
+			bw.log.Error().Err(err).Int64("id", pgID).Msg("get protocol version failed")
+		}
+
+		return false
+	}
+
+	return latest.Version == version && latest.ConfirmedAt.Valid
+}
+
+// confirmProtocol marks the reviewed version as the final one: the reminders of
+// its errands are scheduled and the default report is started. A meeting from
+// before the versions is stored as one first.
+func (bw *BotWrapper) confirmProtocol(ctx context.Context, tr postgres.Transcribition, version int32, userID int64) (bool, error) {
+	if version == 0 {
+		raw, _, err := bw.protocolVersion(ctx, tr, nil)
+		if err != nil {
+			return false, err
+		}
+
+		if version, err = bw.saveProtocol(ctx, tr, raw, userID); err != nil {
+			return false, err
+		}
+	}
+
+	n, err := bw.psql.ConfirmProtocolVersion(ctx, postgres.ConfirmProtocolVersionParams{
+		ConfirmedBy:      pgtype.Int8{Int64: userID, Valid: true},
+		ConfirmedAt:      pgtype.Timestamp{Time: time.Now().UTC(), Valid: true},
+		TranscribitionID: tr.ID,
+		Version:          version,
+	})
+	if err != nil {
+		return false, fmt.Errorf("confirm protocol version failed: %w", err)
+	}
+
+	if n == 0 {
+		return false, nil
+	}
+
+	bw.log.Info().Int64("id", tr.ID).Int64("chatID", userID).Int32("version", version).Msg("protocol confirmed")
+	bw.saveErrands(ctx, tr)
+	bw.defaultReport(ctx, tr)
+
+	return true, nil
+}
+
+func shortButton(s string) string {
+	if r := []rune(s); len(r) > 40 {
+		return string(r[:39]) + "…"
+	}
+
+	return s
+}
+
+// sectionView shows one section with the buttons editing its items. The
+// section of the blocks without a block is the prompt for a new one.
+func (bw *BotWrapper) sectionView(tr postgres.Transcribition, p ReportedRequest, version int32, t protocolTarget) (string, *models.InlineKeyboardMarkup, error) {
+	var title string
+	var lines []string
+	var count int
+
+	switch {
+	case t.section == sectionAgenda:
+		title, lines, count = "Повестка", p.agendaLines(), len(p.Data.Agenda)
+	case t.section == sectionErrand:
+		title, lines, count = "Поручения", p.errandLines(meetingTime(tr)), len(p.Data.Errands)
+	case t.section == sectionBlock && t.block < 0:
+		title = "Новый блок"
+	case t.section == sectionBlock && t.block < len(p.Data.Blocks):
+		title, lines, count = blockTitle(t.block, p.Data.Blocks[t.block]), p.blockLines(t.block), len(p.Data.Blocks[t.block].Proposals)
+	default:
+		return "", nil, errProtocolItem
+	}
+
+	button := func(text, action string, target protocolTarget) models.InlineKeyboardButton {
+		return models.InlineKeyboardButton{Text: text, CallbackData: bw.signedData(protocolAction(action, target, version), tr.ID)}
+	}
+
+	var keyboard [][]models.InlineKeyboardButton
+	for i := 0; i < count; i++ {
+		item := protocolTarget{section: t.section, block: t.block, item: i}
+		keyboard = append(keyboard, []models.InlineKeyboardButton{
+			button(fmt.Sprintf("✏️ %d", i+1), protocolEdit, item),
+			button(fmt.Sprintf("🗑 %d", i+1), protocolDelete, item),
+		})
+	}
+
+	keyboard = append(keyboard, []models.InlineKeyboardButton{button("➕ Добавить", protocolAdd, t)})
+
+	if t.section == sectionBlock && t.block >= 0 {
+		keyboard = append(keyboard, []models.InlineKeyboardButton{
+			button("✏️ Название", protocolEdit, t),
+			button("🗑 Блок", protocolDelete, t),
+		})
+	}
+
+	keyboard = append(keyboard, []models.InlineKeyboardButton{
+		{Text: "« К протоколу", CallbackData: bw.signedData(protocolView, tr.ID)},
+	})
+
+	text := fmt.Sprintf("%s (версия %d):\n%s", title, version, strings.Join(lines, "\n"))
+
+	return clipMessage(text), &models.InlineKeyboardMarkup{InlineKeyboard: keyboard}, nil
+}
+
+func clipMessage(s string) string {
+	if r := []rune(s); len(r) > maxMessageLength {
+		return string(r[:maxMessageLength-1]) + "…"
+	}
+
+	return s
+}
+
+// editPrompt asks for the new text of the item, the user replies to it.
+func editPrompt(p ReportedRequest, action string, t protocolTarget) string {
+	var ask string
+	switch {
+	case t.section == sectionErrand:
+		ask = PROTOCOL_ERRAND
+	case t.section == sectionBlock && t.block < 0:
+		ask = "Ответьте на это сообщение названием нового блока."
+	case t.section == sectionBlock && t.item < 0 && action == protocolActionEdit:
+		ask = "Ответьте на это сообщение новым названием блока."
+	case t.section == sectionBlock:
+		ask = "Ответьте на это сообщение текстом пункта. Со следующей строки можно добавить пояснение."
+	default:
+		ask = "Ответьте на это сообщение текстом пункта повестки."
+	}
+
+	if action == protocolActionAdd {
+		return ask
+	}
+
+	return fmt.Sprintf("Сейчас:\n%s\n\n%s", clipMessage(p.itemText(t)), ask)
+}
+
+// saveProtocol stores the edited protocol as a new version, the reminders of
+// its errands wait until the version is confirmed.
+func (bw *BotWrapper) saveProtocol(ctx context.Context, tr postgres.Transcribition, p ReportedRequest, userID int64) (int32, error) {
+	content, err := json.Marshal(p)
+	if err != nil {
+		return 0, fmt.Errorf("marshal protocol failed: %w", err)
+	}
+
+	version, err := bw.psql.CreateProtocolVersion(ctx, postgres.CreateProtocolVersionParams{
+		TranscribitionID: tr.ID,
+		Content:          string(content),
+		TgUserID:         pgtype.Int8{Int64: userID, Valid: true},
+	})
+	if err != nil {
+		return 0, fmt.Errorf("create protocol version failed: %w", err)
+	}
+
+	bw.log.Info().Int64("id", tr.ID).Int64("chatID", userID).Int32("version", version).Msg("protocol edited")
+
+	return version, nil
+}
+
+// sendProtocol sends the preview of the protocol to the chat of the meeting,
+// the buttons come with the last part of it.
+func (bw *BotWrapper) sendProtocol(ctx context.Context, pgID int64) error {
+	tr, err := bw.psql.GetTranscribition(ctx, pgID)
+	if err != nil {
+		return fmt.Errorf("get transcribition failed: %w", err)
+	}
+
+	p, version, err := bw.protocolVersion(ctx, tr, bw.speakerNames(ctx, tr.ID))
+	if err != nil {
+		return err
+	}
+
+	confirmed := bw.protocolConfirmed(ctx, tr.ID, version)
+
+	parts := transcript.Split(protocolPreview(tr, p, version, confirmed), maxMessageLength)
+	for i, part := range parts {
+		params := &bot.SendMessageParams{
+			ChatID:          tr.ChatID,
+			MessageThreadID: int(tr.MessageThreadID.Int64),
+			Text:            part,
+		}
+
+		if i == len(parts)-1 {
+			params.ReplyMarkup = bw.protocolKeyboard(tr.ID, p, version, confirmed)
+		}
+
+		if _, err := bw.b.SendMessage(ctx, params); err != nil {
+			return fmt.Errorf("send protocol failed: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// protocolHandler sends the protocol of the meeting the command replies to or
+// of the last meeting of the chat for review.
+func (bw *BotWrapper) protocolHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
+	tr, err := bw.chatMeeting(ctx, update.Message)
+	if err != nil {
+		if !errors.Is(err, pgx.ErrNoRows) {
+			bw.log.Error().Err(err).Int64("chatID", update.Message.Chat.ID).Msg("get meeting failed")
+		}
+
+		bw.replyText(ctx, update.Message, NO_MEETING)
+
+		return
+	}
+
+	if !tr.LlamaOutput.Valid {
+		bw.replyText(ctx, update.Message, PROTOCOL_NOT_READY)
+
+		return
+	}
+
+	if err := bw.sendProtocol(ctx, tr.ID); err != nil {
+		bw.log.Error().Err(err).Int64("id", tr.ID).Msg("send protocol failed")
+		bw.replyText(ctx, update.Message, "Не удалось показать протокол.")
+	}
+}
+
+// protocolCallbackQuery navigates the preview of the protocol, deletes its
+// items and asks for the text of the edited and added ones.
+func (bw *BotWrapper) protocolCallbackQuery(ctx context.Context, b *bot.Bot, update *models.Update) {
+	answer := func(text string) {
+		if _, err := b.AnswerCallbackQuery(ctx, &bot.AnswerCallbackQueryParams{
+			CallbackQueryID: update.CallbackQuery.ID,
+			Text:            text,
+		}); err != nil {
+			bw.log.Error().Err(err).Msg("answer callback query failed")
+		}
+	}
+
+	data, pgID, err := bw.parseSignedData(update.CallbackQuery.Data)
+	if err != nil {
+		answer(INVALID_BUTTON)
+
+		return
+	}
+
+	tr, err := bw.psql.GetTranscribition(ctx, pgID)
+	if err != nil || !canAccess(tr, update.CallbackQuery) {
+		answer("Встреча не найдена.")
+
+		return
+	}
+
+	if !tr.LlamaOutput.Valid {
+		answer(PROTOCOL_NOT_READY)
+
+		return
+	}
+
+	p, version, err := bw.protocolVersion(ctx, tr, bw.speakerNames(ctx, tr.ID))
+	if err != nil {
+		bw.log.Error().Err(err).Int64("id", tr.ID).Msg("read protocol failed")
+		answer("Не удалось прочитать протокол.")
+
+		return
+	}
+
+	confirmed := bw.protocolConfirmed(ctx, tr.ID, version)
+
+	showPreview := func() {
+		bw.editCallbackMessage(ctx, update, clipMessage(protocolPreview(tr, p, version, confirmed)), bw.protocolKeyboard(tr.ID, p, version, confirmed))
+	}
+
+	showSection := func(t protocolTarget) {
+		if t.section == sectionBlock && t.block < 0 {
+			showPreview()
+
+			return
+		}
+
+		text, markup, err := bw.sectionView(tr, p, version, t)
+		if err != nil {
+			answer(PROTOCOL_OUTDATED)
+
+			return
+		}
+
+		bw.editCallbackMessage(ctx, update, text, markup)
+	}
+
+	switch {
+	case data == protocolOpen:
+		answer("")
+
+		if err := bw.sendProtocol(ctx, tr.ID); err != nil {
+			bw.log.Error().Err(err).Int64("id", tr.ID).Msg("send protocol failed")
+		}
+	case data == protocolView:
+		answer("")
+		showPreview()
+	case strings.HasPrefix(data, protocolConfirm):
+		v, err := strconv.ParseInt(strings.TrimPrefix(data, protocolConfirm), 10, 32)
+		if err != nil || int32(v) != version {
+			answer(PROTOCOL_OUTDATED)
+
+			return
+		}
+
+		ok, err := bw.confirmProtocol(ctx, tr, version, update.CallbackQuery.From.ID)
+		if err != nil {
+			bw.log.Error().Err(err).Int64("id", tr.ID).Msg("confirm protocol failed")
+			answer("Не удалось утвердить протокол.")
+
+			return
+		}
+
+		if !ok {
+			answer("Протокол уже утвержден.")
+
+			return
+		}
+
+		if p, version, err = bw.protocolVersion(ctx, tr, bw.speakerNames(ctx, tr.ID)); err != nil {
+			answer("Протокол утвержден.")
+
+			return
+		}
+
+		answer(fmt.Sprintf(PROTOCOL_CONFIRMED, version))
+
+		confirmed = true
+		showPreview()
+	case strings.HasPrefix(data, protocolSection):
+		t, err := parseProtocolTarget(strings.TrimPrefix(data, protocolSection))
+		if err != nil {
+			answer(INVALID_BUTTON)
+
+			return
+		}
+
+		// The button of a new block goes straight to the prompt for its name.
+		if t.section == sectionBlock && t.block < 0 {
+			answer("")
+			bw.askProtocolText(ctx, update.CallbackQuery, tr, p, version, protocolActionAdd, t)
+
+			return
+		}
+
+		answer("")
+		showSection(t)
+	case strings.HasPrefix(data, protocolDelete):
+		t, v, err := parseProtocolAction(data, protocolDelete)
+		if err != nil || v != version {
+			answer(PROTOCOL_OUTDATED)
+
+			return
+		}
+
+		// The speakers stay labelled in the stored versions, so later names apply to them too.
+		raw, _, err := bw.protocolVersion(ctx, tr, nil)
+		if err == nil {
+			err = raw.removeItem(t)
+		}
+		if err != nil {
+			answer(PROTOCOL_OUTDATED)
+
+			return
+		}
+
+		if version, err = bw.saveProtocol(ctx, tr, raw, update.CallbackQuery.From.ID); err != nil {
+			bw.log.Error().Err(err).Int64("id", tr.ID).Msg("save protocol failed")
+			answer("Не удалось сохранить протокол.")
+
+			return
+		}
+
+		answer(fmt.Sprintf("Удалено, версия %d.", version))
+
+		if p, _, err = bw.protocolVersion(ctx, tr, bw.speakerNames(ctx, tr.ID)); err == nil {
+			showSection(t.parent())
+		}
+	case strings.HasPrefix(data, protocolEdit), strings.HasPrefix(data, protocolAdd):
+		prefix, action := protocolEdit, protocolActionEdit
+		if strings.HasPrefix(data, protocolAdd) {
+			prefix, action = protocolAdd, protocolActionAdd
+		}
+
+		t, v, err := parseProtocolAction(data, prefix)
+		if err != nil || v != version {
+			answer(PROTOCOL_OUTDATED)
+
+			return
+		}
+
+		answer("")
+		bw.askProtocolText(ctx, update.CallbackQuery, tr, p, version, action, t)
+	default:
+		answer(INVALID_BUTTON)
+	}
+}
+
+// askProtocolText sends the prompt the user replies to with the text of the
+// item, the pending edit is kept until the reply comes.
+func (bw *BotWrapper) askProtocolText(ctx context.Context, query *models.CallbackQuery, tr postgres.Transcribition, p ReportedRequest, version int32, action string, t protocolTarget) {
+	chatID, thread := tr.ChatID, int(tr.MessageThreadID.Int64)
+	if msg := query.Message.Message; msg != nil {
+		chatID, thread = msg.Chat.ID, msg.MessageThreadID
+	}
+
+	m, err := bw.b.SendMessage(ctx, &bot.SendMessageParams{
+		ChatID:          chatID,
+		MessageThreadID: thread,
+		Text:            editPrompt(p, action, t),
+		ReplyMarkup:     &models.ForceReply{ForceReply: true},
+	})
+	if err != nil {
+		bw.log.Error().Err(err).Int64("id", tr.ID).Msg("send protocol prompt failed")
+
+		return
+	}
+
+	if err := bw.psql.CreateProtocolEdit(ctx, postgres.CreateProtocolEditParams{
+		ChatID:           chatID,
+		PromptMessageID:  int64(m.ID),
+		TranscribitionID: tr.ID,
+		TgUserID:         query.From.ID,
+		Action:           action,
+		Target:           t.String(),
+		Version:          version,
+	}); err != nil {
+		bw.log.Error().Err(err).Int64("id", tr.ID).Msg("create protocol edit failed")
+	}
+}
+
+// protocolReply saves the answer to a prompt for the text of a protocol item,
+// it reports whether the message was one.
+func (bw *BotWrapper) protocolReply(ctx context.Context, msg *models.Message) bool {
+	if msg.ReplyToMessage == nil || msg.Text == "" {
+		return false
+	}
+
+	key := postgres.GetProtocolEditParams{ChatID: msg.Chat.ID, PromptMessageID: int64(msg.ReplyToMessage.ID)}
+
+	edit, err := bw.psql.GetProtocolEdit(ctx, key)
+	if err != nil {
+		return false
+	}
+
+	if edit.TgUserID != senderID(msg) {
+		bw.replyText(ctx, msg, "Этот пункт исправляет другой участник.")
+
+		return true
+	}
+
+	done := func() {
+		if err := bw.psql.DeleteProtocolEdit(ctx, postgres.DeleteProtocolEditParams(key)); err != nil {
+			bw.log.Error().Err(err).Int64("id", edit.TranscribitionID).Msg("delete protocol edit failed")
+		}
+	}
+
+	tr, err := bw.psql.GetTranscribition(ctx, edit.TranscribitionID)
+	if err != nil {
+		done()
+		bw.replyText(ctx, msg, "Встреча не найдена.")
+
+		return true
+	}
+
+	t, err := parseProtocolTarget(edit.Target)
+	raw, version, rawErr := bw.protocolVersion(ctx, tr, nil)
+	if err == nil {
+		err = rawErr
+	}
+	if err == nil && version != edit.Version {
+		err = errProtocolItem
+	}
+	if err == nil {
+		err = raw.applyText(edit.Action, t, bw.stripMention(msg.Text))
+	}
+
+	switch {
+	// The prompt is kept, the user may answer it again.
+	case errors.Is(err, errBadDeadline):
+		bw.replyText(ctx, msg, PROTOCOL_BAD_DATE)
+
+		return true
+	case errors.Is(err, errEmptyItem):
+		bw.replyText(ctx, msg, PROTOCOL_EMPTY)
+
+		return true
+	case err != nil:
+		done()
+		bw.replyText(ctx, msg, PROTOCOL_OUTDATED)
+
+		return true
+	}
+
+	if version, err = bw.saveProtocol(ctx, tr, raw, senderID(msg)); err != nil {
+		bw.log.Error().Err(err).Int64("id", tr.ID).Msg("save protocol failed")
+		bw.replyText(ctx, msg, "Не удалось сохранить протокол.")
+
+		return true
+	}
+
+	done()
+	bw.replyText(ctx, msg, fmt.Sprintf(PROTOCOL_SAVED, version))
+
+	// The section is shown again, so the review goes on from where it was.
+	p, _, err := bw.protocolVersion(ctx, tr, bw.speakerNames(ctx, tr.ID))
+	if err != nil {
+		return true
+	}
+
+	// A new version is not confirmed yet.
+	text, markup := clipMessage(protocolPreview(tr, p, version, false)), bw.protocolKeyboard(tr.ID, p, version, false)
+	if section := (protocolTarget{section: t.section, block: t.block, item: -1}); section.section != sectionBlock || section.block >= 0 {
+		if text, markup, err = bw.sectionView(tr, p, version, section); err != nil {
+			return true
+		}
+	}
+
+	if _, err := bw.b.SendMessage(ctx, &bot.SendMessageParams{
+		ChatID:          msg.Chat.ID,
+		MessageThreadID: threadID(msg),
+		Text:            text,
+		ReplyMarkup:     markup,
+	}); err != nil {
+		bw.log.Error().Err(err).Int64("id", tr.ID).Msg("send protocol section failed")
+	}
+
+	return true
+}
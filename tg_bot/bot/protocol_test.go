@@ -0,0 +1,343 @@
+package bot
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseProtocolTarget(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    protocolTarget
+		wantErr bool
+	}{
+		{input: "a", want: protocolTarget{section: sectionAgenda, block: -1, item: -1}},
+		{input: "a2", want: protocolTarget{section: sectionAgenda, block: -1, item: 2}},
+		{input: "e", want: protocolTarget{section: sectionErrand, block: -1, item: -1}},
+		{input: "e10", want: protocolTarget{section: sectionErrand, block: -1, item: 10}},
+		{input: "b", want: protocolTarget{section: sectionBlock, block: -1, item: -1}},
+		{input: "b1", want: protocolTarget{section: sectionBlock, block: 1, item: -1}},
+		{input: "b1-2", want: protocolTarget{section: sectionBlock, block: 1, item: 2}},
+		{input: "", wantErr: true},
+		{input: "x1", wantErr: true},
+		{input: "ax", wantErr: true},
+		{input: "bx", wantErr: true},
+		{input: "b1-x", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			got, err := parseProtocolTarget(tt.input)
+			if tt.wantErr {
+				if !errors.Is(err, errProtocolItem) {
+					t.Errorf("parseProtocolTarget() error = %v, want %v", err, errProtocolItem)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("parseProtocolTarget() error = %v", err)
+			}
+
+			if got != tt.want {
+				t.Errorf("parseProtocolTarget() = %+v, want %+v", got, tt.want)
+			}
+
+			if s := got.String(); s != tt.input {
+				t.Errorf("String() = %q, want %q", s, tt.input)
+			}
+		})
+	}
+}
+
+func TestParseErrand(t *testing.T) {
+	tests := []struct {
+		name    string
+		text    string
+		want    ReportedErrand
+		wantErr error
+	}{
+		{
+			name: "all fields",
+			text: "Подготовить смету\nИванов\n05.10.2024",
+			want: ReportedErrand{Context: "Подготовить смету", Assignee: "Иванов", Deadline: "2024-10-05"},
+		},
+		{
+			name: "deadline with time",
+			text: "Подготовить смету\nИванов\n2024-10-05 14:30",
+			want: ReportedErrand{
+				Context:  "Подготовить смету",
+				Assignee: "Иванов",
+				Deadline: time.Date(2024, 10, 5, 14, 30, 0, 0, time.Local).Format(time.RFC3339),
+			},
+		},
+		{
+			name: "skipped fields",
+			text: " Подготовить смету \n-\n - ",
+			want: ReportedErrand{Context: "Подготовить смету"},
+		},
+		{
+			name: "only the errand",
+			text: "Подготовить смету",
+			want: ReportedErrand{Context: "Подготовить смету"},
+		},
+		{
+			name:    "bad deadline",
+			text:    "Подготовить смету\nИванов\nзавтра",
+			wantErr: errBadDeadline,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseErrand(tt.text)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("parseErrand() error = %v, want %v", err, tt.wantErr)
+			}
+
+			if got != tt.want {
+				t.Errorf("parseErrand() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func testProtocol() ReportedRequest {
+	var p ReportedRequest
+	p.Data.Agenda = []string{"Бюджет", "Сроки"}
+	p.Data.Blocks = []ReportedBlock{
+		{
+			NameBlock: "Бюджет",
+			Proposals: []ReportedProposal{
+				{Text: "Сократить расходы", AudioTime: ReportedTime{Start: "00:01:00", End: "00:02:00"}},
+				{Text: "Перенести закупку"},
+			},
+		},
+	}
+	p.Data.Errands = []ReportedErrand{{Context: "Подготовить смету", Assignee: "Иванов"}}
+
+	return p
+}
+
+func TestApplyText(t *testing.T) {
+	target := func(s string) protocolTarget {
+		pt, _ := parseProtocolTarget(s)
+
+		return pt
+	}
+
+	tests := []struct {
+		name    string
+		action  string
+		target  string
+		text    string
+		want    func(p *ReportedRequest)
+		wantErr error
+	}{
+		{
+			name:   "edit agenda item",
+			action: protocolActionEdit,
+			target: "a1",
+			text:   " Новые сроки ",
+			want:   func(p *ReportedRequest) { p.Data.Agenda[1] = "Новые сроки" },
+		},
+		{
+			name:   "add agenda item",
+			action: protocolActionAdd,
+			target: "a",
+			text:   "Разное",
+			want:   func(p *ReportedRequest) { p.Data.Agenda = append(p.Data.Agenda, "Разное") },
+		},
+		{
+			name:    "edit missing agenda item",
+			action:  protocolActionEdit,
+			target:  "a5",
+			text:    "Разное",
+			wantErr: errProtocolItem,
+		},
+		{
+			name:    "empty text",
+			action:  protocolActionEdit,
+			target:  "a0",
+			text:    " \n ",
+			wantErr: errEmptyItem,
+		},
+		{
+			name:   "edit errand",
+			action: protocolActionEdit,
+			target: "e0",
+			text:   "Согласовать смету\nПетров\n2024-10-05",
+			want: func(p *ReportedRequest) {
+				p.Data.Errands[0] = ReportedErrand{Context: "Согласовать смету", Assignee: "Петров", Deadline: "2024-10-05"}
+			},
+		},
+		{
+			name:   "add errand",
+			action: protocolActionAdd,
+			target: "e",
+			text:   "Собрать отзывы",
+			want: func(p *ReportedRequest) {
+				p.Data.Errands = append(p.Data.Errands, ReportedErrand{Context: "Собрать отзывы"})
+			},
+		},
+		{
+			name:    "errand without text",
+			action:  protocolActionAdd,
+			target:  "e",
+			text:    "-\nИванов",
+			wantErr: errEmptyItem,
+		},
+		{
+			name:    "errand with bad deadline",
+			action:  protocolActionEdit,
+			target:  "e0",
+			text:    "Согласовать смету\nПетров\nскоро",
+			wantErr: errBadDeadline,
+		},
+		{
+			name:   "add block",
+			action: protocolActionAdd,
+			target: "b",
+			text:   "Сроки",
+			want: func(p *ReportedRequest) {
+				p.Data.Blocks = append(p.Data.Blocks, ReportedBlock{NameBlock: "Сроки", Proposals: []ReportedProposal{}})
+			},
+		},
+		{
+			name:    "edit block overview",
+			action:  protocolActionEdit,
+			target:  "b",
+			text:    "Сроки",
+			wantErr: errProtocolItem,
+		},
+		{
+			name:   "rename block",
+			action: protocolActionEdit,
+			target: "b0",
+			text:   "Расходы",
+			want:   func(p *ReportedRequest) { p.Data.Blocks[0].NameBlock = "Расходы" },
+		},
+		{
+			name:   "edit proposal keeps its time",
+			action: protocolActionEdit,
+			target: "b0-0",
+			text:   "Сократить расходы на 10%\nпо итогам квартала",
+			want: func(p *ReportedRequest) {
+				p.Data.Blocks[0].Proposals[0].Text = "Сократить расходы на 10%"
+				p.Data.Blocks[0].Proposals[0].Context = "по итогам квартала"
+			},
+		},
+		{
+			name:   "add proposal",
+			action: protocolActionAdd,
+			target: "b0",
+			text:   "Найти подрядчика",
+			want: func(p *ReportedRequest) {
+				p.Data.Blocks[0].Proposals = append(p.Data.Blocks[0].Proposals, ReportedProposal{Text: "Найти подрядчика"})
+			},
+		},
+		{
+			name:    "edit missing proposal",
+			action:  protocolActionEdit,
+			target:  "b0-2",
+			text:    "Найти подрядчика",
+			wantErr: errProtocolItem,
+		},
+		{
+			name:    "missing block",
+			action:  protocolActionAdd,
+			target:  "b3",
+			text:    "Найти подрядчика",
+			wantErr: errProtocolItem,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := testProtocol()
+
+			err := got.applyText(tt.action, target(tt.target), tt.text)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("applyText() error = %v, want %v", err, tt.wantErr)
+			}
+
+			if err != nil {
+				return
+			}
+
+			want := testProtocol()
+			tt.want(&want)
+
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("applyText() = %+v, want %+v", got.Data, want.Data)
+			}
+		})
+	}
+}
+
+func TestRemoveItem(t *testing.T) {
+	tests := []struct {
+		target  string
+		want    func(p *ReportedRequest)
+		wantErr bool
+	}{
+		{
+			target: "a0",
+			want:   func(p *ReportedRequest) { p.Data.Agenda = []string{"Сроки"} },
+		},
+		{
+			target: "e0",
+			want:   func(p *ReportedRequest) { p.Data.Errands = []ReportedErrand{} },
+		},
+		{
+			target: "b0",
+			want:   func(p *ReportedRequest) { p.Data.Blocks = []ReportedBlock{} },
+		},
+		{
+			target: "b0-0",
+			want: func(p *ReportedRequest) {
+				p.Data.Blocks[0].Proposals = p.Data.Blocks[0].Proposals[1:]
+			},
+		},
+		{target: "a", wantErr: true},
+		{target: "a2", wantErr: true},
+		{target: "e1", wantErr: true},
+		{target: "b", wantErr: true},
+		{target: "b1", wantErr: true},
+		{target: "b0-2", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.target, func(t *testing.T) {
+			target, err := parseProtocolTarget(tt.target)
+			if err != nil {
+				t.Fatalf("parseProtocolTarget() error = %v", err)
+			}
+
+			got := testProtocol()
+
+			err = got.removeItem(target)
+			if tt.wantErr {
+				if !errors.Is(err, errProtocolItem) {
+					t.Errorf("removeItem() error = %v, want %v", err, errProtocolItem)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("removeItem() error = %v", err)
+			}
+
+			want := testProtocol()
+			tt.want(&want)
+
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("removeItem() = %+v, want %+v", got.Data, want.Data)
+			}
+		})
+	}
+}
@@ -0,0 +1,227 @@
+package bot
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+	"github.com/gulldan/cp2024omsk-pmsk/bot/clients/whisper"
+	"github.com/jackc/pgx/v5/pgtype"
+
+	postgres "github.com/gulldan/cp2024omsk-pmsk/bot/postgres/generated"
+)
+
+const (
+	USAGE = "/usage"
+
+	QUOTA_CONCURRENT = "Достигнут лимит встреч в обработке: %d. Дождитесь их завершения."
+	QUOTA_AUDIO_DAY  = "Не хватает дневного лимита аудио: осталось %s при лимите %d мин. в день. Лимит обновится завтра."
+	QUOTA_AUDIO_MON  = "Не хватает месячного лимита аудио: осталось %s при лимите %d мин. в месяц. Лимит обновится в начале следующего месяца."
+	QUOTA_REPORTS    = "Слишком много отчетов: не больше %d в минуту. Попробуйте через минуту."
+
+	usageAudio  = "audio"
+	usageReport = "report"
+)
+
+func dayStart(now time.Time) time.Time {
+	return time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+}
+
+func monthStart(now time.Time) time.Time {
+	return time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location())
+}
+
+// usageTime stores the time in UTC like the other timestamps the bot writes itself.
+func usageTime(t time.Time) pgtype.Timestamp {
+	return pgtype.Timestamp{Time: t.UTC(), Valid: true}
+}
+
+func minutes(d time.Duration) string {
+	return fmt.Sprintf("%.0f мин.", math.Max(0, math.Floor(d.Minutes())))
+}
+
+func (bw *BotWrapper) usage(ctx context.Context, userID int64, kind string, since time.Time) int64 {
+	used, err := bw.psql.SumQuotaUsage(ctx, postgres.SumQuotaUsageParams{
+		TgUserID:  userID,
+		Kind:      kind,
+		CreatedAt: usageTime(since),
+	})
+	if err != nil {
+		bw.log.Error().Err(err).Int64("chatID", userID).Str("kind", kind).Msg("sum quota usage failed")
+	}
+
+	return used
+}
+
+// activeMeetings counts the meetings of the user with an unfinished job, a
+// meeting which got stuck without one does not take a slot.
+func (bw *BotWrapper) activeMeetings(ctx context.Context, userID int64) int64 {
+	active, err := bw.psql.CountActiveTranscribitions(ctx, userID)
+	if err != nil {
+		bw.log.Error().Err(err).Int64("chatID", userID).Msg("count active transcribitions failed")
+	}
+
+	return active
+}
+
+// audioQuota is the audio the user has used and may still upload in the window.
+type audioQuota struct {
+	limit time.Duration
+	used  time.Duration
+}
+
+func (q audioQuota) left() time.Duration {
+	return q.limit - q.used
+}
+
+func (bw *BotWrapper) audioQuotas(ctx context.Context, userID int64) (day, month audioQuota) {
+	now := time.Now()
+
+	day.limit = time.Duration(bw.cfg.QuotaDailyMinutes) * time.Minute
+	if day.limit > 0 {
+		day.used = time.Duration(bw.usage(ctx, userID, usageAudio, dayStart(now))) * time.Second
+	}
+
+	month.limit = time.Duration(bw.cfg.QuotaMonthlyMinutes) * time.Minute
+	if month.limit > 0 {
+		month.used = time.Duration(bw.usage(ctx, userID, usageAudio, monthStart(now))) * time.Second
+	}
+
+	return day, month
+}
+
+// uploadQuota explains why the user may not upload a recording of the duration,
+// an empty string lets the upload in. A zero duration checks that any audio is left.
+func (bw *BotWrapper) uploadQuota(ctx context.Context, userID int64, duration time.Duration) string {
+	if bw.hasRole(ctx, userID, RoleAdmin) {
+		return ""
+	}
+
+	if limit := bw.cfg.QuotaConcurrentJobs; limit > 0 && bw.activeMeetings(ctx, userID) >= int64(limit) {
+		return fmt.Sprintf(QUOTA_CONCURRENT, limit)
+	}
+
+	return bw.audioOverQuota(ctx, userID, duration)
+}
+
+// audioOverQuota explains why the audio of the duration does not fit into what
+// is left of the audio quotas, e.g. of a link whose length is known once stored.
+func (bw *BotWrapper) audioOverQuota(ctx context.Context, userID int64, duration time.Duration) string {
+	if bw.hasRole(ctx, userID, RoleAdmin) {
+		return ""
+	}
+
+	day, month := bw.audioQuotas(ctx, userID)
+
+	if day.limit > 0 && (day.left() <= 0 || duration > day.left()) {
+		return fmt.Sprintf(QUOTA_AUDIO_DAY, minutes(day.left()), bw.cfg.QuotaDailyMinutes)
+	}
+
+	if month.limit > 0 && (month.left() <= 0 || duration > month.left()) {
+		return fmt.Sprintf(QUOTA_AUDIO_MON, minutes(month.left()), bw.cfg.QuotaMonthlyMinutes)
+	}
+
+	return ""
+}
+
+// checkUploadQuota tells the sender why the recording is rejected.
+func (bw *BotWrapper) checkUploadQuota(ctx context.Context, msg *models.Message, duration time.Duration) bool {
+	reason := bw.uploadQuota(ctx, senderID(msg), duration)
+	if reason == "" {
+		return true
+	}
+
+	bw.replyText(ctx, msg, reason)
+
+	return false
+}
+
+// audioSeconds is the probed length stored with the audio, an unknown length is NULL.
+func audioSeconds(d time.Duration) pgtype.Int4 {
+	return pgtype.Int4{Int32: int32(math.Ceil(d.Seconds())), Valid: d > 0}
+}
+
+// recordAudioUsage charges the uploader for the transcribed audio by the length
+// probed at upload, the one the quota was checked with. The meetings from
+// before it is stored are charged by the end of the last segment. The
+// recordings which failed or were cancelled before are not charged. A retry or
+// re-diarization transcribes the same recording again and is not charged twice.
+func (bw *BotWrapper) recordAudioUsage(ctx context.Context, tr postgres.Transcribition, result whisper.Result) {
+	seconds := float64(tr.AudioSeconds.Int32)
+	if !tr.AudioSeconds.Valid {
+		for _, s := range result.Segments {
+			seconds = math.Max(seconds, s.End)
+		}
+	}
+
+	if err := bw.psql.CreateQuotaUsageOnce(ctx, postgres.CreateQuotaUsageOnceParams{
+		TgUserID:         tr.TgUserID,
+		Kind:             usageAudio,
+		Amount:           int64(math.Ceil(seconds)),
+		TranscribitionID: pgtype.Int8{Int64: tr.ID, Valid: true},
+		CreatedAt:        usageTime(time.Now()),
+	}); err != nil {
+		bw.log.Error().Err(err).Int64("id", tr.ID).Msg("create quota usage failed")
+	}
+}
+
+// takeReport counts the report request, it reports false when the user has
+// requested too many reports in the last minute.
+func (bw *BotWrapper) takeReport(ctx context.Context, userID, pgID int64) bool {
+	limit := bw.cfg.QuotaReportsPerMinute
+	if limit > 0 && !bw.hasRole(ctx, userID, RoleAdmin) && bw.usage(ctx, userID, usageReport, time.Now().Add(-time.Minute)) >= int64(limit) {
+		return false
+	}
+
+	if err := bw.psql.CreateQuotaUsage(ctx, postgres.CreateQuotaUsageParams{
+		TgUserID:         userID,
+		Kind:             usageReport,
+		Amount:           1,
+		TranscribitionID: pgtype.Int8{Int64: pgID, Valid: true},
+		CreatedAt:        usageTime(time.Now()),
+	}); err != nil {
+		bw.log.Error().Err(err).Int64("id", pgID).Msg("create quota usage failed")
+	}
+
+	return true
+}
+
+// usageHandler shows the quotas of the sender and what is left of them.
+func (bw *BotWrapper) usageHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
+	userID := senderID(update.Message)
+
+	if bw.hasRole(ctx, userID, RoleAdmin) {
+		bw.replyText(ctx, update.Message, "Для администраторов ограничений нет.")
+
+		return
+	}
+
+	day, month := bw.audioQuotas(ctx, userID)
+
+	audio := func(title string, q audioQuota) string {
+		if q.limit <= 0 {
+			return title + ": без ограничений"
+		}
+
+		return fmt.Sprintf("%s: использовано %s, осталось %s из %s", title, minutes(q.used), minutes(q.left()), minutes(q.limit))
+	}
+
+	lines := []string{
+		audio("Аудио за сегодня", day),
+		audio("Аудио за месяц", month),
+	}
+
+	if limit := bw.cfg.QuotaConcurrentJobs; limit > 0 {
+		lines = append(lines, fmt.Sprintf("Встреч в обработке: %d из %d", bw.activeMeetings(ctx, userID), limit))
+	}
+
+	if limit := bw.cfg.QuotaReportsPerMinute; limit > 0 {
+		lines = append(lines, fmt.Sprintf("Отчетов в минуту: не больше %d", limit))
+	}
+
+	bw.replyText(ctx, update.Message, strings.Join(lines, "\n"))
+}
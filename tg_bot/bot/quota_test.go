@@ -0,0 +1,110 @@
+package bot
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+func TestQuotaWindows(t *testing.T) {
+	omsk := time.FixedZone("Omsk", 6*60*60)
+
+	tests := []struct {
+		name      string
+		now       time.Time
+		wantDay   time.Time
+		wantMonth time.Time
+	}{
+		{
+			name:      "middle of the month",
+			now:       time.Date(2024, 10, 15, 13, 45, 0, 0, omsk),
+			wantDay:   time.Date(2024, 10, 15, 0, 0, 0, 0, omsk),
+			wantMonth: time.Date(2024, 10, 1, 0, 0, 0, 0, omsk),
+		},
+		{
+			name:      "midnight",
+			now:       time.Date(2024, 11, 1, 0, 0, 0, 0, omsk),
+			wantDay:   time.Date(2024, 11, 1, 0, 0, 0, 0, omsk),
+			wantMonth: time.Date(2024, 11, 1, 0, 0, 0, 0, omsk),
+		},
+		{
+			name:      "before midnight in utc",
+			now:       time.Date(2024, 10, 31, 23, 0, 0, 0, time.UTC),
+			wantDay:   time.Date(2024, 10, 31, 0, 0, 0, 0, time.UTC),
+			wantMonth: time.Date(2024, 10, 1, 0, 0, 0, 0, time.UTC),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := dayStart(tt.now); !got.Equal(tt.wantDay) {
+				t.Errorf("dayStart() = %v, want %v", got, tt.wantDay)
+			}
+
+			if got := monthStart(tt.now); !got.Equal(tt.wantMonth) {
+				t.Errorf("monthStart() = %v, want %v", got, tt.wantMonth)
+			}
+		})
+	}
+}
+
+func TestAudioQuotaLeft(t *testing.T) {
+	tests := []struct {
+		name        string
+		quota       audioQuota
+		wantLeft    time.Duration
+		wantMinutes string
+	}{
+		{
+			name:        "unused",
+			quota:       audioQuota{limit: 60 * time.Minute},
+			wantLeft:    60 * time.Minute,
+			wantMinutes: "60 мин.",
+		},
+		{
+			name:        "partly used",
+			quota:       audioQuota{limit: 60 * time.Minute, used: 20*time.Minute + 30*time.Second},
+			wantLeft:    39*time.Minute + 30*time.Second,
+			wantMinutes: "39 мин.",
+		},
+		{
+			name:        "overused",
+			quota:       audioQuota{limit: 60 * time.Minute, used: 75 * time.Minute},
+			wantLeft:    -15 * time.Minute,
+			wantMinutes: "0 мин.",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			left := tt.quota.left()
+			if left != tt.wantLeft {
+				t.Errorf("left() = %v, want %v", left, tt.wantLeft)
+			}
+
+			if got := minutes(left); got != tt.wantMinutes {
+				t.Errorf("minutes(%v) = %q, want %q", left, got, tt.wantMinutes)
+			}
+		})
+	}
+}
+
+func TestAudioSeconds(t *testing.T) {
+	tests := []struct {
+		duration time.Duration
+		want     pgtype.Int4
+	}{
+		{duration: 0, want: pgtype.Int4{}},
+		{duration: 90 * time.Second, want: pgtype.Int4{Int32: 90, Valid: true}},
+		{duration: 90*time.Second + time.Millisecond, want: pgtype.Int4{Int32: 91, Valid: true}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.duration.String(), func(t *testing.T) {
+			if got := audioSeconds(tt.duration); got != tt.want {
+				t.Errorf("audioSeconds() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,107 @@
+package resilient
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	stateClosed = iota
+	stateOpen
+	stateHalfOpen
+)
+
+// Breaker stops calls to a backend after a series of consecutive failures and
+// lets them through again once the cooldown has passed and a probe succeeded.
+type Breaker struct {
+	mu        sync.Mutex
+	state     int
+	failures  int
+	openedAt  time.Time
+	probing   bool
+	threshold int
+	cooldown  time.Duration
+}
+
+func NewBreaker(threshold int, cooldown time.Duration) *Breaker {
+	return &Breaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+	}
+}
+
+// Allow reports whether a call may be made now. Once the cooldown has passed a
+// single call probes the backend, the others wait for its outcome.
+func (b *Breaker) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case stateClosed:
+		return true
+	case stateOpen:
+		if time.Since(b.openedAt) < b.cooldown {
+			return false
+		}
+
+		b.state = stateHalfOpen
+		b.probing = true
+
+		return true
+	default:
+		if b.probing {
+			return false
+		}
+
+		b.probing = true
+
+		return true
+	}
+}
+
+// Available reports whether calls would be let through, unlike Allow it does
+// not take the probe, so queue consumers may poll it.
+func (b *Breaker) Available() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case stateClosed:
+		return true
+	case stateOpen:
+		return time.Since(b.openedAt) >= b.cooldown
+	default:
+		return !b.probing
+	}
+}
+
+func (b *Breaker) Success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.state = stateClosed
+	b.failures = 0
+	b.probing = false
+}
+
+// Abandon gives the probe back when the call was cancelled before the backend
+// answered, the next call probes instead.
+func (b *Breaker) Abandon() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.probing = false
+}
+
+func (b *Breaker) Failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures++
+	b.probing = false
+
+	if b.state == stateHalfOpen || (b.threshold > 0 && b.failures >= b.threshold) {
+		b.state = stateOpen
+		b.openedAt = time.Now()
+	}
+}
@@ -0,0 +1,48 @@
+package resilient
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBreakerSingleProbe(t *testing.T) {
+	b := NewBreaker(1, time.Millisecond)
+
+	b.Failure()
+	if b.Allow() {
+		t.Fatal("Allow() = true right after opening")
+	}
+
+	time.Sleep(2 * time.Millisecond)
+
+	if !b.Available() {
+		t.Fatal("Available() = false after the cooldown")
+	}
+	if !b.Allow() {
+		t.Fatal("Allow() = false for the probe")
+	}
+	if b.Allow() || b.Available() {
+		t.Fatal("a second call is let through while probing")
+	}
+
+	b.Abandon()
+	if !b.Allow() {
+		t.Fatal("Allow() = false after the probe was abandoned")
+	}
+
+	b.Failure()
+	if b.Allow() {
+		t.Fatal("Allow() = true after the probe failed")
+	}
+
+	time.Sleep(2 * time.Millisecond)
+
+	if !b.Allow() {
+		t.Fatal("Allow() = false for the next probe")
+	}
+
+	b.Success()
+	if !b.Allow() || !b.Allow() {
+		t.Fatal("Allow() = false once closed")
+	}
+}
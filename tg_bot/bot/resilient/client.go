@@ -0,0 +1,180 @@
+package resilient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"time"
+)
+
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+// StatusError is returned for responses with a non-2xx status code.
+type StatusError struct {
+	Code int
+	Body string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("unexpected status %d: %s", e.Code, e.Body)
+}
+
+type Options struct {
+	// Timeout limits a single attempt.
+	Timeout time.Duration
+	// ResponseHeaderTimeout limits the wait for the response once the request
+	// is sent. Backends which receive streamed uploads use it instead of
+	// Timeout, the upload of a long recording takes as long as it takes.
+	ResponseHeaderTimeout time.Duration
+	// Retries is the number of additional attempts after a failed one.
+	Retries   int
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	// RetryUnsafe allows retrying POST requests of services whose calls have no
+	// side effects, e.g. rendering a report.
+	RetryUnsafe bool
+
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
+}
+
+// Client is an HTTP client for a single backend with timeouts, retries and a
+// circuit breaker.
+type Client struct {
+	name    string
+	opts    Options
+	http    *http.Client
+	breaker *Breaker
+}
+
+func New(name string, opts Options) *Client {
+	if opts.BaseDelay == 0 {
+		opts.BaseDelay = 500 * time.Millisecond
+	}
+
+	if opts.MaxDelay == 0 {
+		opts.MaxDelay = 10 * time.Second
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = opts.ResponseHeaderTimeout
+
+	return &Client{
+		name:    name,
+		opts:    opts,
+		http:    &http.Client{Timeout: opts.Timeout, Transport: transport},
+		breaker: NewBreaker(opts.BreakerThreshold, opts.BreakerCooldown),
+	}
+}
+
+// Available reports whether the backend is considered alive. Queue consumers
+// use it to pause while the breaker is open.
+func (c *Client) Available() bool {
+	return c.breaker.Available()
+}
+
+// Do sends the request and returns the response with a 2xx status code.
+// Other responses are turned into *StatusError with the body read.
+func (c *Client) Do(req *http.Request) (*http.Response, error) {
+	attempts := 1
+	if c.retryable(req) {
+		attempts += c.opts.Retries
+	}
+
+	var lastErr error
+	for attempt := 0; attempt < attempts; attempt++ {
+		if attempt > 0 {
+			if err := c.sleep(req.Context(), attempt); err != nil {
+				return nil, err
+			}
+
+			if req.GetBody != nil {
+				body, err := req.GetBody()
+				if err != nil {
+					return nil, fmt.Errorf("failed to rewind body: %w", err)
+				}
+				req.Body = body
+			}
+		}
+
+		if !c.breaker.Allow() {
+			return nil, fmt.Errorf("%s: %w", c.name, ErrCircuitOpen)
+		}
+
+		resp, err := c.http.Do(req)
+		if err != nil {
+			if req.Context().Err() != nil {
+				c.breaker.Abandon()
+
+				return nil, err
+			}
+
+			c.breaker.Failure()
+			lastErr = fmt.Errorf("%s: %w", c.name, err)
+
+			continue
+		}
+
+		if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+			c.breaker.Success()
+
+			return resp, nil
+		}
+
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		lastErr = fmt.Errorf("%s: %w", c.name, &StatusError{Code: resp.StatusCode, Body: string(body)})
+
+		if !temporary(resp.StatusCode) {
+			// The backend answered, it is alive even if it did not like the request.
+			c.breaker.Success()
+
+			return nil, lastErr
+		}
+
+		c.breaker.Failure()
+	}
+
+	return nil, lastErr
+}
+
+func (c *Client) retryable(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete, http.MethodOptions:
+		return req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+	default:
+		return c.opts.RetryUnsafe && req.GetBody != nil
+	}
+}
+
+func (c *Client) sleep(ctx context.Context, attempt int) error {
+	delay := c.opts.BaseDelay << (attempt - 1)
+	if delay > c.opts.MaxDelay || delay <= 0 {
+		delay = c.opts.MaxDelay
+	}
+
+	// Full jitter keeps retries of several workers from hitting the backend at once.
+	delay = time.Duration(rand.Int64N(int64(delay)) + 1)
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(delay):
+		return nil
+	}
+}
+
+func temporary(code int) bool {
+	return code == http.StatusTooManyRequests || code >= http.StatusInternalServerError
+}
+
+// IsStatus reports whether err is a StatusError with the given code.
+func IsStatus(err error, code int) bool {
+	var serr *StatusError
+
+	return errors.As(err, &serr) && serr.Code == code
+}
@@ -0,0 +1,320 @@
+package bot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+	"github.com/gulldan/cp2024omsk-pmsk/bot/transcript"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/rs/xid"
+
+	postgres "github.com/gulldan/cp2024omsk-pmsk/bot/postgres/generated"
+)
+
+const (
+	BEGIN = "/begin"
+	END   = "/end"
+
+	SESSION_STARTED = "Встреча начата. Отправляйте части записи, затем завершите встречу командой /end, и все части будут обработаны как одна запись. После /begin можно указать название, описание, #теги и время начала, как в подписи к записи."
+	SESSION_OPEN    = "Встреча уже начата, частей: %d. Отправьте следующую часть или завершите встречу командой /end."
+	SESSION_PART    = "Часть %d добавлена (%s). Всего записано: %s. Отправьте следующую часть или завершите встречу командой /end."
+	SESSION_NONE    = "Нет начатой встречи. Начните ее командой /begin и отправьте части записи."
+	SESSION_EMPTY   = "Во встречу не добавлено ни одной записи, она закрыта."
+	SESSION_PARTS   = "Части встречи объединены в одну запись:\n%s"
+)
+
+// openSession is the session the sender has started in the chat of the message.
+func (bw *BotWrapper) openSession(ctx context.Context, msg *models.Message) (postgres.Session, bool) {
+	session, err := bw.psql.GetOpenSession(ctx, postgres.GetOpenSessionParams{
+		ChatID:   msg.Chat.ID,
+		TgUserID: senderID(msg),
+	})
+	if err != nil {
+		if !errors.Is(err, pgx.ErrNoRows) {
+			bw.log.Error().Err(err).Int64("chatID", msg.Chat.ID).Msg("get open session failed")
+		}
+
+		return postgres.Session{}, false
+	}
+
+	return session, true
+}
+
+// sessionParts returns the parts of the session in the order they were sent and their total duration.
+func (bw *BotWrapper) sessionParts(ctx context.Context, sessionID int64) ([]postgres.SessionPart, time.Duration, error) {
+	parts, err := bw.psql.GetSessionParts(ctx, sessionID)
+	if err != nil {
+		return nil, 0, fmt.Errorf("get session parts failed: %w", err)
+	}
+
+	var total float64
+	for _, p := range parts {
+		total += p.Duration
+	}
+
+	return parts, time.Duration(total * float64(time.Second)), nil
+}
+
+// sessionDuration is the audio already collected in the open session of the
+// sender, it counts against the quota of the next part.
+func (bw *BotWrapper) sessionDuration(ctx context.Context, msg *models.Message) time.Duration {
+	session, ok := bw.openSession(ctx, msg)
+	if !ok {
+		return 0
+	}
+
+	_, total, err := bw.sessionParts(ctx, session.ID)
+	if err != nil {
+		bw.log.Error().Err(err).Int64("session", session.ID).Msg("get session duration failed")
+	}
+
+	return total
+}
+
+// beginHandler starts collecting the parts of a meeting, the text after the
+// command is read like the caption of a recording.
+func (bw *BotWrapper) beginHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
+	if !bw.requireMember(ctx, update.Message) {
+		return
+	}
+
+	if session, ok := bw.openSession(ctx, update.Message); ok {
+		parts, _, err := bw.sessionParts(ctx, session.ID)
+		if err != nil {
+			bw.log.Error().Err(err).Int64("session", session.ID).Msg("get session parts failed")
+		}
+
+		bw.replyText(ctx, update.Message, fmt.Sprintf(SESSION_OPEN, len(parts)))
+
+		return
+	}
+
+	caption := bw.stripMention(strings.TrimPrefix(update.Message.Text, BEGIN))
+
+	if err := bw.psql.CreateSession(ctx, postgres.CreateSessionParams{
+		TgUserID:        senderID(update.Message),
+		ChatID:          update.Message.Chat.ID,
+		MessageThreadID: pgtype.Int8{Int64: int64(threadID(update.Message)), Valid: threadID(update.Message) != 0},
+		Caption:         optionalText(caption),
+	}); err != nil {
+		bw.log.Error().Err(err).Int64("chatID", update.Message.Chat.ID).Msg("create session failed")
+		bw.replyText(ctx, update.Message, "Не удалось начать встречу.")
+
+		return
+	}
+
+	bw.replyText(ctx, update.Message, SESSION_STARTED)
+}
+
+// addSessionPart stores the normalized recording as the next part of the
+// session instead of processing it, the original file is not kept for parts.
+func (bw *BotWrapper) addSessionPart(ctx context.Context, msg, recording *models.Message, session postgres.Session, file string, duration time.Duration) {
+	fileName, bucket, err := bw.uploadFileToMinio(ctx, file, bw.min.GetAudioBucket())
+	if err != nil {
+		bw.log.Error().Err(err).Int64("session", session.ID).Msg("upload session part failed")
+		bw.replyText(ctx, msg, FAILED_TO_DOWNLOAD_FILE)
+
+		return
+	}
+
+	if err := bw.psql.AddSessionPart(ctx, postgres.AddSessionPartParams{
+		SessionID:        session.ID,
+		MessageID:        int64(recording.ID),
+		AudioNameMinio:   fileName,
+		AudioBucketMinio: bucket,
+		Duration:         duration.Seconds(),
+	}); err != nil {
+		bw.log.Error().Err(err).Int64("session", session.ID).Msg("add session part failed")
+		bw.replyText(ctx, msg, FAILED_TO_DOWNLOAD_FILE)
+
+		return
+	}
+
+	parts, total, err := bw.sessionParts(ctx, session.ID)
+	if err != nil {
+		bw.log.Error().Err(err).Int64("session", session.ID).Msg("get session parts failed")
+	}
+
+	bw.replyText(ctx, msg, fmt.Sprintf(SESSION_PART, len(parts), transcript.Clock(duration.Seconds()), transcript.Clock(total.Seconds())))
+}
+
+// endHandler closes the session and processes its parts as one recording, so
+// the speakers, timestamps and protocol cover the whole meeting.
+func (bw *BotWrapper) endHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
+	if !bw.requireMember(ctx, update.Message) {
+		return
+	}
+
+	session, ok := bw.openSession(ctx, update.Message)
+	if !ok {
+		bw.replyText(ctx, update.Message, SESSION_NONE)
+
+		return
+	}
+
+	parts, total, err := bw.sessionParts(ctx, session.ID)
+	if err != nil {
+		bw.log.Error().Err(err).Int64("session", session.ID).Msg("get session parts failed")
+		bw.replyText(ctx, update.Message, "Не удалось завершить встречу.")
+
+		return
+	}
+
+	if len(parts) == 0 {
+		if err := bw.psql.DeleteSession(ctx, session.ID); err != nil {
+			bw.log.Error().Err(err).Int64("session", session.ID).Msg("delete session failed")
+		}
+
+		bw.replyText(ctx, update.Message, SESSION_EMPTY)
+
+		return
+	}
+
+	// The session stays open when the quota is exceeded, it may be ended later.
+	if !bw.checkUploadQuota(ctx, update.Message, total) {
+		return
+	}
+
+	if n, err := bw.psql.EndSession(ctx, postgres.EndSessionParams{
+		EndedAt: pgtype.Timestamp{Time: time.Now().UTC(), Valid: true},
+		ID:      session.ID,
+	}); err != nil || n == 0 {
+		if err != nil {
+			bw.log.Error().Err(err).Int64("session", session.ID).Msg("end session failed")
+		}
+
+		return
+	}
+
+	if err := bw.psql.CreateUser(ctx, senderID(update.Message)); err != nil {
+		bw.log.Error().Err(err).Msg("CreateUser failed")
+		return
+	}
+
+	tr, ok := bw.startTranscribition(ctx, update.Message, session.Caption.String)
+	if !ok {
+		return
+	}
+
+	if err := bw.psql.SetSessionTranscribition(ctx, postgres.SetSessionTranscribitionParams{
+		TranscribitionID: pgtype.Int8{Int64: tr.ID, Valid: true},
+		ID:               session.ID,
+	}); err != nil {
+		bw.log.Error().Err(err).Int64("session", session.ID).Int64("id", tr.ID).Msg("set session transcribition failed")
+	}
+
+	bw.replyText(ctx, update.Message, fmt.Sprintf(SESSION_PARTS, partOffsets(parts)))
+
+	file, err := bw.mergeSessionParts(ctx, parts)
+	if err != nil {
+		bw.failTranscribition(ctx, tr, StatusUploaded, stageError(StatusUploaded, ErrCodeInternal, err))
+		return
+	}
+	defer os.Remove(file)
+
+	fileName, bucket, err := bw.uploadFileToMinio(ctx, file, bw.min.GetAudioBucket())
+	if err != nil {
+		bw.failTranscribition(ctx, tr, StatusUploaded, stageError(StatusUploaded, ErrCodeStorage, fmt.Errorf("UploadToMinio failed: %w", err)))
+		return
+	}
+
+	if err := bw.psql.UpdateMinioLink(ctx, postgres.UpdateMinioLinkParams{
+		AudioNameMinio: pgtype.Text{
+			String: fileName,
+			Valid:  true,
+		},
+		AudioBucketMinio: pgtype.Text{
+			String: bucket,
+			Valid:  true,
+		},
+		AudioSeconds: audioSeconds(total),
+		ID:           tr.ID,
+	}); err != nil {
+		bw.failTranscribition(ctx, tr, StatusUploaded, stageError(StatusUploaded, ErrCodeStorage, fmt.Errorf("UpdateMinioLink failed: %w", err)))
+		return
+	}
+
+	if err := bw.enqueueJob(ctx, tr.ID, StatusTranscription); err != nil {
+		bw.failTranscribition(ctx, tr, StatusUploaded, stageError(StatusUploaded, ErrCodeStorage, err))
+		return
+	}
+
+	for _, p := range parts {
+		if err := bw.min.RemoveFile(ctx, p.AudioNameMinio, p.AudioBucketMinio); err != nil {
+			bw.log.Error().Err(err).Int64("session", session.ID).Str("file", p.AudioNameMinio).Msg("remove session part failed")
+		}
+	}
+}
+
+// partOffsets lists where each part starts in the merged recording, the
+// timestamps of the transcript are counted from the start of the first part.
+func partOffsets(parts []postgres.SessionPart) string {
+	lines := make([]string, len(parts))
+
+	var offset float64
+	for i, p := range parts {
+		lines[i] = fmt.Sprintf("%d. %s – %s", i+1, transcript.Clock(offset), transcript.Clock(offset+p.Duration))
+		offset += p.Duration
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// mergeSessionParts downloads the parts and joins them into one recording.
+func (bw *BotWrapper) mergeSessionParts(ctx context.Context, parts []postgres.SessionPart) (string, error) {
+	files := make([]string, 0, len(parts))
+	defer func() {
+		for _, f := range files {
+			os.Remove(f)
+		}
+	}()
+
+	for _, p := range parts {
+		file, err := bw.downloadPart(ctx, p)
+		if err != nil {
+			return "", err
+		}
+
+		files = append(files, file)
+	}
+
+	file, err := mergeAudio(ctx, files)
+	if err != nil {
+		return "", fmt.Errorf("merge audio failed: %w", err)
+	}
+
+	return file, nil
+}
+
+func (bw *BotWrapper) downloadPart(ctx context.Context, p postgres.SessionPart) (string, error) {
+	r, err := bw.min.DownloadFile(ctx, p.AudioNameMinio, p.AudioBucketMinio)
+	if err != nil {
+		return "", fmt.Errorf("download part failed: %w", err)
+	}
+	defer r.Close()
+
+	file := xid.New().String() + filepath.Ext(p.AudioNameMinio)
+
+	out, err := os.Create(file)
+	if err != nil {
+		return "", fmt.Errorf("failed to create file: %w", err)
+	}
+	defer out.Close()
+
+	if _, err := io.Copy(out, r); err != nil {
+		os.Remove(file)
+
+		return "", fmt.Errorf("failed to copy part: %w", err)
+	}
+
+	return file, nil
+}
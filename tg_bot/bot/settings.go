@@ -0,0 +1,351 @@
+package bot
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+	"github.com/gulldan/cp2024omsk-pmsk/bot/clients/whisper"
+	"github.com/jackc/pgx/v5/pgtype"
+
+	postgres "github.com/gulldan/cp2024omsk-pmsk/bot/postgres/generated"
+)
+
+const (
+	SETTINGS          = "/settings"
+	SETTINGS_CALLBACK = "settings_"
+
+	settingsMenu     = "menu"
+	settingsLanguage = "lang"
+	settingsModel    = "model"
+	settingsSpeakers = "speakers"
+	settingsReport   = "report"
+	settingsNotify   = "notify"
+
+	// LanguageAuto lets whisper detect the language of the recording.
+	LanguageAuto = "auto"
+
+	defaultLanguage = "ru"
+	defaultModel    = "large-v3"
+)
+
+type settingsOption struct {
+	Value string
+	Title string
+}
+
+var languageOptions = []settingsOption{
+	{LanguageAuto, "Автоопределение"},
+	{"ru", "Русский"},
+	{"en", "Английский"},
+	{"kk", "Казахский"},
+	{"uk", "Украинский"},
+	{"de", "Немецкий"},
+	{"fr", "Французский"},
+	{"es", "Испанский"},
+	{"zh", "Китайский"},
+}
+
+var modelOptions = []settingsOption{
+	{"tiny", "tiny — самая быстрая"},
+	{"base", "base"},
+	{"small", "small"},
+	{"medium", "medium"},
+	{"large-v2", "large-v2"},
+	{"large-v3", "large-v3 — самая точная"},
+}
+
+var speakersOptions = []settingsOption{
+	{"0", "Автоматически"},
+	{"1", "1"},
+	{"2", "2"},
+	{"3", "3"},
+	{"4", "4"},
+	{"5", "5"},
+	{"6", "6"},
+}
+
+// reportOptions are <type>-<format>, the report is generated as soon as the meeting is processed.
+var reportOptions = []settingsOption{
+	{"none", "Не создавать"},
+	{"official-docx", "Официальный DOCX"},
+	{"official-pdf", "Официальный PDF"},
+	{"unofficial-docx", "Неофициальный DOCX"},
+	{"unofficial-pdf", "Неофициальный PDF"},
+}
+
+func optionTitle(options []settingsOption, value string) string {
+	for _, o := range options {
+		if o.Value == value {
+			return o.Title
+		}
+	}
+
+	return value
+}
+
+func reportValue(u postgres.User) string {
+	if !u.ReportType.Valid || !u.ReportFormat.Valid {
+		return "none"
+	}
+
+	return u.ReportType.String + "-" + u.ReportFormat.String
+}
+
+func speakersValue(u postgres.User) string {
+	return strconv.Itoa(int(u.Speakers.Int32))
+}
+
+// whisperParams returns the recognition settings of the user, the defaults
+// are used when the user can't be loaded.
+func (bw *BotWrapper) whisperParams(ctx context.Context, chatID int64) whisper.Params {
+	user, err := bw.psql.GetUser(ctx, chatID)
+	if err != nil {
+		bw.log.Error().Err(err).Int64("chatID", chatID).Msg("failed to get user settings")
+
+		return whisper.Params{Model: defaultModel, Language: defaultLanguage}
+	}
+
+	return whisper.Params{
+		Model:       user.AsrModel,
+		Language:    user.AsrLanguage,
+		MinSpeakers: int(user.Speakers.Int32),
+		MaxSpeakers: int(user.Speakers.Int32),
+	}
+}
+
+// settingsHandler shows the personal settings of the sender, in groups as well.
+func (bw *BotWrapper) settingsHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
+	chatID := senderID(update.Message)
+
+	if err := bw.psql.CreateUser(ctx, chatID); err != nil {
+		bw.log.Error().Err(err).Msg("CreateUser failed")
+		return
+	}
+
+	user, err := bw.psql.GetUser(ctx, chatID)
+	if err != nil {
+		bw.log.Error().Err(err).Int64("chatID", chatID).Msg("failed to get user")
+		return
+	}
+
+	text, markup := settingsView(user)
+
+	if _, err := b.SendMessage(ctx, &bot.SendMessageParams{
+		ChatID:          update.Message.Chat.ID,
+		MessageThreadID: threadID(update.Message),
+		Text:            text,
+		ReplyMarkup:     markup,
+	}); err != nil {
+		bw.log.Error().Err(err).Msg("send settings message failed")
+	}
+}
+
+func settingsView(u postgres.User) (string, models.ReplyMarkup) {
+	notify := "выкл"
+	if u.NotifyDone {
+		notify = "вкл"
+	}
+
+	button := func(text, key string) []models.InlineKeyboardButton {
+		return []models.InlineKeyboardButton{{Text: text, CallbackData: SETTINGS_CALLBACK + key}}
+	}
+
+	return "Настройки применяются к каждой новой встрече.", &models.InlineKeyboardMarkup{
+		InlineKeyboard: [][]models.InlineKeyboardButton{
+			button("Язык: "+optionTitle(languageOptions, u.AsrLanguage), settingsLanguage),
+			button("Модель: "+u.AsrModel, settingsModel),
+			button("Спикеров: "+optionTitle(speakersOptions, speakersValue(u)), settingsSpeakers),
+			button("Отчет по умолчанию: "+optionTitle(reportOptions, reportValue(u)), settingsReport),
+			button("Уведомлять о готовности: "+notify, settingsNotify),
+		},
+	}
+}
+
+func settingsChoice(key, title string, options []settingsOption, current string) (string, models.ReplyMarkup) {
+	keyboard := make([][]models.InlineKeyboardButton, 0, len(options)+1)
+	for _, o := range options {
+		text := o.Title
+		if o.Value == current {
+			text = "✓ " + text
+		}
+
+		keyboard = append(keyboard, []models.InlineKeyboardButton{
+			{Text: text, CallbackData: SETTINGS_CALLBACK + key + "_" + o.Value},
+		})
+	}
+
+	keyboard = append(keyboard, []models.InlineKeyboardButton{
+		{Text: "« Назад", CallbackData: SETTINGS_CALLBACK + settingsMenu},
+	})
+
+	return title, &models.InlineKeyboardMarkup{InlineKeyboard: keyboard}
+}
+
+func validOption(options []settingsOption, value string) bool {
+	for _, o := range options {
+		if o.Value == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+// settingsCallbackQuery opens a setting with settings_<key> and stores
+// the chosen value with settings_<key>_<value>.
+func (bw *BotWrapper) settingsCallbackQuery(ctx context.Context, b *bot.Bot, update *models.Update) {
+	answer := func(text string) {
+		if _, err := b.AnswerCallbackQuery(ctx, &bot.AnswerCallbackQueryParams{
+			CallbackQueryID: update.CallbackQuery.ID,
+			Text:            text,
+		}); err != nil {
+			bw.log.Error().Err(err).Msg("answer callback query failed")
+		}
+	}
+
+	user, err := bw.psql.GetUser(ctx, update.CallbackQuery.From.ID)
+	if err != nil {
+		answer("Не удалось загрузить настройки.")
+
+		return
+	}
+
+	key, value, chosen := strings.Cut(strings.TrimPrefix(update.CallbackQuery.Data, SETTINGS_CALLBACK), "_")
+
+	if !chosen {
+		answer("")
+
+		var text string
+		var markup models.ReplyMarkup
+
+		switch key {
+		case settingsLanguage:
+			text, markup = settingsChoice(key, "Язык встреч:", languageOptions, user.AsrLanguage)
+		case settingsModel:
+			text, markup = settingsChoice(key, "Модель распознавания речи, более точные работают медленнее:", modelOptions, user.AsrModel)
+		case settingsSpeakers:
+			text, markup = settingsChoice(key, "Сколько спикеров обычно участвует во встрече:", speakersOptions, speakersValue(user))
+		case settingsReport:
+			text, markup = settingsChoice(key, "Какой отчет присылать, когда протокол утвержден:", reportOptions, reportValue(user))
+		case settingsNotify:
+			user.NotifyDone = !user.NotifyDone
+			if !bw.saveSettings(ctx, user) {
+				return
+			}
+
+			text, markup = settingsView(user)
+		default:
+			text, markup = settingsView(user)
+		}
+
+		bw.editCallbackMessage(ctx, update, text, markup)
+
+		return
+	}
+
+	switch {
+	case key == settingsLanguage && validOption(languageOptions, value):
+		user.AsrLanguage = value
+	case key == settingsModel && validOption(modelOptions, value):
+		user.AsrModel = value
+	case key == settingsSpeakers && validOption(speakersOptions, value):
+		n, _ := strconv.Atoi(value)
+		user.Speakers = pgtype.Int4{Int32: int32(n), Valid: n > 0}
+	case key == settingsReport && validOption(reportOptions, value):
+		reportType, format, ok := strings.Cut(value, "-")
+		user.ReportType = pgtype.Text{String: reportType, Valid: ok}
+		user.ReportFormat = pgtype.Text{String: format, Valid: ok}
+	default:
+		answer("Некорректный запрос.")
+
+		return
+	}
+
+	if !bw.saveSettings(ctx, user) {
+		answer("Не удалось сохранить настройки.")
+
+		return
+	}
+
+	answer("Сохранено.")
+
+	text, markup := settingsView(user)
+	bw.editCallbackMessage(ctx, update, text, markup)
+}
+
+func (bw *BotWrapper) saveSettings(ctx context.Context, u postgres.User) bool {
+	if err := bw.psql.UpdateUserSettings(ctx, postgres.UpdateUserSettingsParams{
+		AsrLanguage:  u.AsrLanguage,
+		AsrModel:     u.AsrModel,
+		Speakers:     u.Speakers,
+		ReportType:   u.ReportType,
+		ReportFormat: u.ReportFormat,
+		NotifyDone:   u.NotifyDone,
+		TgUserID:     u.TgUserID,
+	}); err != nil {
+		bw.log.Error().Err(err).Int64("chatID", u.TgUserID).Msg("update user settings failed")
+
+		return false
+	}
+
+	return true
+}
+
+// meetingDone notifies the user about the processed meeting.
+func (bw *BotWrapper) meetingDone(ctx context.Context, tr postgres.Transcribition) {
+	user, err := bw.psql.GetUser(ctx, tr.TgUserID)
+	if err != nil {
+		bw.log.Error().Err(err).Int64("chatID", tr.TgUserID).Msg("failed to get user settings")
+
+		return
+	}
+
+	// Edited status messages are silent, a new one makes Telegram notify the user.
+	if user.NotifyDone {
+		if _, err := bw.b.SendMessage(ctx, &bot.SendMessageParams{
+			ChatID:          tr.ChatID,
+			MessageThreadID: int(tr.MessageThreadID.Int64),
+			Text:            fmt.Sprintf("%s обработано.", meetingName(tr)),
+			ReplyParameters: &models.ReplyParameters{
+				MessageID:                int(tr.MessageToEdit.Int64),
+				AllowSendingWithoutReply: true,
+			},
+		}); err != nil {
+			bw.log.Error().Err(err).Int64("id", tr.ID).Msg("send done notification failed")
+		}
+	}
+}
+
+// defaultReport starts the report the uploader has chosen as the default one,
+// it is built once the protocol is confirmed.
+func (bw *BotWrapper) defaultReport(ctx context.Context, tr postgres.Transcribition) {
+	user, err := bw.psql.GetUser(ctx, tr.TgUserID)
+	if err != nil {
+		bw.log.Error().Err(err).Int64("chatID", tr.TgUserID).Msg("failed to get user settings")
+
+		return
+	}
+
+	if !user.ReportType.Valid || !user.ReportFormat.Valid {
+		return
+	}
+
+	// The default report counts like the one requested with the buttons.
+	if !bw.takeReport(ctx, tr.TgUserID, tr.ID) {
+		if _, err := bw.b.SendMessage(ctx, &bot.SendMessageParams{
+			ChatID:          tr.ChatID,
+			MessageThreadID: int(tr.MessageThreadID.Int64),
+			Text:            fmt.Sprintf(QUOTA_REPORTS, bw.cfg.QuotaReportsPerMinute),
+		}); err != nil {
+			bw.log.Error().Err(err).Int64("id", tr.ID).Msg("send report quota message failed")
+		}
+
+		return
+	}
+
+	bw.submitReport(tr.TgUserID, tr.ID, user.ReportType.String == "official", user.ReportFormat.String)
+}
@@ -0,0 +1,476 @@
+package bot
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+	"github.com/jackc/pgx/v5/pgtype"
+
+	postgres "github.com/gulldan/cp2024omsk-pmsk/bot/postgres/generated"
+)
+
+const (
+	SPEAKER_CALLBACK = "speaker_"
+	SPEAKER_ASK      = "Кто это? Ответьте на это сообщение именем и ролью через запятую, например: Анна Смирнова, главный бухгалтер. Или выберите участника прошлых встреч."
+	SPEAKER_SAVED    = "Сохранено: %s — %s."
+	SPEAKER_BAD_NAME = "Ошибка. Имя должно быть не длиннее %d символов."
+	SPEAKERS_WAIT    = "ожидание имен спикеров, чтобы указать их в протоколе. Ответьте на сообщения со спикерами или продолжите без имен, через %d мин. обработка продолжится сама."
+	SPEAKERS_SKIP    = "speakers_skip"
+
+	knownSpeakersLimit = 6
+	maxQuoteLength     = 300
+	maxSpeakerName     = 100
+)
+
+// speakerQuotes picks the longest phrase of every diarized speaker, it is the
+// easiest one to recognize the speaker by.
+func speakerQuotes(stored string) ([]string, map[string]string, error) {
+	var v TaskResponseMarshal
+	if err := json.Unmarshal([]byte(stored), &v); err != nil {
+		return nil, nil, fmt.Errorf("json unmarshal failed: %w", err)
+	}
+
+	quotes := make(map[string]string)
+	for _, s := range v.Result.Segments {
+		text := strings.TrimSpace(s.Text)
+		if s.Speaker == "" || utf8.RuneCountInString(text) <= utf8.RuneCountInString(quotes[s.Speaker]) {
+			continue
+		}
+
+		quotes[s.Speaker] = text
+	}
+
+	labels := make([]string, 0, len(quotes))
+	for label, quote := range quotes {
+		if r := []rune(quote); len(r) > maxQuoteLength {
+			quotes[label] = string(r[:maxQuoteLength]) + "…"
+		}
+
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+
+	return labels, quotes, nil
+}
+
+func speakerTitle(name string, role pgtype.Text) string {
+	if role.Valid && role.String != "" {
+		return name + " (" + role.String + ")"
+	}
+
+	return name
+}
+
+// speakerNames maps the diarization labels of the meeting to the names given by the user.
+func (bw *BotWrapper) speakerNames(ctx context.Context, pgID int64) map[string]string {
+	speakers, err := bw.psql.GetSpeakers(ctx, pgID)
+	if err != nil {
+		bw.log.Error().Err(err).Int64("id", pgID).Msg("get speakers failed")
+
+		return nil
+	}
+
+	names := make(map[string]string, len(speakers))
+	for _, s := range speakers {
+		if s.Name.Valid {
+			names[s.Label] = speakerTitle(s.Name.String, s.Role)
+		}
+	}
+
+	return names
+}
+
+// renameSpeakers replaces the labels in a JSON document, the names are escaped
+// so the document stays valid.
+func renameSpeakers(doc string, names map[string]string) string {
+	if len(names) == 0 {
+		return doc
+	}
+
+	pairs := make([]string, 0, len(names)*2)
+	for label, name := range names {
+		escaped, err := json.Marshal(name)
+		if err != nil {
+			continue
+		}
+
+		pairs = append(pairs, label, string(escaped[1:len(escaped)-1]))
+	}
+
+	return strings.NewReplacer(pairs...).Replace(doc)
+}
+
+// askSpeakerNames sends a quote of every speaker of the transcribed meeting, the
+// user answers with the name and the role of the speaker. It returns the number
+// of the prompts sent.
+func (bw *BotWrapper) askSpeakerNames(ctx context.Context, pgID int64) int {
+	tr, err := bw.psql.GetTranscribition(ctx, pgID)
+	if err != nil {
+		bw.log.Error().Err(err).Int64("id", pgID).Msg("get transcribition failed")
+
+		return 0
+	}
+
+	labels, quotes, err := speakerQuotes(tr.Transcription.String)
+	if err != nil {
+		bw.log.Error().Err(err).Int64("id", tr.ID).Msg("pick speaker quotes failed")
+
+		return 0
+	}
+
+	// After re-diarization the labels the meeting has no more are dropped, the
+	// others keep their names and are shown with them to be corrected.
+	if err := bw.psql.DeleteStaleSpeakers(ctx, postgres.DeleteStaleSpeakersParams{
+		TranscribitionID: tr.ID,
+		Labels:           labels,
+	}); err != nil {
+		bw.log.Error().Err(err).Int64("id", tr.ID).Msg("delete stale speakers failed")
+
+		return 0
+	}
+
+	named, err := bw.psql.GetSpeakers(ctx, tr.ID)
+	if err != nil {
+		bw.log.Error().Err(err).Int64("id", tr.ID).Msg("get speakers failed")
+	}
+
+	previous := make(map[string]postgres.Speaker, len(named))
+	for _, s := range named {
+		previous[s.Label] = s
+	}
+
+	known := bw.knownSpeakers(ctx, tr.TgUserID)
+	sent := 0
+
+	for _, label := range labels {
+		s := postgres.Speaker{
+			TranscribitionID: tr.ID,
+			Label:            label,
+			Name:             previous[label].Name,
+			Role:             previous[label].Role,
+			Quote:            pgtype.Text{String: quotes[label], Valid: true},
+		}
+
+		text, markup := bw.speakerPrompt(s, known)
+
+		msg, err := bw.b.SendMessage(ctx, &bot.SendMessageParams{
+			ChatID:          tr.ChatID,
+			MessageThreadID: int(tr.MessageThreadID.Int64),
+			Text:            text,
+			ReplyMarkup:     markup,
+		})
+		if err != nil {
+			bw.log.Error().Err(err).Int64("id", tr.ID).Msg("send speaker prompt failed")
+
+			continue
+		}
+
+		if err := bw.psql.CreateSpeaker(ctx, postgres.CreateSpeakerParams{
+			TranscribitionID: tr.ID,
+			Label:            label,
+			Quote:            s.Quote,
+			PromptMessageID: pgtype.Int8{
+				Int64: int64(msg.ID),
+				Valid: true,
+			},
+		}); err != nil {
+			bw.log.Error().Err(err).Int64("id", tr.ID).Msg("create speaker failed")
+
+			continue
+		}
+
+		sent++
+	}
+
+	return sent
+}
+
+// knownSpeakers are the participants named in the earlier meetings of the uploader.
+func (bw *BotWrapper) knownSpeakers(ctx context.Context, userID int64) []postgres.KnownSpeaker {
+	known, err := bw.psql.GetKnownSpeakers(ctx, postgres.GetKnownSpeakersParams{
+		TgUserID: userID,
+		Limit:    knownSpeakersLimit,
+	})
+	if err != nil {
+		bw.log.Error().Err(err).Int64("chatID", userID).Msg("get known speakers failed")
+	}
+
+	return known
+}
+
+// speakerPrompt shows the quote of the speaker, the name given so far and the
+// participants of earlier meetings to pick from.
+func (bw *BotWrapper) speakerPrompt(s postgres.Speaker, known []postgres.KnownSpeaker) (string, models.ReplyMarkup) {
+	header := s.Label
+	if s.Name.Valid {
+		header += " — " + speakerTitle(s.Name.String, s.Role)
+	}
+
+	text := fmt.Sprintf("%s\n«%s»\n\n%s", header, s.Quote.String, SPEAKER_ASK)
+
+	if len(known) == 0 {
+		return text, nil
+	}
+
+	keyboard := make([][]models.InlineKeyboardButton, 0, len(known))
+	for _, k := range known {
+		keyboard = append(keyboard, []models.InlineKeyboardButton{{
+			Text:         speakerTitle(k.Name, k.Role),
+			CallbackData: bw.signedData(SPEAKER_CALLBACK+strconv.FormatInt(k.ID, 10)+"_"+s.Label, s.TranscribitionID),
+		}})
+	}
+
+	return text, &models.InlineKeyboardMarkup{InlineKeyboard: keyboard}
+}
+
+// assignSpeaker names the speaker of the meeting and remembers the name for the next meetings.
+func (bw *BotWrapper) assignSpeaker(ctx context.Context, userID int64, s *postgres.Speaker, name string, role pgtype.Text) error {
+	if err := bw.psql.UpdateSpeakerName(ctx, postgres.UpdateSpeakerNameParams{
+		Name: pgtype.Text{
+			String: name,
+			Valid:  true,
+		},
+		Role:             role,
+		TranscribitionID: s.TranscribitionID,
+		Label:            s.Label,
+	}); err != nil {
+		return fmt.Errorf("update speaker name failed: %w", err)
+	}
+
+	if err := bw.psql.SaveKnownSpeaker(ctx, postgres.SaveKnownSpeakerParams{
+		TgUserID: userID,
+		Name:     name,
+		Role:     role,
+	}); err != nil {
+		return fmt.Errorf("save known speaker failed: %w", err)
+	}
+
+	s.Name = pgtype.Text{String: name, Valid: true}
+	s.Role = role
+
+	return nil
+}
+
+// speakerReply handles the answer to a speaker prompt, it reports whether the
+// message was one.
+func (bw *BotWrapper) speakerReply(ctx context.Context, msg *models.Message) bool {
+	if msg.ReplyToMessage == nil || msg.Text == "" {
+		return false
+	}
+
+	s, err := bw.psql.GetSpeakerByPrompt(ctx, postgres.GetSpeakerByPromptParams{
+		ChatID: msg.Chat.ID,
+		PromptMessageID: pgtype.Int8{
+			Int64: int64(msg.ReplyToMessage.ID),
+			Valid: true,
+		},
+	})
+	if err != nil {
+		return false
+	}
+
+	tr, err := bw.psql.GetTranscribition(ctx, s.TranscribitionID)
+	if err != nil {
+		return false
+	}
+
+	reply := func(text string) {
+		if _, err := bw.b.SendMessage(ctx, &bot.SendMessageParams{
+			ChatID:          msg.Chat.ID,
+			MessageThreadID: threadID(msg),
+			Text:            text,
+			ReplyParameters: &models.ReplyParameters{
+				MessageID: msg.ID,
+			},
+		}); err != nil {
+			bw.log.Error().Err(err).Msg("send speaker message failed")
+		}
+	}
+
+	name, role, _ := strings.Cut(msg.Text, ",")
+	name, role = strings.TrimSpace(name), strings.TrimSpace(role)
+
+	if name == "" || utf8.RuneCountInString(name) > maxSpeakerName || utf8.RuneCountInString(role) > maxSpeakerName {
+		reply(fmt.Sprintf(SPEAKER_BAD_NAME, maxSpeakerName))
+
+		return true
+	}
+
+	if err := bw.assignSpeaker(ctx, tr.TgUserID, &s, name, pgtype.Text{String: role, Valid: role != ""}); err != nil {
+		bw.log.Error().Err(err).Int64("id", s.TranscribitionID).Msg("assign speaker failed")
+		reply("Не удалось сохранить имя спикера.")
+
+		return true
+	}
+
+	text, markup := bw.speakerPrompt(s, bw.knownSpeakers(ctx, tr.TgUserID))
+
+	if _, err := bw.b.EditMessageText(ctx, &bot.EditMessageTextParams{
+		ChatID:      msg.Chat.ID,
+		MessageID:   msg.ReplyToMessage.ID,
+		Text:        text,
+		ReplyMarkup: markup,
+	}); err != nil {
+		bw.log.Error().Err(err).Int64("id", s.TranscribitionID).Msg("failed to edit message")
+	}
+
+	reply(fmt.Sprintf(SPEAKER_SAVED, s.Label, speakerTitle(name, s.Role)))
+	bw.releaseIfNamed(ctx, tr.ID)
+
+	return true
+}
+
+// speakerCallbackQuery gives the speaker the name of a participant of an earlier
+// meeting, the data is speaker_<id>_<known id>_<label>.
+func (bw *BotWrapper) speakerCallbackQuery(ctx context.Context, b *bot.Bot, update *models.Update) {
+	answer := func(text string) {
+		if _, err := b.AnswerCallbackQuery(ctx, &bot.AnswerCallbackQueryParams{
+			CallbackQueryID: update.CallbackQuery.ID,
+			Text:            text,
+		}); err != nil {
+			bw.log.Error().Err(err).Msg("answer callback query failed")
+		}
+	}
+
+	data, pgID, err := bw.parseSignedData(update.CallbackQuery.Data)
+	if err != nil {
+		answer(callbackError(err))
+
+		return
+	}
+
+	// The action is speaker_<known speaker id>_<label>.
+	known, label, ok := strings.Cut(strings.TrimPrefix(data, SPEAKER_CALLBACK), "_")
+	if !ok {
+		answer("Некорректный запрос.")
+
+		return
+	}
+
+	knownID, err := strconv.ParseInt(known, 10, 64)
+	if err != nil {
+		answer("Некорректный запрос.")
+
+		return
+	}
+
+	tr, err := bw.psql.GetTranscribition(ctx, pgID)
+	if err != nil || !canAccess(tr, update.CallbackQuery) {
+		answer("Встреча не найдена.")
+
+		return
+	}
+
+	k, err := bw.psql.GetKnownSpeaker(ctx, knownID)
+	if err != nil || k.TgUserID != tr.TgUserID {
+		answer("Участник не найден.")
+
+		return
+	}
+
+	var speaker *postgres.Speaker
+
+	speakers, err := bw.psql.GetSpeakers(ctx, tr.ID)
+	if err != nil {
+		bw.log.Error().Err(err).Int64("id", tr.ID).Msg("get speakers failed")
+	}
+
+	for i := range speakers {
+		if speakers[i].Label == label {
+			speaker = &speakers[i]
+		}
+	}
+
+	if speaker == nil {
+		answer("Спикер не найден, возможно, спикеры были перераспределены.")
+
+		return
+	}
+
+	if err := bw.assignSpeaker(ctx, tr.TgUserID, speaker, k.Name, k.Role); err != nil {
+		bw.log.Error().Err(err).Int64("id", tr.ID).Msg("assign speaker failed")
+		answer("Не удалось сохранить имя спикера.")
+
+		return
+	}
+
+	answer("Сохранено.")
+
+	text, markup := bw.speakerPrompt(*speaker, bw.knownSpeakers(ctx, tr.TgUserID))
+	bw.editCallbackMessage(ctx, update, text, markup)
+	bw.releaseIfNamed(ctx, tr.ID)
+}
+
+// releaseIfNamed starts the protocol held for the speaker names once every
+// speaker of the meeting is named.
+func (bw *BotWrapper) releaseIfNamed(ctx context.Context, pgID int64) {
+	speakers, err := bw.psql.GetSpeakers(ctx, pgID)
+	if err != nil {
+		bw.log.Error().Err(err).Int64("id", pgID).Msg("get speakers failed")
+
+		return
+	}
+
+	for _, s := range speakers {
+		if !s.Name.Valid {
+			return
+		}
+	}
+
+	bw.releaseJob(ctx, pgID)
+}
+
+// speakersWaitMarkup lets the user start the protocol without naming the speakers.
+func (bw *BotWrapper) speakersWaitMarkup(pgID int64) models.ReplyMarkup {
+	return &models.InlineKeyboardMarkup{
+		InlineKeyboard: [][]models.InlineKeyboardButton{
+			{
+				{Text: "Продолжить без имен", CallbackData: bw.signedData(SPEAKERS_SKIP, pgID)},
+			},
+			{
+				bw.cancelButton(pgID),
+			},
+		},
+	}
+}
+
+// skipSpeakersCallbackQuery starts the protocol with the speakers named so far.
+func (bw *BotWrapper) skipSpeakersCallbackQuery(ctx context.Context, b *bot.Bot, update *models.Update) {
+	answer := func(text string) {
+		if _, err := b.AnswerCallbackQuery(ctx, &bot.AnswerCallbackQueryParams{
+			CallbackQueryID: update.CallbackQuery.ID,
+			Text:            text,
+		}); err != nil {
+			bw.log.Error().Err(err).Msg("answer callback query failed")
+		}
+	}
+
+	_, pgID, err := bw.parseSignedData(update.CallbackQuery.Data)
+	if err != nil {
+		answer(INVALID_BUTTON)
+
+		return
+	}
+
+	tr, err := bw.psql.GetTranscribition(ctx, pgID)
+	if err != nil || !canAccess(tr, update.CallbackQuery) {
+		answer("Встреча не найдена.")
+
+		return
+	}
+
+	if !bw.releaseJob(ctx, tr.ID) {
+		answer("Встреча уже обрабатывается.")
+
+		return
+	}
+
+	answer("Продолжаем без имен.")
+}
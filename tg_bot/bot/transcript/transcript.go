@@ -0,0 +1,195 @@
+// Package transcript renders the whisper segments as subtitles, text and JSON.
+package transcript
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"github.com/gulldan/cp2024omsk-pmsk/bot/clients/whisper"
+)
+
+func timestamp(seconds float64, sep string) string {
+	d := time.Duration(seconds * float64(time.Second)).Round(time.Millisecond)
+
+	return fmt.Sprintf("%02d:%02d:%02d%s%03d", int(d.Hours()), int(d.Minutes())%60, int(d.Seconds())%60, sep, d.Milliseconds()%1000)
+}
+
+// Clock formats the offset as hh:mm:ss.
+func Clock(seconds float64) string {
+	d := time.Duration(seconds * float64(time.Second))
+
+	return fmt.Sprintf("%02d:%02d:%02d", int(d.Hours()), int(d.Minutes())%60, int(d.Seconds())%60)
+}
+
+// SRT renders the segments as SubRip subtitles, the speaker prefixes the text.
+func SRT(segments []whisper.Segment) string {
+	var sb strings.Builder
+
+	n := 0
+	for _, s := range segments {
+		text := strings.TrimSpace(s.Text)
+		if text == "" {
+			continue
+		}
+
+		if s.Speaker != "" {
+			text = s.Speaker + ": " + text
+		}
+
+		n++
+		fmt.Fprintf(&sb, "%d\n%s --> %s\n%s\n\n", n, timestamp(s.Start, ","), timestamp(s.End, ","), text)
+	}
+
+	return sb.String()
+}
+
+var vttEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+// VTT renders the segments as WebVTT subtitles, the speaker is set with a voice tag.
+func VTT(segments []whisper.Segment) string {
+	var sb strings.Builder
+
+	sb.WriteString("WEBVTT\n\n")
+
+	for _, s := range segments {
+		text := vttEscaper.Replace(strings.TrimSpace(s.Text))
+		if text == "" {
+			continue
+		}
+
+		if s.Speaker != "" {
+			text = "<v " + vttEscaper.Replace(s.Speaker) + ">" + text
+		}
+
+		fmt.Fprintf(&sb, "%s --> %s\n%s\n\n", timestamp(s.Start, "."), timestamp(s.End, "."), text)
+	}
+
+	return sb.String()
+}
+
+// Text renders the segments as speaker turns: consecutive phrases of a speaker
+// are joined into a paragraph headed by its start time and the speaker.
+func Text(segments []whisper.Segment) string {
+	var (
+		sb      strings.Builder
+		speaker string
+	)
+
+	for _, s := range segments {
+		text := strings.TrimSpace(s.Text)
+		if text == "" {
+			continue
+		}
+
+		// The skipped empty phrases don't break the turn of a speaker.
+		if sb.Len() == 0 || s.Speaker != speaker {
+			if sb.Len() > 0 {
+				sb.WriteString("\n\n")
+			}
+
+			sb.WriteString("[" + Clock(s.Start) + "]")
+			if s.Speaker != "" {
+				sb.WriteString(" " + s.Speaker + ":")
+			}
+			sb.WriteString("\n")
+
+			speaker = s.Speaker
+		} else {
+			sb.WriteString(" ")
+		}
+
+		sb.WriteString(text)
+	}
+
+	if sb.Len() > 0 {
+		sb.WriteString("\n")
+	}
+
+	return sb.String()
+}
+
+// JSON exports the segments with the texts trimmed.
+func JSON(segments []whisper.Segment) ([]byte, error) {
+	out := struct {
+		Segments []whisper.Segment `json:"segments"`
+	}{
+		Segments: make([]whisper.Segment, 0, len(segments)),
+	}
+
+	for _, s := range segments {
+		s.Text = strings.TrimSpace(s.Text)
+		out.Segments = append(out.Segments, s)
+	}
+
+	b, err := json.MarshalIndent(out, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("json marshal failed: %w", err)
+	}
+
+	return b, nil
+}
+
+// Split cuts the text into parts of at most limit characters, preferring to
+// cut between paragraphs, then between lines, then between words. Characters
+// are counted in UTF-16 code units like Telegram does, so an emoji takes two.
+func Split(text string, limit int) []string {
+	var parts []string
+
+	for utf16Len(text) > limit {
+		head := text[:utf16Prefix(text, limit)]
+		if head == "" {
+			_, size := utf8.DecodeRuneInString(text)
+			head = text[:size]
+		}
+
+		cut := -1
+		for _, sep := range []string{"\n\n", "\n", " "} {
+			if i := strings.LastIndex(head, sep); i > 0 {
+				cut = i
+				break
+			}
+		}
+
+		if cut < 0 {
+			cut = len(head)
+		}
+
+		if part := strings.TrimSpace(text[:cut]); part != "" {
+			parts = append(parts, part)
+		}
+		text = strings.TrimLeft(text[cut:], " \n")
+	}
+
+	if text = strings.TrimSpace(text); text != "" {
+		parts = append(parts, text)
+	}
+
+	return parts
+}
+
+// utf16Len is the length of the text in UTF-16 code units.
+func utf16Len(text string) int {
+	n := 0
+	for _, r := range text {
+		n += utf16.RuneLen(r)
+	}
+
+	return n
+}
+
+// utf16Prefix returns the byte length of the longest prefix of the text which
+// takes at most limit UTF-16 code units.
+func utf16Prefix(text string, limit int) int {
+	n := 0
+	for i, r := range text {
+		if n += utf16.RuneLen(r); n > limit {
+			return i
+		}
+	}
+
+	return len(text)
+}
@@ -0,0 +1,196 @@
+package transcript
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/gulldan/cp2024omsk-pmsk/bot/clients/whisper"
+)
+
+func TestText(t *testing.T) {
+	tests := []struct {
+		name     string
+		segments []whisper.Segment
+		want     string
+	}{
+		{
+			name: "no segments",
+			want: "",
+		},
+		{
+			name: "only empty segments",
+			segments: []whisper.Segment{
+				{Start: 0, Text: "  ", Speaker: "SPEAKER_00"},
+				{Start: 1, Text: "", Speaker: "SPEAKER_01"},
+			},
+			want: "",
+		},
+		{
+			name: "speaker turns",
+			segments: []whisper.Segment{
+				{Start: 0, Text: " Добрый день.", Speaker: "SPEAKER_00"},
+				{Start: 2, Text: "Начнем.", Speaker: "SPEAKER_00"},
+				{Start: 5, Text: "Согласен.", Speaker: "SPEAKER_01"},
+			},
+			want: "[00:00:00] SPEAKER_00:\nДобрый день. Начнем.\n\n[00:00:05] SPEAKER_01:\nСогласен.\n",
+		},
+		{
+			name: "empty segment of another speaker inside a turn",
+			segments: []whisper.Segment{
+				{Start: 0, Text: "Первое.", Speaker: "SPEAKER_00"},
+				{Start: 1, Text: " ", Speaker: "SPEAKER_01"},
+				{Start: 2, Text: "Второе.", Speaker: "SPEAKER_00"},
+			},
+			want: "[00:00:00] SPEAKER_00:\nПервое. Второе.\n",
+		},
+		{
+			name: "empty first segment",
+			segments: []whisper.Segment{
+				{Start: 0, Text: "", Speaker: "SPEAKER_00"},
+				{Start: 3, Text: "Слово.", Speaker: "SPEAKER_00"},
+			},
+			want: "[00:00:03] SPEAKER_00:\nСлово.\n",
+		},
+		{
+			name: "empty segment between speakers",
+			segments: []whisper.Segment{
+				{Start: 0, Text: "Вопрос?", Speaker: "SPEAKER_00"},
+				{Start: 1, Text: "", Speaker: "SPEAKER_01"},
+				{Start: 2, Text: "Ответ.", Speaker: "SPEAKER_01"},
+			},
+			want: "[00:00:00] SPEAKER_00:\nВопрос?\n\n[00:00:02] SPEAKER_01:\nОтвет.\n",
+		},
+		{
+			name: "without diarization",
+			segments: []whisper.Segment{
+				{Start: 0, Text: "Раз."},
+				{Start: 1, Text: "Два."},
+			},
+			want: "[00:00:00]\nРаз. Два.\n",
+		},
+		{
+			name: "over an hour",
+			segments: []whisper.Segment{
+				{Start: 3725.6, Text: "Итоги.", Speaker: "SPEAKER_00"},
+				{Start: 90061, Text: "Конец.", Speaker: "SPEAKER_01"},
+			},
+			want: "[01:02:05] SPEAKER_00:\nИтоги.\n\n[25:01:01] SPEAKER_01:\nКонец.\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Text(tt.segments); got != tt.want {
+				t.Errorf("Text() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTimestamps(t *testing.T) {
+	tests := []struct {
+		name    string
+		seconds float64
+		clock   string
+		srt     string
+		vtt     string
+	}{
+		{name: "zero", seconds: 0, clock: "00:00:00", srt: "00:00:00,000", vtt: "00:00:00.000"},
+		{name: "milliseconds", seconds: 59.9994, clock: "00:00:59", srt: "00:00:59,999", vtt: "00:00:59.999"},
+		{name: "over an hour", seconds: 3661.25, clock: "01:01:01", srt: "01:01:01,250", vtt: "01:01:01.250"},
+		{name: "over a day", seconds: 90000.5, clock: "25:00:00", srt: "25:00:00,500", vtt: "25:00:00.500"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Clock(tt.seconds); got != tt.clock {
+				t.Errorf("Clock() = %q, want %q", got, tt.clock)
+			}
+
+			if got := timestamp(tt.seconds, ","); got != tt.srt {
+				t.Errorf("timestamp(%q) = %q, want %q", ",", got, tt.srt)
+			}
+
+			if got := timestamp(tt.seconds, "."); got != tt.vtt {
+				t.Errorf("timestamp(%q) = %q, want %q", ".", got, tt.vtt)
+			}
+		})
+	}
+}
+
+func TestSplit(t *testing.T) {
+	const limit = 4096
+
+	paragraph := strings.Repeat("а", 3000)
+	line := strings.Repeat("б", 3000)
+
+	tests := []struct {
+		name string
+		text string
+		want []string
+	}{
+		{
+			name: "empty",
+			text: " \n ",
+			want: nil,
+		},
+		{
+			name: "fits exactly",
+			text: strings.Repeat("я", limit),
+			want: []string{strings.Repeat("я", limit)},
+		},
+		{
+			name: "between paragraphs",
+			text: paragraph + "\n\n" + line + "\n" + line,
+			want: []string{paragraph, line, line},
+		},
+		{
+			name: "between lines",
+			text: line + "\n" + line,
+			want: []string{line, line},
+		},
+		{
+			name: "between words",
+			text: strings.Repeat("слово ", 1000),
+			want: []string{
+				strings.TrimSpace(strings.Repeat("слово ", 682)),
+				strings.TrimSpace(strings.Repeat("слово ", 318)),
+			},
+		},
+		{
+			name: "without separators",
+			text: strings.Repeat("ж", limit+1),
+			want: []string{strings.Repeat("ж", limit), "ж"},
+		},
+		{
+			name: "emoji take two units",
+			text: strings.Repeat("😀", limit/2+1),
+			want: []string{strings.Repeat("😀", limit/2), "😀"},
+		},
+		{
+			name: "emoji does not fit the last unit",
+			text: strings.Repeat("ж", limit-1) + "😀",
+			want: []string{strings.Repeat("ж", limit-1), "😀"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Split(tt.text, limit)
+
+			if len(got) != len(tt.want) {
+				t.Fatalf("Split() returned %d parts, want %d", len(got), len(tt.want))
+			}
+
+			for i := range got {
+				if n := utf16Len(got[i]); n > limit {
+					t.Errorf("part %d has %d characters, the limit is %d", i, n, limit)
+				}
+
+				if got[i] != tt.want[i] {
+					t.Errorf("part %d = %.20q…, want %.20q…", i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
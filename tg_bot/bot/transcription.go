@@ -1,224 +1,183 @@
 package bot
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
-	"mime/multipart"
-	"net/http"
-	"net/url"
 	"path/filepath"
+	"strings"
 	"time"
 
+	"github.com/gulldan/cp2024omsk-pmsk/bot/clients/whisper"
+	"github.com/gulldan/cp2024omsk-pmsk/bot/transcript"
 	"github.com/jackc/pgx/v5/pgtype"
 
 	postgres "github.com/gulldan/cp2024omsk-pmsk/bot/postgres/generated"
 )
 
-type TranscriptionResp struct {
-	ID      string `json:"identifier"`
-	Message string `json:"message"`
-}
+// transcribe runs the audio of the transcribition through whisper and stores the segments.
+func (bw *BotWrapper) transcribe(ctx context.Context, tr postgres.Transcribition) error {
+	bw.log.Info().Int64("chatID", tr.TgUserID).Str("file", tr.AudioNameMinio.String).Msg("start transcription")
 
-func (bw *BotWrapper) startTranscription(ctx context.Context, pgID, chatID int64, file string, messageID int64) {
-	go func() {
-		bw.log.Info().Int64("chatID", chatID).Str("file", file).Msg("start transcription")
+	var (
+		result whisper.Result
+		err    error
+	)
 
-		v, err := bw.runTranscription(ctx, file)
-		if err != nil {
-			bw.log.Error().Err(err).Int64("chatID", chatID).Str("file", file).Msg("run transcription failed")
+	if bw.cfg.AsrMode == AsrModeStages {
+		result, err = bw.runStagedTranscription(ctx, tr)
+	} else {
+		result, err = bw.runTranscription(ctx, tr)
+	}
+	if err != nil {
+		return fmt.Errorf("run transcription failed: %w", err)
+	}
 
-			return
-		}
+	b, err := json.Marshal(TaskResponseMarshal{
+		Result: result,
+	})
+	if err != nil {
+		return stageError(StatusTranscription, ErrCodeInternal, fmt.Errorf("json marshal failed: %w", err))
+	}
 
-		b, err := json.Marshal(TaskResponseMarshal{
-			Result: v.Result,
-		})
-		if err != nil {
-			bw.log.Error().Err(err).Int64("chatID", chatID).Str("file", file).Msg("json marshal failed")
+	if err := bw.psql.UpdateTranscription(ctx, postgres.UpdateTranscriptionParams{
+		Transcription: pgtype.Text{
+			String: string(b),
+			Valid:  true,
+		},
+		ID: tr.ID,
+	}); err != nil {
+		return stageError(StatusTranscription, ErrCodeStorage, fmt.Errorf("update transcription failed: %w", err))
+	}
 
-			return
-		}
+	bw.recordAudioUsage(ctx, tr, result)
 
-		if err := bw.psql.UpdateTranscription(ctx, postgres.UpdateTranscriptionParams{
-			Transcription: pgtype.Text{
-				String: string(b),
-				Valid:  true,
-			},
-			ID: pgID,
-		}); err != nil {
-			bw.log.Error().Err(err).Int64("chatID", chatID).Str("file", file).Msg("update transcription failed")
+	return nil
+}
 
-			return
-		}
+// runTranscription re-attaches to the whisper task stored on the transcribition,
+// so a restart does not upload the same audio twice. A new task is submitted only
+// when there is none or whisper no longer knows about it.
+func (bw *BotWrapper) runTranscription(ctx context.Context, tr postgres.Transcribition) (whisper.Result, error) {
+	if tr.WhisperTaskID.Valid {
+		bw.log.Info().Int64("id", tr.ID).Str("task", tr.WhisperTaskID.String).Msg("reattach to whisper task")
 
-		bw.log.Info().Any("resp", v).Msg("hello")
+		v, err := bw.waitTranscription(ctx, tr.WhisperTaskID.String)
+		if !errors.Is(err, whisper.ErrTaskNotFound) {
+			return taskSegments(v, err)
+		}
 
-		bw.llamaComplete(ctx, string(b), pgID, chatID, messageID)
+		bw.log.Warn().Int64("id", tr.ID).Str("task", tr.WhisperTaskID.String).Msg("whisper task lost, resubmit")
+	}
 
-		bw.updateStatus(ctx, StatusDone, pgID, chatID, messageID)
-	}()
-}
+	taskID, err := bw.submitTranscription(ctx, tr)
+	if err != nil {
+		return whisper.Result{}, stageError(StatusTranscription, ErrCodeWhisperUnavailable, fmt.Errorf("submit transcription failed: %w", err))
+	}
 
-type TaskResponseMarshal struct {
-	Result struct {
-		Segments []struct {
-			Start   float64 `json:"start"`
-			End     float64 `json:"end"`
-			Text    string  `json:"text"`
-			Speaker string  `json:"speaker"`
-		} `json:"segments"`
+	if err := bw.psql.UpdateWhisperTaskID(ctx, postgres.UpdateWhisperTaskIDParams{
+		WhisperTaskID: pgtype.Text{
+			String: taskID,
+			Valid:  true,
+		},
+		ID: tr.ID,
+	}); err != nil {
+		return whisper.Result{}, stageError(StatusTranscription, ErrCodeStorage, fmt.Errorf("update whisper task id failed: %w", err))
 	}
-}
 
-type TaskResponse struct {
-	Status string `json:"status"`
-	Result struct {
-		Segments []struct {
-			Start   float64 `json:"start"`
-			End     float64 `json:"end"`
-			Text    string  `json:"text"`
-			Speaker string  `json:"speaker"`
-		} `json:"segments"`
-	} `json:"result"`
-	Metadata struct {
-		TaskType   string `json:"task_type"`
-		TaskParams struct {
-			Language             string `json:"language"`
-			Task                 string `json:"task"`
-			Model                string `json:"model"`
-			Device               string `json:"device"`
-			DeviceIndex          int    `json:"device_index"`
-			Threads              int    `json:"threads"`
-			BatchSize            int    `json:"batch_size"`
-			ComputeType          string `json:"compute_type"`
-			AlignModel           any    `json:"align_model"`
-			InterpolateMethod    string `json:"interpolate_method"`
-			ReturnCharAlignments bool   `json:"return_char_alignments"`
-			AsrOptions           struct {
-				BeamSize                  int     `json:"beam_size"`
-				Patience                  float64 `json:"patience"`
-				LengthPenalty             float64 `json:"length_penalty"`
-				Temperatures              float64 `json:"temperatures"`
-				CompressionRatioThreshold float64 `json:"compression_ratio_threshold"`
-				LogProbThreshold          float64 `json:"log_prob_threshold"`
-				NoSpeechThreshold         float64 `json:"no_speech_threshold"`
-				InitialPrompt             any     `json:"initial_prompt"`
-				SuppressTokens            []int   `json:"suppress_tokens"`
-				SuppressNumerals          bool    `json:"suppress_numerals"`
-			} `json:"asr_options"`
-			VadOptions struct {
-				VadOnset  float64 `json:"vad_onset"`
-				VadOffset float64 `json:"vad_offset"`
-			} `json:"vad_options"`
-			MinSpeakers any `json:"min_speakers"`
-			MaxSpeakers any `json:"max_speakers"`
-		} `json:"task_params"`
-		Language      string  `json:"language"`
-		FileName      string  `json:"file_name"`
-		URL           any     `json:"url"`
-		Duration      float64 `json:"duration"`
-		AudioDuration any     `json:"audio_duration"`
-	} `json:"metadata"`
-	Error any `json:"error"`
+	return taskSegments(bw.waitTranscription(ctx, taskID))
 }
 
-func (bw *BotWrapper) runTranscription(ctx context.Context, file string) (TaskResponse, error) {
-	b, err := bw.min.DownloadFile(ctx, file, bw.min.GetAudioBucket())
+// taskSegments decodes the segments of a completed whisper task.
+func taskSegments(v whisper.Task, err error) (whisper.Result, error) {
 	if err != nil {
-		return TaskResponse{}, fmt.Errorf("download file failed: %w", err)
+		return whisper.Result{}, whisperError(err)
 	}
 
-	var buf bytes.Buffer
-	w := multipart.NewWriter(&buf)
-	var fw io.Writer
-	if fw, err = w.CreateFormFile("file", filepath.Base(file)); err != nil {
-		return TaskResponse{}, err
+	r, err := v.Transcript()
+	if err != nil {
+		return whisper.Result{}, stageError(StatusTranscription, ErrCodeWhisperTaskFailed, err)
 	}
 
-	if _, err = io.Copy(fw, b); err != nil {
-		return TaskResponse{}, err
+	return r, nil
+}
+
+// whisperError tells a failed whisper task apart from an unreachable whisper.
+func whisperError(err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, errWhisperTaskFailed):
+		return stageError(StatusTranscription, ErrCodeWhisperTaskFailed, err)
+	default:
+		return stageError(StatusTranscription, ErrCodeWhisperUnavailable, err)
 	}
+}
 
-	w.Close()
+// TaskResponseMarshal is the format the transcription is stored in.
+type TaskResponseMarshal struct {
+	Result whisper.Result
+}
 
-	whisper, err := url.Parse(bw.cfg.WhisperAddr + "/speech-to-text")
-	if err != nil {
-		return TaskResponse{}, fmt.Errorf("url parser failed: %w", err)
+// segmentLine renders the phrase as "[hh:mm:ss] Speaker: text".
+func segmentLine(s whisper.Segment) string {
+	line := "[" + transcript.Clock(s.Start) + "] "
+	if s.Speaker != "" {
+		line += s.Speaker + ": "
 	}
-	values := whisper.Query()
-	values.Add("model", "large-v3")
-	values.Add("language", "ru")
-	whisper.RawQuery = values.Encode()
 
-	newReq, err := http.NewRequest("POST", whisper.String(), &buf)
-	if err != nil {
-		return TaskResponse{}, err
+	return line + strings.TrimSpace(s.Text)
+}
+
+// submitTranscription uploads the audio to whisper and returns the identifier of the created task.
+// Links are always downloaded by the bot, whisper never fetches a URL given by a user.
+func (bw *BotWrapper) submitTranscription(ctx context.Context, tr postgres.Transcribition) (string, error) {
+	params := bw.whisperParams(ctx, tr.TgUserID)
+
+	if !tr.AudioNameMinio.Valid {
+		return "", stageError(StatusTranscription, ErrCodeLinkUnavailable, errors.New("audio is not stored"))
 	}
 
-	newReq.Header.Set("Content-Type", w.FormDataContentType())
+	file := tr.AudioNameMinio.String
 
-	resp, err := http.DefaultClient.Do(newReq)
+	b, err := bw.min.DownloadFile(ctx, file, bw.min.GetAudioBucket())
 	if err != nil {
-		return TaskResponse{}, err
+		return "", fmt.Errorf("download file failed: %w", err)
 	}
+	defer b.Close()
 
-	body, err := io.ReadAll(resp.Body)
+	created, err := bw.whisper.SpeechToText(ctx, filepath.Base(file), b, params)
 	if err != nil {
-		return TaskResponse{}, err
+		return "", err
 	}
 
-	fmt.Println(string(body))
-
-	defer resp.Body.Close()
+	return created.ID, nil
+}
 
-	var respCreated TranscriptionResp
-	if err := json.Unmarshal(body, &respCreated); err != nil {
-		return TaskResponse{}, err
-	}
+var errWhisperTaskFailed = errors.New("whisper task failed")
 
-loop:
+// waitTranscription polls whisper until the task is completed or failed.
+func (bw *BotWrapper) waitTranscription(ctx context.Context, id string) (whisper.Task, error) {
 	for {
-		time.Sleep(time.Second)
-		whisper, err = url.Parse(bw.cfg.WhisperAddr + "/task/" + respCreated.ID)
-		if err != nil {
-			return TaskResponse{}, err
-		}
-		newReq, err = http.NewRequest("GET", whisper.String(), http.NoBody)
-		if err != nil {
-			return TaskResponse{}, err
+		select {
+		case <-ctx.Done():
+			return whisper.Task{}, ctx.Err()
+		case <-time.After(time.Second):
 		}
 
-		resp, err = http.DefaultClient.Do(newReq)
+		r, err := bw.whisper.Task(ctx, id)
 		if err != nil {
-			return TaskResponse{}, err
-		}
-
-		body, err = io.ReadAll(resp.Body)
-		if err != nil {
-			return TaskResponse{}, err
-		}
-		resp.Body.Close()
-
-		fmt.Println(string(body))
-
-		var r TaskResponse
-		if err := json.Unmarshal(body, &r); err != nil {
-			return TaskResponse{}, err
+			return whisper.Task{}, err
 		}
 
-		bw.log.Debug().Any("resp", r).Msg("waiting")
+		bw.log.Debug().Str("task", id).Str("status", r.Status).Msg("waiting")
 
 		switch r.Status {
-		case "completed":
+		case whisper.TaskStatusCompleted:
 			return r, nil
-		case "failed":
-			return TaskResponse{}, errors.New("task failed")
-		default:
-			continue loop
+		case whisper.TaskStatusFailed:
+			return whisper.Task{}, fmt.Errorf("%w: %v", errWhisperTaskFailed, r.Error)
 		}
 	}
 }
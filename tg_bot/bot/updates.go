@@ -0,0 +1,139 @@
+package bot
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+)
+
+const (
+	UpdateModePolling = "polling"
+	UpdateModeWebhook = "webhook"
+
+	webhookSecretHeader = "X-Telegram-Bot-Api-Secret-Token"
+)
+
+// webhookSecret is the secret Telegram sends with every update, the one
+// derived from the token survives restarts like the token itself.
+func (bw *BotWrapper) webhookSecret() string {
+	if bw.cfg.WebhookSecret != "" {
+		return bw.cfg.WebhookSecret
+	}
+
+	sum := sha256.Sum256([]byte("webhook:" + bw.cfg.Token))
+
+	return hex.EncodeToString(sum[:])
+}
+
+// webhookPath is the path the API server receives the updates on, a reverse
+// proxy may serve the public URL under another one.
+func (bw *BotWrapper) webhookPath() (string, error) {
+	u, err := url.Parse(bw.cfg.WebhookURL)
+	if err != nil {
+		return "", fmt.Errorf("parse webhook url failed: %w", err)
+	}
+
+	if u.Scheme != "https" || u.Host == "" {
+		return "", errors.New("webhook url must be an absolute https url")
+	}
+
+	if bw.cfg.WebhookPath != "" {
+		return bw.cfg.WebhookPath, nil
+	}
+
+	if u.Path == "" {
+		return "/", nil
+	}
+
+	return u.Path, nil
+}
+
+// setWebhook points Telegram to the webhook of the bot.
+func (bw *BotWrapper) setWebhook(ctx context.Context) error {
+	if _, err := bw.webhookPath(); err != nil {
+		return err
+	}
+
+	params := &bot.SetWebhookParams{
+		URL:         bw.cfg.WebhookURL,
+		SecretToken: bw.webhookSecret(),
+	}
+
+	if bw.cfg.WebhookSelfSigned {
+		cert, err := os.ReadFile(bw.cfg.TLSCert)
+		if err != nil {
+			return fmt.Errorf("read certificate failed: %w", err)
+		}
+
+		params.Certificate = &models.InputFileUpload{Filename: "cert.pem", Data: bytes.NewReader(cert)}
+	}
+
+	if _, err := bw.b.SetWebhook(ctx, params); err != nil {
+		return fmt.Errorf("set webhook failed: %w", err)
+	}
+
+	return nil
+}
+
+// webhookHandler passes the updates to the bot, the requests without the
+// secret are not from Telegram and are rejected.
+func (bw *BotWrapper) webhookHandler(handler http.HandlerFunc) gin.HandlerFunc {
+	secret := []byte(bw.webhookSecret())
+
+	return func(c *gin.Context) {
+		if subtle.ConstantTimeCompare([]byte(c.GetHeader(webhookSecretHeader)), secret) != 1 {
+			bw.log.Warn().Str("ip", c.ClientIP()).Msg("webhook request with invalid secret")
+			c.AbortWithStatus(http.StatusUnauthorized)
+
+			return
+		}
+
+		handler(c.Writer, c.Request)
+	}
+}
+
+// receiveUpdates runs the bot until the context is done. The webhook is used
+// when configured and Telegram accepts it, otherwise the updates are polled.
+func (bw *BotWrapper) receiveUpdates(ctx context.Context) {
+	webhook := false
+
+	switch bw.cfg.UpdateMode {
+	case UpdateModeWebhook:
+		if err := bw.setWebhook(ctx); err != nil {
+			bw.log.Error().Err(err).Str("url", bw.cfg.WebhookURL).Msg("webhook failed, falling back to long polling")
+		} else {
+			webhook = true
+		}
+	case UpdateModePolling:
+	default:
+		bw.log.Warn().Str("mode", bw.cfg.UpdateMode).Msg("unknown update mode, using long polling")
+	}
+
+	bw.serveApi(ctx, webhook)
+
+	if webhook {
+		bw.log.Info().Str("url", bw.cfg.WebhookURL).Msg("receiving updates by webhook")
+		bw.b.StartWebhook(ctx)
+
+		return
+	}
+
+	// getUpdates is refused while a webhook is set, e.g. by a previous run in webhook mode.
+	if _, err := bw.b.DeleteWebhook(ctx, &bot.DeleteWebhookParams{}); err != nil {
+		bw.log.Error().Err(err).Msg("delete webhook failed")
+	}
+
+	bw.log.Info().Msg("receiving updates by long polling")
+	bw.b.Start(ctx)
+}
@@ -0,0 +1,421 @@
+package bot
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/rs/xid"
+
+	postgres "github.com/gulldan/cp2024omsk-pmsk/bot/postgres/generated"
+)
+
+const (
+	URL              = "/url"
+	URL_USAGE        = "Отправьте ссылку на запись встречи: /url https://example.com/meeting.mp3"
+	URL_NOT_ALLOWED  = "Ошибка. Ссылка должна вести по HTTP(S) на аудио- или видеофайл в интернете."
+	URL_DOWNLOADING  = "скачивание записи по ссылке."
+	URL_NOT_RESOLVED = "Ошибка. Не удалось открыть ссылку."
+)
+
+// linkSniffLen is the head of the linked file the format is detected by, the
+// most mimetype reads.
+const linkSniffLen = 3072
+
+var (
+	errLinkNotAllowed = errors.New("link is not allowed")
+	errLinkTooLarge   = errors.New("linked file is too large")
+)
+
+// parseLink returns the link when the text is a single http(s) URL.
+func parseLink(text string) (string, bool) {
+	text = strings.TrimSpace(text)
+	if strings.ContainsAny(text, " \n\t") {
+		return "", false
+	}
+
+	u, err := url.Parse(text)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", false
+	}
+
+	return text, true
+}
+
+// validateLink makes sure the link points to a public host, the bot should not
+// be used to reach the internal network. It only answers early, the download
+// itself is guarded by linkClient. The format is told by the content once the
+// download starts.
+func validateLink(ctx context.Context, u *url.URL) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("%w: scheme %s", errLinkNotAllowed, u.Scheme)
+	}
+
+	return validateHost(ctx, u)
+}
+
+func validateHost(ctx context.Context, u *url.URL) error {
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, u.Hostname())
+	if err != nil {
+		return fmt.Errorf("resolve %s failed: %w", u.Hostname(), err)
+	}
+
+	for _, ip := range ips {
+		if !publicIP(ip.IP) {
+			return fmt.Errorf("%w: %s resolves to %s", errLinkNotAllowed, u.Hostname(), ip.IP)
+		}
+	}
+
+	return nil
+}
+
+// internalPrefixes are the ranges publicIP refuses on top of the ones net.IP knows.
+var internalPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"), // carrier-grade NAT
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+	netip.MustParsePrefix("64:ff9b::/96"), // NAT64 reaches IPv4 through the gateway
+}
+
+// publicIP reports whether the address is on the internet rather than in the
+// internal network of the bot.
+func publicIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsMulticast() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() {
+		return false
+	}
+
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return false
+	}
+
+	for _, prefix := range internalPrefixes {
+		if prefix.Contains(addr.Unmap()) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// linkClient downloads the links. The address is checked when the connection
+// is dialled, so neither a DNS record changed after validateLink nor a
+// redirect reaches the internal network. Proxies are not used, the check
+// would see the address of the proxy instead.
+func linkClient() *http.Client {
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+
+			if ip := net.ParseIP(host); ip == nil || !publicIP(ip) {
+				return fmt.Errorf("%w: %s", errLinkNotAllowed, host)
+			}
+
+			return nil
+		},
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+
+	return &http.Client{
+		Transport: transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 10 {
+				return errors.New("too many redirects")
+			}
+
+			if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+				return fmt.Errorf("%w: redirect to %s", errLinkNotAllowed, req.URL.Scheme)
+			}
+
+			return nil
+		},
+	}
+}
+
+func (bw *BotWrapper) urlHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
+	link, ok := parseLink(bw.stripMention(strings.TrimPrefix(update.Message.Text, URL)))
+	if !ok {
+		if _, err := b.SendMessage(ctx, &bot.SendMessageParams{
+			ChatID:          update.Message.Chat.ID,
+			MessageThreadID: threadID(update.Message),
+			Text:            URL_USAGE,
+		}); err != nil {
+			bw.log.Error().Err(err).Msg("send url usage message failed")
+		}
+
+		return
+	}
+
+	bw.ingestLink(ctx, b, update.Message, link)
+}
+
+// ingestLink starts processing of the recording behind the link. Long meetings
+// don't fit into the Telegram download limit, so they are shared as links.
+func (bw *BotWrapper) ingestLink(ctx context.Context, b *bot.Bot, msg *models.Message, link string) {
+	chatID := msg.Chat.ID
+
+	reply := func(text string) {
+		if _, err := b.SendMessage(ctx, &bot.SendMessageParams{
+			ChatID:          chatID,
+			MessageThreadID: threadID(msg),
+			Text:            text,
+		}); err != nil {
+			bw.log.Error().Err(err).Msg("send url message failed")
+		}
+	}
+
+	if !bw.requireMember(ctx, msg) || !bw.checkUploadQuota(ctx, msg, 0) {
+		return
+	}
+
+	u, err := url.Parse(link)
+	if err != nil {
+		reply(URL_NOT_ALLOWED)
+
+		return
+	}
+
+	if err := validateLink(ctx, u); err != nil {
+		bw.log.Warn().Err(err).Int64("chatID", chatID).Str("url", link).Msg("link rejected")
+
+		if errors.Is(err, errLinkNotAllowed) {
+			reply(URL_NOT_ALLOWED)
+		} else {
+			reply(URL_NOT_RESOLVED)
+		}
+
+		return
+	}
+
+	if err := bw.psql.CreateUser(ctx, senderID(msg)); err != nil {
+		bw.log.Error().Err(err).Msg("CreateUser failed")
+		return
+	}
+
+	tr, ok := bw.startTranscribition(ctx, msg, "")
+	if !ok {
+		return
+	}
+
+	// Downloading an hour long recording takes a while, don't hold back other updates.
+	go bw.storeLink(ctx, msg, tr, u)
+}
+
+// storeLink streams the linked recording into minio and queues the transcription.
+// The download is aborted by the cancel button like a running stage.
+func (bw *BotWrapper) storeLink(ctx context.Context, msg *models.Message, tr postgres.Transcribition, u *url.URL) {
+	dctx, cancel := context.WithTimeout(ctx, bw.cfg.URLTimeout)
+	defer cancel()
+
+	bw.trackJob(tr.ID, cancel)
+	defer bw.untrackJob(tr.ID)
+
+	if _, err := bw.b.EditMessageText(ctx, &bot.EditMessageTextParams{
+		ChatID:      tr.ChatID,
+		MessageID:   int(tr.MessageToEdit.Int64),
+		Text:        fmt.Sprintf(StatusMessageWait, URL_DOWNLOADING),
+		ReplyMarkup: bw.cancelMarkup(tr.ID),
+	}); err != nil {
+		bw.log.Error().Int64("id", tr.ID).Err(err).Msg("failed to edit message")
+	}
+
+	original, format, err := bw.uploadLinkToMinio(dctx, u)
+	if err != nil {
+		// Cancelled by the user or the bot is shutting down.
+		if errors.Is(dctx.Err(), context.Canceled) {
+			return
+		}
+
+		bw.failTranscribition(ctx, tr, StatusUploaded, linkError(err))
+
+		return
+	}
+
+	if err := bw.psql.UpdateOriginalName(ctx, postgres.UpdateOriginalNameParams{
+		OriginalNameMinio: pgtype.Text{
+			String: original,
+			Valid:  true,
+		},
+		ID: tr.ID,
+	}); err != nil {
+		bw.failTranscribition(ctx, tr, StatusUploaded, stageError(StatusUploaded, ErrCodeStorage, fmt.Errorf("UpdateOriginalName failed: %w", err)))
+		return
+	}
+
+	file, duration, err := bw.normalizeLink(dctx, original, format)
+	if err != nil {
+		if errors.Is(dctx.Err(), context.Canceled) {
+			return
+		}
+
+		bw.failTranscribition(ctx, tr, StatusUploaded, err)
+
+		return
+	}
+	defer os.Remove(file)
+
+	// The length of the recording is only known now, the number of meetings
+	// was checked when the link came, so only the audio quotas are left.
+	if reason := bw.audioOverQuota(ctx, tr.TgUserID, duration); reason != "" {
+		bw.replyText(ctx, msg, reason)
+		bw.failTranscribition(ctx, tr, StatusUploaded, stageError(StatusUploaded, ErrCodeAudioQuota, fmt.Errorf("link of %s is over quota", duration)))
+
+		return
+	}
+
+	fileName, bucket, err := bw.uploadFileToMinio(ctx, file, bw.min.GetAudioBucket())
+	if err != nil {
+		bw.failTranscribition(ctx, tr, StatusUploaded, stageError(StatusUploaded, ErrCodeStorage, fmt.Errorf("UploadToMinio failed: %w", err)))
+		return
+	}
+
+	if err := bw.psql.UpdateMinioLink(ctx, postgres.UpdateMinioLinkParams{
+		AudioNameMinio: pgtype.Text{
+			String: fileName,
+			Valid:  true,
+		},
+		AudioBucketMinio: pgtype.Text{
+			String: bucket,
+			Valid:  true,
+		},
+		AudioSeconds: audioSeconds(duration),
+		ID:           tr.ID,
+	}); err != nil {
+		bw.failTranscribition(ctx, tr, StatusUploaded, stageError(StatusUploaded, ErrCodeStorage, fmt.Errorf("UpdateMinioLink failed: %w", err)))
+		return
+	}
+
+	if err := bw.enqueueJob(ctx, tr.ID, StatusTranscription); err != nil {
+		bw.failTranscribition(ctx, tr, StatusUploaded, stageError(StatusUploaded, ErrCodeStorage, err))
+	}
+}
+
+// normalizeLink extracts the audio track of the stored recording into
+// canonicalFormat. The recording is read by ffmpeg straight from minio, only
+// the small normalized audio is written to disk, so even ready formats are
+// converted.
+func (bw *BotWrapper) normalizeLink(ctx context.Context, original string, format mediaFormat) (string, time.Duration, error) {
+	src, err := bw.min.PresignedURL(ctx, original, bw.min.GetOriginalBucket(), bw.cfg.URLTimeout)
+	if err != nil {
+		return "", 0, stageError(StatusUploaded, ErrCodeStorage, err)
+	}
+
+	file, err := normalizeAudio(ctx, src)
+	if err != nil {
+		return "", 0, stageError(StatusUploaded, ErrCodeLinkNotAllowed, fmt.Errorf("normalize %s failed: %w", format.Mime, err))
+	}
+
+	duration, err := audioDuration(ctx, file)
+	if err != nil {
+		bw.log.Warn().Err(err).Str("file", original).Msg("probe duration failed")
+	}
+
+	return file, duration, nil
+}
+
+func linkError(err error) error {
+	switch {
+	case errors.Is(err, errLinkTooLarge):
+		return stageError(StatusUploaded, ErrCodeLinkTooLarge, err)
+	case errors.Is(err, errLinkNotAllowed):
+		return stageError(StatusUploaded, ErrCodeLinkNotAllowed, err)
+	default:
+		return stageError(StatusUploaded, ErrCodeLinkUnavailable, err)
+	}
+}
+
+// uploadLinkToMinio streams the response body straight into the bucket of the
+// originals without a local copy. The format is detected by the head of the
+// body like the one of an upload, links often have no extension or a wrong one.
+func (bw *BotWrapper) uploadLinkToMinio(ctx context.Context, u *url.URL) (string, mediaFormat, error) {
+	client := linkClient()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), http.NoBody)
+	if err != nil {
+		return "", mediaFormat{}, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", mediaFormat{}, fmt.Errorf("failed to make request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", mediaFormat{}, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	if resp.ContentLength > bw.cfg.URLMaxSize {
+		return "", mediaFormat{}, fmt.Errorf("%w: %d bytes", errLinkTooLarge, resp.ContentLength)
+	}
+
+	head := make([]byte, linkSniffLen)
+	n, err := io.ReadFull(resp.Body, head)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return "", mediaFormat{}, fmt.Errorf("failed to read body: %w", err)
+	}
+	head = head[:n]
+
+	format, err := detectReaderFormat(bytes.NewReader(head))
+	if err != nil {
+		if errors.Is(err, errUnsupportedFormat) {
+			return "", mediaFormat{}, fmt.Errorf("%w: %w", errLinkNotAllowed, err)
+		}
+
+		return "", mediaFormat{}, err
+	}
+
+	body := &limitedReader{r: io.MultiReader(bytes.NewReader(head), resp.Body), n: bw.cfg.URLMaxSize}
+	fileName := xid.New().String() + format.Ext
+
+	if err := bw.min.UploadFile(ctx, body, resp.ContentLength, fileName, bw.min.GetOriginalBucket()); err != nil {
+		if body.n < 0 {
+			return "", mediaFormat{}, errLinkTooLarge
+		}
+
+		return "", mediaFormat{}, fmt.Errorf("failed to upload file: %w", err)
+	}
+
+	return fileName, format, nil
+}
+
+// limitedReader fails instead of silently truncating the body once it exceeds n bytes.
+type limitedReader struct {
+	r io.Reader
+	n int64
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+
+	if l.n < 0 {
+		return n, errLinkTooLarge
+	}
+
+	return n, err
+}
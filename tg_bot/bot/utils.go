@@ -2,7 +2,6 @@ package bot
 
 import (
 	"context"
-	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -11,13 +10,9 @@ import (
 	"github.com/rs/xid"
 )
 
-func downloadFileFromLink(ctx context.Context, fileUrl string, mime string) (string, error) {
-	fileType, err := mimeToType(mime)
-	if err != nil {
-		return "", fmt.Errorf("failed to convert mime: %w", err)
-	}
-
-	s := xid.New().String() + fileType
+// downloadFileFromLink saves the file without an extension, it is given one after sniffing.
+func downloadFileFromLink(ctx context.Context, fileUrl string) (string, error) {
+	s := xid.New().String()
 	out, err := os.Create(s)
 	if err != nil {
 		return "", fmt.Errorf("failed to create file: %w", err)
@@ -42,16 +37,3 @@ func downloadFileFromLink(ctx context.Context, fileUrl string, mime string) (str
 
 	return s, nil
 }
-
-func mimeToType(mime string) (string, error) {
-	switch mime {
-	case "audio/mpeg":
-		return ".mp3", nil
-	case "audio/ogg":
-		return ".ogg", nil
-	case "audio/vnd.wav":
-		return ".wav", nil
-	default:
-		return "", errors.New("unknown mime type")
-	}
-}
@@ -2,11 +2,37 @@ package config
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/kelseyhightower/envconfig"
 )
 
 type Config struct {
+	Token string `required:"true"`
+	// Debug logs every request to the Telegram API and every update.
+	Debug bool `default:"false"`
+
+	// UpdateMode is "polling" to fetch the updates with getUpdates or "webhook"
+	// to let Telegram post them to WebhookURL. The bot falls back to polling
+	// when the webhook can not be set.
+	UpdateMode string `default:"polling"`
+	// WebhookURL is the public https URL Telegram posts the updates to, it is
+	// served by the API server under WebhookPath, the path of the URL when empty.
+	WebhookURL  string
+	WebhookPath string
+	// WebhookSecret is checked in the X-Telegram-Bot-Api-Secret-Token header,
+	// one derived from the token is used when empty.
+	WebhookSecret string
+	// WebhookSelfSigned uploads TLSCert to Telegram, so it trusts the self-signed certificate.
+	WebhookSelfSigned bool `default:"false"`
+
+	// APIAddr is the address of the HTTP server of the API and the webhook. It
+	// serves TLS when TLSCert and TLSKey are set, otherwise plain HTTP for a
+	// reverse proxy terminating TLS in front of it.
+	APIAddr string `default:"0.0.0.0:8888"`
+	TLSCert string
+	TLSKey  string
+
 	MinioEndpoint        string
 	MinioAccessKey       string
 	MinioSecretAccessKey string
@@ -19,6 +45,57 @@ type Config struct {
 	WhisperAddr  string
 	ReporterAddr string
 	LlamaAddr    string
+
+	// CallbackSecret signs the meeting ids in inline buttons, the bot token is used when empty.
+	CallbackSecret string
+
+	// AsrMode is "full" to transcribe with a single whisper task or "stages"
+	// to run transcription, alignment, diarization and combining one by one.
+	AsrMode string `default:"full"`
+
+	// Linked recordings are always streamed into minio by the bot, so the
+	// checks of the link apply to every download.
+	URLMaxSize int64         `default:"4294967296"`
+	URLTimeout time.Duration `default:"1h"`
+
+	// Admins are the Telegram ids which are always admins, they bootstrap the access control.
+	Admins []int64
+	// DefaultRole is the role of the users nobody has granted one: "guest" keeps
+	// the bot invite-only, "member" lets anyone process recordings.
+	DefaultRole string `default:"guest"`
+
+	// Quotas of the members, zero turns the limit off. The audio minutes are
+	// counted per calendar day and month, admins are not limited.
+	QuotaDailyMinutes     int `default:"240"`
+	QuotaMonthlyMinutes   int `default:"3000"`
+	QuotaConcurrentJobs   int `default:"2"`
+	QuotaReportsPerMinute int `default:"5"`
+
+	// GroupAutoProcess makes the bot process every recording posted to a group,
+	// otherwise only the ones it is mentioned with. Admins override it per chat.
+	GroupAutoProcess bool `default:"false"`
+
+	AsrWorkers      int           `default:"1"`
+	LlmWorkers      int           `default:"1"`
+	ReportWorkers   int           `default:"2"`
+	JobPollInterval time.Duration `default:"1s"`
+	JobMaxAttempts  int           `default:"10"`
+
+	// SpeakerNamesTimeout is how long the protocol waits for the speakers to be
+	// named, so the names get into it. Zero starts the protocol right away.
+	SpeakerNamesTimeout time.Duration `default:"15m"`
+
+	// ReminderPollInterval is how often the due errand reminders are looked up.
+	ReminderPollInterval time.Duration `default:"1m"`
+
+	// WhisperTimeout limits the wait for an answer of whisper once the audio
+	// is uploaded, the upload itself is not limited.
+	WhisperTimeout   time.Duration `default:"5m"`
+	LlamaTimeout     time.Duration `default:"10m"`
+	ReporterTimeout  time.Duration `default:"2m"`
+	HTTPRetries      int           `default:"3"`
+	BreakerThreshold int           `default:"5"`
+	BreakerCooldown  time.Duration `default:"30s"`
 }
 
 func New() (Config, error) {
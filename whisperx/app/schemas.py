@@ -203,11 +203,11 @@ class VADOptions(BaseModel):
 
 
 class WhsiperModelParams(BaseModel):
-    language: str = Field(
+    language: str | None = Field(
         Query(
             default=LANG,
-            description="Language to transcribe",
-            enum=list(utils.LANGUAGES.keys()),
+            description="Language to transcribe, 'auto' to detect it from the audio",
+            enum=["auto", *utils.LANGUAGES.keys()],
         )
     )
     task: TaskEnum = Field(
@@ -238,6 +238,11 @@ class WhsiperModelParams(BaseModel):
     batch_size: int = Field(Query(8, description="The preferred batch size for inference"))
     compute_type: ComputeType = Field(Query("float16", description="Type of computation"))
 
+    @validator("language")
+    def detect_language(cls, value):
+        # whisper detects the language when none is given
+        return None if value == "auto" else value
+
 
 class AlignmentParams(BaseModel):
     align_model: str | None = Field(Query(None, description="Name of phoneme-level ASR model to do alignment"))